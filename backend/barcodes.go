@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ProductBarcode is an additional scannable code for a product. Pack
+// barcodes carry a multiplier, e.g. a 6-pack scans as 6 units.
+type ProductBarcode struct {
+    ID             uint   `gorm:"primaryKey" json:"id"`
+    OrganizationID uint   `gorm:"uniqueIndex:idx_org_barcode" json:"organization_id"`
+    ProductID      uint   `gorm:"index" json:"product_id"`
+    Code           string `gorm:"size:64;uniqueIndex:idx_org_barcode" json:"code"`
+    Multiplier     int    `json:"multiplier"`
+    Label          string `json:"label"`
+    DateCreated    string `json:"date_created"`
+}
+
+// validGTIN reports whether an all-digit EAN-8, UPC-A, EAN-13 or GTIN-14
+// code has a correct check digit. Other codes (Code128, internal) pass.
+func validGTIN(code string) bool {
+    switch len(code) {
+    case 8, 12, 13, 14:
+    default:
+        return true
+    }
+    sum := 0
+    for i := 0; i < len(code)-1; i++ {
+        ch := code[i]
+        if ch < '0' || ch > '9' { return true }
+        d := int(ch - '0')
+        // weights alternate 3,1 starting from the digit next to the check digit
+        if (len(code)-1-i)%2 == 1 { d *= 3 }
+        sum += d
+    }
+    last := code[len(code)-1]
+    if last < '0' || last > '9' { return true }
+    return (10-sum%10)%10 == int(last-'0')
+}
+
+func allDigits(s string) bool {
+    for i := 0; i < len(s); i++ {
+        if s[i] < '0' || s[i] > '9' { return false }
+    }
+    return s != ""
+}
+
+// lookupBarcode resolves an exact code to a product: product barcodes
+// first, then scale barcodes carrying a weight or price, then the product
+// SKU.
+func lookupBarcode(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    code := strings.TrimSpace(c.Param("code"))
+    var p Product
+    var bc ProductBarcode
+    err := db.Where("organization_id = ? AND code = ?", orgUser.OrganizationID, code).First(&bc).Error
+    if err == nil {
+        if err := db.Scopes(notArchived).Where("id = ? AND organization_id = ?", bc.ProductID, orgUser.OrganizationID).First(&p).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+        }
+        c.JSON(http.StatusOK, gin.H{"product": p, "quantity": bc.Multiplier, "barcode": bc})
+        return
+    }
+    if !errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    item, err := parseScaleBarcode(db, orgUser.OrganizationID, code)
+    if err == nil {
+        c.JSON(http.StatusOK, gin.H{"product": item.Product, "quantity": item.Quantity, "barcode": nil, "scale": item})
+        return
+    }
+    if !errors.Is(err, errNotScaleBarcode) && !errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()}); return }
+    if err := db.Scopes(notArchived).Where("organization_id = ? AND sku = ?", orgUser.OrganizationID, code).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    c.JSON(http.StatusOK, gin.H{"product": p, "quantity": 1, "barcode": nil})
+}
+
+func listProductBarcodes(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var barcodes []ProductBarcode
+    db.Where("organization_id = ? AND product_id = ?", orgUser.OrganizationID, id).Order("id asc").Find(&barcodes)
+    c.JSON(http.StatusOK, barcodes)
+}
+
+func addProductBarcode(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    var body struct {
+        Code       string `json:"code"`
+        Multiplier int    `json:"multiplier"`
+        Label      string `json:"label"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    body.Code = strings.TrimSpace(body.Code)
+    if body.Code == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"}); return }
+    if !validGTIN(body.Code) { c.JSON(http.StatusBadRequest, gin.H{"error": "invalid EAN/UPC check digit"}); return }
+    if body.Multiplier == 0 { body.Multiplier = 1 }
+    if body.Multiplier < 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "multiplier must be positive"}); return }
+    var existing ProductBarcode
+    if err := db.Where("organization_id = ? AND code = ?", orgUser.OrganizationID, body.Code).First(&existing).Error; err == nil {
+        c.JSON(http.StatusConflict, gin.H{"error": "barcode already assigned", "product_id": existing.ProductID}); return
+    }
+    bc := ProductBarcode{OrganizationID: orgUser.OrganizationID, ProductID: p.ID, Code: body.Code, Multiplier: body.Multiplier, Label: body.Label, DateCreated: nowISO()}
+    if err := db.Create(&bc).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, bc)
+}
+
+func deleteProductBarcode(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    barcodeID, _ := strconv.Atoi(c.Param("barcodeId"))
+    res := db.Where("id = ? AND product_id = ? AND organization_id = ?", barcodeID, id, orgUser.OrganizationID).Delete(&ProductBarcode{})
+    if res.Error != nil { c.JSON(http.StatusBadRequest, gin.H{"error": res.Error.Error()}); return }
+    if res.RowsAffected == 0 { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestValidGTIN(t *testing.T) {
+    tests := []struct {
+        code string
+        want bool
+    }{
+        {"96385074", true},       // EAN-8
+        {"96385075", false},
+        {"036000291452", true},   // UPC-A
+        {"036000291453", false},
+        {"8992761111113", true},  // EAN-13
+        {"4006381333931", true},
+        {"4006381333932", false},
+        {"10012345678902", true}, // GTIN-14
+        {"10012345678903", false},
+        {"0000000000000", true},
+        {"ABC-123", true},        // not a GTIN length
+        {"12345", true},
+        {"40063813339X1", true},  // not all digits
+    }
+    for _, tt := range tests {
+        if got := validGTIN(tt.code); got != tt.want { t.Errorf("validGTIN(%q) = %v, want %v", tt.code, got, tt.want) }
+    }
+}
+
+func TestDeleteProductBarcode(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 0)
+    other := e.product("Coffee", 7000, 0)
+    b := ProductBarcode{OrganizationID: e.org.ID, ProductID: p.ID, Code: "8992761111113", Multiplier: 1, DateCreated: nowISO()}
+    mustCreate(t, &b)
+
+    e.expect(e.do(http.MethodDelete, fmt.Sprintf("/products/%d/barcodes/%d", other.ID, b.ID), nil), http.StatusNotFound, nil)
+    e.expect(e.do(http.MethodDelete, fmt.Sprintf("/products/%d/barcodes/%d", p.ID, b.ID), nil), http.StatusNoContent, nil)
+    e.expect(e.do(http.MethodDelete, fmt.Sprintf("/products/%d/barcodes/%d", p.ID, b.ID), nil), http.StatusNotFound, nil)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Coupon is a voucher code worth a fixed amount or a percentage of the
+// eligible items. Without targets every item is eligible.
+type Coupon struct {
+    ID                 uint           `gorm:"primaryKey" json:"id"`
+    OrganizationID     uint           `gorm:"uniqueIndex:idx_org_coupon" json:"organization_id"`
+    Code               string         `gorm:"size:64;uniqueIndex:idx_org_coupon" json:"code"`
+    Type               string         `json:"type"` // fixed, percent
+    Value              float64        `json:"value"`
+    MinSpend           float64        `json:"min_spend"`
+    MaxDiscount        float64        `json:"max_discount"` // 0 for no cap
+    StartDate          *string        `json:"start_date"` // YYYY-MM-DD, inclusive
+    EndDate            *string        `json:"end_date"`
+    MaxUses            int            `json:"max_uses"` // 0 for unlimited
+    MaxUsesPerCustomer int            `json:"max_uses_per_customer"`
+    UsesCount          int            `json:"uses_count"`
+    IsActive           bool           `json:"is_active"`
+    Targets            []CouponTarget `gorm:"foreignKey:CouponID" json:"targets"`
+    DateCreated        string         `json:"date_created"`
+    DateUpdated        string         `json:"date_updated"`
+}
+
+// CouponTarget makes a product or a category eligible for a coupon.
+type CouponTarget struct {
+    ID        uint    `gorm:"primaryKey" json:"id"`
+    CouponID  uint    `gorm:"index" json:"coupon_id"`
+    ProductID *uint   `json:"product_id"`
+    Category  *string `json:"category"`
+}
+
+type CouponRedemption struct {
+    ID             uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID uint    `gorm:"index" json:"organization_id"`
+    CouponID       uint    `gorm:"index" json:"coupon_id"`
+    TransactionID  uint    `gorm:"index" json:"transaction_id"`
+    CustomerID     *uint   `gorm:"index" json:"customer_id"`
+    Discount       float64 `json:"discount"`
+    DateCreated    string  `json:"date_created"`
+}
+
+// couponError is a reason a coupon cannot be applied to a cart.
+type couponError string
+
+func (e couponError) Error() string { return string(e) }
+
+func normalizeCouponCode(code string) string { return strings.ToUpper(strings.TrimSpace(code)) }
+
+func validateCoupon(cp *Coupon) error {
+    cp.Code = normalizeCouponCode(cp.Code)
+    if cp.Code == "" { return errors.New("code is required") }
+    switch cp.Type {
+    case "fixed":
+        if cp.Value <= 0 { return errors.New("value must be positive") }
+    case "percent":
+        if cp.Value <= 0 || cp.Value > 100 { return errors.New("percent value must be in (0, 100]") }
+    default:
+        return errors.New("type must be fixed or percent")
+    }
+    if cp.MinSpend < 0 || cp.MaxDiscount < 0 || cp.MaxUses < 0 || cp.MaxUsesPerCustomer < 0 { return errors.New("limits must not be negative") }
+    for _, d := range []*string{cp.StartDate, cp.EndDate} {
+        if d == nil { continue }
+        if _, err := time.Parse(dateLayout, *d); err != nil { return errors.New("dates must be YYYY-MM-DD") }
+    }
+    for _, t := range cp.Targets {
+        if (t.ProductID == nil) == (t.Category == nil) { return errors.New("each target needs either product_id or category") }
+    }
+    return nil
+}
+
+// couponDiscount checks a coupon's validity, limits and minimum spend against
+// a cart whose amount still payable (after promotions) is payable, and
+// returns the discount it gives.
+func couponDiscount(tx *gorm.DB, cp Coupon, customerID *uint, lines []cartLine, payable float64, at time.Time) (float64, error) {
+    day := at.Format(dateLayout)
+    if !cp.IsActive { return 0, couponError("coupon is not active") }
+    if cp.StartDate != nil && day < *cp.StartDate { return 0, couponError("coupon is not valid yet") }
+    if cp.EndDate != nil && day > *cp.EndDate { return 0, couponError("coupon has expired") }
+    if cp.MaxUses > 0 && cp.UsesCount >= cp.MaxUses { return 0, couponError("coupon has been fully redeemed") }
+    if cp.MaxUsesPerCustomer > 0 {
+        if customerID == nil { return 0, couponError("coupon requires a customer") }
+        var used int64
+        if err := tx.Model(&CouponRedemption{}).Where("coupon_id = ? AND customer_id = ?", cp.ID, *customerID).Count(&used).Error; err != nil { return 0, err }
+        if int(used) >= cp.MaxUsesPerCustomer { return 0, couponError("customer has already used this coupon") }
+    }
+    if payable < cp.MinSpend { return 0, couponError("minimum spend not reached") }
+
+    eligible := 0.0
+    for _, l := range lines {
+        if couponCovers(cp, l) { eligible += lineTotal(l.UnitPrice, l.Quantity) }
+    }
+    if eligible <= 0 { return 0, couponError("no eligible items in cart") }
+    discount := cp.Value
+    if cp.Type == "percent" { discount = eligible * cp.Value / 100 }
+    if discount > eligible { discount = eligible }
+    if cp.MaxDiscount > 0 && discount > cp.MaxDiscount { discount = cp.MaxDiscount }
+    if discount > payable { discount = payable }
+    return math.Round(discount*100) / 100, nil
+}
+
+func couponCovers(cp Coupon, l cartLine) bool {
+    if len(cp.Targets) == 0 { return true }
+    for _, t := range cp.Targets {
+        if t.ProductID != nil && *t.ProductID == l.ProductID { return true }
+        if t.Category != nil && l.Category != nil && strings.EqualFold(*t.Category, *l.Category) { return true }
+    }
+    return false
+}
+
+// redeemCoupon locks the coupon row, re-checks it and counts one use, so
+// concurrent checkouts cannot redeem a single-use code twice. It must run
+// inside the checkout's database transaction.
+func redeemCoupon(tx *gorm.DB, orgID uint, code string, customerID *uint, lines []cartLine, payable float64, at time.Time) (Coupon, float64, error) {
+    var cp Coupon
+    err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Targets").Where("organization_id = ? AND code = ?", orgID, normalizeCouponCode(code)).First(&cp).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) { return cp, 0, couponError("unknown coupon code") }
+    if err != nil { return cp, 0, err }
+    discount, err := couponDiscount(tx, cp, customerID, lines, payable, at)
+    if err != nil { return cp, 0, err }
+    if err := tx.Model(&Coupon{}).Where("id = ?", cp.ID).UpdateColumn("uses_count", gorm.Expr("uses_count + 1")).Error; err != nil { return cp, 0, err }
+    return cp, discount, nil
+}
+
+// Coupon handlers
+func listCoupons(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var coupons []Coupon
+    db.Preload("Targets").Where("organization_id = ?", orgUser.OrganizationID).Order("code asc").Find(&coupons)
+    c.JSON(http.StatusOK, coupons)
+}
+
+func createCoupon(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    cp := Coupon{IsActive: true}
+    if err := c.BindJSON(&cp); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if err := validateCoupon(&cp); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    var existing Coupon
+    if err := db.Where("organization_id = ? AND code = ?", orgUser.OrganizationID, cp.Code).First(&existing).Error; err == nil {
+        c.JSON(http.StatusConflict, gin.H{"error": "coupon code already exists"}); return
+    }
+    now := nowISO()
+    cp.ID = 0
+    cp.OrganizationID = orgUser.OrganizationID
+    cp.UsesCount = 0
+    cp.DateCreated = now
+    cp.DateUpdated = now
+    for i := range cp.Targets { cp.Targets[i].ID = 0 }
+    if err := db.Create(&cp).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, cp)
+}
+
+func updateCoupon(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var existing Coupon
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&existing).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    var cp Coupon
+    if err := c.BindJSON(&cp); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    // The code identifies redemptions and cannot change
+    cp.Code = existing.Code
+    if err := validateCoupon(&cp); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    cp.ID = existing.ID
+    cp.OrganizationID = existing.OrganizationID
+    cp.DateCreated = existing.DateCreated
+    cp.DateUpdated = nowISO()
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Where("coupon_id = ?", cp.ID).Delete(&CouponTarget{}).Error; err != nil { return err }
+        for i := range cp.Targets {
+            cp.Targets[i].ID = 0
+            cp.Targets[i].CouponID = cp.ID
+        }
+        if len(cp.Targets) > 0 {
+            if err := tx.Create(&cp.Targets).Error; err != nil { return err }
+        }
+        // uses_count is maintained by redemptions only
+        return tx.Omit("Targets", "UsesCount").Save(&cp).Error
+    })
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    cp.UsesCount = existing.UsesCount
+    c.JSON(http.StatusOK, cp)
+}
+
+// validateCouponForCart lets the cashier check a code against the current
+// cart before payment. It does not redeem the coupon.
+func validateCouponForCart(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        Code        string            `json:"code"`
+        CustomerID  *uint             `json:"customer_id"`
+        PriceListID *uint             `json:"price_list_id"`
+        Items       []TransactionItem `json:"items"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if body.CustomerID != nil && body.PriceListID == nil {
+        var cu Customer
+        if err := db.Where("id = ? AND organization_id = ?", *body.CustomerID, orgUser.OrganizationID).First(&cu).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown customer"}); return }
+        body.PriceListID = cu.PriceListID
+    }
+    at := time.Now().In(orgTimezone(orgUser.OrganizationID))
+    subtotal, lines, err := priceCart(db, orgUser.OrganizationID, body.Items, body.PriceListID, at)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    promoDiscount := 0.0
+    for _, a := range evaluatePromotions(loadPromotions(db, orgUser.OrganizationID), lines, at) { promoDiscount += a.Discount }
+    var cp Coupon
+    if err := db.Preload("Targets").Where("organization_id = ? AND code = ?", orgUser.OrganizationID, normalizeCouponCode(body.Code)).First(&cp).Error; err != nil {
+        c.JSON(http.StatusOK, gin.H{"valid": false, "error": "unknown coupon code"}); return
+    }
+    discount, err := couponDiscount(db, cp, body.CustomerID, lines, subtotal-promoDiscount, at)
+    var ce couponError
+    if errors.As(err, &ce) { c.JSON(http.StatusOK, gin.H{"valid": false, "error": ce.Error()}); return }
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, gin.H{"valid": true, "code": cp.Code, "discount": discount, "total_amount": subtotal - promoDiscount - discount})
+}
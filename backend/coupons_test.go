@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCouponDiscount(t *testing.T) {
+    newTestDB(t)
+    drinks := ptr("Drinks")
+    lines := []cartLine{
+        {ProductID: 1, Category: drinks, Quantity: 2, UnitPrice: 5000},
+        {ProductID: 2, Quantity: 1, UnitPrice: 20000},
+    }
+    at := time.Date(2026, 6, 15, 10, 0, 0, 0, time.FixedZone("WIB", 7*3600))
+    customer := ptr(uint(7))
+    mustCreate(t, &CouponRedemption{CouponID: 99, TransactionID: 1, CustomerID: customer, DateCreated: nowISO()})
+
+    fixed := Coupon{ID: 1, Type: "fixed", Value: 5000, IsActive: true}
+    with := func(f func(*Coupon)) Coupon { cp := fixed; f(&cp); return cp }
+    tests := []struct {
+        name     string
+        coupon   Coupon
+        customer *uint
+        payable  float64
+        want     float64
+        wantErr  string
+    }{
+        {name: "fixed", coupon: fixed, payable: 30000, want: 5000},
+        {name: "percent", coupon: with(func(c *Coupon) { c.Type, c.Value = "percent", 10 }), payable: 30000, want: 3000},
+        {name: "percent capped", coupon: with(func(c *Coupon) { c.Type, c.Value, c.MaxDiscount = "percent", 50, 4000 }), payable: 30000, want: 4000},
+        {name: "no more than payable", coupon: with(func(c *Coupon) { c.Value = 50000 }), payable: 25000, want: 25000},
+        {name: "product target", coupon: with(func(c *Coupon) { c.Value = 50000; c.Targets = []CouponTarget{{ProductID: ptr(uint(2))}} }), payable: 30000, want: 20000},
+        {name: "category target", coupon: with(func(c *Coupon) { c.Type, c.Value = "percent", 10; c.Targets = []CouponTarget{{Category: ptr("drinks")}} }), payable: 30000, want: 1000},
+        {name: "no eligible items", coupon: with(func(c *Coupon) { c.Targets = []CouponTarget{{ProductID: ptr(uint(3))}} }), payable: 30000, wantErr: "no eligible items in cart"},
+        {name: "minimum spend", coupon: with(func(c *Coupon) { c.MinSpend = 30000 }), payable: 29999, wantErr: "minimum spend not reached"},
+        {name: "inactive", coupon: with(func(c *Coupon) { c.IsActive = false }), payable: 30000, wantErr: "coupon is not active"},
+        {name: "not yet valid", coupon: with(func(c *Coupon) { c.StartDate = ptr("2026-06-16") }), payable: 30000, wantErr: "coupon is not valid yet"},
+        {name: "last valid day", coupon: with(func(c *Coupon) { c.EndDate = ptr("2026-06-15") }), payable: 30000, want: 5000},
+        {name: "expired", coupon: with(func(c *Coupon) { c.EndDate = ptr("2026-06-14") }), payable: 30000, wantErr: "coupon has expired"},
+        {name: "fully redeemed", coupon: with(func(c *Coupon) { c.MaxUses, c.UsesCount = 3, 3 }), payable: 30000, wantErr: "coupon has been fully redeemed"},
+        {name: "per customer needs a customer", coupon: with(func(c *Coupon) { c.MaxUsesPerCustomer = 1 }), payable: 30000, wantErr: "coupon requires a customer"},
+        {name: "per customer used up", coupon: with(func(c *Coupon) { c.ID, c.MaxUsesPerCustomer = 99, 1 }), customer: customer, payable: 30000, wantErr: "customer has already used this coupon"},
+        {name: "per customer left", coupon: with(func(c *Coupon) { c.ID, c.MaxUsesPerCustomer = 99, 2 }), customer: customer, payable: 30000, want: 5000},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := couponDiscount(db, tt.coupon, tt.customer, lines, tt.payable, at)
+            if tt.wantErr != "" {
+                if err == nil || err.Error() != tt.wantErr { t.Fatalf("err = %v, want %q", err, tt.wantErr) }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            if got != tt.want { t.Fatalf("discount = %v, want %v", got, tt.want) }
+        })
+    }
+}
+
+func TestVoidTransaction(t *testing.T) {
+    e := newTestEnv(t)
+    tea := e.product("Tea", 5000, 0)
+    lot := e.addLot(tea, e.loc.ID, "L1", "2026-04-01", 5)
+    e.addLot(tea, e.loc.ID, "L2", "2026-05-01", 5)
+    // a recipe product uses stock of its ingredient
+    milk := e.product("Milk", 1000, 10)
+    latte := e.product("Latte", 20000, 0)
+    mustCreate(t, &RecipeItem{OrganizationID: e.org.ID, ProductID: latte.ID, IngredientID: milk.ID, Quantity: 2, DateCreated: nowISO()})
+    now := nowISO()
+    promo := Promotion{OrganizationID: e.org.ID, Name: "Tea 2+1", Type: promoBuyXGetY, IsActive: true, ProductID: &tea.ID, BuyQuantity: 2, FreeQuantity: 1, DateCreated: now, DateUpdated: now}
+    mustCreate(t, &promo)
+    coupon := Coupon{OrganizationID: e.org.ID, Code: "HEMAT", Type: "fixed", Value: 1000, MaxUses: 1, IsActive: true, DateCreated: now, DateUpdated: now}
+    mustCreate(t, &coupon)
+
+    var sale struct {
+        ID             uint    `json:"id"`
+        CouponDiscount float64 `json:"coupon_discount"`
+        Promotions     []appliedPromotion `json:"promotions"`
+    }
+    e.expect(e.do(http.MethodPost, "/transactions", map[string]any{
+        "amount_received": 100000, "transaction_date": now, "coupon_code": "HEMAT",
+        "items": []map[string]any{{"product_id": tea.ID, "quantity": 7}, {"product_id": latte.ID, "quantity": 1}},
+    }), http.StatusCreated, &sale)
+    if sale.CouponDiscount != 1000 || len(sale.Promotions) != 1 { t.Fatalf("sale = %+v", sale) }
+    if got := orgTotal(t, tea.ID); got != 3 { t.Fatalf("tea after sale = %v, want 3", got) }
+
+    e.expect(e.do(http.MethodDelete, fmt.Sprintf("/transactions/%d", sale.ID), nil), http.StatusNoContent, nil)
+    if got := orgTotal(t, tea.ID); got != 10 { t.Errorf("tea total after void = %v, want 10", got) }
+    if got := stockAt(t, tea.ID, e.loc.ID); got != 10 { t.Errorf("tea at location after void = %v, want 10", got) }
+    if got := lotRemaining(t, lot.ID); got != 5 { t.Errorf("first lot after void = %v, want 5", got) }
+    if got := stockAt(t, milk.ID, e.loc.ID); got != 10 || orgTotal(t, milk.ID) != 10 { t.Errorf("milk after void = %v, want 10", got) }
+    var cp Coupon
+    db.First(&cp, coupon.ID)
+    if cp.UsesCount != 0 { t.Errorf("coupon uses = %d, want 0", cp.UsesCount) }
+    for _, model := range []any{&CouponRedemption{}, &TransactionPromotion{}, &TransactionItem{}} {
+        var n int64
+        db.Model(model).Where("transaction_id = ?", sale.ID).Count(&n)
+        if n != 0 { t.Errorf("%T rows left: %d", model, n) }
+    }
+    var voids int64
+    db.Model(&InventoryMovement{}).Where("reason = ? AND reference_id = ?", "void", sale.ID).Count(&voids)
+    if voids != 3 { t.Errorf("void movements = %d, want 3 (two tea lots and milk)", voids) }
+
+    // the coupon can be used again and the sale is gone
+    e.expect(e.do(http.MethodDelete, fmt.Sprintf("/transactions/%d", sale.ID), nil), http.StatusNotFound, nil)
+    e.expect(e.do(http.MethodPost, "/transactions", map[string]any{
+        "amount_received": 10000, "transaction_date": now, "coupon_code": "HEMAT",
+        "items": []map[string]any{{"product_id": tea.ID, "quantity": 1}},
+    }), http.StatusCreated, nil)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Customer is a known buyer of an organization. A customer on a price list
+// (e.g. wholesale, member) is charged that list's prices at checkout.
+type Customer struct {
+    ID             uint   `gorm:"primaryKey" json:"id"`
+    OrganizationID uint   `gorm:"index" json:"organization_id"`
+    Name           string `json:"name"`
+    Phone          string `json:"phone"`
+    Email          string `json:"email"`
+    PriceListID    *uint  `json:"price_list_id"`
+    DateCreated    string `json:"date_created"`
+    DateUpdated    string `json:"date_updated"`
+}
+
+func listCustomers(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    q := db.Where("organization_id = ?", orgUser.OrganizationID)
+    if s := c.Query("q"); s != "" { q = q.Where("name LIKE ? OR phone LIKE ?", "%"+s+"%", "%"+s+"%") }
+    var customers []Customer
+    q.Order("name asc").Find(&customers)
+    c.JSON(http.StatusOK, customers)
+}
+
+func createCustomer(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var cu Customer
+    if err := c.BindJSON(&cu); err != nil || cu.Name == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if cu.PriceListID != nil {
+        var pl PriceList
+        if err := db.Where("id = ? AND organization_id = ?", *cu.PriceListID, orgUser.OrganizationID).First(&pl).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown price list"}); return }
+    }
+    now := nowISO()
+    cu.ID = 0
+    cu.OrganizationID = orgUser.OrganizationID
+    cu.DateCreated = now
+    cu.DateUpdated = now
+    if err := db.Create(&cu).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, cu)
+}
+
+func updateCustomer(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var cu Customer
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&cu).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    var body Customer
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if body.PriceListID != nil {
+        var pl PriceList
+        if err := db.Where("id = ? AND organization_id = ?", *body.PriceListID, orgUser.OrganizationID).First(&pl).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown price list"}); return }
+    }
+    cu.Name = body.Name
+    cu.Phone = body.Phone
+    cu.Email = body.Email
+    cu.PriceListID = body.PriceListID
+    cu.DateUpdated = nowISO()
+    if err := db.Save(&cu).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, cu)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// A Device is a till registered to an organization by an owner. It keeps
+// the device token it was given at registration and sends it as
+// X-Device-Token, which lets cashiers sign in on it with a PIN instead of
+// a password. PIN sessions last one shift, have no refresh token, carry at
+// most the organization's cashier permissions and end when the next
+// cashier signs in on the device.
+type Device struct {
+    ID             uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID uint    `gorm:"index" json:"organization_id"`
+    Name           string  `json:"name"`
+    LocationID     *uint   `json:"location_id"`
+    TokenHash      string  `gorm:"size:64;uniqueIndex" json:"-"`
+    RegisteredBy   uint    `json:"registered_by"`
+    LastUsedAt     *string `json:"last_used_at"`
+    RevokedAt      *string `json:"revoked_at"`
+    DateCreated    string  `json:"date_created"`
+}
+
+// DeviceResponse is what the API shows of a device; the token hash stays
+// server-side.
+type DeviceResponse struct {
+    ID             uint    `json:"id"`
+    OrganizationID uint    `json:"organization_id"`
+    Name           string  `json:"name"`
+    LocationID     *uint   `json:"location_id"`
+    RegisteredBy   uint    `json:"registered_by"`
+    LastUsedAt     *string `json:"last_used_at"`
+    RevokedAt      *string `json:"revoked_at"`
+    DateCreated    string  `json:"date_created"`
+}
+
+func deviceResponse(d Device) DeviceResponse {
+    return DeviceResponse{ID: d.ID, OrganizationID: d.OrganizationID, Name: d.Name, LocationID: d.LocationID, RegisteredBy: d.RegisteredBy, LastUsedAt: d.LastUsedAt, RevokedAt: d.RevokedAt, DateCreated: d.DateCreated}
+}
+
+const pinTokenExpiry = 8 * time.Hour
+
+func validPIN(pin string) bool { return len(pin) >= 4 && len(pin) <= 6 && allDigits(pin) }
+
+// hashPIN returns the stored form of a PIN; an empty PIN clears it.
+func hashPIN(pin string) (string, error) {
+    if pin == "" { return "", nil }
+    if !validPIN(pin) { return "", errors.New("pin must be 4-6 digits") }
+    h, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+    return string(h), err
+}
+
+func deviceFromRequest(c *gin.Context) (Device, error) {
+    var d Device
+    token := c.GetHeader("X-Device-Token")
+    if token == "" { return d, errors.New("missing device token") }
+    if err := db.Where("token_hash = ? AND revoked_at IS NULL", hashToken(token)).First(&d).Error; err != nil { return d, errors.New("unknown device") }
+    return d, nil
+}
+
+// cashierPermissions limits a PIN session to what the organization's
+// cashier role may do.
+func cashierPermissions(orgID uint, perms []string) []string {
+    cashier, _ := rolePermissions(db, orgID, "cashier")
+    out := []string{}
+    for _, p := range perms {
+        if hasPermission(cashier, p) { out = append(out, p) }
+    }
+    return out
+}
+
+// Device handlers
+func listDevices(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var devices []Device
+    db.Where("organization_id = ? AND revoked_at IS NULL", orgUser.OrganizationID).Order("name asc").Find(&devices)
+    out := make([]DeviceResponse, 0, len(devices))
+    for _, d := range devices { out = append(out, deviceResponse(d)) }
+    c.JSON(http.StatusOK, out)
+}
+
+// registerDevice returns the device token once; only its hash is kept.
+func registerDevice(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    if _, ok := c.Get("deviceID"); ok { c.JSON(http.StatusForbidden, gin.H{"error": "devices cannot be registered from a PIN session"}); return }
+    var body struct {
+        Name       string `json:"name"`
+        LocationID *uint  `json:"location_id"`
+    }
+    if err := c.BindJSON(&body); err != nil || strings.TrimSpace(body.Name) == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "name required"}); return }
+    if body.LocationID != nil {
+        if _, err := orgLocation(db, orgUser.OrganizationID, *body.LocationID); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown location"}); return }
+    }
+    var raw [32]byte
+    if _, err := rand.Read(raw[:]); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    token := base64.RawURLEncoding.EncodeToString(raw[:])
+    d := Device{OrganizationID: orgUser.OrganizationID, Name: strings.TrimSpace(body.Name), LocationID: body.LocationID, TokenHash: hashToken(token), RegisteredBy: uid, DateCreated: nowISO()}
+    if err := db.Create(&d).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, gin.H{"device": deviceResponse(d), "device_token": token})
+}
+
+// revokeDevice retires a device and ends the PIN sessions on it.
+func revokeDevice(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var d Device
+    if err := db.Where("id = ? AND organization_id = ? AND revoked_at IS NULL", id, orgUser.OrganizationID).First(&d).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&d).Update("revoked_at", nowISO()).Error; err != nil { return err }
+        return tx.Model(&AuthSession{}).Where("device_id = ? AND revoked_at IS NULL", d.ID).
+            Updates(map[string]any{"revoked_at": nowISO(), "revoke_reason": "device revoked"}).Error
+    })
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.Status(http.StatusNoContent)
+}
+
+// pinUsers lists who can sign in on the device, for its user picker.
+func pinUsers(c *gin.Context) {
+    d, err := deviceFromRequest(c)
+    if err != nil { c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()}); return }
+    type res struct {
+        UserID uint   `json:"user_id"`
+        Name   string `json:"name"`
+    }
+    var rows []res
+    db.Raw(`
+        SELECT u.id as user_id, u.name
+        FROM organization_users ou
+        JOIN users u ON u.id = ou.user_id
+        WHERE ou.organization_id = ? AND ou.is_active = ? AND ou.pin_hash <> ''
+        ORDER BY u.name ASC`, d.OrganizationID, true).Scan(&rows)
+    c.JSON(http.StatusOK, rows)
+}
+
+// pinLogin signs a cashier in on a registered device. Failed PINs count
+// towards the same lockout as failed passwords.
+func pinLogin(c *gin.Context) {
+    d, err := deviceFromRequest(c)
+    if err != nil { c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()}); return }
+    var body struct {
+        UserID uint   `json:"user_id"`
+        PIN    string `json:"pin"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.UserID == 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var user User
+    if err := db.First(&user, body.UserID).Error; err != nil { c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid pin"}); return }
+    if !checkLoginAllowed(c, user.Username) { return }
+    ou, err := activeMembership(db, user.ID, d.OrganizationID)
+    if err != nil || ou.PinHash == "" || bcrypt.CompareHashAndPassword([]byte(ou.PinHash), []byte(body.PIN)) != nil {
+        recordLoginAttempt(c, user.Username, "bad_pin")
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid pin"})
+        return
+    }
+    recordLoginAttempt(c, user.Username, "success")
+    now := nowISO()
+    s := AuthSession{UserID: user.ID, OrganizationID: d.OrganizationID, DeviceID: &d.ID, LocationID: d.LocationID, UserAgent: c.Request.UserAgent(), IP: c.ClientIP(), LastUsedAt: now, DateCreated: now}
+    err = db.Transaction(func(tx *gorm.DB) error {
+        // one cashier per device: the previous one is signed out
+        if err := tx.Model(&AuthSession{}).Where("device_id = ? AND revoked_at IS NULL", d.ID).
+            Updates(map[string]any{"revoked_at": now, "revoke_reason": "next cashier"}).Error; err != nil { return err }
+        if err := tx.Create(&s).Error; err != nil { return err }
+        return tx.Model(&d).Update("last_used_at", now).Error
+    })
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    token, err := signToken(user.ID, s.ID, d.OrganizationID, pinTokenExpiry)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    var org Organization
+    _ = db.First(&org, d.OrganizationID).Error
+    perms, _ := rolePermissions(db, d.OrganizationID, ou.Role)
+    locationID := ou.DefaultLocationID
+    if d.LocationID != nil { locationID = d.LocationID }
+    c.JSON(http.StatusOK, gin.H{
+        "token": token,
+        "expires_in": int(pinTokenExpiry.Seconds()),
+        "user": userResponse(user),
+        "organization": org,
+        "role": ou.Role,
+        "permissions": cashierPermissions(d.OrganizationID, perms),
+        "default_location_id": locationID,
+    })
+}
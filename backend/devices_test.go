@@ -0,0 +1,57 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// pinLogin signs the user in on the device and returns the access token.
+func (e *testEnv) pinLogin(deviceToken string, userID uint, pin string) string {
+    e.t.Helper()
+    b, _ := json.Marshal(map[string]any{"user_id": userID, "pin": pin})
+    r := httptest.NewRequest(http.MethodPost, "/api/v1/auth/pin-login", bytes.NewReader(b))
+    r.Header.Set("Content-Type", "application/json")
+    r.Header.Set("X-Device-Token", deviceToken)
+    w := httptest.NewRecorder()
+    e.router.ServeHTTP(w, r)
+    var out struct {
+        Token             string `json:"token"`
+        DefaultLocationID *uint  `json:"default_location_id"`
+    }
+    e.expect(w, http.StatusOK, &out)
+    return out.Token
+}
+
+func TestPINSessionSellsAtDeviceLocation(t *testing.T) {
+    e := newTestEnv(t)
+    shop := e.location("Shop")
+    tea := e.product("Tea", 5000, 6)
+    if err := putLocationStock(db, e.org.ID, shop.ID, tea.ID, 4); err != nil { t.Fatal(err) }
+    if err := db.Model(&tea).Update("stock_quantity", 10).Error; err != nil { t.Fatal(err) }
+
+    var reg struct {
+        DeviceToken string `json:"device_token"`
+    }
+    e.expect(e.do(http.MethodPost, "/devices", map[string]any{"name": "Till 2", "location_id": shop.ID}), http.StatusCreated, &reg)
+    cashier, _ := e.member("kasir", "cashier")
+    pin, err := hashPIN("1234")
+    if err != nil { t.Fatal(err) }
+    if err := db.Model(&OrganizationUser{}).Where("user_id = ?", cashier.ID).Update("pin_hash", pin).Error; err != nil { t.Fatal(err) }
+    token := e.pinLogin(reg.DeviceToken, cashier.ID, "1234")
+
+    var sale struct {
+        ID uint `json:"id"`
+    }
+    e.expect(e.doAs(token, http.MethodPost, "/transactions", map[string]any{
+        "amount_received": 10000, "transaction_date": nowISO(),
+        "items": []map[string]any{{"product_id": tea.ID, "quantity": 1}},
+    }), http.StatusCreated, &sale)
+    var saved Transaction
+    if err := db.First(&saved, sale.ID).Error; err != nil { t.Fatal(err) }
+    if saved.LocationID == nil || *saved.LocationID != shop.ID { t.Fatalf("sale location = %v, want %d", saved.LocationID, shop.ID) }
+    if got := stockAt(t, tea.ID, shop.ID); got != 3 { t.Errorf("shop stock = %v, want 3", got) }
+    if got := stockAt(t, tea.ID, e.loc.ID); got != 6 { t.Errorf("default location stock = %v, want 6", got) }
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Product images are re-encoded as JPEG in two sizes and kept in an
+// imageStore under random, never reused names, so they can be cached
+// forever. Product.ImageURL and ThumbnailURL point at GET /images/:name,
+// as does Organization.LogoURL.
+
+const (
+    maxImageUpload = 5 << 20  // bytes
+    maxImagePixels = 40e6     // refuse decompression bombs before decoding
+    imageMaxSide   = 1024
+    thumbMaxSide   = 200
+    imagesPath     = "/api/v1/images/"
+)
+
+// allowedImageTypes are checked against the sniffed content, not the
+// client's Content-Type.
+var allowedImageTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true}
+
+// imageStore holds encoded images by name. diskImageStore is the default;
+// an object store can be plugged in by implementing the same methods.
+type imageStore interface {
+    Put(name string, data []byte) error
+    Open(name string) (io.ReadCloser, error)
+    Delete(name string) error
+}
+
+type diskImageStore struct{ dir string }
+
+func (s diskImageStore) Put(name string, data []byte) error {
+    if err := os.MkdirAll(s.dir, 0o755); err != nil { return err }
+    tmp := filepath.Join(s.dir, name+".tmp")
+    if err := os.WriteFile(tmp, data, 0o644); err != nil { return err }
+    return os.Rename(tmp, filepath.Join(s.dir, name))
+}
+
+func (s diskImageStore) Open(name string) (io.ReadCloser, error) { return os.Open(filepath.Join(s.dir, name)) }
+
+func (s diskImageStore) Delete(name string) error {
+    err := os.Remove(filepath.Join(s.dir, name))
+    if errors.Is(err, os.ErrNotExist) { return nil }
+    return err
+}
+
+var imageStorage imageStore
+
+// validImageName accepts only names made by randomImageName.
+func validImageName(name string) bool {
+    base, ok := strings.CutSuffix(name, ".jpg")
+    if !ok { return false }
+    base = strings.TrimSuffix(base, "-thumb")
+    if len(base) != 32 { return false }
+    _, err := hex.DecodeString(base)
+    return err == nil
+}
+
+// fitImage scales img down so its longer side is at most maxSide, onto a
+// white background since JPEG has no transparency.
+func fitImage(img image.Image, maxSide int) *image.RGBA {
+    b := img.Bounds()
+    w, h := b.Dx(), b.Dy()
+    if w > maxSide || h > maxSide {
+        if w >= h {
+            h = max(1, h*maxSide/w)
+            w = maxSide
+        } else {
+            w = max(1, w*maxSide/h)
+            h = maxSide
+        }
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+    draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+    return dst
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil { return nil, err }
+    return buf.Bytes(), nil
+}
+
+// removeProductImages deletes the stored files behind a product's image URLs.
+func removeProductImages(p Product) {
+    for _, u := range []*string{p.ImageURL, p.ThumbnailURL} {
+        if u != nil { _ = imageStorage.Delete(path.Base(*u)) }
+    }
+}
+
+// readUploadedImage decodes the multipart field `image` (JPEG, PNG, GIF or
+// WebP, up to 5 MB). It responds itself and returns false when the upload
+// is missing or not an acceptable image.
+func readUploadedImage(c *gin.Context) (image.Image, bool) {
+    c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImageUpload+1<<20)
+    fh, err := c.FormFile("image")
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "multipart field image is required (max 5 MB)"}); return nil, false }
+    if fh.Size > maxImageUpload { c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "image must be at most 5 MB"}); return nil, false }
+    f, err := fh.Open()
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return nil, false }
+    data, err := io.ReadAll(io.LimitReader(f, maxImageUpload+1))
+    f.Close()
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return nil, false }
+    if len(data) > maxImageUpload { c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "image must be at most 5 MB"}); return nil, false }
+    if ct := http.DetectContentType(data); !allowedImageTypes[ct] {
+        c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "image must be JPEG, PNG, GIF or WebP, got " + ct})
+        return nil, false
+    }
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil { c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unreadable image"}); return nil, false }
+    if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels { c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "image dimensions too large"}); return nil, false }
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil { c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unreadable image"}); return nil, false }
+    return img, true
+}
+
+func randomImageName() (string, error) {
+    var rnd [16]byte
+    if _, err := rand.Read(rnd[:]); err != nil { return "", err }
+    return hex.EncodeToString(rnd[:]), nil
+}
+
+// uploadProductImage takes a multipart field `image` and stores a full size
+// and a thumbnail version.
+func uploadProductImage(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+        return
+    }
+    img, ok := readUploadedImage(c)
+    if !ok { return }
+
+    full, err := encodeJPEG(fitImage(img, imageMaxSide))
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    thumb, err := encodeJPEG(fitImage(img, thumbMaxSide))
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    name, err := randomImageName()
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    fullName, thumbName := name+".jpg", name+"-thumb.jpg"
+    if err := imageStorage.Put(fullName, full); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    if err := imageStorage.Put(thumbName, thumb); err != nil {
+        _ = imageStorage.Delete(fullName)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    // lock the row so concurrent uploads each clean up the image they replace
+    var old Product
+    fullURL, thumbURL := imagesPath+fullName, imagesPath+thumbName
+    err = db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&old, p.ID).Error; err != nil { return err }
+        return tx.Model(&Product{}).Where("id = ?", p.ID).Updates(map[string]any{"image_url": fullURL, "thumbnail_url": thumbURL, "version": gorm.Expr("version + 1"), "date_updated": nowISO()}).Error
+    })
+    if err != nil {
+        _ = imageStorage.Delete(fullName)
+        _ = imageStorage.Delete(thumbName)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    removeProductImages(old)
+    db.First(&p, p.ID)
+    c.JSON(http.StatusOK, p)
+}
+
+func deleteProductImage(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+        return
+    }
+    if p.ImageURL == nil { c.JSON(http.StatusOK, p); return }
+    // only clear the image we looked at; a concurrent upload keeps its own
+    res := db.Model(&Product{}).Where("id = ? AND image_url = ?", p.ID, *p.ImageURL).Updates(map[string]any{"image_url": nil, "thumbnail_url": nil, "version": gorm.Expr("version + 1"), "date_updated": nowISO()})
+    if res.Error != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()}); return }
+    if res.RowsAffected > 0 { removeProductImages(p) }
+    db.First(&p, p.ID)
+    c.JSON(http.StatusOK, p)
+}
+
+// serveImage is public so image URLs work in <img> tags and image widgets;
+// names are random and unguessable. Content never changes under a name.
+func serveImage(c *gin.Context) {
+    name := c.Param("name")
+    if !validImageName(name) { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    etag := `"` + strings.TrimSuffix(name, ".jpg") + `"`
+    if c.GetHeader("If-None-Match") == etag { c.Status(http.StatusNotModified); return }
+    rc, err := imageStorage.Open(name)
+    if err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    defer rc.Close()
+    c.Header("Cache-Control", "public, max-age=31536000, immutable")
+    c.Header("ETag", etag)
+    c.Header("X-Content-Type-Options", "nosniff")
+    c.DataFromReader(http.StatusOK, -1, "image/jpeg", rc, nil)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+// uploadImage posts data as the multipart field to a product's image.
+func (e *testEnv) uploadImage(productID uint, field string, data []byte) *httptest.ResponseRecorder {
+    e.t.Helper()
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    fw, err := mw.CreateFormFile(field, "photo")
+    if err != nil { e.t.Fatal(err) }
+    fw.Write(data)
+    mw.Close()
+    r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v1/products/%d/image", productID), &body)
+    r.Header.Set("Content-Type", mw.FormDataContentType())
+    r.Header.Set("Authorization", "Bearer "+e.token)
+    w := httptest.NewRecorder()
+    e.router.ServeHTTP(w, r)
+    return w
+}
+
+func testImage(w, h int) *image.RGBA {
+    img := image.NewRGBA(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ { img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255}) }
+    }
+    return img
+}
+
+func encodeTestImage(t *testing.T, format string, w, h int) []byte {
+    t.Helper()
+    var buf bytes.Buffer
+    var err error
+    switch format {
+    case "png":
+        err = png.Encode(&buf, testImage(w, h))
+    case "jpeg":
+        err = jpeg.Encode(&buf, testImage(w, h), nil)
+    case "gif":
+        err = gif.Encode(&buf, testImage(w, h), nil)
+    }
+    if err != nil { t.Fatal(err) }
+    return buf.Bytes()
+}
+
+// gifHeader is a GIF that claims w×h pixels without holding any, like a
+// decompression bomb's header.
+func gifHeader(w, h uint16) []byte {
+    b := []byte("GIF89a")
+    b = binary.LittleEndian.AppendUint16(b, w)
+    b = binary.LittleEndian.AppendUint16(b, h)
+    return append(b, 0, 0, 0, ';')
+}
+
+func TestUploadProductImage(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 0)
+    oversize := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, maxImageUpload)...)
+
+    tests := []struct {
+        name    string
+        field   string
+        data    []byte
+        status  int
+        full    image.Point // stored sizes on success
+        thumb   image.Point
+    }{
+        {name: "png scaled down", field: "image", data: encodeTestImage(t, "png", 2048, 1024), status: http.StatusOK, full: image.Pt(1024, 512), thumb: image.Pt(200, 100)},
+        {name: "tall jpeg", field: "image", data: encodeTestImage(t, "jpeg", 300, 600), status: http.StatusOK, full: image.Pt(300, 600), thumb: image.Pt(100, 200)},
+        {name: "small gif kept", field: "image", data: encodeTestImage(t, "gif", 64, 48), status: http.StatusOK, full: image.Pt(64, 48), thumb: image.Pt(64, 48)},
+        {name: "wrong field", field: "file", data: encodeTestImage(t, "png", 10, 10), status: http.StatusBadRequest},
+        {name: "not an image", field: "image", data: []byte("<html><body>hello</body></html>"), status: http.StatusUnsupportedMediaType},
+        {name: "pdf", field: "image", data: []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"), status: http.StatusUnsupportedMediaType},
+        {name: "png signature only", field: "image", data: []byte("\x89PNG\r\n\x1a\nnot really a png"), status: http.StatusUnsupportedMediaType},
+        {name: "over 5 MB", field: "image", data: oversize, status: http.StatusRequestEntityTooLarge},
+        {name: "too many pixels", field: "image", data: gifHeader(10000, 5000), status: http.StatusRequestEntityTooLarge},
+        {name: "no pixels", field: "image", data: gifHeader(0, 10), status: http.StatusRequestEntityTooLarge},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var before Product
+            db.First(&before, p.ID)
+            var got Product
+            w := e.with(t).uploadImage(p.ID, tt.field, tt.data)
+            if tt.status != http.StatusOK {
+                e.with(t).expect(w, tt.status, nil)
+                var after Product
+                db.First(&after, p.ID)
+                if after.Version != before.Version { t.Errorf("version changed on a refused upload") }
+                return
+            }
+            e.with(t).expect(w, http.StatusOK, &got)
+            if got.ImageURL == nil || got.ThumbnailURL == nil { t.Fatalf("urls = %v, %v", got.ImageURL, got.ThumbnailURL) }
+            if got.Version != before.Version+1 { t.Errorf("version = %d, want %d", got.Version, before.Version+1) }
+            store := imageStorage.(memImageStore)
+            if len(store) != 2 { t.Errorf("stored %d files, want 2 (the replaced image is removed)", len(store)) }
+            for _, c := range []struct {
+                url  *string
+                want image.Point
+            }{{got.ImageURL, tt.full}, {got.ThumbnailURL, tt.thumb}} {
+                data, ok := store[path.Base(*c.url)]
+                if !ok { t.Fatalf("%s not stored", *c.url) }
+                cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+                if err != nil { t.Fatal(err) }
+                if format != "jpeg" || cfg.Width != c.want.X || cfg.Height != c.want.Y { t.Errorf("%s: %s %dx%d, want jpeg %dx%d", *c.url, format, cfg.Width, cfg.Height, c.want.X, c.want.Y) }
+            }
+        })
+    }
+
+    e.expect(e.uploadImage(99999, "image", encodeTestImage(t, "png", 10, 10)), http.StatusNotFound, nil)
+}
+
+func TestServeAndDeleteProductImage(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 0)
+    e.expect(e.uploadImage(p.ID, "image", encodeTestImage(t, "png", 400, 300)), http.StatusOK, &p)
+    name := path.Base(*p.ImageURL)
+    imagePath := strings.TrimPrefix(*p.ImageURL, "/api/v1")
+
+    // images are public and never change under a name
+    w := e.doAs("", http.MethodGet, imagePath, nil)
+    e.expect(w, http.StatusOK, nil)
+    if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" { t.Errorf("content type = %q", ct) }
+    if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") { t.Errorf("cache control = %q", cc) }
+    if w.Header().Get("X-Content-Type-Options") != "nosniff" { t.Error("missing nosniff") }
+    if !bytes.Equal(w.Body.Bytes(), imageStorage.(memImageStore)[name]) { t.Error("served bytes differ from the stored image") }
+    etag := w.Header().Get("ETag")
+
+    tests := []struct {
+        name        string
+        path        string
+        ifNoneMatch string
+        status      int
+    }{
+        {"thumbnail", strings.TrimPrefix(*p.ThumbnailURL, "/api/v1"), "", http.StatusOK},
+        {"cached", imagePath, etag, http.StatusNotModified},
+        {"other etag", imagePath, `"0123"`, http.StatusOK},
+        {"unknown name", "/images/" + strings.Repeat("ab", 16) + ".jpg", "", http.StatusNotFound},
+        {"not a generated name", "/images/logo.jpg", "", http.StatusNotFound},
+        {"wrong extension", "/images/" + strings.TrimSuffix(name, ".jpg") + ".png", "", http.StatusNotFound},
+        {"path traversal", "/images/..%2F..%2Ftest.db", "", http.StatusNotFound},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/api/v1"+tt.path, nil)
+            if tt.ifNoneMatch != "" { r.Header.Set("If-None-Match", tt.ifNoneMatch) }
+            w := httptest.NewRecorder()
+            e.router.ServeHTTP(w, r)
+            if w.Code != tt.status { t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String()) }
+        })
+    }
+
+    // deleting clears the urls and the stored files; deleting again is a no-op
+    for i := 0; i < 2; i++ {
+        var got Product
+        e.expect(e.do(http.MethodDelete, fmt.Sprintf("/products/%d/image", p.ID), nil), http.StatusOK, &got)
+        if got.ImageURL != nil || got.ThumbnailURL != nil { t.Errorf("after delete urls = %v, %v", got.ImageURL, got.ThumbnailURL) }
+        if got.Version != p.Version+1 { t.Errorf("after delete %d: version = %d, want %d", i+1, got.Version, p.Version+1) }
+    }
+    if n := len(imageStorage.(memImageStore)); n != 0 { t.Errorf("%d files left after delete", n) }
+    e.expect(e.doAs("", http.MethodGet, imagePath, nil), http.StatusNotFound, nil)
+    e.expect(e.do(http.MethodDelete, "/products/99999/image", nil), http.StatusNotFound, nil)
+
+    // hard-deleting a product removes its image files
+    e.expect(e.uploadImage(p.ID, "image", encodeTestImage(t, "png", 10, 10)), http.StatusOK, nil)
+    e.expect(e.do(http.MethodDelete, fmt.Sprintf("/products/%d?hard=true", p.ID), nil), http.StatusNoContent, nil)
+    if n := len(imageStorage.(memImageStore)); n != 0 { t.Errorf("%d files left after hard delete", n) }
+}
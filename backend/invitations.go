@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// An Invitation lets someone join an organization in a preset role and
+// choose their own password. The inviter passes the link on, by email or
+// otherwise; the server only keeps a hash of its token. Invitations expire,
+// work once and can be revoked. With OPEN_REGISTRATION=false they are the
+// only way to get an account.
+type Invitation struct {
+    ID                uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID    uint    `gorm:"index" json:"organization_id"`
+    Email             string  `json:"email"`
+    Name              string  `json:"name"`
+    Role              string  `json:"role"`
+    DefaultLocationID *uint   `json:"default_location_id"`
+    TokenHash         string  `gorm:"size:64;uniqueIndex" json:"-"`
+    InvitedBy         uint    `json:"invited_by"`
+    ExpiresAt         string  `json:"expires_at"`
+    AcceptedAt        *string `json:"accepted_at"`
+    AcceptedBy        *uint   `json:"accepted_by"`
+    RevokedAt         *string `json:"revoked_at"`
+    DateCreated       string  `json:"date_created"`
+}
+
+// InvitationResponse is what the API shows of an invitation; the token
+// hash stays server-side.
+type InvitationResponse struct {
+    ID                uint    `json:"id"`
+    OrganizationID    uint    `json:"organization_id"`
+    Email             string  `json:"email"`
+    Name              string  `json:"name"`
+    Role              string  `json:"role"`
+    DefaultLocationID *uint   `json:"default_location_id"`
+    InvitedBy         uint    `json:"invited_by"`
+    ExpiresAt         string  `json:"expires_at"`
+    AcceptedAt        *string `json:"accepted_at"`
+    AcceptedBy        *uint   `json:"accepted_by"`
+    RevokedAt         *string `json:"revoked_at"`
+    DateCreated       string  `json:"date_created"`
+}
+
+func invitationResponse(inv Invitation) InvitationResponse {
+    return InvitationResponse{ID: inv.ID, OrganizationID: inv.OrganizationID, Email: inv.Email, Name: inv.Name, Role: inv.Role, DefaultLocationID: inv.DefaultLocationID, InvitedBy: inv.InvitedBy, ExpiresAt: inv.ExpiresAt, AcceptedAt: inv.AcceptedAt, AcceptedBy: inv.AcceptedBy, RevokedAt: inv.RevokedAt, DateCreated: inv.DateCreated}
+}
+
+const (
+    defaultInvitationExpiry = 72 * time.Hour
+    maxInvitationExpiry     = 30 * 24 * time.Hour
+)
+
+// Set from OPEN_REGISTRATION and INVITE_URL in main.
+var (
+    openRegistration = true
+    inviteURL        = "" // the token is appended, e.g. https://pos.example.com/invite?token=
+)
+
+var errInvitationInvalid = errors.New("invitation is invalid, used or expired")
+
+// pendingInvitation finds an invitation that can still be accepted.
+func pendingInvitation(tx *gorm.DB, token string) (Invitation, error) {
+    var inv Invitation
+    err := tx.Where("token_hash = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", hashToken(token), nowISO()).First(&inv).Error
+    if err != nil { return inv, errInvitationInvalid }
+    return inv, nil
+}
+
+// Invitation handlers
+func listInvitations(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var invs []Invitation
+    db.Where("organization_id = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", orgUser.OrganizationID, nowISO()).Order("id desc").Find(&invs)
+    out := make([]InvitationResponse, 0, len(invs))
+    for _, inv := range invs { out = append(out, invitationResponse(inv)) }
+    c.JSON(http.StatusOK, out)
+}
+
+// createInvitation returns the invitation token, and the link when
+// INVITE_URL is set, once.
+func createInvitation(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        Email             string `json:"email"`
+        Name              string `json:"name"`
+        Role              string `json:"role"`
+        DefaultLocationID *uint  `json:"default_location_id"`
+        ExpiresInHours    int    `json:"expires_in_hours"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.Role == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "role required"}); return }
+    if !mayGrant(c, orgUser.OrganizationID, body.Role) { return }
+    if body.DefaultLocationID != nil {
+        if _, err := orgLocation(db, orgUser.OrganizationID, *body.DefaultLocationID); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown location"}); return }
+    }
+    expiry := defaultInvitationExpiry
+    if body.ExpiresInHours != 0 {
+        expiry = time.Duration(body.ExpiresInHours) * time.Hour
+        if expiry <= 0 || expiry > maxInvitationExpiry { c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_hours must be 1-720"}); return }
+    }
+    var raw [32]byte
+    if _, err := rand.Read(raw[:]); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    token := base64.RawURLEncoding.EncodeToString(raw[:])
+    inv := Invitation{
+        OrganizationID: orgUser.OrganizationID, Email: strings.TrimSpace(body.Email), Name: strings.TrimSpace(body.Name),
+        Role: body.Role, DefaultLocationID: body.DefaultLocationID, TokenHash: hashToken(token), InvitedBy: uid,
+        ExpiresAt: time.Now().Add(expiry).UTC().Format(time.RFC3339), DateCreated: nowISO(),
+    }
+    if err := db.Create(&inv).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    res := gin.H{"invitation": invitationResponse(inv), "token": token}
+    if inviteURL != "" { res["url"] = inviteURL + token }
+    c.JSON(http.StatusCreated, res)
+}
+
+func revokeInvitation(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    res := db.Model(&Invitation{}).Where("id = ? AND organization_id = ? AND accepted_at IS NULL AND revoked_at IS NULL", id, orgUser.OrganizationID).Update("revoked_at", nowISO())
+    if res.Error != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()}); return }
+    if res.RowsAffected == 0 { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    c.Status(http.StatusNoContent)
+}
+
+// inspectInvitation shows the invitee what they are joining. The token is
+// sent in the body so it stays out of access logs.
+func inspectInvitation(c *gin.Context) {
+    var body struct{ Token string `json:"token"` }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    inv, err := pendingInvitation(db, body.Token)
+    if err != nil { c.JSON(http.StatusNotFound, gin.H{"error": err.Error()}); return }
+    var org Organization
+    _ = db.First(&org, inv.OrganizationID).Error
+    c.JSON(http.StatusOK, gin.H{"organization": gin.H{"id": org.ID, "name": org.Name}, "role": inv.Role, "email": inv.Email, "name": inv.Name, "expires_at": inv.ExpiresAt})
+}
+
+// acceptInvitation joins the invitation's organization, either with a new
+// account or, with existing_account, an account the invitee already has
+// (say, at another store). It signs them in.
+func acceptInvitation(c *gin.Context) {
+    var body struct {
+        Token           string `json:"token"`
+        Name            string `json:"name"`
+        Username        string `json:"username"`
+        Password        string `json:"password"`
+        ExistingAccount bool   `json:"existing_account"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.Username == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if _, err := pendingInvitation(db, body.Token); err != nil { c.JSON(http.StatusNotFound, gin.H{"error": err.Error()}); return }
+    var user User
+    hashed := ""
+    if body.ExistingAccount {
+        if !checkLoginAllowed(c, body.Username) { return }
+        if err := db.Where("username = ?", body.Username).First(&user).Error; err != nil {
+            recordLoginAttempt(c, body.Username, "unknown_user")
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+            return
+        }
+        if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.Password)) != nil {
+            recordLoginAttempt(c, body.Username, "bad_password")
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+            return
+        }
+        recordLoginAttempt(c, body.Username, "password_ok")
+    } else {
+        if err := checkPassword(body.Password, body.Username); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+        h, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "hash error"}); return }
+        hashed = string(h)
+    }
+    var ou OrganizationUser
+    err := db.Transaction(func(tx *gorm.DB) error {
+        inv, err := pendingInvitation(tx, body.Token)
+        if err != nil { return err }
+        now := nowISO()
+        if !body.ExistingAccount {
+            name := strings.TrimSpace(body.Name)
+            if name == "" { name = inv.Name }
+            user = User{Name: name, Username: body.Username, Password: hashed, DateCreated: now, DateUpdated: now}
+            if err := tx.Create(&user).Error; err != nil {
+                if errors.Is(err, gorm.ErrDuplicatedKey) { return errors.New("username is taken") }
+                return err
+            }
+        }
+        // single use: only one request can mark it accepted
+        res := tx.Model(&Invitation{}).Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", inv.ID).Updates(map[string]any{"accepted_at": now, "accepted_by": user.ID})
+        if res.Error != nil { return res.Error }
+        if res.RowsAffected == 0 { return errInvitationInvalid }
+        err = tx.Where("organization_id = ? AND user_id = ?", inv.OrganizationID, user.ID).First(&ou).Error
+        if err == nil {
+            if ou.IsActive { return errors.New("already a member of this organization") }
+            ou.Role, ou.IsActive, ou.DefaultLocationID, ou.DateUpdated = inv.Role, true, inv.DefaultLocationID, now
+            return tx.Save(&ou).Error
+        }
+        ou = OrganizationUser{OrganizationID: inv.OrganizationID, UserID: user.ID, Role: inv.Role, IsActive: true, DefaultLocationID: inv.DefaultLocationID, DateCreated: now, DateUpdated: now}
+        return tx.Create(&ou).Error
+    })
+    if errors.Is(err, errInvitationInvalid) { c.JSON(http.StatusNotFound, gin.H{"error": err.Error()}); return }
+    if err != nil { c.JSON(http.StatusConflict, gin.H{"error": err.Error()}); return }
+    // enrolled users still finish with their second factor, as at login
+    if user.TOTPEnabled {
+        challenge, err := signTwoFactorChallenge(user.ID, ou.OrganizationID)
+        if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+        c.JSON(http.StatusOK, gin.H{"two_factor_required": true, "challenge_token": challenge, "expires_in": int(twoFactorChallengeExpiry.Seconds())})
+        return
+    }
+    recordLoginAttempt(c, user.Username, "success")
+    completeLogin(c, user, ou)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// invite creates an invitation as the owner and returns it with its token.
+func (e *testEnv) invite(body map[string]any) (InvitationResponse, string) {
+    e.t.Helper()
+    var out struct {
+        Invitation InvitationResponse `json:"invitation"`
+        Token      string             `json:"token"`
+    }
+    e.expect(e.do(http.MethodPost, "/invitations", body), http.StatusCreated, &out)
+    return out.Invitation, out.Token
+}
+
+type acceptResponse struct {
+    Token             string `json:"token"`
+    Role              string `json:"role"`
+    DefaultLocationID *uint  `json:"default_location_id"`
+    Organization      Organization `json:"organization"`
+    TwoFactorRequired bool   `json:"two_factor_required"`
+    ChallengeToken    string `json:"challenge_token"`
+}
+
+func (e *testEnv) accept(body map[string]any, status int) acceptResponse {
+    e.t.Helper()
+    var out acceptResponse
+    e.expect(e.doAs("", http.MethodPost, "/auth/invitation/accept", body), status, &out)
+    return out
+}
+
+func invitationAccepted(t *testing.T, id uint) bool {
+    t.Helper()
+    var inv Invitation
+    if err := db.First(&inv, id).Error; err != nil { t.Fatal(err) }
+    return inv.AcceptedAt != nil
+}
+
+func lastOutcomes(username string, n int) []string {
+    var attempts []LoginAttempt
+    db.Where("username = ?", username).Order("id desc").Limit(n).Find(&attempts)
+    out := make([]string, len(attempts))
+    for i, a := range attempts { out[len(attempts)-1-i] = a.Outcome }
+    return out
+}
+
+func TestAcceptInvitationNewAccount(t *testing.T) {
+    e := newTestEnv(t)
+    shop := e.location("Shop")
+    inv, token := e.invite(map[string]any{"name": "Budi", "role": "cashier", "default_location_id": shop.ID})
+    body := func(username, password string) map[string]any {
+        return map[string]any{"token": token, "username": username, "password": password}
+    }
+
+    // refusals leave the invitation usable
+    e.accept(body("budi", "short"), http.StatusBadRequest)
+    e.accept(body(e.owner.Username, "correct horse battery"), http.StatusConflict)
+    if invitationAccepted(t, inv.ID) { t.Fatal("refused acceptance used the invitation") }
+
+    got := e.accept(body("budi", "correct horse battery"), http.StatusOK)
+    if got.Token == "" || got.Role != "cashier" || got.Organization.ID != e.org.ID || got.DefaultLocationID == nil || *got.DefaultLocationID != shop.ID { t.Fatalf("accepted = %+v", got) }
+    var u User
+    db.Where("username = ?", "budi").First(&u)
+    if u.Name != "Budi" { t.Errorf("name = %q, want the invitation's Budi", u.Name) }
+    e.expect(e.doAs(got.Token, http.MethodGet, "/auth/me", nil), http.StatusOK, nil)
+
+    // single use
+    e.accept(body("budi2", "correct horse battery"), http.StatusNotFound)
+    e.expect(e.doAs("", http.MethodPost, "/auth/invitation", map[string]any{"token": token}), http.StatusNotFound, nil)
+    var users int64
+    db.Model(&User{}).Where("username = ?", "budi2").Count(&users)
+    if users != 0 { t.Error("a used invitation created an account") }
+}
+
+func TestInvitationRevokeAndExpiry(t *testing.T) {
+    e := newTestEnv(t)
+    other := Organization{Name: "Other Store", DateCreated: nowISO(), DateUpdated: nowISO()}
+    mustCreate(t, &other)
+    tests := []struct {
+        name         string
+        setup        func(inv InvitationResponse)
+        revokeStatus int  // of a DELETE after setup
+        usable       bool // whether the invitation still works after that
+    }{
+        {"pending", func(inv InvitationResponse) {}, http.StatusNoContent, false},
+        {"revoked", func(inv InvitationResponse) {
+            e.expect(e.do(http.MethodDelete, fmt.Sprintf("/invitations/%d", inv.ID), nil), http.StatusNoContent, nil)
+        }, http.StatusNotFound, false},
+        {"expired", func(inv InvitationResponse) {
+            db.Model(&Invitation{}).Where("id = ?", inv.ID).Update("expires_at", time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+        }, http.StatusNoContent, false},
+        // only the inviting organization can revoke
+        {"another organization's", func(inv InvitationResponse) {
+            db.Model(&Invitation{}).Where("id = ?", inv.ID).Update("organization_id", other.ID)
+        }, http.StatusNotFound, true},
+    }
+    for i, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            inv, token := e.with(t).invite(map[string]any{"role": "cashier"})
+            tt.setup(inv)
+            e.with(t).expect(e.do(http.MethodDelete, fmt.Sprintf("/invitations/%d", inv.ID), nil), tt.revokeStatus, nil)
+            status := http.StatusNotFound
+            if tt.usable { status = http.StatusOK }
+            e.with(t).expect(e.doAs("", http.MethodPost, "/auth/invitation", map[string]any{"token": token}), status, nil)
+            e.with(t).accept(map[string]any{"token": token, "username": fmt.Sprintf("user%d", i), "password": "correct horse battery"}, status)
+            if invitationAccepted(t, inv.ID) != tt.usable { t.Errorf("invitation accepted = %v, want %v", !tt.usable, tt.usable) }
+        })
+    }
+
+    // an accepted invitation can't be revoked, and is no longer listed
+    inv, token := e.invite(map[string]any{"role": "cashier"})
+    e.accept(map[string]any{"token": token, "username": "late", "password": "correct horse battery"}, http.StatusOK)
+    e.expect(e.do(http.MethodDelete, fmt.Sprintf("/invitations/%d", inv.ID), nil), http.StatusNotFound, nil)
+    var listed []InvitationResponse
+    e.expect(e.do(http.MethodGet, "/invitations", nil), http.StatusOK, &listed)
+    if len(listed) != 0 { t.Errorf("listed = %+v, want none pending", listed) }
+}
+
+func TestAcceptInvitationExistingAccount(t *testing.T) {
+    e := newTestEnv(t)
+    now := nowISO()
+    account := func(username string) User {
+        u := User{Name: username, Username: username, Password: mustHash(t, "correct horse battery"), DateCreated: now, DateUpdated: now}
+        mustCreate(t, &u)
+        return u
+    }
+    existing := func(username, password string) map[string]any {
+        _, token := e.invite(map[string]any{"role": "manager"})
+        return map[string]any{"token": token, "username": username, "password": password, "existing_account": true}
+    }
+    tests := []struct {
+        name     string
+        username string
+        setup    func(u User)
+        password string
+        status   int
+        outcomes []string // latest login attempts of the username
+        joined   bool
+    }{
+        {name: "right password", username: "siti", password: "correct horse battery", status: http.StatusOK, outcomes: []string{"password_ok", "success"}, joined: true},
+        {name: "wrong password", username: "rina", password: "wrong", status: http.StatusUnauthorized, outcomes: []string{"bad_password"}},
+        {name: "unknown account", username: "", password: "correct horse battery", status: http.StatusUnauthorized, outcomes: []string{"unknown_user"}},
+        {name: "locked account", username: "dewi", setup: func(u User) {
+            for i := 0; i < maxLoginFailures; i++ { mustCreate(t, &LoginAttempt{Username: u.Username, Outcome: "bad_password", DateCreated: nowISO()}) }
+        }, password: "correct horse battery", status: http.StatusTooManyRequests, outcomes: []string{"bad_password", "locked"}},
+        {name: "already an active member", username: "agus", setup: func(u User) {
+            mustCreate(t, &OrganizationUser{OrganizationID: e.org.ID, UserID: u.ID, Role: "cashier", IsActive: true, DateCreated: now, DateUpdated: now})
+        }, password: "correct horse battery", status: http.StatusConflict, outcomes: []string{"password_ok"}, joined: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            username := tt.username
+            var u User
+            if username == "" {
+                username = "nobody"
+            } else {
+                u = account(username)
+            }
+            if tt.setup != nil { tt.setup(u) }
+            body := existing(username, tt.password)
+            e.with(t).accept(body, tt.status)
+            if got := lastOutcomes(username, len(tt.outcomes)); fmt.Sprint(got) != fmt.Sprint(tt.outcomes) { t.Errorf("outcomes = %v, want %v", got, tt.outcomes) }
+            var n int64
+            db.Model(&OrganizationUser{}).Where("organization_id = ? AND user_id = ? AND is_active = ?", e.org.ID, u.ID, true).Count(&n)
+            if (n == 1) != tt.joined { t.Errorf("active memberships = %d, want joined %v", n, tt.joined) }
+            var inv Invitation
+            db.Where("token_hash = ?", hashToken(body["token"].(string))).First(&inv)
+            if (inv.AcceptedAt != nil) != (tt.status == http.StatusOK) { t.Errorf("invitation accepted_at = %v after status %d", inv.AcceptedAt, tt.status) }
+        })
+    }
+
+    // failed acceptances count towards the lockout like failed logins
+    u := account("tono")
+    for i := 0; i < maxLoginFailures; i++ { e.accept(existing(u.Username, "wrong"), http.StatusUnauthorized) }
+    e.accept(existing(u.Username, "correct horse battery"), http.StatusTooManyRequests)
+    e.expect(e.doAs("", http.MethodPost, "/auth/login", map[string]any{"username": u.Username, "password": "correct horse battery"}), http.StatusTooManyRequests, nil)
+}
+
+func TestAcceptInvitationTwoFactor(t *testing.T) {
+    e := newTestEnv(t)
+    now := nowISO()
+    secret := []byte("12345678901234567890")
+    u := User{Name: "Wati", Username: "wati", Password: mustHash(t, "correct horse battery"), TOTPSecret: totpEncoding.EncodeToString(secret), TOTPEnabled: true, DateCreated: now, DateUpdated: now}
+    mustCreate(t, &u)
+    inv, token := e.invite(map[string]any{"role": "manager"})
+
+    got := e.accept(map[string]any{"token": token, "username": "wati", "password": "correct horse battery", "existing_account": true}, http.StatusOK)
+    if !got.TwoFactorRequired || got.ChallengeToken == "" || got.Token != "" { t.Fatalf("accepted = %+v, want a second factor challenge only", got) }
+    // the membership is in place, but there is no session until the code is given
+    if !invitationAccepted(t, inv.ID) { t.Error("invitation not accepted") }
+    if got := lastOutcomes("wati", 1); len(got) != 1 || got[0] != "password_ok" { t.Errorf("outcomes = %v, want password_ok", got) }
+    var sessions int64
+    db.Model(&AuthSession{}).Where("user_id = ?", u.ID).Count(&sessions)
+    if sessions != 0 { t.Errorf("sessions = %d before the second factor", sessions) }
+
+    e.expect(e.doAs("", http.MethodPost, "/auth/2fa/verify", map[string]any{"challenge_token": got.ChallengeToken, "code": "000000"}), http.StatusUnauthorized, nil)
+    var done acceptResponse
+    code := totpCode(secret, clock().Unix()/totpPeriod)
+    e.expect(e.doAs("", http.MethodPost, "/auth/2fa/verify", map[string]any{"challenge_token": got.ChallengeToken, "code": code}), http.StatusOK, &done)
+    if done.Token == "" || done.Organization.ID != e.org.ID || done.Role != "manager" { t.Errorf("verified = %+v, want a manager session in the inviting organization", done) }
+    if got := lastOutcomes("wati", 1); got[0] != "success" { t.Errorf("outcome after code = %v, want success", got) }
+}
+
+func TestAcceptInvitationReactivatesMembership(t *testing.T) {
+    e := newTestEnv(t)
+    now := nowISO()
+    shop := e.location("Shop")
+    u := User{Name: "Eko", Username: "eko", Password: mustHash(t, "correct horse battery"), DateCreated: now, DateUpdated: now}
+    mustCreate(t, &u)
+    old := OrganizationUser{OrganizationID: e.org.ID, UserID: u.ID, Role: "cashier", IsActive: false, DateCreated: now, DateUpdated: now}
+    mustCreate(t, &old)
+    _, token := e.invite(map[string]any{"role": "manager", "default_location_id": shop.ID})
+
+    got := e.accept(map[string]any{"token": token, "username": "eko", "password": "correct horse battery", "existing_account": true}, http.StatusOK)
+    if got.Token == "" || got.Role != "manager" { t.Fatalf("accepted = %+v", got) }
+    var rows []OrganizationUser
+    db.Where("organization_id = ? AND user_id = ?", e.org.ID, u.ID).Find(&rows)
+    if len(rows) != 1 { t.Fatalf("memberships = %d, want the old one reused", len(rows)) }
+    if r := rows[0]; !r.IsActive || r.Role != "manager" || r.DefaultLocationID == nil || *r.DefaultLocationID != shop.ID || r.DateCreated != old.DateCreated {
+        t.Errorf("membership = %+v, want active manager at the shop, created %s", r, old.DateCreated)
+    }
+    e.expect(e.doAs(got.Token, http.MethodGet, "/auth/me", nil), http.StatusOK, nil)
+}
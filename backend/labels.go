@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/ean"
+	"github.com/boombuler/barcode/qr"
+	"github.com/gin-gonic/gin"
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// LabelTemplate describes a shelf/price label layout for an organization.
+type LabelTemplate struct {
+    ID                 uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID     uint    `gorm:"index" json:"organization_id"`
+    Name               string  `json:"name"`
+    WidthMM            float64 `json:"width_mm"`
+    HeightMM           float64 `json:"height_mm"`
+    ShowName           bool    `json:"show_name"`
+    ShowPrice          bool    `json:"show_price"`
+    ShowSKU            bool    `json:"show_sku"`
+    BarcodeType        string  `json:"barcode_type"` // code128, ean13, qr, none
+    CurrencySymbol     string  `json:"currency_symbol"`
+    CurrencyDecimals   int     `json:"currency_decimals"`
+    ThousandsSeparator string  `json:"thousands_separator"`
+    DecimalSeparator   string  `json:"decimal_separator"`
+    IsDefault          bool    `json:"is_default"`
+    DateCreated        string  `json:"date_created"`
+    DateUpdated        string  `json:"date_updated"`
+}
+
+// defaultLabelTemplate is used when an organization has no default template.
+func defaultLabelTemplate() LabelTemplate {
+    return LabelTemplate{Name: "Default", WidthMM: 50, HeightMM: 30, ShowName: true, ShowPrice: true, ShowSKU: true, BarcodeType: "code128", CurrencySymbol: "Rp", CurrencyDecimals: 0, ThousandsSeparator: ".", DecimalSeparator: ","}
+}
+
+func validateLabelTemplate(t *LabelTemplate) error {
+    if t.Name == "" { return errors.New("name is required") }
+    if t.WidthMM < 20 || t.WidthMM > 200 || t.HeightMM < 10 || t.HeightMM > 200 { return errors.New("label size must be 20-200mm wide and 10-200mm high") }
+    switch t.BarcodeType {
+    case "code128", "ean13", "qr", "none":
+    case "":
+        t.BarcodeType = "code128"
+    default:
+        return errors.New("barcode_type must be code128, ean13, qr or none")
+    }
+    if t.CurrencyDecimals < 0 || t.CurrencyDecimals > 4 { return errors.New("currency_decimals must be 0-4") }
+    return nil
+}
+
+// formatMoney formats an amount with the template's currency settings,
+// e.g. "Rp 15.500".
+func formatMoney(amount float64, t LabelTemplate) string {
+    s := strconv.FormatFloat(math.Abs(amount), 'f', t.CurrencyDecimals, 64)
+    intPart, frac, _ := strings.Cut(s, ".")
+    var sb strings.Builder
+    for i, ch := range intPart {
+        if i > 0 && (len(intPart)-i)%3 == 0 { sb.WriteString(t.ThousandsSeparator) }
+        sb.WriteRune(ch)
+    }
+    if frac != "" { sb.WriteString(t.DecimalSeparator + frac) }
+    sign := ""
+    if amount < 0 { sign = "-" }
+    if t.CurrencySymbol == "" { return sign + sb.String() }
+    return sign + t.CurrencySymbol + " " + sb.String()
+}
+
+// labelPrice is the product's price, per unit for products not sold by
+// the piece ("Rp 12.000 / kg").
+func labelPrice(p Product, t LabelTemplate) string {
+    if p.Unit == "" || p.Unit == defaultUnit { return formatMoney(p.Price, t) }
+    return formatMoney(p.Price, t) + " / " + p.Unit
+}
+
+// encodeBarcode renders content as the requested symbology, scaled to w×h
+// pixels. EAN-13 needs 12 or 13 digits; other content falls back to Code128.
+func encodeBarcode(kind, content string, w, h int) (image.Image, error) {
+    var bc barcode.Barcode
+    var err error
+    switch kind {
+    case "qr":
+        bc, err = qr.Encode(content, qr.M, qr.Auto)
+        if w > h { w = h } else { h = w }
+    case "ean13":
+        if allDigits(content) && (len(content) == 12 || len(content) == 13 && validGTIN(content)) {
+            bc, err = ean.Encode(content)
+            break
+        }
+        fallthrough
+    default:
+        bc, err = code128.Encode(content)
+    }
+    if err != nil { return nil, err }
+    if min := bc.Bounds().Dx(); w < min { w = min }
+    scaled, err := barcode.Scale(bc, w, h)
+    if err != nil { return nil, err }
+    // barcodes use a 16-bit gray model, which gofpdf cannot embed
+    gray := image.NewGray(scaled.Bounds())
+    draw.Draw(gray, gray.Bounds(), scaled, scaled.Bounds().Min, draw.Src)
+    return gray, nil
+}
+
+// labelContent picks what a product's label barcode encodes: its SKU, else
+// its first unit barcode.
+func labelContent(p Product) string {
+    if p.SKU != nil && *p.SKU != "" { return *p.SKU }
+    var bc ProductBarcode
+    if err := db.Where("product_id = ? AND multiplier = ?", p.ID, 1).Order("id asc").First(&bc).Error; err == nil { return bc.Code }
+    return ""
+}
+
+// Pixels per millimetre for PNG output (~203 dpi, typical thermal printers).
+const labelPxPerMM = 8
+
+// Limits for POST /labels. A PNG sheet is held in memory at 4 bytes per
+// pixel, so it is capped by size (16M pixels, 64 MB); larger runs need PDF.
+const (
+    maxLabelCount     = 1000
+    maxLabelPNGPixels = 16 << 20
+)
+
+func renderLabelPNG(p Product, t LabelTemplate) (*image.RGBA, error) {
+    w, h := int(t.WidthMM*labelPxPerMM), int(t.HeightMM*labelPxPerMM)
+    img := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+    d := &font.Drawer{Dst: img, Src: image.NewUniform(color.Black), Face: basicfont.Face7x13}
+    y := 16
+    line := func(s string) {
+        d.Dot = fixed.P(8, y)
+        d.DrawString(s)
+        y += 16
+    }
+    if t.ShowName { line(p.Name) }
+    if t.ShowPrice { line(labelPrice(p, t)) }
+    if t.ShowSKU && p.SKU != nil { line(*p.SKU) }
+    if content := labelContent(p); t.BarcodeType != "none" && content != "" && h-y > 16 {
+        bc, err := encodeBarcode(t.BarcodeType, content, w-16, h-y-8)
+        if err != nil { return nil, err }
+        draw.Draw(img, bc.Bounds().Add(image.Pt((w-bc.Bounds().Dx())/2, y)), bc, image.Point{}, draw.Src)
+    }
+    return img, nil
+}
+
+// renderLabelsPDF tiles labels across A4 pages with a 10mm margin.
+func renderLabelsPDF(products []Product, t LabelTemplate, copies int) ([]byte, error) {
+    const pageW, pageH, margin = 210.0, 297.0, 10.0
+    pdf := gofpdf.New("P", "mm", "A4", "")
+    pdf.SetMargins(margin, margin, margin)
+    pdf.SetAutoPageBreak(false, margin)
+    tr := pdf.UnicodeTranslatorFromDescriptor("")
+    cols := int((pageW - 2*margin) / t.WidthMM)
+    rows := int((pageH - 2*margin) / t.HeightMM)
+    if cols < 1 || rows < 1 { return nil, errors.New("label does not fit on an A4 page") }
+    n := 0
+    for _, p := range products {
+        for c := 0; c < copies; c++ {
+            slot := n % (cols * rows)
+            if slot == 0 { pdf.AddPage() }
+            x := margin + float64(slot%cols)*t.WidthMM
+            y := margin + float64(slot/cols)*t.HeightMM
+            pdf.SetDrawColor(200, 200, 200)
+            pdf.Rect(x, y, t.WidthMM, t.HeightMM, "D")
+            cy := y + 2
+            if t.ShowName {
+                pdf.SetFont("Helvetica", "", 8)
+                pdf.SetXY(x+2, cy)
+                pdf.CellFormat(t.WidthMM-4, 4, tr(p.Name), "", 0, "L", false, 0, "")
+                cy += 4
+            }
+            if t.ShowPrice {
+                pdf.SetFont("Helvetica", "B", 12)
+                pdf.SetXY(x+2, cy)
+                pdf.CellFormat(t.WidthMM-4, 6, tr(labelPrice(p, t)), "", 0, "L", false, 0, "")
+                cy += 6
+            }
+            if t.ShowSKU && p.SKU != nil {
+                pdf.SetFont("Helvetica", "", 7)
+                pdf.SetXY(x+2, cy)
+                pdf.CellFormat(t.WidthMM-4, 3.5, tr(*p.SKU), "", 0, "L", false, 0, "")
+                cy += 3.5
+            }
+            bh := y + t.HeightMM - cy - 2
+            if content := labelContent(p); t.BarcodeType != "none" && content != "" && bh > 4 {
+                bw := t.WidthMM - 4
+                if t.BarcodeType == "qr" { bw = bh }
+                bc, err := encodeBarcode(t.BarcodeType, content, int(bw*labelPxPerMM), int(bh*labelPxPerMM))
+                if err != nil { return nil, err }
+                var buf bytes.Buffer
+                if err := png.Encode(&buf, bc); err != nil { return nil, err }
+                name := fmt.Sprintf("bc-%d", p.ID)
+                opts := gofpdf.ImageOptions{ImageType: "PNG"}
+                if info := pdf.GetImageInfo(name); info == nil { pdf.RegisterImageOptionsReader(name, opts, &buf) }
+                pdf.ImageOptions(name, x+(t.WidthMM-bw)/2, cy, bw, bh, false, opts, 0, "")
+            }
+            n++
+        }
+    }
+    var out bytes.Buffer
+    if err := pdf.Output(&out); err != nil { return nil, err }
+    return out.Bytes(), nil
+}
+
+// Label template handlers
+func listLabelTemplates(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var templates []LabelTemplate
+    db.Where("organization_id = ?", orgUser.OrganizationID).Order("name asc").Find(&templates)
+    c.JSON(http.StatusOK, templates)
+}
+
+func createLabelTemplate(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    t := defaultLabelTemplate()
+    t.Name = ""
+    if err := c.BindJSON(&t); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if err := validateLabelTemplate(&t); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    now := nowISO()
+    t.ID = 0
+    t.OrganizationID = orgUser.OrganizationID
+    t.DateCreated = now
+    t.DateUpdated = now
+    if err := db.Create(&t).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if t.IsDefault { db.Model(&LabelTemplate{}).Where("organization_id = ? AND id <> ?", t.OrganizationID, t.ID).Update("is_default", false) }
+    c.JSON(http.StatusCreated, t)
+}
+
+func updateLabelTemplate(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var t LabelTemplate
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&t).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    dateCreated := t.DateCreated
+    if err := c.BindJSON(&t); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if err := validateLabelTemplate(&t); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    t.ID = uint(id)
+    t.OrganizationID = orgUser.OrganizationID
+    t.DateCreated = dateCreated
+    t.DateUpdated = nowISO()
+    if err := db.Save(&t).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if t.IsDefault { db.Model(&LabelTemplate{}).Where("organization_id = ? AND id <> ?", t.OrganizationID, t.ID).Update("is_default", false) }
+    c.JSON(http.StatusOK, t)
+}
+
+func deleteLabelTemplate(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).Delete(&LabelTemplate{}).Error; err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// printLabels renders labels for the selected products as a PDF sheet or,
+// for png, one image with the labels stacked vertically.
+func printLabels(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        ProductIDs []uint `json:"product_ids"`
+        TemplateID *uint  `json:"template_id"`
+        Format     string `json:"format"`
+        Copies     int    `json:"copies"`
+    }
+    if err := c.BindJSON(&body); err != nil || len(body.ProductIDs) == 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if body.Copies <= 0 { body.Copies = 1 }
+    if body.Copies > maxLabelCount || len(body.ProductIDs) > maxLabelCount || len(body.ProductIDs)*body.Copies > maxLabelCount { c.JSON(http.StatusBadRequest, gin.H{"error": "too many labels"}); return }
+    t := defaultLabelTemplate()
+    if body.TemplateID != nil {
+        if err := db.Where("id = ? AND organization_id = ?", *body.TemplateID, orgUser.OrganizationID).First(&t).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "template not found"}); return
+        }
+    } else {
+        _ = db.Where("organization_id = ? AND is_default = ?", orgUser.OrganizationID, true).First(&t).Error
+    }
+    var products []Product
+    db.Where("organization_id = ? AND id IN ?", orgUser.OrganizationID, body.ProductIDs).Order("name asc").Find(&products)
+    if len(products) == 0 { c.JSON(http.StatusNotFound, gin.H{"error": "no products found"}); return }
+
+    switch body.Format {
+    case "", "pdf":
+        out, err := renderLabelsPDF(products, t, body.Copies)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+        c.Header("Content-Disposition", `inline; filename="labels.pdf"`)
+        c.Data(http.StatusOK, "application/pdf", out)
+    case "png":
+        lw, lh := int(t.WidthMM*labelPxPerMM), int(t.HeightMM*labelPxPerMM)
+        n := len(products) * body.Copies
+        if lw*lh*n > maxLabelPNGPixels { c.JSON(http.StatusBadRequest, gin.H{"error": "too many labels for png, use pdf"}); return }
+        sheet := image.NewRGBA(image.Rect(0, 0, lw, lh*n))
+        for i, p := range products {
+            img, err := renderLabelPNG(p, t)
+            if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+            for k := 0; k < body.Copies; k++ {
+                draw.Draw(sheet, img.Bounds().Add(image.Pt(0, (i*body.Copies+k)*lh)), img, image.Point{}, draw.Src)
+            }
+        }
+        var buf bytes.Buffer
+        if err := png.Encode(&buf, sheet); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+        c.Data(http.StatusOK, "image/png", buf.Bytes())
+    default:
+        c.JSON(http.StatusBadRequest, gin.H{"error": "format must be pdf or png"})
+    }
+}
+
+// productBarcodeImage serves a product's barcode as PNG.
+// Query: type=code128|ean13|qr, width, height in pixels.
+func productBarcodeImage(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    content := labelContent(p)
+    if content == "" { c.JSON(http.StatusNotFound, gin.H{"error": "product has no SKU or barcode"}); return }
+    w, _ := strconv.Atoi(c.DefaultQuery("width", "400"))
+    h, _ := strconv.Atoi(c.DefaultQuery("height", "120"))
+    if w <= 0 || h <= 0 || w > 4000 || h > 4000 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad size"}); return }
+    kind := c.DefaultQuery("type", "code128")
+    if kind != "code128" && kind != "ean13" && kind != "qr" { c.JSON(http.StatusBadRequest, gin.H{"error": "type must be code128, ean13 or qr"}); return }
+    img, err := encodeBarcode(kind, content, w, h)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, img); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.Data(http.StatusOK, "image/png", buf.Bytes())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func TestFormatMoney(t *testing.T) {
+    rupiah := defaultLabelTemplate()
+    dollar := LabelTemplate{CurrencySymbol: "$", CurrencyDecimals: 2, ThousandsSeparator: ",", DecimalSeparator: "."}
+    bare := LabelTemplate{CurrencyDecimals: 1, ThousandsSeparator: " ", DecimalSeparator: ","}
+    tests := []struct {
+        amount float64
+        t      LabelTemplate
+        want   string
+    }{
+        {0, rupiah, "Rp 0"},
+        {999, rupiah, "Rp 999"},
+        {15500, rupiah, "Rp 15.500"},
+        {1234567, rupiah, "Rp 1.234.567"},
+        {15500.6, rupiah, "Rp 15.501"},
+        {-15500, rupiah, "-Rp 15.500"},
+        {1234.5, dollar, "$ 1,234.50"},
+        {0.005, dollar, "$ 0.01"},
+        {-0.5, dollar, "-$ 0.50"},
+        {1234567.25, bare, "1 234 567,2"},
+        {-12, bare, "-12,0"},
+    }
+    for _, tt := range tests {
+        if got := formatMoney(tt.amount, tt.t); got != tt.want { t.Errorf("formatMoney(%v, %q) = %q, want %q", tt.amount, tt.t.CurrencySymbol, got, tt.want) }
+    }
+}
+
+func TestLabelPrice(t *testing.T) {
+    tpl := defaultLabelTemplate()
+    tests := []struct {
+        unit string
+        want string
+    }{
+        {"", "Rp 12.000"},
+        {defaultUnit, "Rp 12.000"},
+        {"kg", "Rp 12.000 / kg"},
+    }
+    for _, tt := range tests {
+        if got := labelPrice(Product{Price: 12000, Unit: tt.unit}, tpl); got != tt.want { t.Errorf("labelPrice(unit %q) = %q, want %q", tt.unit, got, tt.want) }
+    }
+}
+
+func TestEncodeBarcode(t *testing.T) {
+    tests := []struct {
+        name          string
+        kind, content string
+        w, h          int
+        wantW, wantH  int
+        wantErr       bool
+    }{
+        {"code128", "code128", "ABC-123", 400, 120, 400, 120, false},
+        {"ean13 with check digit", "ean13", "8992761111113", 380, 100, 380, 100, false},
+        {"ean13 without check digit", "ean13", "899276111111", 380, 100, 380, 100, false},
+        // a bad check digit or non-digits fall back to Code128
+        {"ean13 bad check digit", "ean13", "8992761111114", 380, 100, 380, 100, false},
+        {"ean13 not digits", "ean13", "SKU-1", 380, 100, 380, 100, false},
+        {"qr is square", "qr", "SKU-1", 400, 120, 120, 120, false},
+        {"widened to the symbol", "code128", "ABC-123", 10, 50, -1, 50, false},
+        {"empty content", "code128", "", 400, 120, 0, 0, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            img, err := encodeBarcode(tt.kind, tt.content, tt.w, tt.h)
+            if tt.wantErr {
+                if err == nil { t.Fatal("want an error") }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            if _, ok := img.(*image.Gray); !ok { t.Errorf("got %T, want *image.Gray", img) }
+            b := img.Bounds()
+            if tt.wantW < 0 {
+                if b.Dx() <= tt.w { t.Errorf("width %d not widened past %d", b.Dx(), tt.w) }
+            } else if b.Dx() != tt.wantW {
+                t.Errorf("width %d, want %d", b.Dx(), tt.wantW)
+            }
+            if b.Dy() != tt.wantH { t.Errorf("height %d, want %d", b.Dy(), tt.wantH) }
+        })
+    }
+}
+
+func TestPrintLabels(t *testing.T) {
+    e := newTestEnv(t)
+    sku := "TEA-1"
+    tea := e.product("Tea", 15500, 0)
+    db.Model(&tea).Update("sku", sku)
+    coffee := e.product("Coffee", 7000, 0)
+    now := nowISO()
+    large := LabelTemplate{OrganizationID: e.org.ID, Name: "Large", WidthMM: 180, HeightMM: 180, ShowName: true, ShowPrice: true, BarcodeType: "qr", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &large)
+    ids := []uint{tea.ID, coffee.ID}
+
+    tests := []struct {
+        name   string
+        body   map[string]any
+        status int
+        labels int // labels expected on a png sheet
+    }{
+        {"pdf by default", map[string]any{"product_ids": ids}, http.StatusOK, 0},
+        {"pdf copies", map[string]any{"product_ids": ids, "copies": 30, "format": "pdf"}, http.StatusOK, 0},
+        {"png stacks copies", map[string]any{"product_ids": ids, "copies": 3, "format": "png"}, http.StatusOK, 6},
+        {"png with a template", map[string]any{"product_ids": []uint{tea.ID}, "template_id": large.ID, "format": "png"}, http.StatusOK, 1},
+        {"no products", map[string]any{"product_ids": []uint{}}, http.StatusBadRequest, 0},
+        {"unknown products", map[string]any{"product_ids": []uint{99999}}, http.StatusNotFound, 0},
+        {"unknown template", map[string]any{"product_ids": ids, "template_id": 99999}, http.StatusNotFound, 0},
+        {"bad format", map[string]any{"product_ids": ids, "format": "gif"}, http.StatusBadRequest, 0},
+        {"too many labels", map[string]any{"product_ids": ids, "copies": 501}, http.StatusBadRequest, 0},
+        {"too many copies", map[string]any{"product_ids": ids, "copies": 1001}, http.StatusBadRequest, 0},
+        // would wrap around to a small count if multiplied first
+        {"copies overflow", map[string]any{"product_ids": []uint{tea.ID, coffee.ID, tea.ID, coffee.ID}, "copies": 1 << 62}, http.StatusBadRequest, 0},
+        {"png too large", map[string]any{"product_ids": ids, "template_id": large.ID, "copies": 5, "format": "png"}, http.StatusBadRequest, 0},
+        {"large run as pdf", map[string]any{"product_ids": ids, "template_id": large.ID, "copies": 5, "format": "pdf"}, http.StatusOK, 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := e.with(t).do(http.MethodPost, "/labels", tt.body)
+            e.with(t).expect(w, tt.status, nil)
+            if tt.status != http.StatusOK { return }
+            if tt.labels == 0 {
+                if ct := w.Header().Get("Content-Type"); ct != "application/pdf" { t.Errorf("content type %q", ct) }
+                if !bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF")) { t.Error("body is not a PDF") }
+                return
+            }
+            img, err := png.Decode(w.Body)
+            if err != nil { t.Fatal(err) }
+            tpl := defaultLabelTemplate()
+            if id, ok := tt.body["template_id"]; ok && id == large.ID { tpl = large }
+            wantW, wantH := int(tpl.WidthMM*labelPxPerMM), int(tpl.HeightMM*labelPxPerMM)*tt.labels
+            if b := img.Bounds(); b.Dx() != wantW || b.Dy() != wantH { t.Errorf("sheet %dx%d, want %dx%d", b.Dx(), b.Dy(), wantW, wantH) }
+        })
+    }
+}
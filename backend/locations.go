@@ -0,0 +1,458 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Location is an outlet or warehouse belonging to an organization. Each
+// organization has one default location, where sales and stock receipts
+// that name no location are booked.
+type Location struct {
+    ID             uint   `gorm:"primaryKey" json:"id"`
+    OrganizationID uint   `gorm:"index" json:"organization_id"`
+    Name           string `json:"name"`
+    Type           string `json:"type"` // outlet, warehouse
+    IsActive       bool   `json:"is_active"`
+    IsDefault      bool   `json:"is_default"`
+    DateCreated    string `json:"date_created"`
+    DateUpdated    string `json:"date_updated"`
+}
+
+// ProductStock holds the on-hand quantity of a product at one location.
+// Product.StockQuantity remains the organization-wide total: the sum over
+// locations plus stock in transit between them.
+type ProductStock struct {
+    OrganizationID uint   `gorm:"index" json:"organization_id"`
+    ProductID      uint   `gorm:"primaryKey" json:"product_id"`
+    LocationID     uint   `gorm:"primaryKey" json:"location_id"`
+    Quantity       float64 `gorm:"type:decimal(14,3)" json:"quantity"`
+    DateUpdated    string  `json:"date_updated"`
+}
+
+type StockTransfer struct {
+    ID             uint                `gorm:"primaryKey" json:"id"`
+    OrganizationID uint                `gorm:"index" json:"organization_id"`
+    UserID         uint                `json:"user_id"`
+    FromLocationID uint                `json:"from_location_id"`
+    ToLocationID   uint                `json:"to_location_id"`
+    Status         string              `json:"status"` // in_transit, received, cancelled
+    InOrgTotal     bool                `gorm:"not null;default:false" json:"-"` // false for transfers shipped before in-transit stock counted in the total
+    Note           string              `json:"note"`
+    DateShipped    string              `json:"date_shipped"`
+    DateReceived   *string             `json:"date_received"`
+    DateCreated    string              `json:"date_created"`
+    DateUpdated    string              `json:"date_updated"`
+    Items          []StockTransferItem `gorm:"foreignKey:TransferID" json:"items"`
+    Lots           []StockTransferLot  `gorm:"foreignKey:TransferID" json:"lots"`
+}
+
+type StockTransferItem struct {
+    ID         uint    `gorm:"primaryKey" json:"id"`
+    TransferID uint    `gorm:"index" json:"transfer_id"`
+    ProductID  uint    `json:"product_id"`
+    Quantity   float64 `gorm:"type:decimal(14,3)" json:"quantity"`
+}
+
+// StockTransferLot is the part of a transfer taken from one lot at the
+// source. It becomes a lot with the same number and expiry at the
+// destination, or goes back into its lot when the transfer is cancelled.
+type StockTransferLot struct {
+    ID           uint    `gorm:"primaryKey" json:"id"`
+    TransferID   uint    `gorm:"index" json:"transfer_id"`
+    ProductID    uint    `json:"product_id"`
+    LotID        uint    `json:"lot_id"`
+    LotNumber    *string `json:"lot_number"`
+    ExpiryDate   *string `json:"expiry_date"`
+    DateReceived string  `json:"date_received"`
+    Quantity     float64 `gorm:"type:decimal(14,3)" json:"quantity"`
+}
+
+const (
+    transferInTransit = "in_transit"
+    transferReceived  = "received"
+    transferCancelled = "cancelled"
+)
+
+var errInsufficientStock = errors.New("insufficient stock at location")
+
+// putLocationStock adds delta to the product's quantity at a location only,
+// for stock moving between locations.
+func putLocationStock(tx *gorm.DB, orgID, locationID, productID uint, delta float64) error {
+    ps := ProductStock{OrganizationID: orgID, ProductID: productID, LocationID: locationID, Quantity: delta, DateUpdated: nowISO()}
+    return tx.Clauses(clause.OnConflict{
+        DoUpdates: clause.Assignments(map[string]any{"quantity": gorm.Expr("quantity + ?", delta), "date_updated": ps.DateUpdated}),
+    }).Create(&ps).Error
+}
+
+// takeLocationStock is putLocationStock for outgoing stock that must be
+// available at the location.
+func takeLocationStock(tx *gorm.DB, locationID, productID uint, qty float64) error {
+    res := tx.Model(&ProductStock{}).
+        Where("product_id = ? AND location_id = ? AND quantity >= ?", productID, locationID, qty).
+        Updates(map[string]any{"quantity": gorm.Expr("quantity - ?", qty), "date_updated": nowISO()})
+    if res.Error != nil { return res.Error }
+    if res.RowsAffected == 0 { return errInsufficientStock }
+    return nil
+}
+
+// adjustLocationStock adds delta to the product's quantity at a location and
+// to the product's organization-wide total.
+func adjustLocationStock(tx *gorm.DB, orgID, locationID, productID uint, delta float64) error {
+    if err := putLocationStock(tx, orgID, locationID, productID, delta); err != nil { return err }
+    return addProductStock(tx, orgID, productID, delta)
+}
+
+// withdrawLocationStock is adjustLocationStock for stock leaving the
+// organization that must be available at the location.
+func withdrawLocationStock(tx *gorm.DB, orgID, locationID, productID uint, qty float64) error {
+    if err := takeLocationStock(tx, locationID, productID, qty); err != nil { return err }
+    return addProductStock(tx, orgID, productID, -qty)
+}
+
+// createDefaultLocation gives a new organization its default location.
+func createDefaultLocation(tx *gorm.DB, orgID uint) (Location, error) {
+    now := nowISO()
+    loc := Location{OrganizationID: orgID, Name: "Main store", Type: "outlet", IsActive: true, IsDefault: true, DateCreated: now, DateUpdated: now}
+    return loc, tx.Create(&loc).Error
+}
+
+// defaultLocationID returns the organization's default location, nil if it
+// has none.
+func defaultLocationID(tx *gorm.DB, orgID uint) *uint {
+    var loc Location
+    if err := tx.Where("organization_id = ? AND is_default = ?", orgID, true).First(&loc).Error; err != nil { return nil }
+    return &loc.ID
+}
+
+// allocateLocationStock brings stock kept before locations existed into
+// them. Transfers shipped when in-transit stock left the organization
+// total are added back to it. Every organization gets a default location,
+// the oldest active one or a new one. Products that have never been at a
+// location get their stock booked there, with an adjustment movement, and
+// lots without a location follow. A product already at locations whose
+// total does not match them is only logged: that drift needs a stock count,
+// not a silent correction on every start.
+func allocateLocationStock(tx *gorm.DB) error {
+    return tx.Transaction(func(tx *gorm.DB) error {
+        var old []StockTransfer
+        if err := tx.Preload("Items").Where("status = ? AND in_org_total = ?", transferInTransit, false).Find(&old).Error; err != nil { return err }
+        for _, t := range old {
+            for _, it := range t.Items {
+                if err := addProductStock(tx, t.OrganizationID, it.ProductID, it.Quantity); err != nil { return err }
+            }
+        }
+        if err := tx.Model(&StockTransfer{}).Where("in_org_total = ?", false).Update("in_org_total", true).Error; err != nil { return err }
+
+        var orgs []Organization
+        if err := tx.Select("id").Find(&orgs).Error; err != nil { return err }
+        for _, org := range orgs {
+            if defaultLocationID(tx, org.ID) != nil { continue }
+            var loc Location
+            err := tx.Where("organization_id = ? AND is_active = ?", org.ID, true).Order("id asc").First(&loc).Error
+            if errors.Is(err, gorm.ErrRecordNotFound) {
+                if _, err := createDefaultLocation(tx, org.ID); err != nil { return err }
+                continue
+            }
+            if err != nil { return err }
+            if err := tx.Model(&loc).Update("is_default", true).Error; err != nil { return err }
+        }
+        // Lots received before locations sit where their stock is booked.
+        for _, org := range orgs {
+            loc := defaultLocationID(tx, org.ID)
+            if loc == nil { continue }
+            if err := tx.Model(&StockLot{}).Where("organization_id = ? AND location_id IS NULL", org.ID).Update("location_id", *loc).Error; err != nil { return err }
+        }
+
+        var rows []struct {
+            ID             uint
+            OrganizationID uint
+            Located        bool
+            Unallocated    float64
+        }
+        err := tx.Raw(`
+            SELECT p.id, p.organization_id,
+                   EXISTS (SELECT 1 FROM product_stocks ps WHERE ps.product_id = p.id) AS located,
+                   p.stock_quantity
+                   - COALESCE((SELECT SUM(ps.quantity) FROM product_stocks ps WHERE ps.product_id = p.id), 0)
+                   - COALESCE((SELECT SUM(i.quantity) FROM stock_transfer_items i JOIN stock_transfers t ON t.id = i.transfer_id
+                               WHERE i.product_id = p.id AND t.status = ?), 0) AS unallocated
+            FROM products p`, transferInTransit).Scan(&rows).Error
+        if err != nil { return err }
+        now := nowISO()
+        for _, r := range rows {
+            q := roundQuantity(r.Unallocated)
+            if q == 0 { continue }
+            loc := defaultLocationID(tx, r.OrganizationID)
+            if r.Located || q < 0 || loc == nil {
+                log.Printf("product %d (organization %d): stock differs from its locations by %v; left for a stock count", r.ID, r.OrganizationID, q)
+                continue
+            }
+            if err := putLocationStock(tx, r.OrganizationID, *loc, r.ID, q); err != nil { return err }
+            m := InventoryMovement{OrganizationID: r.OrganizationID, ProductID: r.ID, LocationID: loc, Quantity: q, Reason: "adjustment", Note: "stock kept before locations", DateCreated: now}
+            if err := tx.Create(&m).Error; err != nil { return err }
+            log.Printf("product %d (organization %d): booked %v kept before locations into the default location", r.ID, r.OrganizationID, q)
+        }
+        return nil
+    })
+}
+
+// orgLocation loads an active location only if it belongs to the organization.
+func orgLocation(tx *gorm.DB, orgID, locationID uint) (Location, error) {
+    var loc Location
+    err := tx.Where("id = ? AND organization_id = ? AND is_active = ?", locationID, orgID, true).First(&loc).Error
+    return loc, err
+}
+
+// Location handlers
+func listLocations(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var locations []Location
+    db.Where("organization_id = ?", orgUser.OrganizationID).Order("name asc").Find(&locations)
+    c.JSON(http.StatusOK, locations)
+}
+
+func createLocation(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        Name string `json:"name"`
+        Type string `json:"type"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.Name == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if body.Type == "" { body.Type = "outlet" }
+    if body.Type != "outlet" && body.Type != "warehouse" { c.JSON(http.StatusBadRequest, gin.H{"error": "type must be outlet or warehouse"}); return }
+    now := nowISO()
+    loc := Location{OrganizationID: orgUser.OrganizationID, Name: body.Name, Type: body.Type, IsActive: true, DateCreated: now, DateUpdated: now}
+    if err := db.Create(&loc).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, loc)
+}
+
+func updateLocation(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var loc Location
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&loc).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    var body struct {
+        Name      *string `json:"name"`
+        Type      *string `json:"type"`
+        IsActive  *bool   `json:"is_active"`
+        IsDefault *bool   `json:"is_default"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if body.Name != nil { loc.Name = *body.Name }
+    if body.Type != nil {
+        if *body.Type != "outlet" && *body.Type != "warehouse" { c.JSON(http.StatusBadRequest, gin.H{"error": "type must be outlet or warehouse"}); return }
+        loc.Type = *body.Type
+    }
+    if body.IsActive != nil { loc.IsActive = *body.IsActive }
+    // the default moves by making another location the default
+    if body.IsDefault != nil && !*body.IsDefault && loc.IsDefault { c.JSON(http.StatusBadRequest, gin.H{"error": "make another location the default instead"}); return }
+    if body.IsDefault != nil && *body.IsDefault { loc.IsDefault = true }
+    if loc.IsDefault && !loc.IsActive { c.JSON(http.StatusBadRequest, gin.H{"error": "the default location cannot be deactivated"}); return }
+    loc.DateUpdated = nowISO()
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if loc.IsDefault {
+            if err := tx.Model(&Location{}).Where("organization_id = ? AND id <> ?", loc.OrganizationID, loc.ID).Update("is_default", false).Error; err != nil { return err }
+        }
+        return tx.Save(&loc).Error
+    })
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, loc)
+}
+
+func listLocationStock(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var loc Location
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&loc).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    type stockRes struct {
+        ProductID   uint    `json:"product_id"`
+        ProductName string  `json:"product_name"`
+        SKU         *string `json:"sku"`
+        Quantity    float64 `json:"quantity"`
+        DateUpdated string  `json:"date_updated"`
+    }
+    var rows []stockRes
+    db.Raw(`
+        SELECT ps.product_id, p.name as product_name, p.sku, ps.quantity, ps.date_updated
+        FROM product_stocks ps
+        JOIN products p ON p.id = ps.product_id
+        WHERE ps.location_id = ? AND ps.organization_id = ?
+        ORDER BY p.name ASC`, loc.ID, orgUser.OrganizationID).Scan(&rows)
+    c.JSON(http.StatusOK, rows)
+}
+
+// adjustStock applies a manual stock correction or receipt at a location.
+func adjustStock(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var body struct {
+        ProductID uint    `json:"product_id"`
+        Delta     float64 `json:"delta"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.Delta == 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if _, err := orgLocation(tx, orgUser.OrganizationID, uint(id)); err != nil { return err }
+        var p Product
+        if err := tx.Where("id = ? AND organization_id = ?", body.ProductID, orgUser.OrganizationID).First(&p).Error; err != nil { return err }
+        loc := uint(id)
+        delta := roundQuantity(body.Delta)
+        if delta < 0 {
+            if err := withdrawLocationStock(tx, orgUser.OrganizationID, loc, p.ID, -delta); err != nil { return err }
+            return depleteLots(tx, -delta, InventoryMovement{OrganizationID: orgUser.OrganizationID, ProductID: p.ID, LocationID: &loc, UserID: uid, Reason: "adjustment"})
+        }
+        m := InventoryMovement{OrganizationID: orgUser.OrganizationID, ProductID: p.ID, LocationID: &loc, UserID: uid, Quantity: delta, Reason: "adjustment", DateCreated: nowISO()}
+        if err := tx.Create(&m).Error; err != nil { return err }
+        return adjustLocationStock(tx, orgUser.OrganizationID, loc, p.ID, delta)
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if errors.Is(err, errInsufficientStock) { c.JSON(http.StatusConflict, gin.H{"error": err.Error()}); return }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// Stock transfer handlers
+func listStockTransfers(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    q := db.Where("organization_id = ?", orgUser.OrganizationID)
+    if status := c.Query("status"); status != "" { q = q.Where("status = ?", status) }
+    var transfers []StockTransfer
+    q.Preload("Items").Preload("Lots").Order("date_created desc").Find(&transfers)
+    c.JSON(http.StatusOK, transfers)
+}
+
+func getStockTransfer(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var t StockTransfer
+    if err := db.Preload("Items").Preload("Lots").Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&t).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    c.JSON(http.StatusOK, t)
+}
+
+// createStockTransfer ships goods from one location: stock leaves the source
+// immediately and stays in transit until the destination receives it. It
+// stays in the organization total throughout.
+func createStockTransfer(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        FromLocationID uint                `json:"from_location_id"`
+        ToLocationID   uint                `json:"to_location_id"`
+        Note           string              `json:"note"`
+        Items          []StockTransferItem `json:"items"`
+    }
+    if err := c.BindJSON(&body); err != nil || len(body.Items) == 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if body.FromLocationID == body.ToLocationID { c.JSON(http.StatusBadRequest, gin.H{"error": "source and destination must differ"}); return }
+    now := nowISO()
+    t := StockTransfer{OrganizationID: orgUser.OrganizationID, UserID: uid, FromLocationID: body.FromLocationID, ToLocationID: body.ToLocationID, Status: transferInTransit, InOrgTotal: true, Note: body.Note, DateShipped: now, DateCreated: now, DateUpdated: now}
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if _, err := orgLocation(tx, orgUser.OrganizationID, body.FromLocationID); err != nil { return err }
+        if _, err := orgLocation(tx, orgUser.OrganizationID, body.ToLocationID); err != nil { return err }
+        if err := tx.Omit("Items", "Lots").Create(&t).Error; err != nil { return err }
+        from := body.FromLocationID
+        for _, it := range body.Items {
+            if it.Quantity <= 0 { return errors.New("quantity must be positive") }
+            if err := takeLocationStock(tx, from, it.ProductID, it.Quantity); err != nil { return err }
+            item := StockTransferItem{TransferID: t.ID, ProductID: it.ProductID, Quantity: it.Quantity}
+            if err := tx.Create(&item).Error; err != nil { return err }
+            t.Items = append(t.Items, item)
+            taken, _, err := takeLots(tx, t.OrganizationID, &from, it.ProductID, it.Quantity)
+            if err != nil { return err }
+            for _, lt := range taken {
+                l := StockTransferLot{TransferID: t.ID, ProductID: it.ProductID, LotID: lt.Lot.ID, LotNumber: lt.Lot.LotNumber, ExpiryDate: lt.Lot.ExpiryDate, DateReceived: lt.Lot.DateReceived, Quantity: lt.Quantity}
+                if err := tx.Create(&l).Error; err != nil { return err }
+                t.Lots = append(t.Lots, l)
+            }
+        }
+        return transferMovements(tx, t, from, -1, nil, uid, now)
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "location not found"}); return }
+    if errors.Is(err, errInsufficientStock) { c.JSON(http.StatusConflict, gin.H{"error": err.Error()}); return }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, t)
+}
+
+// transferMovements records one leg of a transfer at a location: a movement
+// per lot it carries and one for the quantity no lot covered. sign is -1
+// for the outgoing leg and 1 for the incoming one; lotIDs maps transfer
+// lots to the lot they arrived in, nil for the outgoing leg.
+func transferMovements(tx *gorm.DB, t StockTransfer, locationID uint, sign float64, lotIDs map[uint]uint, userID uint, now string) error {
+    reason := "transfer_out"
+    if sign > 0 { reason = "transfer_in" }
+    rest := map[uint]float64{}
+    for _, it := range t.Items { rest[it.ProductID] += it.Quantity }
+    for _, l := range t.Lots {
+        lotID := l.LotID
+        if lotIDs != nil { lotID = lotIDs[l.ID] }
+        m := InventoryMovement{OrganizationID: t.OrganizationID, ProductID: l.ProductID, LocationID: &locationID, LotID: &lotID, UserID: userID, Quantity: sign * l.Quantity, Reason: reason, ReferenceID: &t.ID, DateCreated: now}
+        if err := tx.Create(&m).Error; err != nil { return err }
+        rest[l.ProductID] = roundQuantity(rest[l.ProductID] - l.Quantity)
+    }
+    for _, it := range t.Items {
+        q := rest[it.ProductID]
+        if q <= 0 { continue }
+        rest[it.ProductID] = 0
+        m := InventoryMovement{OrganizationID: t.OrganizationID, ProductID: it.ProductID, LocationID: &locationID, UserID: userID, Quantity: sign * q, Reason: reason, ReferenceID: &t.ID, DateCreated: now}
+        if err := tx.Create(&m).Error; err != nil { return err }
+    }
+    return nil
+}
+
+func receiveStockTransfer(c *gin.Context) {
+    finishStockTransfer(c, transferReceived)
+}
+
+func cancelStockTransfer(c *gin.Context) {
+    finishStockTransfer(c, transferCancelled)
+}
+
+// finishStockTransfer books in-transit stock into the destination (received)
+// or back into the source (cancelled).
+func finishStockTransfer(c *gin.Context, status string) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var t StockTransfer
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").Preload("Lots").Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&t).Error; err != nil { return err }
+        if t.Status != transferInTransit { return errors.New("transfer is not in transit") }
+        target := t.ToLocationID
+        if status == transferCancelled { target = t.FromLocationID }
+        now := nowISO()
+        for _, it := range t.Items {
+            if err := putLocationStock(tx, t.OrganizationID, target, it.ProductID, it.Quantity); err != nil { return err }
+        }
+        lotIDs := map[uint]uint{}
+        for _, l := range t.Lots {
+            if status == transferCancelled {
+                if err := tx.Model(&StockLot{}).Where("id = ?", l.LotID).Updates(map[string]any{"quantity_remaining": gorm.Expr("quantity_remaining + ?", l.Quantity), "date_updated": now}).Error; err != nil { return err }
+                lotIDs[l.ID] = l.LotID
+                continue
+            }
+            lot := StockLot{OrganizationID: t.OrganizationID, ProductID: l.ProductID, LocationID: &target, LotNumber: l.LotNumber, ExpiryDate: l.ExpiryDate, QuantityReceived: l.Quantity, QuantityRemaining: l.Quantity, DateReceived: l.DateReceived, DateCreated: now, DateUpdated: now}
+            if err := tx.Create(&lot).Error; err != nil { return err }
+            lotIDs[l.ID] = lot.ID
+        }
+        if err := transferMovements(tx, t, target, 1, lotIDs, uid, now); err != nil { return err }
+        t.Status = status
+        t.DateUpdated = now
+        if status == transferReceived { t.DateReceived = &now }
+        return tx.Omit("Items", "Lots").Save(&t).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if err != nil { c.JSON(http.StatusConflict, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, t)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStockTransferKeepsOrganizationTotal(t *testing.T) {
+    for _, finish := range []string{"receive", "cancel"} {
+        t.Run(finish, func(t *testing.T) {
+            e := newTestEnv(t)
+            warehouse := e.location("Warehouse")
+            p := e.product("Rice", 10000, 10)
+
+            var tr StockTransfer
+            e.expect(e.do(http.MethodPost, "/stock-transfers", map[string]any{
+                "from_location_id": e.loc.ID, "to_location_id": warehouse.ID,
+                "items": []map[string]any{{"product_id": p.ID, "quantity": 4}},
+            }), http.StatusCreated, &tr)
+            if got := orgTotal(t, p.ID); got != 10 { t.Fatalf("total after ship = %v, want 10", got) }
+            if got := stockAt(t, p.ID, e.loc.ID); got != 6 { t.Fatalf("source after ship = %v, want 6", got) }
+
+            e.expect(e.do(http.MethodPost, fmt.Sprintf("/stock-transfers/%d/%s", tr.ID, finish), nil), http.StatusOK, nil)
+            if got := orgTotal(t, p.ID); got != 10 { t.Fatalf("total after %s = %v, want 10", finish, got) }
+            wantSource, wantDest := 6.0, 4.0
+            if finish == "cancel" { wantSource, wantDest = 10, 0 }
+            if got := stockAt(t, p.ID, e.loc.ID); got != wantSource { t.Errorf("source = %v, want %v", got, wantSource) }
+            if got := stockAt(t, p.ID, warehouse.ID); got != wantDest { t.Errorf("destination = %v, want %v", got, wantDest) }
+
+            var moves []InventoryMovement
+            db.Where("reference_id = ? AND reason IN ?", tr.ID, []string{"transfer_out", "transfer_in"}).Order("id").Find(&moves)
+            if len(moves) != 2 || moves[0].Reason != "transfer_out" || moves[0].Quantity != -4 || moves[1].Reason != "transfer_in" || moves[1].Quantity != 4 {
+                t.Fatalf("movements = %+v, want transfer_out -4 then transfer_in 4", moves)
+            }
+        })
+    }
+}
+
+func TestStockTransferInsufficientStock(t *testing.T) {
+    e := newTestEnv(t)
+    warehouse := e.location("Warehouse")
+    p := e.product("Rice", 10000, 3)
+    e.expect(e.do(http.MethodPost, "/stock-transfers", map[string]any{
+        "from_location_id": e.loc.ID, "to_location_id": warehouse.ID,
+        "items": []map[string]any{{"product_id": p.ID, "quantity": 4}},
+    }), http.StatusConflict, nil)
+    if got := stockAt(t, p.ID, e.loc.ID); got != 3 { t.Fatalf("source = %v, want 3", got) }
+}
+
+func TestAllocateLocationStock(t *testing.T) {
+    e := newTestEnv(t)
+    warehouse := e.location("Warehouse")
+    now := nowISO()
+    // Stock from before locations: on the product only, with 3 shipped to
+    // the warehouse under the old rule that took it out of the total.
+    p := Product{OrganizationID: e.org.ID, UserID: e.owner.ID, Name: "Sugar", Unit: defaultUnit, StockQuantity: 7, Version: 1, DateCreated: now, DateUpdated: now}
+    mustCreate(t, &p)
+    tr := StockTransfer{OrganizationID: e.org.ID, UserID: e.owner.ID, FromLocationID: e.loc.ID, ToLocationID: warehouse.ID, Status: transferInTransit, DateShipped: now, DateCreated: now, DateUpdated: now,
+        Items: []StockTransferItem{{ProductID: p.ID, Quantity: 3}}}
+    mustCreate(t, &tr)
+
+    for run := 0; run < 2; run++ {
+        if err := allocateLocationStock(db); err != nil { t.Fatal(err) }
+        if got := orgTotal(t, p.ID); got != 10 { t.Fatalf("run %d: total = %v, want 10", run, got) }
+        if got := stockAt(t, p.ID, e.loc.ID); got != 7 { t.Fatalf("run %d: default location = %v, want 7", run, got) }
+    }
+
+    var moves []InventoryMovement
+    db.Where("product_id = ?", p.ID).Find(&moves)
+    if len(moves) != 1 || moves[0].Reason != "adjustment" || moves[0].Quantity != 7 { t.Fatalf("movements = %+v, want one adjustment of 7", moves) }
+
+    e.expect(e.do(http.MethodPost, fmt.Sprintf("/stock-transfers/%d/receive", tr.ID), nil), http.StatusOK, nil)
+    if got := orgTotal(t, p.ID); got != 10 { t.Fatalf("total after receive = %v, want 10", got) }
+    if got := stockAt(t, p.ID, warehouse.ID); got != 3 { t.Fatalf("warehouse = %v, want 3", got) }
+}
+
+func TestAllocateLocationStockCreatesDefault(t *testing.T) {
+    newTestDB(t)
+    now := nowISO()
+    org := Organization{Name: "Old Store", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &org)
+    p := Product{OrganizationID: org.ID, Name: "Salt", Unit: defaultUnit, StockQuantity: 5, Version: 1, DateCreated: now, DateUpdated: now}
+    mustCreate(t, &p)
+    if err := allocateLocationStock(db); err != nil { t.Fatal(err) }
+    loc := defaultLocationID(db, org.ID)
+    if loc == nil { t.Fatal("no default location created") }
+    if got := stockAt(t, p.ID, *loc); got != 5 { t.Fatalf("default location = %v, want 5", got) }
+}
+
+// Stock that drifted from the locations is reported, not booked.
+func TestAllocateLocationStockLeavesDrift(t *testing.T) {
+    e := newTestEnv(t)
+    drifted := e.product("Flour", 1000, 5)
+    if err := db.Model(&drifted).Update("stock_quantity", 8).Error; err != nil { t.Fatal(err) }
+    now := nowISO()
+    negative := Product{OrganizationID: e.org.ID, UserID: e.owner.ID, Name: "Oil", Unit: defaultUnit, StockQuantity: -2, Version: 1, DateCreated: now, DateUpdated: now}
+    mustCreate(t, &negative)
+    if err := allocateLocationStock(db); err != nil { t.Fatal(err) }
+    tests := []struct {
+        name string
+        p    Product
+        at   float64
+    }{
+        {"drifted from its locations", drifted, 5},
+        {"negative before locations", negative, 0},
+    }
+    for _, tt := range tests {
+        if got := stockAt(t, tt.p.ID, e.loc.ID); got != tt.at { t.Errorf("%s: default location = %v, want %v", tt.name, got, tt.at) }
+        var n int64
+        db.Model(&InventoryMovement{}).Where("product_id = ?", tt.p.ID).Count(&n)
+        if n != 0 { t.Errorf("%s: %d movements, want none", tt.name, n) }
+    }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LoginAttempt is the audit trail of logins. It also drives throttling:
+// a username is locked after maxLoginFailures consecutive failures, for a
+// period that doubles with every further failure, and an address is
+// throttled after ipMaxLoginFailures failures within ipLoginWindow.
+// Attempts refused while locked or throttled are recorded but do not
+// extend the lock. A success or an unlock ends a run of failures.
+type LoginAttempt struct {
+    ID          uint   `gorm:"primaryKey" json:"id"`
+    Username    string `gorm:"size:191;index" json:"username"`
+    IP          string `gorm:"size:64;index" json:"ip"`
+    Outcome     string `json:"outcome"` // success, password_ok (2FA pending), no_organization, bad_password, unknown_user, bad_pin, bad_totp, locked, throttled, unlocked
+    UserAgent   string `json:"user_agent"`
+    DateCreated string `gorm:"index" json:"date_created"`
+}
+
+const (
+    maxLoginFailures   = 5
+    lockoutBase        = 30 * time.Second
+    lockoutMax         = time.Hour
+    ipMaxLoginFailures = 50
+    ipLoginWindow      = 15 * time.Minute
+)
+
+var loginFailureOutcomes = []string{"bad_password", "unknown_user", "bad_pin", "bad_totp"}
+
+func recordLoginAttempt(c *gin.Context, username, outcome string) {
+    _ = db.Create(&LoginAttempt{Username: username, IP: c.ClientIP(), Outcome: outcome, UserAgent: c.Request.UserAgent(), DateCreated: nowISO()}).Error
+}
+
+// lockedUntil returns when a username's lockout ends; the zero time when it
+// is not locked.
+func lockedUntil(username string) time.Time {
+    var lastReset LoginAttempt
+    db.Where("username = ? AND outcome IN ?", username, []string{"success", "unlocked"}).Order("id desc").Limit(1).Find(&lastReset)
+    q := db.Model(&LoginAttempt{}).Where("username = ? AND outcome IN ? AND id > ?", username, loginFailureOutcomes, lastReset.ID)
+    var failures int64
+    q.Count(&failures)
+    if failures < maxLoginFailures { return time.Time{} }
+    var last LoginAttempt
+    if err := q.Order("id desc").First(&last).Error; err != nil { return time.Time{} }
+    at, err := time.Parse(time.RFC3339, last.DateCreated)
+    if err != nil { return time.Time{} }
+    lock := lockoutMax
+    if n := failures - maxLoginFailures; n < 20 { lock = min(lockoutBase<<n, lockoutMax) }
+    return at.Add(lock)
+}
+
+// ipThrottledUntil returns when the address may try again; the zero time
+// when it is not throttled.
+func ipThrottledUntil(ip string) time.Time {
+    since := time.Now().Add(-ipLoginWindow).UTC().Format(time.RFC3339)
+    q := db.Model(&LoginAttempt{}).Where("ip = ? AND outcome IN ? AND date_created >= ?", ip, loginFailureOutcomes, since)
+    var failures int64
+    q.Count(&failures)
+    if failures < ipMaxLoginFailures { return time.Time{} }
+    // throttled until enough of the window's failures have aged out
+    var oldest LoginAttempt
+    if err := q.Order("id desc").Offset(ipMaxLoginFailures - 1).First(&oldest).Error; err != nil { return time.Time{} }
+    at, err := time.Parse(time.RFC3339, oldest.DateCreated)
+    if err != nil { return time.Time{} }
+    return at.Add(ipLoginWindow)
+}
+
+// checkLoginAllowed refuses a login attempt while the address is throttled
+// or the username locked. It writes the 429 response when refusing.
+func checkLoginAllowed(c *gin.Context, username string) bool {
+    now := time.Now()
+    if until := ipThrottledUntil(c.ClientIP()); until.After(now) {
+        recordLoginAttempt(c, username, "throttled")
+        tooManyLogins(c, "too many failed logins from this address", until.Sub(now))
+        return false
+    }
+    if until := lockedUntil(username); until.After(now) {
+        recordLoginAttempt(c, username, "locked")
+        tooManyLogins(c, "account temporarily locked after failed logins", until.Sub(now))
+        return false
+    }
+    return true
+}
+
+func tooManyLogins(c *gin.Context, msg string, wait time.Duration) {
+    secs := int(wait.Seconds()) + 1
+    c.Header("Retry-After", strconv.Itoa(secs))
+    c.JSON(http.StatusTooManyRequests, gin.H{"error": msg, "retry_after": secs})
+}
+
+// Lockout handlers
+func listUserLoginAttempts(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var u User
+    if err := db.Joins("JOIN organization_users ou ON ou.user_id = users.id AND ou.organization_id = ?", orgUser.OrganizationID).First(&u, id).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    var attempts []LoginAttempt
+    db.Where("username = ?", u.Username).Order("id desc").Limit(100).Find(&attempts)
+    res := gin.H{"attempts": attempts, "locked_until": nil}
+    if until := lockedUntil(u.Username); until.After(time.Now()) { res["locked_until"] = until.Format(time.RFC3339) }
+    c.JSON(http.StatusOK, res)
+}
+
+// unlockUser ends a user's lockout and resets their failure count.
+func unlockUser(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var ou OrganizationUser
+    if err := db.Where("organization_id = ? AND user_id = ?", orgUser.OrganizationID, id).First(&ou).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    if !mayGrant(c, orgUser.OrganizationID, ou.Role) { return }
+    var u User
+    if err := db.First(&u, id).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    recordLoginAttempt(c, u.Username, "unlocked")
+    c.JSON(http.StatusOK, gin.H{"ok": true})
+}
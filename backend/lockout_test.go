@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLoginAttemptOutcomes(t *testing.T) {
+    e := newTestEnv(t)
+    now := nowISO()
+    drifter := User{Name: "drifter", Username: "drifter", Password: mustHash(t, "correct horse battery"), DateCreated: now, DateUpdated: now}
+    mustCreate(t, &drifter)
+    cases := []struct {
+        username, password string
+        status             int
+        outcome            string
+    }{
+        {"nobody", "correct horse battery", http.StatusUnauthorized, "unknown_user"},
+        {e.owner.Username, "wrong", http.StatusUnauthorized, "bad_password"},
+        {drifter.Username, "correct horse battery", http.StatusUnauthorized, "no_organization"},
+        {e.owner.Username, "correct horse battery", http.StatusOK, "success"},
+    }
+    for _, tc := range cases {
+        e.expect(e.doAs("", http.MethodPost, "/auth/login", map[string]any{"username": tc.username, "password": tc.password}), tc.status, nil)
+        var a LoginAttempt
+        db.Where("username = ?", tc.username).Order("id desc").Limit(1).Find(&a)
+        if a.Outcome != tc.outcome { t.Errorf("%s/%s: outcome = %q, want %q", tc.username, tc.password, a.Outcome, tc.outcome) }
+    }
+}
+
+// A right password without a membership must not clear a lock.
+func TestNoOrganizationKeepsLock(t *testing.T) {
+    newTestDB(t)
+    for i := 0; i < maxLoginFailures; i++ {
+        mustCreate(t, &LoginAttempt{Username: "drifter", Outcome: "bad_password", DateCreated: nowISO()})
+    }
+    mustCreate(t, &LoginAttempt{Username: "drifter", Outcome: "no_organization", DateCreated: nowISO()})
+    if lockedUntil("drifter").IsZero() { t.Error("no_organization ended the lock") }
+}
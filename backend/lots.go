@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// StockLot is one receipt of a product, optionally with a lot number and
+// expiry date. Sales deplete lots first-expired-first-out.
+type StockLot struct {
+    ID                uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID    uint    `gorm:"index" json:"organization_id"`
+    ProductID         uint    `gorm:"index" json:"product_id"`
+    LocationID        *uint   `json:"location_id"`
+    LotNumber         *string `json:"lot_number"`
+    ExpiryDate        *string `gorm:"index" json:"expiry_date"` // YYYY-MM-DD
+    QuantityReceived  float64 `gorm:"type:decimal(14,3)" json:"quantity_received"`
+    QuantityRemaining float64 `gorm:"type:decimal(14,3)" json:"quantity_remaining"`
+    DateReceived      string  `json:"date_received"`
+    DateCreated       string  `json:"date_created"`
+    DateUpdated       string  `json:"date_updated"`
+}
+
+// InventoryMovement is the stock history of a product. Quantity is signed.
+type InventoryMovement struct {
+    ID             uint   `gorm:"primaryKey" json:"id"`
+    OrganizationID uint   `gorm:"index" json:"organization_id"`
+    ProductID      uint   `gorm:"index" json:"product_id"`
+    LocationID     *uint  `json:"location_id"`
+    LotID          *uint  `json:"lot_id"`
+    UserID         uint   `json:"user_id"`
+    Quantity       float64 `gorm:"type:decimal(14,3)" json:"quantity"`
+    Reason         string `json:"reason"` // receipt, sale, void, write_off, adjustment, transfer_out, transfer_in
+    ReferenceID    *uint  `json:"reference_id"` // transaction id for sales and voids, transfer id for transfers
+    ViaProductID   *uint  `json:"via_product_id"` // composite product sold, for ingredients used by a recipe
+    Note           string `json:"note"`
+    DateCreated    string `json:"date_created"`
+}
+
+const dateLayout = "2006-01-02"
+
+// lotTake is the quantity taken from one lot.
+type lotTake struct {
+    Lot      StockLot
+    Quantity float64
+}
+
+// takeLots removes qty of a product from its open lots, earliest expiry
+// first (lots without an expiry date last). It returns what came from which
+// lot and the part no lot covered.
+func takeLots(tx *gorm.DB, orgID uint, locationID *uint, productID uint, qty float64) ([]lotTake, float64, error) {
+    q := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+        Where("organization_id = ? AND product_id = ? AND quantity_remaining > 0", orgID, productID)
+    if locationID != nil { q = q.Where("location_id = ?", *locationID) }
+    var lots []StockLot
+    if err := q.Order("expiry_date IS NULL, expiry_date asc, id asc").Find(&lots).Error; err != nil { return nil, 0, err }
+    now := nowISO()
+    remaining := roundQuantity(qty)
+    var taken []lotTake
+    for _, lot := range lots {
+        if remaining <= 0 { break }
+        take := min(lot.QuantityRemaining, remaining)
+        if err := tx.Model(&StockLot{}).Where("id = ?", lot.ID).Updates(map[string]any{"quantity_remaining": gorm.Expr("quantity_remaining - ?", take), "date_updated": now}).Error; err != nil { return nil, 0, err }
+        taken = append(taken, lotTake{Lot: lot, Quantity: take})
+        remaining = roundQuantity(remaining - take)
+    }
+    return taken, max(remaining, 0), nil
+}
+
+// depleteLots takes qty of m's product out of lots at m's location with
+// takeLots and records a copy of m per lot, plus one without a lot for the
+// quantity no lot covered.
+func depleteLots(tx *gorm.DB, qty float64, m InventoryMovement) error {
+    taken, rest, err := takeLots(tx, m.OrganizationID, m.LocationID, m.ProductID, qty)
+    if err != nil { return err }
+    m.DateCreated = nowISO()
+    for _, t := range taken {
+        lm := m
+        lm.LotID = &t.Lot.ID
+        lm.Quantity = -t.Quantity
+        if err := tx.Create(&lm).Error; err != nil { return err }
+    }
+    if rest > 0 {
+        m.Quantity = -rest
+        return tx.Create(&m).Error
+    }
+    return nil
+}
+
+// Lot handlers
+func listStockLots(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    q := db.Where("organization_id = ?", orgUser.OrganizationID)
+    if pid := c.Query("product_id"); pid != "" { q = q.Where("product_id = ?", pid) }
+    if c.Query("include_empty") != "true" { q = q.Where("quantity_remaining > 0") }
+    var lots []StockLot
+    q.Order("expiry_date IS NULL, expiry_date asc, id asc").Find(&lots)
+    c.JSON(http.StatusOK, lots)
+}
+
+// receiveStockLot books a stock receipt as a new lot.
+func receiveStockLot(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        ProductID  uint    `json:"product_id"`
+        LocationID *uint   `json:"location_id"`
+        LotNumber  *string `json:"lot_number"`
+        ExpiryDate *string `json:"expiry_date"`
+        Quantity   float64 `json:"quantity"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.Quantity <= 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    body.Quantity = roundQuantity(body.Quantity)
+    if body.ExpiryDate != nil {
+        if _, err := time.Parse(dateLayout, *body.ExpiryDate); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "expiry_date must be YYYY-MM-DD"}); return }
+    }
+    if body.LocationID == nil { body.LocationID = defaultLocationID(db, orgUser.OrganizationID) }
+    now := nowISO()
+    lot := StockLot{OrganizationID: orgUser.OrganizationID, ProductID: body.ProductID, LocationID: body.LocationID, LotNumber: body.LotNumber, ExpiryDate: body.ExpiryDate, QuantityReceived: body.Quantity, QuantityRemaining: body.Quantity, DateReceived: now, DateCreated: now, DateUpdated: now}
+    err := db.Transaction(func(tx *gorm.DB) error {
+        var p Product
+        if err := tx.Where("id = ? AND organization_id = ?", body.ProductID, orgUser.OrganizationID).First(&p).Error; err != nil { return err }
+        if body.LocationID != nil {
+            if _, err := orgLocation(tx, orgUser.OrganizationID, *body.LocationID); err != nil { return err }
+            if err := adjustLocationStock(tx, orgUser.OrganizationID, *body.LocationID, p.ID, body.Quantity); err != nil { return err }
+        } else if err := addProductStock(tx, p.OrganizationID, p.ID, body.Quantity); err != nil {
+            return err
+        }
+        if err := tx.Create(&lot).Error; err != nil { return err }
+        m := InventoryMovement{OrganizationID: orgUser.OrganizationID, ProductID: p.ID, LocationID: body.LocationID, LotID: &lot.ID, UserID: uid, Quantity: body.Quantity, Reason: "receipt", DateCreated: now}
+        return tx.Create(&m).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, lot)
+}
+
+// expiringStockLots lists open lots expiring within ?days= (default 7),
+// including ones already expired.
+func expiringStockLots(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+    if err != nil || days < 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad days"}); return }
+    until := time.Now().In(orgTimezone(orgUser.OrganizationID)).AddDate(0, 0, days).Format(dateLayout)
+    type lotRes struct {
+        StockLot
+        ProductName string `json:"product_name"`
+    }
+    var rows []lotRes
+    db.Raw(`
+        SELECT l.*, p.name as product_name
+        FROM stock_lots l
+        JOIN products p ON p.id = l.product_id
+        WHERE l.organization_id = ? AND l.quantity_remaining > 0
+          AND l.expiry_date IS NOT NULL AND l.expiry_date <= ?
+        ORDER BY l.expiry_date ASC, l.id ASC`, orgUser.OrganizationID, until).Scan(&rows)
+    c.JSON(http.StatusOK, rows)
+}
+
+// writeOffStockLot removes spoiled or expired stock from a lot. Without a
+// quantity the whole remainder is written off.
+func writeOffStockLot(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var body struct {
+        Quantity *float64 `json:"quantity"`
+        Note     string   `json:"note"`
+    }
+    if err := c.ShouldBindJSON(&body); err != nil && c.Request.ContentLength > 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var lot StockLot
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&lot).Error; err != nil { return err }
+        var p Product
+        if err := tx.Select("id", "unit").First(&p, lot.ProductID).Error; err != nil { return err }
+        qty := lot.QuantityRemaining
+        if body.Quantity != nil { qty = *body.Quantity }
+        if err := checkQuantity(qty, p.Unit); err != nil { return err }
+        if qty > lot.QuantityRemaining { return errors.New("quantity exceeds lot remainder") }
+        now := nowISO()
+        lot.QuantityRemaining = roundQuantity(lot.QuantityRemaining - qty)
+        lot.DateUpdated = now
+        if err := tx.Save(&lot).Error; err != nil { return err }
+        if lot.LocationID != nil {
+            if err := adjustLocationStock(tx, lot.OrganizationID, *lot.LocationID, lot.ProductID, -qty); err != nil { return err }
+        } else if err := addProductStock(tx, lot.OrganizationID, lot.ProductID, -qty); err != nil {
+            return err
+        }
+        m := InventoryMovement{OrganizationID: lot.OrganizationID, ProductID: lot.ProductID, LocationID: lot.LocationID, LotID: &lot.ID, UserID: uid, Quantity: -qty, Reason: "write_off", Note: body.Note, DateCreated: now}
+        return tx.Create(&m).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, lot)
+}
+
+func listInventoryMovements(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    q := db.Where("organization_id = ?", orgUser.OrganizationID)
+    if pid := c.Query("product_id"); pid != "" { q = q.Where("product_id = ?", pid) }
+    if reason := c.Query("reason"); reason != "" { q = q.Where("reason = ?", reason) }
+    var movements []InventoryMovement
+    q.Order("id desc").Limit(500).Find(&movements)
+    c.JSON(http.StatusOK, movements)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// addLot puts a lot of a product at a location, with its stock.
+func (e *testEnv) addLot(p Product, locationID uint, number, expiry string, qty float64) StockLot {
+    e.t.Helper()
+    now := nowISO()
+    lot := StockLot{OrganizationID: e.org.ID, ProductID: p.ID, LocationID: &locationID, QuantityReceived: qty, QuantityRemaining: qty, DateReceived: now, DateCreated: now, DateUpdated: now}
+    if number != "" { lot.LotNumber = &number }
+    if expiry != "" { lot.ExpiryDate = &expiry }
+    mustCreate(e.t, &lot)
+    if err := adjustLocationStock(db, e.org.ID, locationID, p.ID, qty); err != nil { e.t.Fatal(err) }
+    return lot
+}
+
+func lotRemaining(t *testing.T, id uint) float64 {
+    t.Helper()
+    var lot StockLot
+    if err := db.First(&lot, id).Error; err != nil { t.Fatal(err) }
+    return lot.QuantityRemaining
+}
+
+func TestTakeLotsFirstExpiredFirstOut(t *testing.T) {
+    tests := []struct {
+        qty       float64
+        wantTaken []float64 // per lot, in the order created below
+        wantRest  float64
+    }{
+        {qty: 1, wantTaken: []float64{0, 1, 0, 0}},
+        {qty: 3, wantTaken: []float64{0, 2, 1, 0}},
+        {qty: 7, wantTaken: []float64{2, 2, 3, 0}},
+        {qty: 9, wantTaken: []float64{2, 2, 3, 2}},
+        {qty: 12.5, wantTaken: []float64{2, 2, 3, 4}, wantRest: 1.5},
+    }
+    for _, tt := range tests {
+        t.Run(fmt.Sprint(tt.qty), func(t *testing.T) {
+            e := newTestEnv(t)
+            p := e.product("Milk", 18000, 0)
+            lots := []StockLot{
+                e.addLot(p, e.loc.ID, "C", "2026-03-01", 2),
+                e.addLot(p, e.loc.ID, "A", "2026-02-01", 2),
+                e.addLot(p, e.loc.ID, "B", "2026-02-01", 3),
+                e.addLot(p, e.loc.ID, "", "", 4),
+            }
+            // Lots elsewhere are not touched.
+            other := e.addLot(p, e.location("Warehouse").ID, "Z", "2026-01-01", 5)
+
+            taken, rest, err := takeLots(db, e.org.ID, &e.loc.ID, p.ID, tt.qty)
+            if err != nil { t.Fatal(err) }
+            got := make([]float64, len(lots))
+            for _, lt := range taken {
+                for i, l := range lots {
+                    if l.ID == lt.Lot.ID { got[i] = lt.Quantity }
+                }
+            }
+            if !reflect.DeepEqual(got, tt.wantTaken) || rest != tt.wantRest { t.Fatalf("taken %v rest %v, want %v rest %v", got, rest, tt.wantTaken, tt.wantRest) }
+            for i, l := range lots {
+                if r := lotRemaining(t, l.ID); r != l.QuantityReceived-tt.wantTaken[i] { t.Errorf("lot %d remaining %v", i, r) }
+            }
+            if r := lotRemaining(t, other.ID); r != 5 { t.Errorf("lot at other location remaining %v, want 5", r) }
+        })
+    }
+}
+
+func TestNegativeAdjustmentDepletesLots(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Milk", 18000, 0)
+    late := e.addLot(p, e.loc.ID, "L2", "2026-05-01", 5)
+    early := e.addLot(p, e.loc.ID, "L1", "2026-04-01", 5)
+    e.expect(e.do(http.MethodPost, fmt.Sprintf("/locations/%d/stock", e.loc.ID), map[string]any{"product_id": p.ID, "delta": -7}), http.StatusOK, nil)
+    if r := lotRemaining(t, early.ID); r != 0 { t.Errorf("early lot remaining %v, want 0", r) }
+    if r := lotRemaining(t, late.ID); r != 3 { t.Errorf("late lot remaining %v, want 3", r) }
+    if got := stockAt(t, p.ID, e.loc.ID); got != 3 { t.Errorf("location stock %v, want 3", got) }
+    var moves []InventoryMovement
+    db.Where("product_id = ? AND reason = ?", p.ID, "adjustment").Order("id").Find(&moves)
+    if len(moves) != 2 || *moves[0].LotID != early.ID || moves[0].Quantity != -5 || *moves[1].LotID != late.ID || moves[1].Quantity != -2 {
+        t.Fatalf("adjustment movements = %+v", moves)
+    }
+}
+
+func TestStockTransferCarriesLots(t *testing.T) {
+    for _, finish := range []string{"receive", "cancel"} {
+        t.Run(finish, func(t *testing.T) {
+            e := newTestEnv(t)
+            warehouse := e.location("Warehouse")
+            p := e.product("Milk", 18000, 1) // 1 without a lot
+            lot := e.addLot(p, e.loc.ID, "L1", "2026-04-01", 3)
+
+            var tr StockTransfer
+            e.expect(e.do(http.MethodPost, "/stock-transfers", map[string]any{
+                "from_location_id": e.loc.ID, "to_location_id": warehouse.ID,
+                "items": []map[string]any{{"product_id": p.ID, "quantity": 4}},
+            }), http.StatusCreated, &tr)
+            if len(tr.Lots) != 1 || tr.Lots[0].LotID != lot.ID || tr.Lots[0].Quantity != 3 { t.Fatalf("transfer lots = %+v", tr.Lots) }
+            if r := lotRemaining(t, lot.ID); r != 0 { t.Fatalf("source lot remaining %v after ship, want 0", r) }
+
+            e.expect(e.do(http.MethodPost, fmt.Sprintf("/stock-transfers/%d/%s", tr.ID, finish), nil), http.StatusOK, nil)
+            if finish == "cancel" {
+                if r := lotRemaining(t, lot.ID); r != 3 { t.Fatalf("source lot remaining %v after cancel, want 3", r) }
+                return
+            }
+            var arrived []StockLot
+            db.Where("product_id = ? AND location_id = ?", p.ID, warehouse.ID).Find(&arrived)
+            if len(arrived) != 1 || arrived[0].QuantityRemaining != 3 || *arrived[0].LotNumber != "L1" || *arrived[0].ExpiryDate != "2026-04-01" {
+                t.Fatalf("lots at destination = %+v", arrived)
+            }
+            var in []InventoryMovement
+            db.Where("reference_id = ? AND reason = ?", tr.ID, "transfer_in").Order("id").Find(&in)
+            if len(in) != 2 || *in[0].LotID != arrived[0].ID || in[0].Quantity != 3 || in[1].LotID != nil || in[1].Quantity != 1 {
+                t.Fatalf("transfer_in movements = %+v", in)
+            }
+        })
+    }
+}
+
+func TestWriteOffStockLot(t *testing.T) {
+    e := newTestEnv(t)
+    eggs := e.product("Eggs", 2000, 0)
+    flour := e.product("Flour", 12000, 0)
+    if err := db.Model(&flour).Update("unit", "kg").Error; err != nil { t.Fatal(err) }
+    tests := []struct {
+        name string
+        p    Product
+        body map[string]any
+        want int
+        left float64
+    }{
+        {"part of a lot", eggs, map[string]any{"quantity": 4}, http.StatusOK, 6},
+        {"fraction of a count", eggs, map[string]any{"quantity": 1.5}, http.StatusBadRequest, 10},
+        {"more than the lot", eggs, map[string]any{"quantity": 11}, http.StatusBadRequest, 10},
+        {"zero", eggs, map[string]any{"quantity": 0}, http.StatusBadRequest, 10},
+        {"negative", eggs, map[string]any{"quantity": -2}, http.StatusBadRequest, 10},
+        {"whole remainder", eggs, nil, http.StatusOK, 0},
+        {"fraction of a weight", flour, map[string]any{"quantity": 2.25}, http.StatusOK, 7.75},
+        {"more than 3 decimals", flour, map[string]any{"quantity": 0.0005}, http.StatusBadRequest, 10},
+    }
+    for _, tt := range tests {
+        lot := e.addLot(tt.p, e.loc.ID, "", "", 10)
+        w := e.do(http.MethodPost, fmt.Sprintf("/stock-lots/%d/write-off", lot.ID), tt.body)
+        if w.Code != tt.want { t.Errorf("%s: status = %d, want %d (%s)", tt.name, w.Code, tt.want, w.Body) }
+        if got := lotRemaining(t, lot.ID); got != tt.left { t.Errorf("%s: lot remainder = %v, want %v", tt.name, got, tt.left) }
+    }
+}
+
+// The expiry window counts days in the organization's timezone.
+func TestExpiringStockLots(t *testing.T) {
+    for _, zone := range []string{"Pacific/Kiritimati", "Pacific/Pago_Pago"} {
+        t.Run(zone, func(t *testing.T) {
+            e := newTestEnv(t).with(t)
+            if err := db.Model(&e.org).Update("timezone", zone).Error; err != nil { t.Fatal(err) }
+            loc, _ := time.LoadLocation(zone)
+            today := time.Now().In(loc)
+            milk := e.product("Milk", 18000, 0)
+            inWindow := e.addLot(milk, e.loc.ID, "A", today.AddDate(0, 0, 3).Format(dateLayout), 1)
+            e.addLot(milk, e.loc.ID, "B", today.AddDate(0, 0, 4).Format(dateLayout), 1)
+            var lots []StockLot
+            e.expect(e.do(http.MethodGet, "/stock-lots/expiring?days=3", nil), http.StatusOK, &lots)
+            if len(lots) != 1 || lots[0].ID != inWindow.ID { t.Fatalf("expiring = %+v, want only lot %d", lots, inWindow.ID) }
+        })
+    }
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -13,6 +14,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Models (aligned to Flutter app domain)
@@ -20,36 +22,79 @@ type User struct {
     ID          uint   `gorm:"primaryKey" json:"id"`
     Name        string `json:"name"`
     Username    string `gorm:"uniqueIndex" json:"username"`
-    Password    string `json:"password"` // store hashed
+    Password    string `json:"-"` // bcrypt hash
+    TOTPSecret  string `json:"-"` // base32; set at 2FA setup, in use once TOTPEnabled
+    TOTPEnabled bool   `json:"totp_enabled"`
+    TOTPLastStep int64 `json:"-"` // last time step used, so codes work once
+    MustChangePassword bool `json:"must_change_password"` // set by an admin reset
     DateCreated string `json:"date_created"`
     DateUpdated string `json:"date_updated"`
 }
 
+// UserResponse is what the API shows of a user. Handlers return it rather
+// than User, so credentials added to the model later stay server-side even
+// if their tags are wrong.
+type UserResponse struct {
+    ID                 uint   `json:"id"`
+    Name               string `json:"name"`
+    Username           string `json:"username"`
+    TOTPEnabled        bool   `json:"totp_enabled"`
+    MustChangePassword bool   `json:"must_change_password"`
+    DateCreated        string `json:"date_created"`
+    DateUpdated        string `json:"date_updated"`
+}
+
+func userResponse(u User) UserResponse {
+    return UserResponse{ID: u.ID, Name: u.Name, Username: u.Username, TOTPEnabled: u.TOTPEnabled, MustChangePassword: u.MustChangePassword, DateCreated: u.DateCreated, DateUpdated: u.DateUpdated}
+}
+
+// Organization is also the business profile printed on receipts and
+// invoices; see organizations.go.
 type Organization struct {
-    ID          uint   `gorm:"primaryKey" json:"id"`
-    Name        string `json:"name"`
-    DateCreated string `json:"date_created"`
-    DateUpdated string `json:"date_updated"`
+    ID            uint    `gorm:"primaryKey" json:"id"`
+    Name          string  `json:"name"` // trading name
+    LegalName     string  `json:"legal_name"`
+    Address       string  `gorm:"size:500" json:"address"`
+    TaxID         string  `gorm:"size:32" json:"tax_id"` // NPWP
+    Phone         string  `gorm:"size:32" json:"phone"`
+    LogoURL       *string `json:"logo_url"`
+    Currency      string  `gorm:"size:3;not null;default:IDR" json:"currency"`
+    Timezone      string  `gorm:"size:64;not null;default:Asia/Jakarta" json:"timezone"`
+    Locale        string  `gorm:"size:35;not null;default:id-ID" json:"locale"`
+    ReceiptFooter string  `gorm:"size:500" json:"receipt_footer"`
+    Version       int     `gorm:"not null;default:1" json:"version"`
+    DateCreated   string  `json:"date_created"`
+    DateUpdated   string  `json:"date_updated"`
 }
 
 type OrganizationUser struct {
     OrganizationID uint   `gorm:"primaryKey" json:"organization_id"`
     UserID         uint   `gorm:"primaryKey" json:"user_id"`
-    Role           string `json:"role"` // owner, manager, cashier
+    Role           string `json:"role"` // owner, manager, cashier or a custom role
     IsActive       bool   `json:"is_active"`
+    DefaultLocationID *uint `json:"default_location_id"`
+    PinHash        string `json:"-"` // bcrypt of the PIN for device sign-in, empty when unset
     DateCreated    string `json:"date_created"`
     DateUpdated    string `json:"date_updated"`
 }
 
 type Product struct {
     ID           uint    `gorm:"primaryKey" json:"id"`
-    OrganizationID uint  `json:"organization_id"`
+    OrganizationID uint  `gorm:"uniqueIndex:idx_org_sku" json:"organization_id"`
     UserID       uint    `json:"user_id"`
     Name         string  `json:"name"`
     Price        float64 `json:"price"`
-    SKU          *string `json:"sku"`
+    Cost         *float64 `json:"cost"` // purchase cost per unit; composite products roll up from their recipe
+    SKU          *string `gorm:"size:100;uniqueIndex:idx_org_sku" json:"sku"` // unique per organization; VARCHAR(100) as in database_schema.sql
     Icon         *string `json:"icon"`
-    StockQuantity int    `json:"stock_quantity"`
+    ImageURL     *string `json:"image_url"` // see images.go
+    ThumbnailURL *string `json:"thumbnail_url"`
+    Category     *string `json:"category"`
+    Unit         string  `gorm:"size:8;not null;default:pcs" json:"unit"` // see units.go
+    PLU          *string `gorm:"size:5;index" json:"plu"` // item code in scale barcodes
+    StockQuantity float64 `gorm:"type:decimal(14,3)" json:"stock_quantity"`
+    ArchivedAt   *string `gorm:"index" json:"archived_at"`
+    Version      int     `gorm:"not null;default:1" json:"version"` // bumped on every write, see versioning.go
     DateCreated  string  `json:"date_created"`
     DateUpdated  string  `json:"date_updated"`
 }
@@ -58,6 +103,11 @@ type Transaction struct {
     ID              uint    `gorm:"primaryKey" json:"id"`
     OrganizationID  uint    `json:"organization_id"`
     UserID          uint    `json:"user_id"`
+    LocationID      *uint   `json:"location_id"`
+    CustomerID      *uint   `json:"customer_id"`
+    PriceListID     *uint   `json:"price_list_id"`
+    Subtotal        float64 `json:"subtotal"`
+    DiscountAmount  float64 `json:"discount_amount"`
     TotalAmount     float64 `json:"total_amount"`
     AmountReceived  float64 `json:"amount_received"`
     Change          float64 `json:"change"`
@@ -70,7 +120,8 @@ type TransactionItem struct {
     ID                 uint    `gorm:"primaryKey" json:"id"`
     TransactionID      uint    `json:"transaction_id"`
     ProductID          uint    `json:"product_id"`
-    Quantity           int     `json:"quantity"`
+    Quantity           float64 `gorm:"type:decimal(14,3)" json:"quantity"` // in Unit
+    Unit               string  `gorm:"size:8" json:"unit"`
     PriceAtTransaction float64 `json:"price_at_transaction"`
     DateCreated        string  `json:"date_created"`
     DateUpdated        string  `json:"date_updated"`
@@ -81,16 +132,20 @@ type Setting struct {
     UserID uint   `gorm:"primaryKey" json:"user_id"`
     Key    string `gorm:"primaryKey" json:"key"`
     Value  string `json:"value"`
+    Version int   `gorm:"not null;default:1" json:"version"`
 }
 
 // Global state
 var (
     db          *gorm.DB
     jwtSecret   []byte
-    tokenExpiry = time.Hour * 72
+    tokenExpiry = time.Minute * 15 // access tokens; sessions live on through refresh tokens
 )
 
-func nowISO() string { return time.Now().Format(time.RFC3339) }
+func nowISO() string { return time.Now().UTC().Format(time.RFC3339) }
+
+// models are the tables AutoMigrate keeps up to date.
+var models = []any{&User{}, &Organization{}, &OrganizationUser{}, &Product{}, &Transaction{}, &TransactionItem{}, &Setting{}, &Location{}, &ProductStock{}, &StockTransfer{}, &StockTransferItem{}, &StockTransferLot{}, &StockLot{}, &InventoryMovement{}, &ProductBarcode{}, &LabelTemplate{}, &Customer{}, &PriceList{}, &PriceListItem{}, &ScheduledPriceChange{}, &PriceHistory{}, &Promotion{}, &PromotionItem{}, &TransactionPromotion{}, &Coupon{}, &CouponTarget{}, &CouponRedemption{}, &ProductSearchToken{}, &ScaleBarcodeRule{}, &RecipeItem{}, &AuthSession{}, &RefreshToken{}, &RolePermissions{}, &LoginAttempt{}, &Device{}, &RecoveryCode{}, &Invitation{}}
 
 func main() {
     dsn := os.Getenv("MYSQL_DSN")
@@ -103,76 +158,248 @@ func main() {
         secret = "dev-secret-change-me"
     }
     jwtSecret = []byte(secret)
+    if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+        d, err := time.ParseDuration(ttl)
+        if err != nil || d <= 0 { log.Fatalf("bad ACCESS_TOKEN_TTL %q", ttl) }
+        tokenExpiry = d
+    }
+
+    if err := loadPasswordPolicy(); err != nil { log.Fatalf("password policy: %v", err) }
+    if v := os.Getenv("OPEN_REGISTRATION"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil { log.Fatalf("bad OPEN_REGISTRATION %q", v) }
+        openRegistration = b
+    }
+    inviteURL = os.Getenv("INVITE_URL")
+
+    imageDir := os.Getenv("IMAGE_DIR")
+    if imageDir == "" { imageDir = "uploads/images" }
+    imageStorage = diskImageStore{dir: imageDir}
 
     var err error
-    db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+    db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{TranslateError: true})
     if err != nil {
         log.Fatalf("failed to connect database: %v", err)
     }
 
-    if err := db.AutoMigrate(&User{}, &Organization{}, &OrganizationUser{}, &Product{}, &Transaction{}, &TransactionItem{}, &Setting{}); err != nil {
+    // SKUs must be unique per organization before the unique SKU index is built
+    if err := dedupeSKUs(db); err != nil {
+        log.Fatalf("failed to resolve duplicate SKUs: %v", err)
+    }
+
+    if err := db.AutoMigrate(models...); err != nil {
         log.Fatalf("failed to migrate: %v", err)
     }
+    if err := moveProfileSettings(db); err != nil {
+        log.Fatalf("failed to move settings into organization profiles: %v", err)
+    }
+    if err := normalizeTimestamps(db); err != nil {
+        log.Fatalf("failed to convert timestamps to UTC: %v", err)
+    }
 
     // Seed initial data if DB is empty
     seedData(db)
+    if err := allocateLocationStock(db); err != nil {
+        log.Fatalf("failed to book stock into locations: %v", err)
+    }
+
+    if err := buildSearchIndex(db); err != nil {
+        log.Fatalf("failed to build search index: %v", err)
+    }
+
+    go runPriceScheduler()
 
     r := gin.Default()
+    // Login throttling goes by client address, so only listed proxies may
+    // set it through X-Forwarded-For
+    var proxies []string
+    if p := os.Getenv("TRUSTED_PROXIES"); p != "" { proxies = strings.Split(p, ",") }
+    if err := r.SetTrustedProxies(proxies); err != nil { log.Fatalf("bad TRUSTED_PROXIES: %v", err) }
+
+    registerRoutes(r)
 
+    port := os.Getenv("PORT")
+    if port == "" { port = "8080" }
+    if err := r.Run(":" + port); err != nil {
+        log.Fatal(err)
+    }
+}
+
+func registerRoutes(r *gin.Engine) {
     api := r.Group("/api/v1")
     {
         api.POST("/auth/login", loginHandler)
         api.POST("/auth/register", registerHandler)
+        api.POST("/auth/refresh", refreshHandler)
+        api.POST("/auth/2fa/verify", verifyTwoFactor)
+        api.GET("/auth/password-policy", getPasswordPolicy)
+        api.POST("/auth/invitation", inspectInvitation)
+        api.POST("/auth/invitation/accept", acceptInvitation)
+        api.GET("/auth/pin/users", pinUsers)
+        api.POST("/auth/pin-login", pinLogin)
+        api.GET("/images/:name", serveImage)
         api.GET("/health", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"status": "ok"}) })
 
         auth := api.Group("")
         auth.Use(authMiddleware())
         {
+            // Open to every signed-in user; other routes name a permission
             auth.GET("/auth/me", meHandler)
+            auth.POST("/auth/logout", logoutHandler)
+            auth.GET("/auth/sessions", listSessions)
+            auth.GET("/auth/me/permissions", myPermissions)
+            auth.GET("/auth/organizations", listMyOrganizations)
+            auth.POST("/auth/switch-organization", switchOrganization)
+            auth.POST("/auth/password", changePassword)
+            auth.POST("/auth/2fa/setup", setupTwoFactor)
+            auth.POST("/auth/2fa/enable", enableTwoFactor)
+            auth.POST("/auth/2fa/disable", disableTwoFactor)
+            auth.POST("/auth/2fa/recovery-codes", regenerateRecoveryCodes)
+
+            // Roles and permissions
+            auth.GET("/permissions", requirePermission("user.manage"), listPermissions)
+            auth.GET("/roles", requirePermission("user.manage"), listRoles)
+            auth.PUT("/roles/:role", requirePermission("role.manage"), putRole)
+            auth.DELETE("/roles/:role", requirePermission("role.manage"), deleteRole)
+
+            // User management
+            auth.GET("/users", requirePermission("user.manage"), listUsers)
+            auth.POST("/users", requirePermission("user.manage"), createUser)
+            auth.PUT("/users/:id", requirePermission("user.manage"), updateUser)
+            auth.POST("/users/:id/reset-password", requirePermission("user.manage"), resetUserPassword)
+            auth.GET("/users/:id/login-attempts", requirePermission("user.manage"), listUserLoginAttempts)
+            auth.POST("/users/:id/unlock", requirePermission("user.manage"), unlockUser)
+            auth.POST("/users/:id/reset-2fa", requirePermission("user.manage"), resetUserTwoFactor)
 
-            // User management (owner/manager)
-            auth.GET("/users", listUsers)
-            auth.POST("/users", createUser)
-            auth.PUT("/users/:id", updateUser)
-            auth.POST("/users/:id/reset-password", resetUserPassword)
+            auth.GET("/invitations", requirePermission("user.manage"), listInvitations)
+            auth.POST("/invitations", requirePermission("user.manage"), createInvitation)
+            auth.DELETE("/invitations/:id", requirePermission("user.manage"), revokeInvitation)
+
+            // Devices for PIN sign-in
+            auth.GET("/devices", requirePermission("device.manage"), listDevices)
+            auth.POST("/devices", requirePermission("device.manage"), registerDevice)
+            auth.DELETE("/devices/:id", requirePermission("device.manage"), revokeDevice)
 
             // Products
-            auth.GET("/products", listProducts)
-            auth.POST("/products", createProduct)
-            auth.GET("/products/:id", getProduct)
-            auth.PUT("/products/:id", updateProduct)
-            auth.DELETE("/products/:id", deleteProduct)
-            auth.GET("/products/search", searchProducts)
+            auth.GET("/products", requirePermission("product.read"), listProducts)
+            auth.POST("/products", requirePermission("product.write"), createProduct)
+            auth.GET("/products/:id", requirePermission("product.read"), getProduct)
+            auth.PUT("/products/:id", requirePermission("product.write"), updateProduct)
+            auth.PATCH("/products/:id", requirePermission("product.write"), patchProduct)
+            auth.DELETE("/products/:id", requirePermission("product.delete"), deleteProduct)
+            auth.POST("/products/:id/restore", requirePermission("product.write"), restoreProduct)
+            auth.POST("/products/:id/image", requirePermission("product.write"), uploadProductImage)
+            auth.DELETE("/products/:id/image", requirePermission("product.write"), deleteProductImage)
+            auth.GET("/products/search", requirePermission("product.read"), searchProducts)
+            auth.POST("/products/import", requirePermission("product.write"), importProducts)
+            auth.GET("/products/export", requirePermission("product.read"), exportProducts)
+            auth.GET("/products/:id/barcodes", requirePermission("product.read"), listProductBarcodes)
+            auth.POST("/products/:id/barcodes", requirePermission("product.write"), addProductBarcode)
+            auth.DELETE("/products/:id/barcodes/:barcodeId", requirePermission("product.write"), deleteProductBarcode)
+            auth.GET("/barcodes/:code", requirePermission("product.read"), lookupBarcode)
+            auth.GET("/products/:id/barcode.png", requirePermission("product.read"), productBarcodeImage)
+
+            // Labels
+            auth.GET("/label-templates", requirePermission("label.print"), listLabelTemplates)
+            auth.POST("/label-templates", requirePermission("label.write"), createLabelTemplate)
+            auth.PUT("/label-templates/:id", requirePermission("label.write"), updateLabelTemplate)
+            auth.DELETE("/label-templates/:id", requirePermission("label.write"), deleteLabelTemplate)
+            auth.POST("/labels", requirePermission("label.print"), printLabels)
+
+            // Customers and pricing
+            auth.GET("/customers", requirePermission("customer.read"), listCustomers)
+            auth.POST("/customers", requirePermission("customer.write"), createCustomer)
+            auth.PUT("/customers/:id", requirePermission("customer.write"), updateCustomer)
+            auth.GET("/price-lists", requirePermission("product.read"), listPriceLists)
+            auth.POST("/price-lists", requirePermission("pricing.write"), createPriceList)
+            auth.PUT("/price-lists/:id", requirePermission("pricing.write"), updatePriceList)
+            auth.DELETE("/price-lists/:id", requirePermission("pricing.write"), deletePriceList)
+            auth.GET("/price-lists/:id/items", requirePermission("product.read"), listPriceListItems)
+            auth.PUT("/price-lists/:id/items/:productId", requirePermission("pricing.write"), putPriceListItem)
+            auth.DELETE("/price-lists/:id/items/:productId", requirePermission("pricing.write"), deletePriceListItem)
+            auth.GET("/price-changes", requirePermission("product.read"), listPriceChanges)
+            auth.POST("/price-changes", requirePermission("pricing.write"), schedulePriceChange)
+            auth.DELETE("/price-changes/:id", requirePermission("pricing.write"), cancelPriceChange)
+            auth.GET("/products/:id/price", requirePermission("product.read"), productPrice)
+            auth.GET("/products/:id/price-history", requirePermission("product.read"), productPriceHistory)
+            auth.GET("/products/:id/unit-price", requirePermission("product.read"), unitPrice)
+
+            // Recipes
+            auth.GET("/products/:id/recipe", requirePermission("product.read"), getRecipe)
+            auth.PUT("/products/:id/recipe", requirePermission("product.write"), putRecipe)
+            auth.GET("/analytics/ingredient-usage", requirePermission("report.read"), ingredientUsageReport)
+
+            // Scale barcodes
+            auth.GET("/scale-barcode-rules", requirePermission("product.read"), listScaleRules)
+            auth.PUT("/scale-barcode-rules", requirePermission("pricing.write"), putScaleRules)
+
+            // Promotions
+            auth.GET("/promotions", requirePermission("product.read"), listPromotions)
+            auth.POST("/promotions", requirePermission("promotion.write"), createPromotion)
+            auth.PUT("/promotions/:id", requirePermission("promotion.write"), updatePromotion)
+            auth.DELETE("/promotions/:id", requirePermission("promotion.write"), deletePromotion)
+            auth.POST("/checkout/evaluate", requirePermission("transaction.create"), evaluateCart)
+            auth.GET("/analytics/promotions", requirePermission("report.read"), promotionReport)
+
+            // Coupons
+            auth.GET("/coupons", requirePermission("product.read"), listCoupons)
+            auth.POST("/coupons", requirePermission("promotion.write"), createCoupon)
+            auth.PUT("/coupons/:id", requirePermission("promotion.write"), updateCoupon)
+            auth.POST("/coupons/validate", requirePermission("transaction.create"), validateCouponForCart)
 
             // Transactions
-            auth.GET("/transactions", listTransactions)
-            auth.GET("/transactions/:id", getTransaction)
-            auth.GET("/transactions/:id/items", getTransactionItems)
-            auth.POST("/transactions", createTransaction)
-            auth.DELETE("/transactions/:id", deleteTransaction)
+            auth.GET("/transactions", requirePermission("transaction.read"), listTransactions)
+            auth.GET("/transactions/:id", requirePermission("transaction.read"), getTransaction)
+            auth.GET("/transactions/:id/items", requirePermission("transaction.read"), getTransactionItems)
+            auth.GET("/transactions/:id/receipt", requirePermission("transaction.read"), getTransactionReceipt)
+            auth.POST("/transactions", requirePermission("transaction.create"), createTransaction)
+            auth.DELETE("/transactions/:id", requirePermission("transaction.void"), deleteTransaction)
 
             // Settings
-            auth.GET("/settings/:key", getSetting)
-            auth.PUT("/settings/:key", putSetting)
+            auth.GET("/settings/:key", requirePermission("settings.read"), getSetting)
+            auth.PUT("/settings/:key", requirePermission("settings.write"), putSetting)
+            auth.GET("/organization", requirePermission("settings.read"), getOrganization)
+            auth.PUT("/organization", requirePermission("organization.write"), updateOrganization)
+            auth.POST("/organization/logo", requirePermission("organization.write"), uploadOrganizationLogo)
+            auth.DELETE("/organization/logo", requirePermission("organization.write"), deleteOrganizationLogo)
 
             // Analytics
-            auth.GET("/analytics/today-summary", todaySummary)
-            auth.GET("/analytics/top-selling", topSelling)
-        }
-    }
+            auth.GET("/analytics/today-summary", requirePermission("report.read"), todaySummary)
+            auth.GET("/analytics/top-selling", requirePermission("report.read"), topSelling)
 
-    port := os.Getenv("PORT")
-    if port == "" { port = "8080" }
-    if err := r.Run(":" + port); err != nil {
-        log.Fatal(err)
+            // Locations and stock transfers
+            auth.GET("/locations", requirePermission("inventory.read"), listLocations)
+            auth.POST("/locations", requirePermission("location.write"), createLocation)
+            auth.PUT("/locations/:id", requirePermission("location.write"), updateLocation)
+            auth.GET("/locations/:id/stock", requirePermission("inventory.read"), listLocationStock)
+            auth.POST("/locations/:id/stock", requirePermission("inventory.write"), adjustStock)
+            auth.GET("/stock-transfers", requirePermission("inventory.read"), listStockTransfers)
+            auth.POST("/stock-transfers", requirePermission("inventory.write"), createStockTransfer)
+            auth.GET("/stock-transfers/:id", requirePermission("inventory.read"), getStockTransfer)
+            auth.POST("/stock-transfers/:id/receive", requirePermission("inventory.write"), receiveStockTransfer)
+            auth.POST("/stock-transfers/:id/cancel", requirePermission("inventory.write"), cancelStockTransfer)
+
+            // Lots, expiry and inventory history
+            auth.GET("/stock-lots", requirePermission("inventory.read"), listStockLots)
+            auth.POST("/stock-lots", requirePermission("inventory.write"), receiveStockLot)
+            auth.GET("/stock-lots/expiring", requirePermission("inventory.read"), expiringStockLots)
+            auth.POST("/stock-lots/:id/write-off", requirePermission("inventory.write"), writeOffStockLot)
+            auth.GET("/inventory/movements", requirePermission("inventory.read"), listInventoryMovements)
+        }
     }
 }
 
 // Auth helpers
-func generateToken(userID uint) (string, error) {
+func generateToken(userID, sessionID, orgID uint) (string, error) {
+    return signToken(userID, sessionID, orgID, tokenExpiry)
+}
+
+func signToken(userID, sessionID, orgID uint, ttl time.Duration) (string, error) {
     claims := jwt.MapClaims{
         "sub": userID,
-        "exp": time.Now().Add(tokenExpiry).Unix(),
+        "sid": sessionID,
+        "org": orgID,
+        "exp": time.Now().Add(ttl).Unix(),
         "iat": time.Now().Unix(),
     }
     token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -207,6 +434,45 @@ func authMiddleware() gin.HandlerFunc {
             c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "bad subject"})
             return
         }
+        // Tokens are only good while their session is: logout, deactivation
+        // and password resets revoke it
+        sid, ok := claims["sid"].(float64)
+        if !ok {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+            return
+        }
+        var session AuthSession
+        if err := db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", uint(sid), c.MustGet("userID")).First(&session).Error; err != nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session revoked"})
+            return
+        }
+        c.Set("sessionID", session.ID)
+        orgID, _ := claims["org"].(float64)
+        orgHeader := c.GetHeader("X-Organization-ID")
+        if orgHeader != "" {
+            v, err := strconv.ParseUint(orgHeader, 10, 32)
+            if err != nil || v == 0 {
+                c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad X-Organization-ID"})
+                return
+            }
+            orgID = float64(v)
+        }
+        // PIN sessions are bound to their device's organization
+        if session.DeviceID != nil {
+            if uint(orgID) != session.OrganizationID {
+                c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not a member of this organization"})
+                return
+            }
+            c.Set("deviceID", *session.DeviceID)
+            if session.LocationID != nil { c.Set("sessionLocationID", *session.LocationID) }
+        }
+        // Without a membership only the self-service routes work
+        if ou, err := activeMembership(db, c.MustGet("userID").(uint), uint(orgID)); err == nil {
+            c.Set("orgUser", ou)
+        } else if orgHeader != "" {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not a member of this organization"})
+            return
+        }
         c.Next()
     }
 }
@@ -215,6 +481,7 @@ func authMiddleware() gin.HandlerFunc {
 type loginRequest struct {
     Username string `json:"username"`
     Password string `json:"password"`
+    OrganizationID uint `json:"organization_id"` // optional, defaults to the oldest membership
 }
 
 func loginHandler(c *gin.Context) {
@@ -223,46 +490,74 @@ func loginHandler(c *gin.Context) {
         c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"})
         return
     }
+    if !checkLoginAllowed(c, req.Username) { return }
     var user User
     if err := db.Where("username = ?", req.Username).First(&user).Error; err != nil {
+        recordLoginAttempt(c, req.Username, "unknown_user")
         c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
         return
     }
     // Compare bcrypt hashed password
     if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+        recordLoginAttempt(c, req.Username, "bad_password")
         c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
         return
     }
-    // Load primary organization membership
-    var orgUser OrganizationUser
-    if err := db.Where("user_id = ? AND is_active = ?", user.ID, true).First(&orgUser).Error; err != nil {
+    // A right password without a membership is not a login, so it does
+    // not end a run of failures either
+    orgUser, err := activeMembership(db, user.ID, req.OrganizationID)
+    if err != nil {
+        recordLoginAttempt(c, req.Username, "no_organization")
         c.JSON(http.StatusUnauthorized, gin.H{"error": "user has no active organization"})
         return
     }
+    // Enrolled users finish at POST /auth/2fa/verify; a right password
+    // alone does not end a run of failures
+    if user.TOTPEnabled {
+        recordLoginAttempt(c, req.Username, "password_ok")
+        challenge, err := signTwoFactorChallenge(user.ID, orgUser.OrganizationID)
+        if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+        c.JSON(http.StatusOK, gin.H{"two_factor_required": true, "challenge_token": challenge, "expires_in": int(twoFactorChallengeExpiry.Seconds())})
+        return
+    }
+    recordLoginAttempt(c, req.Username, "success")
+    completeLogin(c, user, orgUser)
+}
+
+// completeLogin opens the session and writes the login response.
+func completeLogin(c *gin.Context, user User, orgUser OrganizationUser) {
     var org Organization
     _ = db.First(&org, orgUser.OrganizationID).Error
-    token, _ := generateToken(user.ID)
+    tokens, err := startSession(c, user.ID, orgUser.OrganizationID)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
     c.JSON(http.StatusOK, gin.H{
-        "token": token,
-        "user": user,
+        "token": tokens["token"],
+        "refresh_token": tokens["refresh_token"],
+        "expires_in": tokens["expires_in"],
+        "user": userResponse(user),
         "organization": org,
         "role": orgUser.Role,
+        "default_location_id": orgUser.DefaultLocationID,
     })
 }
 
 func registerHandler(c *gin.Context) {
-    var user User
-    if err := c.BindJSON(&user); err != nil {
+    if !openRegistration { c.JSON(http.StatusForbidden, gin.H{"error": "registration is closed; ask for an invitation"}); return }
+    var body struct {
+        Name     string `json:"name"`
+        Username string `json:"username"`
+        Password string `json:"password"`
+    }
+    if err := c.BindJSON(&body); err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"})
         return
     }
+    if err := checkPassword(body.Password, body.Username); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
     now := nowISO()
     // Hash password
-    hashed, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+    hashed, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
     if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "hash error"}); return }
-    user.Password = string(hashed)
-    user.DateCreated = now
-    user.DateUpdated = now
+    user := User{Name: body.Name, Username: body.Username, Password: string(hashed), DateCreated: now, DateUpdated: now}
     if err := db.Create(&user).Error; err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
@@ -271,8 +566,9 @@ func registerHandler(c *gin.Context) {
     org := Organization{Name: user.Name + "'s Store", DateCreated: now, DateUpdated: now}
     if err := db.Create(&org).Error; err == nil {
         _ = db.Create(&OrganizationUser{OrganizationID: org.ID, UserID: user.ID, Role: "owner", IsActive: true, DateCreated: now, DateUpdated: now}).Error
+        _, _ = createDefaultLocation(db, org.ID)
     }
-    c.JSON(http.StatusCreated, user)
+    c.JSON(http.StatusCreated, userResponse(user))
 }
 
 func meHandler(c *gin.Context) {
@@ -283,54 +579,70 @@ func meHandler(c *gin.Context) {
         return
     }
     var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    if v, ok := c.Get("orgUser"); ok { orgUser = v.(OrganizationUser) }
     var org Organization
     _ = db.First(&org, orgUser.OrganizationID).Error
-    c.JSON(http.StatusOK, gin.H{"user": user, "organization": org, "role": orgUser.Role})
+    c.JSON(http.StatusOK, gin.H{"user": userResponse(user), "organization": org, "role": orgUser.Role, "default_location_id": orgUser.DefaultLocationID})
 }
 
 // Product handlers
 func listProducts(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    q := db.Where("organization_id = ?", orgUser.OrganizationID)
+    if c.Query("archived") == "true" { q = q.Where("archived_at IS NOT NULL") } else { q = q.Scopes(notArchived) }
     var products []Product
-    db.Where("organization_id = ?", orgUser.OrganizationID).Order("name asc").Find(&products)
+    q.Order("name asc").Find(&products)
     c.JSON(http.StatusOK, products)
 }
 
 func createProduct(c *gin.Context) {
     uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     var p Product
     if err := c.BindJSON(&p); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    p.SKU = normalizeSKU(p.SKU)
+    if p.Unit == "" { p.Unit = defaultUnit }
+    if err := checkUnitAndPLU(p.Unit, p.PLU); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if !checkSKU(c, orgUser.OrganizationID, p.SKU, 0) { return }
     now := nowISO()
     p.UserID = uid
     p.OrganizationID = orgUser.OrganizationID
+    p.Version = 1
     p.DateCreated = now
     p.DateUpdated = now
-    if err := db.Create(&p).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    p.StockQuantity = roundQuantity(p.StockQuantity)
+    // opening stock is booked at the default location
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Create(&p).Error; err != nil { return err }
+        loc := defaultLocationID(tx, p.OrganizationID)
+        if p.StockQuantity == 0 || loc == nil { return nil }
+        if err := putLocationStock(tx, p.OrganizationID, *loc, p.ID, p.StockQuantity); err != nil { return err }
+        m := InventoryMovement{OrganizationID: p.OrganizationID, ProductID: p.ID, LocationID: loc, UserID: uid, Quantity: p.StockQuantity, Reason: "adjustment", Note: "opening stock", DateCreated: now}
+        return tx.Create(&m).Error
+    })
+    if err != nil { saveSKUError(c, err, p.OrganizationID, p.SKU, 0); return }
+    _ = indexProduct(db, p)
     c.JSON(http.StatusCreated, p)
 }
 
 func getProduct(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     id, _ := strconv.Atoi(c.Param("id"))
     var p Product
     if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
         return
     }
+    setETag(c, p.Version)
     c.JSON(http.StatusOK, p)
 }
 
+// updateProduct replaces every editable field. The write only succeeds if
+// the product is still at the version the client read (If-Match or body
+// version); without either it is checked against the version loaded here.
 func updateProduct(c *gin.Context) {
     uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     id, _ := strconv.Atoi(c.Param("id"))
     var p Product
     if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
@@ -339,48 +651,98 @@ func updateProduct(c *gin.Context) {
     }
     var body Product
     if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
-    p.Name = body.Name
-    p.Price = body.Price
-    p.SKU = body.SKU
-    p.Icon = body.Icon
-    p.StockQuantity = body.StockQuantity
-    p.DateUpdated = nowISO()
-    if err := db.Save(&p).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    version, err := expectedVersion(c, body.Version)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if version == 0 { respondVersionRequired(c, p.Version); return }
+    oldPrice := p.Price
+    sku := normalizeSKU(body.SKU)
+    // clients that predate units don't send unit or plu; keep them
+    if body.Unit == "" { body.Unit = p.Unit }
+    if body.PLU == nil { body.PLU = p.PLU }
+    if body.Cost == nil { body.Cost = p.Cost }
+    if err := checkUnitAndPLU(body.Unit, body.PLU); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if !checkSKU(c, p.OrganizationID, sku, p.ID) { return }
+    updates := map[string]any{"name": body.Name, "price": body.Price, "sku": sku, "icon": body.Icon, "category": body.Category, "unit": body.Unit, "plu": body.PLU, "cost": body.Cost}
+    if !writeProduct(c, &p, version, updates) { return }
+    _ = recordPriceChange(db, p.OrganizationID, p.ID, nil, oldPrice, p.Price, uid, "manual")
     c.JSON(http.StatusOK, p)
 }
 
+// deleteProduct archives a product, hiding it from listings, search and
+// checkout while keeping it for sales history. With ?hard=true the row is
+// removed instead, which is refused once any sale references it.
 func deleteProduct(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     id, _ := strconv.Atoi(c.Param("id"))
-    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).Delete(&Product{}).Error; err != nil {
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+        return
+    }
+    if c.Query("hard") != "true" {
+        now := nowISO()
+        if err := db.Model(&p).Updates(map[string]any{"archived_at": now, "version": gorm.Expr("version + 1"), "date_updated": now}).Error; err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        c.Status(http.StatusNoContent)
+        return
+    }
+    var sales int64
+    db.Model(&TransactionItem{}).Where("product_id = ?", p.ID).Count(&sales)
+    if sales > 0 {
+        c.JSON(http.StatusConflict, gin.H{"error": "product has sales history; archive it instead", "sales": sales})
+        return
+    }
+    var usedIn int64
+    db.Model(&RecipeItem{}).Where("ingredient_id = ?", p.ID).Count(&usedIn)
+    if usedIn > 0 {
+        c.JSON(http.StatusConflict, gin.H{"error": "product is an ingredient of other products; remove it from their recipes first", "recipes": usedIn})
+        return
+    }
+    err := db.Transaction(func(tx *gorm.DB) error {
+        for _, m := range []any{&ProductBarcode{}, &PriceListItem{}, &ProductStock{}, &ProductSearchToken{}, &RecipeItem{}, &ScheduledPriceChange{}} {
+            if err := tx.Where("product_id = ?", p.ID).Delete(m).Error; err != nil { return err }
+        }
+        return tx.Delete(&p).Error
+    })
+    if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
+    removeProductImages(p)
     c.Status(http.StatusNoContent)
 }
 
-func searchProducts(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
-    q := c.Query("q")
-    var products []Product
-    db.Where("organization_id = ? AND (name LIKE ? OR sku LIKE ?)", orgUser.OrganizationID, "%"+q+"%", "%"+q+"%").Order("name asc").Find(&products)
-    c.JSON(http.StatusOK, products)
+func restoreProduct(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ? AND archived_at IS NOT NULL", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "no archived product"})
+        return
+    }
+    p.ArchivedAt = nil
+    p.Version++
+    p.DateUpdated = nowISO()
+    if err := db.Save(&p).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, p)
 }
 
+// notArchived limits a product query to products that are not archived.
+func notArchived(tx *gorm.DB) *gorm.DB { return tx.Where("archived_at IS NULL") }
+
+
 // Transaction handlers
 type createTransactionRequest struct {
     Transaction
+    CouponCode *string `json:"coupon_code"`
     Items []TransactionItem `json:"items"`
 }
 
 func createTransaction(c *gin.Context) {
     uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     var req createTransactionRequest
     if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
     now := nowISO()
@@ -389,32 +751,91 @@ func createTransaction(c *gin.Context) {
     t.OrganizationID = orgUser.OrganizationID
     t.DateCreated = now
     t.DateUpdated = now
-    if err := db.Create(&t).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
-    for i := range req.Items {
-        it := req.Items[i]
-        it.TransactionID = t.ID
-        it.DateCreated = now
-        it.DateUpdated = now
-        if err := db.Create(&it).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
-        // Update stock
-        db.Model(&Product{}).Where("id = ? AND organization_id = ?", it.ProductID, orgUser.OrganizationID).UpdateColumn("stock_quantity", gorm.Expr("stock_quantity - ?", it.Quantity))
+    loc := orgTimezone(orgUser.OrganizationID)
+    if strings.TrimSpace(t.TransactionDate) == "" {
+        t.TransactionDate = now
+    } else {
+        at, err := utcTimestamp(t.TransactionDate, loc)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "transaction_date: " + err.Error()}); return }
+        t.TransactionDate = at
+    }
+    // Sales happen at the requested location, else the till's (for PIN
+    // sessions), else the cashier's default one, else the organization's
+    if v, ok := c.Get("sessionLocationID"); ok && t.LocationID == nil { id := v.(uint); t.LocationID = &id }
+    if t.LocationID == nil { t.LocationID = orgUser.DefaultLocationID }
+    if t.LocationID == nil { t.LocationID = defaultLocationID(db, orgUser.OrganizationID) }
+    if t.LocationID != nil {
+        if _, err := orgLocation(db, orgUser.OrganizationID, *t.LocationID); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown location"}); return }
+    }
+    // Resolve prices server-side: the explicit price list, else the customer's
+    if t.CustomerID != nil {
+        var cu Customer
+        if err := db.Where("id = ? AND organization_id = ?", *t.CustomerID, orgUser.OrganizationID).First(&cu).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown customer"}); return }
+        if t.PriceListID == nil { t.PriceListID = cu.PriceListID }
     }
-    c.JSON(http.StatusCreated, gin.H{"id": t.ID})
+    if t.PriceListID != nil {
+        var pl PriceList
+        if err := db.Where("id = ? AND organization_id = ?", *t.PriceListID, orgUser.OrganizationID).First(&pl).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown price list"}); return }
+    }
+    // promotion and coupon days are the organization's
+    pricedAt := time.Now().In(loc)
+    subtotal, lines, err := priceCart(db, orgUser.OrganizationID, req.Items, t.PriceListID, pricedAt)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    // Apply promotions server-side
+    applied := evaluatePromotions(loadPromotions(db, orgUser.OrganizationID), lines, pricedAt)
+    discount := 0.0
+    for _, a := range applied { discount += a.Discount }
+    // Write the sale, its stock movements and any coupon redemption atomically
+    couponAmount := 0.0
+    err = db.Transaction(func(tx *gorm.DB) error {
+        var coupon Coupon
+        if req.CouponCode != nil && *req.CouponCode != "" {
+            var err error
+            coupon, couponAmount, err = redeemCoupon(tx, orgUser.OrganizationID, *req.CouponCode, t.CustomerID, lines, subtotal-discount, pricedAt)
+            if err != nil { return err }
+        }
+        t.Subtotal = subtotal
+        t.DiscountAmount = discount + couponAmount
+        t.TotalAmount = subtotal - t.DiscountAmount
+        t.Change = t.AmountReceived - t.TotalAmount
+        if err := tx.Create(&t).Error; err != nil { return err }
+        if coupon.ID != 0 {
+            r := CouponRedemption{OrganizationID: t.OrganizationID, CouponID: coupon.ID, TransactionID: t.ID, CustomerID: t.CustomerID, Discount: couponAmount, DateCreated: now}
+            if err := tx.Create(&r).Error; err != nil { return err }
+        }
+        for _, a := range applied {
+            tp := TransactionPromotion{OrganizationID: t.OrganizationID, TransactionID: t.ID, PromotionID: a.PromotionID, Name: a.Name, Discount: a.Discount, DateCreated: now}
+            if err := tx.Create(&tp).Error; err != nil { return err }
+        }
+        for i := range req.Items {
+            it := req.Items[i]
+            it.TransactionID = t.ID
+            it.DateCreated = now
+            it.DateUpdated = now
+            if err := tx.Create(&it).Error; err != nil { return err }
+            // Update stock of the product, or of its recipe's ingredients, depleting lots
+            // first-expired-first-out and recording the sale in inventory history
+            if err := consumeStock(tx, orgUser.OrganizationID, t.LocationID, it.ProductID, it.Quantity, uid, t.ID); err != nil { return err }
+        }
+        return nil
+    })
+    var ce couponError
+    if errors.As(err, &ce) { c.JSON(http.StatusUnprocessableEntity, gin.H{"error": ce.Error()}); return }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, gin.H{"id": t.ID, "subtotal": t.Subtotal, "discount_amount": t.DiscountAmount, "coupon_discount": couponAmount, "total_amount": t.TotalAmount, "change": t.Change, "promotions": applied})
 }
 
 func listTransactions(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    q := db.Where("organization_id = ?", orgUser.OrganizationID)
+    if loc := c.Query("location_id"); loc != "" { q = q.Where("location_id = ?", loc) }
     var txs []Transaction
-    db.Where("organization_id = ?", orgUser.OrganizationID).Order("transaction_date desc").Find(&txs)
+    q.Order("transaction_date desc").Find(&txs)
     c.JSON(http.StatusOK, txs)
 }
 
 func getTransaction(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     id, _ := strconv.Atoi(c.Param("id"))
     var t Transaction
     if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&t).Error; err != nil {
@@ -425,84 +846,176 @@ func getTransaction(c *gin.Context) {
 }
 
 func getTransactionItems(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     id, _ := strconv.Atoi(c.Param("id"))
     var t Transaction
     if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&t).Error; err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
         return
     }
-    // Join to include product name for client receipt display
-    type itemRes struct {
+    c.JSON(http.StatusOK, transactionItemRows(t.ID))
+}
+
+// transactionItemRow is a transaction item with its product name for
+// receipt display.
+type transactionItemRow struct {
         ID                 uint    `json:"id"`
         TransactionID      uint    `json:"transaction_id"`
         ProductID          uint    `json:"product_id"`
-        Quantity           int     `json:"quantity"`
+        Quantity           float64 `json:"quantity"`
+        Unit               string  `json:"unit"`
         PriceAtTransaction float64 `json:"price_at_transaction"`
         ProductName        string  `json:"product_name"`
         DateCreated        string  `json:"date_created"`
         DateUpdated        string  `json:"date_updated"`
-    }
-    var rows []itemRes
+}
+
+func transactionItemRows(transactionID uint) []transactionItemRow {
+    var rows []transactionItemRow
     db.Raw(`
-        SELECT ti.id, ti.transaction_id, ti.product_id, ti.quantity, ti.price_at_transaction,
+        SELECT ti.id, ti.transaction_id, ti.product_id, ti.quantity, ti.unit, ti.price_at_transaction,
                COALESCE(p.name, '') as product_name, ti.date_created, ti.date_updated
         FROM transaction_items ti
         LEFT JOIN products p ON ti.product_id = p.id
         WHERE ti.transaction_id = ?
-    `, id).Scan(&rows)
-    c.JSON(http.StatusOK, rows)
+    `, transactionID).Scan(&rows)
+    return rows
 }
 
-func deleteTransaction(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+// getTransactionReceipt returns everything a receipt or invoice prints:
+// the organization profile, the sale with its items, discounts, location
+// and customer, and the sale time in the organization's timezone.
+func getTransactionReceipt(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     id, _ := strconv.Atoi(c.Param("id"))
-    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).Delete(&Transaction{}).Error; err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    var t Transaction
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&t).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
         return
     }
+    var org Organization
+    if err := db.First(&org, t.OrganizationID).Error; err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    var promos []TransactionPromotion
+    db.Where("transaction_id = ?", t.ID).Order("id asc").Find(&promos)
+    res := gin.H{
+        "organization": org, "currency_decimals": currencyDecimals(org.Currency),
+        "transaction": t, "local_transaction_date": localTime(t.TransactionDate, org.location()),
+        "items": transactionItemRows(t.ID), "promotions": promos, "location": nil, "customer": nil,
+    }
+    if t.LocationID != nil {
+        var l Location
+        if db.First(&l, *t.LocationID).Error == nil { res["location"] = l }
+    }
+    if t.CustomerID != nil {
+        var cu Customer
+        if db.First(&cu, *t.CustomerID).Error == nil { res["customer"] = cu }
+    }
+    c.JSON(http.StatusOK, res)
+}
+
+// deleteTransaction voids a sale: its coupon use and promotions are taken
+// back, the stock it sold returns to the lots and locations it came from,
+// and the sale is removed.
+func deleteTransaction(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    err := db.Transaction(func(tx *gorm.DB) error {
+        var t Transaction
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&t).Error; err != nil { return err }
+        var redemptions []CouponRedemption
+        if err := tx.Where("transaction_id = ? AND organization_id = ?", t.ID, t.OrganizationID).Find(&redemptions).Error; err != nil { return err }
+        for _, r := range redemptions {
+            if err := tx.Model(&Coupon{}).Where("id = ? AND uses_count > 0", r.CouponID).UpdateColumn("uses_count", gorm.Expr("uses_count - 1")).Error; err != nil { return err }
+        }
+        if err := tx.Where("transaction_id = ? AND organization_id = ?", t.ID, t.OrganizationID).Delete(&CouponRedemption{}).Error; err != nil { return err }
+        if err := tx.Where("transaction_id = ? AND organization_id = ?", t.ID, t.OrganizationID).Delete(&TransactionPromotion{}).Error; err != nil { return err }
+
+        var sold []InventoryMovement
+        if err := tx.Where("organization_id = ? AND reason = ? AND reference_id = ?", t.OrganizationID, "sale", t.ID).Order("id asc").Find(&sold).Error; err != nil { return err }
+        now := nowISO()
+        for _, m := range sold {
+            q := -m.Quantity
+            if m.LotID != nil {
+                if err := tx.Model(&StockLot{}).Where("id = ?", *m.LotID).Updates(map[string]any{"quantity_remaining": gorm.Expr("quantity_remaining + ?", q), "date_updated": now}).Error; err != nil { return err }
+            }
+            if m.LocationID != nil {
+                if err := adjustLocationStock(tx, t.OrganizationID, *m.LocationID, m.ProductID, q); err != nil { return err }
+            } else if err := addProductStock(tx, t.OrganizationID, m.ProductID, q); err != nil {
+                return err
+            }
+            back := InventoryMovement{OrganizationID: t.OrganizationID, ProductID: m.ProductID, LocationID: m.LocationID, LotID: m.LotID, UserID: uid, Quantity: q, Reason: "void", ReferenceID: &t.ID, ViaProductID: m.ViaProductID, DateCreated: now}
+            if err := tx.Create(&back).Error; err != nil { return err }
+        }
+        if err := tx.Where("transaction_id = ?", t.ID).Delete(&TransactionItem{}).Error; err != nil { return err }
+        return tx.Delete(&t).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
     c.Status(http.StatusNoContent)
 }
 
 // Settings
 func getSetting(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     key := c.Param("key")
+    if field, ok := profileSettings[key]; ok { getProfileSetting(c, key, field); return }
     var s Setting
     if err := db.Where("organization_id = ? AND `key` = ?", orgUser.OrganizationID, key).First(&s).Error; err != nil {
         c.JSON(http.StatusOK, gin.H{"key": key, "value": nil})
         return
     }
+    setETag(c, s.Version)
     c.JSON(http.StatusOK, s)
 }
 
 func putSetting(c *gin.Context) {
     uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     key := c.Param("key")
-    var body struct{ Value string `json:"value"` }
+    var body struct {
+        Value   string `json:"value"`
+        Version int    `json:"version"`
+    }
     if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
-    s := Setting{OrganizationID: orgUser.OrganizationID, UserID: uid, Key: key, Value: body.Value}
-    if err := db.Save(&s).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    version, err := expectedVersion(c, body.Version)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if field, ok := profileSettings[key]; ok { putProfileSetting(c, key, field, body.Value, version); return }
+    var s Setting
+    err = db.Where("organization_id = ? AND `key` = ?", orgUser.OrganizationID, key).First(&s).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        // a version can only match a setting that exists
+        if version != 0 { c.JSON(http.StatusPreconditionFailed, gin.H{"error": "setting does not exist", "version": 0}); return }
+        s = Setting{OrganizationID: orgUser.OrganizationID, UserID: uid, Key: key, Value: body.Value, Version: 1}
+        if err := db.Create(&s).Error; err != nil {
+            if errors.Is(err, gorm.ErrDuplicatedKey) { c.JSON(http.StatusPreconditionFailed, gin.H{"error": "modified by someone else, reload and retry"}); return }
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return
+        }
+        setETag(c, s.Version)
+        c.JSON(http.StatusOK, s)
+        return
+    }
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    if version == 0 { respondVersionRequired(c, s.Version); return }
+    res := db.Model(&Setting{}).Where("organization_id = ? AND user_id = ? AND `key` = ? AND version = ?", s.OrganizationID, s.UserID, s.Key, version).
+        Updates(map[string]any{"value": body.Value, "version": gorm.Expr("version + 1")})
+    if res.Error != nil { c.JSON(http.StatusBadRequest, gin.H{"error": res.Error.Error()}); return }
+    db.Where("organization_id = ? AND user_id = ? AND `key` = ?", s.OrganizationID, s.UserID, s.Key).First(&s)
+    if res.RowsAffected == 0 { respondStale(c, s.Version, s); return }
+    setETag(c, s.Version)
     c.JSON(http.StatusOK, s)
 }
 
 // Analytics
 func todaySummary(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
-    today := time.Now().Format("2006-01-02")
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    loc := orgTimezone(orgUser.OrganizationID)
+    today := time.Now().In(loc).Format(dateLayout)
+    start, end, err := localDayRange(today, today, loc)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
     type row struct { TotalRevenue *float64; TotalTransactions *int }
     var r row
-    db.Raw("SELECT SUM(total_amount) as total_revenue, COUNT(id) as total_transactions FROM transactions WHERE organization_id = ? AND substr(transaction_date, 1, 10) = ?", orgUser.OrganizationID, today).Scan(&r)
+    db.Raw("SELECT SUM(total_amount) as total_revenue, COUNT(id) as total_transactions FROM transactions WHERE organization_id = ? AND transaction_date >= ? AND transaction_date < ?", orgUser.OrganizationID, start, end).Scan(&r)
     totalRevenue := 0.0
     totalTransactions := 0
     if r.TotalRevenue != nil { totalRevenue = *r.TotalRevenue }
@@ -517,13 +1030,14 @@ func todaySummary(c *gin.Context) {
 }
 
 func topSelling(c *gin.Context) {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
-    from := time.Now().AddDate(0, 0, -30).Format("2006-01-02")
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    loc := orgTimezone(orgUser.OrganizationID)
+    now := time.Now().In(loc)
+    start, end, err := localDayRange(now.AddDate(0, 0, -30).Format(dateLayout), now.Format(dateLayout), loc)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
     type res struct{
         Name string `json:"name"`
-        TotalQuantitySold int `json:"totalQuantitySold"`
+        TotalQuantitySold float64 `json:"totalQuantitySold"`
     }
     var rows []res
     db.Raw(`
@@ -531,46 +1045,37 @@ func topSelling(c *gin.Context) {
         FROM transaction_items ti
         JOIN products p ON ti.product_id = p.id
         JOIN transactions t ON ti.transaction_id = t.id
-        WHERE p.organization_id = ? AND substr(t.transaction_date, 1, 10) >= ?
+        WHERE p.organization_id = ? AND t.organization_id = ? AND t.transaction_date >= ? AND t.transaction_date < ?
         GROUP BY p.name
         ORDER BY total_quantity_sold DESC
-        LIMIT 5`, orgUser.OrganizationID, from).Scan(&rows)
+        LIMIT 5`, orgUser.OrganizationID, orgUser.OrganizationID, start, end).Scan(&rows)
     c.JSON(http.StatusOK, rows)
 }
 
-// Authorization helpers
-func requireRole(c *gin.Context, roles ...string) bool {
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    if err := db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error; err != nil {
-        c.JSON(http.StatusForbidden, gin.H{"error": "no organization"})
-        return false
-    }
-    for _, r := range roles {
-        if orgUser.Role == r { return true }
-    }
-    c.JSON(http.StatusForbidden, gin.H{"error": "insufficient role"})
-    return false
+// User management handlers
+// MemberResponse is what the API shows of a user in an organization: the
+// user and their membership, with has_pin in place of the PIN hash.
+type MemberResponse struct {
+    ID uint `json:"id"`
+    Name string `json:"name"`
+    Username string `json:"username"`
+    Role string `json:"role"`
+    IsActive bool `json:"is_active"`
+    DefaultLocationID *uint `json:"default_location_id"`
+    HasPIN bool `json:"has_pin"`
+    DateCreated string `json:"date_created"`
+    DateUpdated string `json:"date_updated"`
+}
+
+func memberResponse(u User, ou OrganizationUser) MemberResponse {
+    return MemberResponse{ID: u.ID, Name: u.Name, Username: u.Username, Role: ou.Role, IsActive: ou.IsActive, DefaultLocationID: ou.DefaultLocationID, HasPIN: ou.PinHash != "", DateCreated: u.DateCreated, DateUpdated: u.DateUpdated}
 }
 
-// User management handlers
 func listUsers(c *gin.Context) {
-    if !requireRole(c, "owner", "manager") { return }
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
-    type result struct {
-        ID uint `json:"id"`
-        Name string `json:"name"`
-        Username string `json:"username"`
-        Role string `json:"role"`
-        IsActive bool `json:"is_active"`
-        DateCreated string `json:"date_created"`
-        DateUpdated string `json:"date_updated"`
-    }
-    var rows []result
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    rows := []MemberResponse{}
     db.Raw(`
-        SELECT u.id, u.name, u.username, ou.role, ou.is_active, u.date_created, u.date_updated
+        SELECT u.id, u.name, u.username, ou.role, ou.is_active, ou.default_location_id, ou.pin_hash <> '' as has_pin, u.date_created, u.date_updated
         FROM organization_users ou
         JOIN users u ON u.id = ou.user_id
         WHERE ou.organization_id = ?
@@ -579,51 +1084,73 @@ func listUsers(c *gin.Context) {
 }
 
 func createUser(c *gin.Context) {
-    if !requireRole(c, "owner", "manager") { return }
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     var body struct {
         Name string `json:"name"`
         Username string `json:"username"`
         Password string `json:"password"`
         Role string `json:"role"`
+        DefaultLocationID *uint `json:"default_location_id"`
+        PIN string `json:"pin"`
     }
     if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if !mayGrant(c, orgUser.OrganizationID, body.Role) { return }
+    pinHash, err := hashPIN(body.PIN)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if body.DefaultLocationID != nil {
+        if _, err := orgLocation(db, orgUser.OrganizationID, *body.DefaultLocationID); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown location"}); return }
+    }
     now := nowISO()
+    if err := checkPassword(body.Password, body.Username); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
     hashed, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
     if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "hash error"}); return }
     u := User{Name: body.Name, Username: body.Username, Password: string(hashed), DateCreated: now, DateUpdated: now}
     if err := db.Create(&u).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
-    ou := OrganizationUser{OrganizationID: orgUser.OrganizationID, UserID: u.ID, Role: body.Role, IsActive: true, DateCreated: now, DateUpdated: now}
+    ou := OrganizationUser{OrganizationID: orgUser.OrganizationID, UserID: u.ID, Role: body.Role, IsActive: true, DefaultLocationID: body.DefaultLocationID, PinHash: pinHash, DateCreated: now, DateUpdated: now}
     if err := db.Create(&ou).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
-    c.JSON(http.StatusCreated, gin.H{"id": u.ID})
+    c.JSON(http.StatusCreated, memberResponse(u, ou))
 }
 
 func updateUser(c *gin.Context) {
-    if !requireRole(c, "owner", "manager") { return }
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     id, _ := strconv.Atoi(c.Param("id"))
-    var body struct { Role *string `json:"role"`; IsActive *bool `json:"is_active"` }
+    var body struct { Role *string `json:"role"`; IsActive *bool `json:"is_active"`; DefaultLocationID *uint `json:"default_location_id"`; PIN *string `json:"pin"` }
     if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
     var ou OrganizationUser
     if err := db.Where("organization_id = ? AND user_id = ?", orgUser.OrganizationID, id).First(&ou).Error; err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
     }
-    if body.Role != nil { ou.Role = *body.Role }
+    // users can only manage those who hold no more than they do
+    if !mayGrant(c, orgUser.OrganizationID, ou.Role) { return }
+    if body.Role != nil {
+        if !mayGrant(c, orgUser.OrganizationID, *body.Role) { return }
+        ou.Role = *body.Role
+    }
     if body.IsActive != nil { ou.IsActive = *body.IsActive }
+    if body.PIN != nil {
+        h, err := hashPIN(*body.PIN)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+        ou.PinHash = h
+    }
+    if body.DefaultLocationID != nil {
+        if _, err := orgLocation(db, orgUser.OrganizationID, *body.DefaultLocationID); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown location"}); return }
+        ou.DefaultLocationID = body.DefaultLocationID
+    }
     ou.DateUpdated = nowISO()
-    if err := db.Save(&ou).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Save(&ou).Error; err != nil { return err }
+        if ou.IsActive { return nil }
+        // sessions in this organization lose access on their next request;
+        // sign the user out only once no organization is left
+        if _, err := activeMembership(tx, ou.UserID, 0); err == nil { return nil }
+        return revokeUserSessions(tx, ou.UserID, "deactivated")
+    })
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
     c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
 func resetUserPassword(c *gin.Context) {
-    if !requireRole(c, "owner", "manager") { return }
-    uid := c.MustGet("userID").(uint)
-    var orgUser OrganizationUser
-    _ = db.Where("user_id = ? AND is_active = ?", uid, true).First(&orgUser).Error
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
     id, _ := strconv.Atoi(c.Param("id"))
     var body struct{ NewPassword string `json:"newPassword"` }
     if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
@@ -632,11 +1159,18 @@ func resetUserPassword(c *gin.Context) {
     if err := db.Where("organization_id = ? AND user_id = ?", orgUser.OrganizationID, id).First(&ou).Error; err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
     }
+    if !mayGrant(c, orgUser.OrganizationID, ou.Role) { return }
+    var u User
+    if err := db.First(&u, id).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if err := checkPassword(body.NewPassword, u.Username); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
     hashed, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), bcrypt.DefaultCost)
     if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "hash error"}); return }
-    if err := db.Model(&User{}).Where("id = ?", id).Updates(map[string]any{"password": string(hashed), "date_updated": nowISO()}).Error; err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return
-    }
+    // the admin knows this password, so the user must replace it
+    err = db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&User{}).Where("id = ?", id).Updates(map[string]any{"password": string(hashed), "must_change_password": true, "date_updated": nowISO()}).Error; err != nil { return err }
+        return revokeUserSessions(tx, uint(id), "password reset")
+    })
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
     c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
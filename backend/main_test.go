@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Tests run against a fresh SQLite database each; the app's SQL is kept
+// to what both it and MySQL understand.
+
+func init() { gin.SetMode(gin.TestMode) }
+
+type memImageStore map[string][]byte
+
+func (s memImageStore) Put(name string, data []byte) error { s[name] = data; return nil }
+func (s memImageStore) Open(name string) (io.ReadCloser, error) {
+    b, ok := s[name]
+    if !ok { return nil, os.ErrNotExist }
+    return io.NopCloser(bytes.NewReader(b)), nil
+}
+func (s memImageStore) Delete(name string) error { delete(s, name); return nil }
+
+// newTestDB points db at an empty, migrated database.
+func newTestDB(t *testing.T) {
+    t.Helper()
+    dsn := filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+    var err error
+    db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{TranslateError: true, Logger: logger.Default.LogMode(logger.Silent)})
+    if err != nil { t.Fatal(err) }
+    if err := db.AutoMigrate(models...); err != nil { t.Fatal(err) }
+    t.Cleanup(func() {
+        if sqlDB, err := db.DB(); err == nil { sqlDB.Close() }
+    })
+    searchVocab.orgs = map[uint]orgVocab{} // organization ids repeat across test databases
+    jwtSecret = []byte("test-secret")
+    imageStorage = memImageStore{}
+}
+
+// testEnv is an organization with an owner signed in through the router.
+type testEnv struct {
+    t      *testing.T
+    router *gin.Engine
+    org    Organization
+    owner  User
+    loc    Location // the default location
+    token  string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+    t.Helper()
+    newTestDB(t)
+    e := &testEnv{t: t, router: gin.New()}
+    registerRoutes(e.router)
+    now := nowISO()
+    e.owner = User{Name: "Owner", Username: "owner", Password: mustHash(t, "correct horse battery"), DateCreated: now, DateUpdated: now}
+    mustCreate(t, &e.owner)
+    e.org = Organization{Name: "Test Store", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &e.org)
+    mustCreate(t, &OrganizationUser{OrganizationID: e.org.ID, UserID: e.owner.ID, Role: "owner", IsActive: true, DateCreated: now, DateUpdated: now})
+    loc, err := createDefaultLocation(db, e.org.ID)
+    if err != nil { t.Fatal(err) }
+    e.loc = loc
+    e.token = e.signIn(e.owner.ID)
+    return e
+}
+
+// with returns e reporting to t, for use in subtests.
+func (e *testEnv) with(t *testing.T) *testEnv {
+    c := *e
+    c.t = t
+    return &c
+}
+
+// member adds a user with role to the organization and returns them with
+// a signed-in token.
+func (e *testEnv) member(username, role string) (User, string) {
+    e.t.Helper()
+    now := nowISO()
+    u := User{Name: username, Username: username, Password: mustHash(e.t, "correct horse battery"), DateCreated: now, DateUpdated: now}
+    mustCreate(e.t, &u)
+    mustCreate(e.t, &OrganizationUser{OrganizationID: e.org.ID, UserID: u.ID, Role: role, IsActive: true, DateCreated: now, DateUpdated: now})
+    return u, e.signIn(u.ID)
+}
+
+// signIn opens a session for the user in the organization and returns an
+// access token for it.
+func (e *testEnv) signIn(userID uint) string {
+    e.t.Helper()
+    s := AuthSession{UserID: userID, OrganizationID: e.org.ID, LastUsedAt: nowISO(), DateCreated: nowISO()}
+    mustCreate(e.t, &s)
+    token, err := generateToken(userID, s.ID, e.org.ID)
+    if err != nil { e.t.Fatal(err) }
+    return token
+}
+
+// do sends a JSON request as the owner.
+func (e *testEnv) do(method, path string, body any) *httptest.ResponseRecorder {
+    e.t.Helper()
+    return e.doAs(e.token, method, path, body)
+}
+
+func (e *testEnv) doAs(token, method, path string, body any) *httptest.ResponseRecorder {
+    e.t.Helper()
+    var r *http.Request
+    if body == nil {
+        r = httptest.NewRequest(method, "/api/v1"+path, nil)
+    } else {
+        b, err := json.Marshal(body)
+        if err != nil { e.t.Fatal(err) }
+        r = httptest.NewRequest(method, "/api/v1"+path, bytes.NewReader(b))
+        r.Header.Set("Content-Type", "application/json")
+    }
+    if token != "" { r.Header.Set("Authorization", "Bearer "+token) }
+    w := httptest.NewRecorder()
+    e.router.ServeHTTP(w, r)
+    return w
+}
+
+// expect fails the test unless the response has the status, and decodes
+// its body into v when v is not nil.
+func (e *testEnv) expect(w *httptest.ResponseRecorder, status int, v any) {
+    e.t.Helper()
+    if w.Code != status { e.t.Fatalf("%s: got status %d, want %d: %s", e.t.Name(), w.Code, status, w.Body.String()) }
+    if v != nil {
+        if err := json.Unmarshal(w.Body.Bytes(), v); err != nil { e.t.Fatalf("decode %s: %v", w.Body.String(), err) }
+    }
+}
+
+// product creates a product with stock at the default location.
+func (e *testEnv) product(name string, price, stock float64) Product {
+    e.t.Helper()
+    now := nowISO()
+    p := Product{OrganizationID: e.org.ID, UserID: e.owner.ID, Name: name, Price: price, Unit: defaultUnit, StockQuantity: stock, Version: 1, DateCreated: now, DateUpdated: now}
+    mustCreate(e.t, &p)
+    if stock != 0 {
+        if err := putLocationStock(db, e.org.ID, e.loc.ID, p.ID, stock); err != nil { e.t.Fatal(err) }
+    }
+    return p
+}
+
+func (e *testEnv) location(name string) Location {
+    e.t.Helper()
+    now := nowISO()
+    l := Location{OrganizationID: e.org.ID, Name: name, Type: "outlet", IsActive: true, DateCreated: now, DateUpdated: now}
+    mustCreate(e.t, &l)
+    return l
+}
+
+func mustCreate(t *testing.T, v any) {
+    t.Helper()
+    if err := db.Create(v).Error; err != nil { t.Fatal(err) }
+}
+
+func mustHash(t *testing.T, pw string) string {
+    t.Helper()
+    h, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.MinCost)
+    if err != nil { t.Fatal(err) }
+    return string(h)
+}
+
+// stockAt is a product's quantity at a location.
+func stockAt(t *testing.T, productID, locationID uint) float64 {
+    t.Helper()
+    var ps ProductStock
+    db.Where("product_id = ? AND location_id = ?", productID, locationID).Limit(1).Find(&ps)
+    return ps.Quantity
+}
+
+func orgTotal(t *testing.T, productID uint) float64 {
+    t.Helper()
+    var p Product
+    if err := db.First(&p, productID).Error; err != nil { t.Fatal(err) }
+    return p.StockQuantity
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones work on hosts without a zoneinfo database
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A user may belong to several organizations, such as a franchise owner
+// with a store per organization. Each session works in one of them: it is
+// chosen at login, named by the "org" claim of access tokens, and changed
+// with POST /auth/switch-organization. A request can also pick another of
+// the user's organizations with the X-Organization-ID header. authMiddleware
+// resolves the membership and leaves it in the context as "orgUser".
+
+// The organization is also the business profile: the trading and legal
+// name, address, NPWP, phone and logo printed on receipts and invoices,
+// and the currency, timezone and locale clients format amounts and dates
+// with. Reports count days in the organization's timezone. Only owners may
+// edit it by default (organization.write). The business_name and
+// receipt_footer settings of older clients read and write the profile.
+
+const (
+    logoMaxSide         = 512
+    placeholderBusiness = "My Business" // the app's default business_name
+)
+
+var (
+    taxIDPattern = regexp.MustCompile(`^[0-9][0-9. -]*[0-9]$`)
+    phonePattern = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{5,23}$`)
+)
+
+// validateOrganization checks a profile and normalizes its codes.
+func validateOrganization(o *Organization) error {
+    o.Name = strings.TrimSpace(o.Name)
+    o.LegalName = strings.TrimSpace(o.LegalName)
+    o.TaxID = strings.TrimSpace(o.TaxID)
+    o.Phone = strings.TrimSpace(o.Phone)
+    if o.Name == "" { return errors.New("name is required") }
+    if utf8.RuneCountInString(o.Name) > 191 || utf8.RuneCountInString(o.LegalName) > 191 { return errors.New("name and legal_name must be at most 191 characters") }
+    if utf8.RuneCountInString(o.Address) > 500 || utf8.RuneCountInString(o.ReceiptFooter) > 500 { return errors.New("address and receipt_footer must be at most 500 characters") }
+    if o.TaxID != "" {
+        digits := strings.Count(strings.Map(func(r rune) rune { if r >= '0' && r <= '9' { return 'd' }; return -1 }, o.TaxID), "d")
+        // 15 digits (01.234.567.8-901.000), or 16 for NIK-based numbers
+        if !taxIDPattern.MatchString(o.TaxID) || (digits != 15 && digits != 16) { return errors.New("tax_id must be an NPWP of 15 or 16 digits") }
+    }
+    if o.Phone != "" && !phonePattern.MatchString(o.Phone) { return errors.New("phone must be a phone number such as +62 21 555 0100") }
+    cur, err := currency.ParseISO(strings.ToUpper(strings.TrimSpace(o.Currency)))
+    if err != nil { return errors.New("currency must be an ISO 4217 code such as IDR") }
+    o.Currency = cur.String()
+    o.Timezone = strings.TrimSpace(o.Timezone)
+    if o.Timezone == "" || o.Timezone == "Local" { return errors.New("timezone must be an IANA name such as Asia/Jakarta") }
+    if _, err := time.LoadLocation(o.Timezone); err != nil { return errors.New("timezone must be an IANA name such as Asia/Jakarta") }
+    tag, err := language.Parse(strings.TrimSpace(o.Locale))
+    if err != nil { return errors.New("locale must be a language tag such as id-ID") }
+    o.Locale = tag.String()
+    return nil
+}
+
+// location returns the organization's timezone, or the server's when it
+// cannot be loaded.
+func (o Organization) location() *time.Location {
+    loc, err := time.LoadLocation(o.Timezone)
+    if err != nil || o.Timezone == "" { return time.Local }
+    return loc
+}
+
+func orgTimezone(orgID uint) *time.Location {
+    var org Organization
+    if err := db.Select("id", "timezone").First(&org, orgID).Error; err != nil { return time.Local }
+    return org.location()
+}
+
+// currencyDecimals is the number of decimals amounts in cur are shown
+// with: its cash digits, so none for IDR.
+func currencyDecimals(cur string) int {
+    u, err := currency.ParseISO(cur)
+    if err != nil { return 2 }
+    scale, _ := currency.Cash.Rounding(u)
+    return scale
+}
+
+// localTime renders an RFC3339 timestamp in loc, or returns it as is when
+// it does not parse.
+func localTime(ts string, loc *time.Location) string {
+    t, err := time.Parse(time.RFC3339, ts)
+    if err != nil { return ts }
+    return t.In(loc).Format(time.RFC3339)
+}
+
+// Timestamps are stored as RFC3339 in UTC, so a range of them compares as
+// strings: localDayRange turns days in an organization's timezone into the
+// UTC instants that bound them.
+func localDayRange(from, to string, loc *time.Location) (string, string, error) {
+    f, err := time.Parse(dateLayout, from)
+    if err != nil { return "", "", errors.New("from must be YYYY-MM-DD") }
+    t, err := time.Parse(dateLayout, to)
+    if err != nil { return "", "", errors.New("to must be YYYY-MM-DD") }
+    start := time.Date(f.Year(), f.Month(), f.Day(), 0, 0, 0, 0, loc)
+    end := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+    return start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), nil
+}
+
+var errBadTimestamp = errors.New("timestamps must be RFC3339, such as 2024-05-01T09:30:00+07:00")
+
+// utcTimestamp converts a timestamp from a client to the stored form.
+// Timestamps without an offset, as the app used to send, are read in loc.
+func utcTimestamp(s string, loc *time.Location) (string, error) {
+    s = strings.TrimSpace(s)
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil { t, err = time.ParseInLocation("2006-01-02T15:04:05", s, loc) }
+    if err != nil { return "", errBadTimestamp }
+    return t.UTC().Format(time.RFC3339), nil
+}
+
+// normalizeTimestamps rewrites the timestamps that date ranges and expiry
+// checks compare, from older versions that kept the writer's offset, to
+// UTC. Those without an offset are read in the organization's timezone;
+// ones that do not parse are left alone.
+func normalizeTimestamps(tx *gorm.DB) error {
+    zones := map[uint]*time.Location{}
+    zone := func(orgID uint) *time.Location {
+        if orgID == 0 { return time.Local }
+        if _, ok := zones[orgID]; !ok {
+            var org Organization
+            zones[orgID] = time.Local
+            if tx.Select("id", "timezone").First(&org, orgID).Error == nil { zones[orgID] = org.location() }
+        }
+        return zones[orgID]
+    }
+    for _, c := range []struct{ table, column string; perOrg bool }{
+        {"transactions", "transaction_date", true},
+        {"inventory_movements", "date_created", true},
+        {"invitations", "expires_at", true},
+        {"refresh_tokens", "expires_at", false},
+    } {
+        if !tx.Migrator().HasTable(c.table) { continue }
+        var rows []struct {
+            ID    uint
+            OrgID uint
+            At    string
+        }
+        org := "0"
+        if c.perOrg { org = "organization_id" }
+        if err := tx.Table(c.table).Select("id, "+org+" AS org_id, "+c.column+" AS at").Where(c.column+" NOT LIKE ?", "%Z").Scan(&rows).Error; err != nil { return err }
+        for _, r := range rows {
+            at, err := utcTimestamp(r.At, zone(r.OrgID))
+            if err != nil || at == r.At { continue }
+            if err := tx.Table(c.table).Where("id = ?", r.ID).Update(c.column, at).Error; err != nil { return err }
+        }
+    }
+    return nil
+}
+
+// writeOrganization saves the profile fields of o if it is still at
+// version and reloads o. It responds itself and returns false on a stale
+// version or a failed save.
+func writeOrganization(c *gin.Context, o *Organization, version int) bool {
+    res := db.Model(&Organization{}).Where("id = ? AND version = ?", o.ID, version).Updates(map[string]any{
+        "name": o.Name, "legal_name": o.LegalName, "address": o.Address, "tax_id": o.TaxID, "phone": o.Phone,
+        "currency": o.Currency, "timezone": o.Timezone, "locale": o.Locale, "receipt_footer": o.ReceiptFooter,
+        "version": gorm.Expr("version + 1"), "date_updated": nowISO(),
+    })
+    if res.Error != nil { c.JSON(http.StatusBadRequest, gin.H{"error": res.Error.Error()}); return false }
+    if err := db.First(o, o.ID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return false }
+    if res.RowsAffected == 0 { respondStale(c, o.Version, o); return false }
+    setETag(c, o.Version)
+    return true
+}
+
+// profileSettings are the settings keys that now live in the profile.
+var profileSettings = map[string]func(o *Organization) *string{
+    "business_name":  func(o *Organization) *string { return &o.Name },
+    "receipt_footer": func(o *Organization) *string { return &o.ReceiptFooter },
+}
+
+// getProfileSetting and putProfileSetting answer GET and PUT
+// /settings/:key for profileSettings, in the shape of a Setting whose
+// version is the profile's.
+func getProfileSetting(c *gin.Context, key string, field func(o *Organization) *string) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var org Organization
+    if err := db.First(&org, orgUser.OrganizationID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    setETag(c, org.Version)
+    c.JSON(http.StatusOK, Setting{OrganizationID: org.ID, Key: key, Value: *field(&org), Version: org.Version})
+}
+
+func putProfileSetting(c *gin.Context, key string, field func(o *Organization) *string, value string, version int) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    if !hasPermission(c.MustGet("permissions").([]string), "organization.write") {
+        c.JSON(http.StatusForbidden, gin.H{"error": "missing permission", "permission": "organization.write"}); return
+    }
+    var org Organization
+    if err := db.First(&org, orgUser.OrganizationID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if version == 0 { respondVersionRequired(c, org.Version); return }
+    *field(&org) = value
+    if err := validateOrganization(&org); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if !writeOrganization(c, &org, version) { return }
+    c.JSON(http.StatusOK, Setting{OrganizationID: org.ID, Key: key, Value: *field(&org), Version: org.Version})
+}
+
+// moveProfileSettings folds the business_name and receipt_footer settings
+// of older versions into the organization profiles and drops them. The
+// app's placeholder business name does not replace an organization name.
+func moveProfileSettings(tx *gorm.DB) error {
+    var old []Setting
+    if err := tx.Where("`key` IN ?", []string{"business_name", "receipt_footer"}).Find(&old).Error; err != nil { return err }
+    for _, s := range old {
+        err := tx.Transaction(func(tx *gorm.DB) error {
+            value := strings.TrimSpace(s.Value)
+            column := "receipt_footer"
+            if s.Key == "business_name" { column = "name" }
+            if value != "" && !(s.Key == "business_name" && value == placeholderBusiness) {
+                if err := tx.Model(&Organization{}).Where("id = ?", s.OrganizationID).Updates(map[string]any{column: value, "version": gorm.Expr("version + 1")}).Error; err != nil { return err }
+            }
+            return tx.Delete(&s).Error
+        })
+        if err != nil { return err }
+    }
+    return nil
+}
+
+// activeMembership returns the user's active membership in orgID, or with
+// orgID 0 their oldest one.
+func activeMembership(tx *gorm.DB, userID, orgID uint) (OrganizationUser, error) {
+    q := tx.Where("user_id = ? AND is_active = ?", userID, true)
+    if orgID != 0 { q = q.Where("organization_id = ?", orgID) }
+    var ou OrganizationUser
+    err := q.Order("date_created asc, organization_id asc").First(&ou).Error
+    return ou, err
+}
+
+// Organization handlers
+func listMyOrganizations(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    var current uint
+    if v, ok := c.Get("orgUser"); ok { current = v.(OrganizationUser).OrganizationID }
+    type res struct {
+        Organization      Organization `json:"organization"`
+        Role              string       `json:"role"`
+        DefaultLocationID *uint        `json:"default_location_id"`
+        Current           bool         `json:"current"`
+    }
+    var memberships []OrganizationUser
+    db.Where("user_id = ? AND is_active = ?", uid, true).Order("date_created asc, organization_id asc").Find(&memberships)
+    out := make([]res, 0, len(memberships))
+    for _, m := range memberships {
+        var org Organization
+        if err := db.First(&org, m.OrganizationID).Error; err != nil { continue }
+        out = append(out, res{org, m.Role, m.DefaultLocationID, m.OrganizationID == current})
+    }
+    c.JSON(http.StatusOK, out)
+}
+
+// switchOrganization moves the session to another of the user's
+// organizations and returns an access token for it. The refresh token
+// stays valid and keeps issuing tokens for the new organization.
+func switchOrganization(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    sid := c.MustGet("sessionID").(uint)
+    if _, ok := c.Get("deviceID"); ok { c.JSON(http.StatusForbidden, gin.H{"error": "PIN sessions stay in their device's organization"}); return }
+    var body struct{ OrganizationID uint `json:"organization_id"` }
+    if err := c.BindJSON(&body); err != nil || body.OrganizationID == 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    ou, err := activeMembership(db, uid, body.OrganizationID)
+    if err != nil { c.JSON(http.StatusForbidden, gin.H{"error": "not a member of this organization"}); return }
+    if err := db.Model(&AuthSession{}).Where("id = ?", sid).Update("organization_id", ou.OrganizationID).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+    }
+    token, err := generateToken(uid, sid, ou.OrganizationID)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    var org Organization
+    _ = db.First(&org, ou.OrganizationID).Error
+    c.JSON(http.StatusOK, gin.H{"token": token, "expires_in": int(tokenExpiry.Seconds()), "organization": org, "role": ou.Role, "default_location_id": ou.DefaultLocationID})
+}
+
+func getOrganization(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var org Organization
+    if err := db.First(&org, orgUser.OrganizationID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    setETag(c, org.Version)
+    c.JSON(http.StatusOK, org)
+}
+
+// updateOrganization changes the fields present in the body. The logo has
+// its own endpoints.
+func updateOrganization(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var org Organization
+    if err := db.First(&org, orgUser.OrganizationID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    current := org
+    // the version comes from the client, not the row loaded here
+    org.Version = 0
+    if err := c.BindJSON(&org); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    version, err := expectedVersion(c, org.Version)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if version == 0 { respondVersionRequired(c, current.Version); return }
+    org.ID, org.LogoURL, org.DateCreated = current.ID, current.LogoURL, current.DateCreated
+    if err := validateOrganization(&org); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if !writeOrganization(c, &org, version) { return }
+    c.JSON(http.StatusOK, org)
+}
+
+// uploadOrganizationLogo takes a multipart field `image` and stores it
+// scaled down to logoMaxSide.
+func uploadOrganizationLogo(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    img, ok := readUploadedImage(c)
+    if !ok { return }
+    data, err := encodeJPEG(fitImage(img, logoMaxSide))
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    name, err := randomImageName()
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    name += ".jpg"
+    if err := imageStorage.Put(name, data); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+
+    // lock the row so concurrent uploads each clean up the logo they replace
+    var old Organization
+    err = db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&old, orgUser.OrganizationID).Error; err != nil { return err }
+        return tx.Model(&Organization{}).Where("id = ?", old.ID).Updates(map[string]any{"logo_url": imagesPath + name, "version": gorm.Expr("version + 1"), "date_updated": nowISO()}).Error
+    })
+    if err != nil {
+        _ = imageStorage.Delete(name)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    if old.LogoURL != nil { _ = imageStorage.Delete(path.Base(*old.LogoURL)) }
+    var org Organization
+    db.First(&org, old.ID)
+    setETag(c, org.Version)
+    c.JSON(http.StatusOK, org)
+}
+
+func deleteOrganizationLogo(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var org Organization
+    if err := db.First(&org, orgUser.OrganizationID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if org.LogoURL == nil { c.JSON(http.StatusOK, org); return }
+    // only clear the logo we looked at; a concurrent upload keeps its own
+    res := db.Model(&Organization{}).Where("id = ? AND logo_url = ?", org.ID, *org.LogoURL).Updates(map[string]any{"logo_url": nil, "version": gorm.Expr("version + 1"), "date_updated": nowISO()})
+    if res.Error != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()}); return }
+    if res.RowsAffected > 0 { _ = imageStorage.Delete(path.Base(*org.LogoURL)) }
+    db.First(&org, org.ID)
+    setETag(c, org.Version)
+    c.JSON(http.StatusOK, org)
+}
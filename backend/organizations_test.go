@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestLocalDayRange(t *testing.T) {
+    jakarta, _ := time.LoadLocation("Asia/Jakarta")
+    newYork, _ := time.LoadLocation("America/New_York")
+    tests := []struct {
+        name             string
+        from, to         string
+        loc              *time.Location
+        wantStart, wantEnd string
+        wantErr          bool
+    }{
+        {"one day east of UTC", "2026-06-01", "2026-06-01", jakarta, "2026-05-31T17:00:00Z", "2026-06-01T17:00:00Z", false},
+        {"several days", "2026-06-01", "2026-06-30", jakarta, "2026-05-31T17:00:00Z", "2026-06-30T17:00:00Z", false},
+        {"west of UTC", "2026-06-01", "2026-06-01", newYork, "2026-06-01T04:00:00Z", "2026-06-02T04:00:00Z", false},
+        {"23 hour day", "2026-03-08", "2026-03-08", newYork, "2026-03-08T05:00:00Z", "2026-03-09T04:00:00Z", false},
+        {"25 hour day", "2026-11-01", "2026-11-01", newYork, "2026-11-01T04:00:00Z", "2026-11-02T05:00:00Z", false},
+        {"end of month", "2026-01-31", "2026-01-31", time.UTC, "2026-01-31T00:00:00Z", "2026-02-01T00:00:00Z", false},
+        {"bad from", "2026-6-1", "2026-06-01", time.UTC, "", "", true},
+        {"bad to", "2026-06-01", "tomorrow", time.UTC, "", "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            start, end, err := localDayRange(tt.from, tt.to, tt.loc)
+            if (err != nil) != tt.wantErr { t.Fatalf("err = %v, want error %v", err, tt.wantErr) }
+            if start != tt.wantStart || end != tt.wantEnd { t.Fatalf("range = [%s, %s), want [%s, %s)", start, end, tt.wantStart, tt.wantEnd) }
+        })
+    }
+}
+
+func TestUTCTimestamp(t *testing.T) {
+    jakarta, _ := time.LoadLocation("Asia/Jakarta")
+    tests := []struct {
+        in, want string
+        wantErr  bool
+    }{
+        {"2026-06-01T00:30:00+07:00", "2026-05-31T17:30:00Z", false},
+        {"2026-06-01T00:30:00Z", "2026-06-01T00:30:00Z", false},
+        {"2026-06-01T00:30:00.123Z", "2026-06-01T00:30:00Z", false},
+        {"2026-06-01T00:30:00.123456", "2026-05-31T17:30:00Z", false}, // the app's local time without an offset
+        {" 2026-06-01T00:30:00 ", "2026-05-31T17:30:00Z", false},
+        {"2026-06-01", "", true},
+        {"yesterday", "", true},
+    }
+    for _, tt := range tests {
+        got, err := utcTimestamp(tt.in, jakarta)
+        if (err != nil) != tt.wantErr || got != tt.want { t.Errorf("utcTimestamp(%q) = %q, %v; want %q", tt.in, got, err, tt.want) }
+    }
+}
+
+func TestNormalizeTimestamps(t *testing.T) {
+    newTestDB(t)
+    org := Organization{Name: "Toko", Timezone: "Asia/Jakarta", DateCreated: nowISO(), DateUpdated: nowISO()}
+    mustCreate(t, &org)
+    tests := []struct{ in, want string }{
+        {"2026-06-01T00:30:00+07:00", "2026-05-31T17:30:00Z"},
+        {"2026-06-01T00:30:00.5", "2026-05-31T17:30:00Z"},
+        {"2026-06-01T00:30:00Z", "2026-06-01T00:30:00Z"},
+        {"not a time", "not a time"},
+    }
+    ids := make([]uint, len(tests))
+    for i, tt := range tests {
+        tx := Transaction{OrganizationID: org.ID, TransactionDate: tt.in}
+        mustCreate(t, &tx)
+        ids[i] = tx.ID
+    }
+    if err := normalizeTimestamps(db); err != nil { t.Fatal(err) }
+    for i, tt := range tests {
+        var tx Transaction
+        db.First(&tx, ids[i])
+        if tx.TransactionDate != tt.want { t.Errorf("%q became %q, want %q", tt.in, tx.TransactionDate, tt.want) }
+    }
+}
+
+// Reports count a sale on the organization's local day, whatever offset it
+// was sent with.
+func TestReportsUseLocalDays(t *testing.T) {
+    e := newTestEnv(t)
+    if err := db.Model(&e.org).Update("timezone", "Asia/Jakarta").Error; err != nil { t.Fatal(err) }
+    tests := []struct {
+        at      string
+        onJune1 bool
+    }{
+        {"2026-05-31T16:59:59Z", false},
+        {"2026-05-31T17:00:00Z", true},
+        {"2026-06-01T00:00:00+07:00", true},
+        {"2026-06-01T23:59:59", true}, // local time without an offset
+        {"2026-06-01T23:59:59+07:00", true},
+        {"2026-06-01T17:00:00Z", false},
+        {"2026-06-02T00:00:00+07:00", false},
+    }
+    want := 0
+    for _, tt := range tests {
+        var sale struct{ ID uint `json:"id"` }
+        e.expect(e.do(http.MethodPost, "/transactions", map[string]any{
+            "amount_received": 5000, "transaction_date": tt.at,
+            "items": []map[string]any{{"product_id": e.product("Tea "+tt.at, 5000, 1).ID, "quantity": 1}},
+        }), http.StatusCreated, &sale)
+        mustCreate(t, &TransactionPromotion{OrganizationID: e.org.ID, TransactionID: sale.ID, PromotionID: 1, Name: "Tea deal", Discount: 500, DateCreated: nowISO()})
+        if tt.onJune1 { want++ }
+    }
+    var rows []struct {
+        Uses int `json:"uses"`
+    }
+    e.expect(e.do(http.MethodGet, "/analytics/promotions?from=2026-06-01&to=2026-06-01", nil), http.StatusOK, &rows)
+    if len(rows) != 1 || rows[0].Uses != want { t.Fatalf("uses on June 1 = %+v, want %d", rows, want) }
+
+    e.expect(e.do(http.MethodPost, "/transactions", map[string]any{
+        "amount_received": 5000, "transaction_date": "last tuesday",
+        "items": []map[string]any{{"product_id": e.product("Coffee", 5000, 1).ID, "quantity": 1}},
+    }), http.StatusBadRequest, nil)
+}
+
+// tokenClaims reads an access token's claims.
+func tokenClaims(t *testing.T, token string) jwt.MapClaims {
+    t.Helper()
+    parsed, err := jwt.Parse(token, func(*jwt.Token) (any, error) { return jwtSecret, nil })
+    if err != nil { t.Fatal(err) }
+    return parsed.Claims.(jwt.MapClaims)
+}
+
+// otherOrganizations gives the owner a cashier membership in one more
+// organization and an inactive one in another, and makes a third the owner
+// is not in. Each has one product named after it.
+func (e *testEnv) otherOrganizations() (member, inactive, foreign Organization) {
+    e.t.Helper()
+    now := nowISO()
+    orgs := []*Organization{&member, &inactive, &foreign}
+    for i, name := range []string{"Member", "Inactive", "Foreign"} {
+        *orgs[i] = Organization{Name: name + " Store", DateCreated: now, DateUpdated: now}
+        mustCreate(e.t, orgs[i])
+        mustCreate(e.t, &Product{OrganizationID: orgs[i].ID, UserID: e.owner.ID, Name: name + " product", Unit: defaultUnit, Version: 1, DateCreated: now, DateUpdated: now})
+    }
+    mustCreate(e.t, &OrganizationUser{OrganizationID: member.ID, UserID: e.owner.ID, Role: "cashier", IsActive: true, DateCreated: now, DateUpdated: now})
+    mustCreate(e.t, &OrganizationUser{OrganizationID: inactive.ID, UserID: e.owner.ID, Role: "manager", IsActive: false, DateCreated: now, DateUpdated: now})
+    e.product("Home product", 1000, 0)
+    return member, inactive, foreign
+}
+
+// productNames lists the products a token sees, with an optional
+// X-Organization-ID header.
+func (e *testEnv) productNames(token, orgHeader string) (int, []string) {
+    e.t.Helper()
+    r := httptest.NewRequest(http.MethodGet, "/api/v1/products", nil)
+    r.Header.Set("Authorization", "Bearer "+token)
+    if orgHeader != "" { r.Header.Set("X-Organization-ID", orgHeader) }
+    w := httptest.NewRecorder()
+    e.router.ServeHTTP(w, r)
+    if w.Code != http.StatusOK { return w.Code, nil }
+    var products []Product
+    if err := json.Unmarshal(w.Body.Bytes(), &products); err != nil { e.t.Fatal(err) }
+    var names []string
+    for _, p := range products { names = append(names, p.Name) }
+    return w.Code, names
+}
+
+func TestOrganizationHeader(t *testing.T) {
+    e := newTestEnv(t)
+    member, inactive, foreign := e.otherOrganizations()
+    id := func(o Organization) string { return strconv.FormatUint(uint64(o.ID), 10) }
+    tests := []struct {
+        name   string
+        header string
+        status int
+        want   []string
+    }{
+        {"session organization", "", http.StatusOK, []string{"Home product"}},
+        {"same organization", id(e.org), http.StatusOK, []string{"Home product"}},
+        {"another membership", id(member), http.StatusOK, []string{"Member product"}},
+        {"inactive membership", id(inactive), http.StatusForbidden, nil},
+        {"not a member", id(foreign), http.StatusForbidden, nil},
+        {"no such organization", "99999", http.StatusForbidden, nil},
+        {"zero", "0", http.StatusBadRequest, nil},
+        {"not a number", "store", http.StatusBadRequest, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            status, names := e.with(t).productNames(e.token, tt.header)
+            if status != tt.status || !reflect.DeepEqual(names, tt.want) { t.Errorf("got %d %v, want %d %v", status, names, tt.status, tt.want) }
+        })
+    }
+
+    // the header also takes the role held there: the owner is a cashier in member
+    r := httptest.NewRequest(http.MethodPost, "/api/v1/products", strings.NewReader(`{"name":"Sneaky","price":1}`))
+    r.Header.Set("Authorization", "Bearer "+e.token)
+    r.Header.Set("Content-Type", "application/json")
+    r.Header.Set("X-Organization-ID", id(member))
+    w := httptest.NewRecorder()
+    e.router.ServeHTTP(w, r)
+    if w.Code != http.StatusForbidden { t.Errorf("cashier creating a product: status %d, want 403", w.Code) }
+}
+
+func TestSwitchOrganization(t *testing.T) {
+    e := newTestEnv(t)
+    member, inactive, foreign := e.otherOrganizations()
+    sid := uint(tokenClaims(t, e.token)["sid"].(float64))
+
+    tests := []struct {
+        name   string
+        org    uint
+        status int
+    }{
+        {"inactive membership", inactive.ID, http.StatusForbidden},
+        {"not a member", foreign.ID, http.StatusForbidden},
+        {"no organization", 0, http.StatusBadRequest},
+        {"member", member.ID, http.StatusOK},
+    }
+    var switched struct {
+        Token        string       `json:"token"`
+        Organization Organization `json:"organization"`
+        Role         string       `json:"role"`
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var v any
+            if tt.status == http.StatusOK { v = &switched }
+            e.with(t).expect(e.do(http.MethodPost, "/auth/switch-organization", map[string]any{"organization_id": tt.org}), tt.status, v)
+            var s AuthSession
+            db.First(&s, sid)
+            want := e.org.ID
+            if tt.status == http.StatusOK { want = tt.org }
+            if s.OrganizationID != want { t.Errorf("session organization = %d, want %d", s.OrganizationID, want) }
+        })
+    }
+    if switched.Organization.ID != member.ID || switched.Role != "cashier" { t.Fatalf("switched = %+v", switched) }
+    claims := tokenClaims(t, switched.Token)
+    if uint(claims["org"].(float64)) != member.ID || uint(claims["sid"].(float64)) != sid { t.Errorf("claims = %v, want org %d in session %d", claims, member.ID, sid) }
+
+    // the new token sees the new organization's data with its role
+    if _, names := e.productNames(switched.Token, ""); !reflect.DeepEqual(names, []string{"Member product"}) { t.Errorf("after switch products = %v", names) }
+    e.expect(e.doAs(switched.Token, http.MethodPost, "/products", map[string]any{"name": "Sneaky", "price": 1}), http.StatusForbidden, nil)
+    // a refresh stays in the organization switched to
+    refresh, err := issueRefreshToken(db, sid)
+    if err != nil { t.Fatal(err) }
+    pair := e.refresh(refresh, http.StatusOK)
+    if uint(tokenClaims(t, pair.Token)["org"].(float64)) != member.ID { t.Error("refresh left the switched organization") }
+    // and switching back restores the old scope
+    e.expect(e.doAs(switched.Token, http.MethodPost, "/auth/switch-organization", map[string]any{"organization_id": e.org.ID}), http.StatusOK, &switched)
+    if _, names := e.productNames(switched.Token, ""); !reflect.DeepEqual(names, []string{"Home product"}) { t.Errorf("after switching back products = %v", names) }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Password policy: a minimum length, bcrypt's 72 byte maximum, not the
+// username, and not on the list of breached passwords bundled with the
+// server (extendable with PASSWORD_BLOCKLIST_FILE). It applies whenever a
+// password is chosen, not to existing ones; users whose password was set
+// by someone else must change it before they can do anything else.
+
+//go:embed common_passwords.txt
+var bundledBlocklist string
+
+const maxPasswordBytes = 72 // bcrypt ignores the rest
+
+var passwordPolicy = struct {
+    MinLength     int  `json:"min_length"`
+    MaxBytes      int  `json:"max_bytes"`
+    CheckBreached bool `json:"check_breached"`
+    blocked       map[string]bool
+}{MinLength: 8, MaxBytes: maxPasswordBytes, CheckBreached: true}
+
+func parseBlocklist(list string, into map[string]bool) {
+    for _, line := range strings.Split(list, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") { continue }
+        into[strings.ToLower(line)] = true
+    }
+}
+
+// loadPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_CHECK_BREACHED and
+// PASSWORD_BLOCKLIST_FILE.
+func loadPasswordPolicy() error {
+    if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > maxPasswordBytes { return fmt.Errorf("bad PASSWORD_MIN_LENGTH %q", v) }
+        passwordPolicy.MinLength = n
+    }
+    if v := os.Getenv("PASSWORD_CHECK_BREACHED"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil { return fmt.Errorf("bad PASSWORD_CHECK_BREACHED %q", v) }
+        passwordPolicy.CheckBreached = b
+    }
+    passwordPolicy.blocked = map[string]bool{}
+    parseBlocklist(bundledBlocklist, passwordPolicy.blocked)
+    if path := os.Getenv("PASSWORD_BLOCKLIST_FILE"); path != "" {
+        b, err := os.ReadFile(path)
+        if err != nil { return err }
+        parseBlocklist(string(b), passwordPolicy.blocked)
+    }
+    return nil
+}
+
+// checkPassword validates a new password for username against the policy.
+func checkPassword(pw, username string) error {
+    if utf8.RuneCountInString(pw) < passwordPolicy.MinLength { return fmt.Errorf("password must be at least %d characters", passwordPolicy.MinLength) }
+    if len(pw) > maxPasswordBytes { return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes) }
+    lower := strings.ToLower(pw)
+    if username != "" && strings.Contains(lower, strings.ToLower(username)) { return errors.New("password must not contain the username") }
+    if passwordPolicy.CheckBreached && passwordPolicy.blocked[lower] { return errors.New("password is too common; choose another") }
+    return nil
+}
+
+// Password handlers
+func getPasswordPolicy(c *gin.Context) {
+    c.JSON(http.StatusOK, passwordPolicy)
+}
+
+// changePassword lets users change their own password. Wrong current
+// passwords count towards the login lockout. Other sessions are signed out.
+func changePassword(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    sid := c.MustGet("sessionID").(uint)
+    var body struct {
+        CurrentPassword string `json:"current_password"`
+        NewPassword     string `json:"new_password"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var user User
+    if err := db.First(&user, uid).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "user not found"}); return }
+    if !checkLoginAllowed(c, user.Username) { return }
+    if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.CurrentPassword)) != nil {
+        recordLoginAttempt(c, user.Username, "bad_password")
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong current password"})
+        return
+    }
+    if err := checkPassword(body.NewPassword, user.Username); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if body.NewPassword == body.CurrentPassword { c.JSON(http.StatusBadRequest, gin.H{"error": "new password must differ from the current one"}); return }
+    hashed, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), bcrypt.DefaultCost)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "hash error"}); return }
+    err = db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Model(&user).Updates(map[string]any{"password": string(hashed), "must_change_password": false, "date_updated": nowISO()}).Error; err != nil { return err }
+        return tx.Model(&AuthSession{}).Where("user_id = ? AND id <> ? AND revoked_at IS NULL", uid, sid).
+            Updates(map[string]any{"revoked_at": nowISO(), "revoke_reason": "password changed"}).Error
+    })
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withPolicy loads the password policy from the given environment and
+// restores the previous one after the test.
+func withPolicy(t *testing.T, env map[string]string) {
+    t.Helper()
+    saved := passwordPolicy
+    t.Cleanup(func() { passwordPolicy = saved })
+    for _, k := range []string{"PASSWORD_MIN_LENGTH", "PASSWORD_CHECK_BREACHED", "PASSWORD_BLOCKLIST_FILE"} { t.Setenv(k, env[k]) }
+    if err := loadPasswordPolicy(); err != nil { t.Fatal(err) }
+}
+
+func TestCheckPassword(t *testing.T) {
+    list := filepath.Join(t.TempDir(), "extra.txt")
+    if err := os.WriteFile(list, []byte("# local leaks\nwarungkopi1\n"), 0o600); err != nil { t.Fatal(err) }
+    cases := []struct {
+        name     string
+        env      map[string]string
+        pw, user string
+        ok       bool
+    }{
+        {"long enough", nil, "kopi susu gula aren", "budi", true},
+        {"too short", nil, "kopi123", "budi", false},
+        {"length counts characters, not bytes", nil, "ééééééé", "budi", false},
+        {"eight characters of two bytes", nil, "éééééééé", "budi", true},
+        {"over bcrypt's 72 bytes", nil, strings.Repeat("é", 37), "budi", false},
+        {"exactly 72 bytes", nil, strings.Repeat("é", 36), "budi", true},
+        {"contains the username", nil, "xxBudi2024xx", "budi", false},
+        {"no username to compare", nil, "xxBudi2024xx", "", true},
+        {"breached", nil, "password", "budi", false},
+        {"breached in another case", nil, "PassWord", "budi", false},
+        {"breached check turned off", map[string]string{"PASSWORD_CHECK_BREACHED": "false"}, "password", "budi", true},
+        {"raised minimum", map[string]string{"PASSWORD_MIN_LENGTH": "12"}, "kopisusu123", "budi", false},
+        {"extra blocklist", map[string]string{"PASSWORD_BLOCKLIST_FILE": list}, "WarungKopi1", "budi", false},
+        {"comments in the blocklist are not entries", map[string]string{"PASSWORD_BLOCKLIST_FILE": list}, "# local leaks", "budi", true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            withPolicy(t, tc.env)
+            if err := checkPassword(tc.pw, tc.user); (err == nil) != tc.ok { t.Errorf("checkPassword(%q, %q) = %v, want ok %v", tc.pw, tc.user, err, tc.ok) }
+        })
+    }
+}
+
+func TestLoadPasswordPolicyRejectsBadSettings(t *testing.T) {
+    for _, env := range []map[string]string{
+        {"PASSWORD_MIN_LENGTH": "0"},
+        {"PASSWORD_MIN_LENGTH": "73"},
+        {"PASSWORD_MIN_LENGTH": "eight"},
+        {"PASSWORD_CHECK_BREACHED": "maybe"},
+        {"PASSWORD_BLOCKLIST_FILE": filepath.Join(t.TempDir(), "missing.txt")},
+    } {
+        saved := passwordPolicy
+        for _, k := range []string{"PASSWORD_MIN_LENGTH", "PASSWORD_CHECK_BREACHED", "PASSWORD_BLOCKLIST_FILE"} { t.Setenv(k, env[k]) }
+        if err := loadPasswordPolicy(); err == nil { t.Errorf("%v: no error", env) }
+        passwordPolicy = saved
+    }
+}
+
+func TestChangePassword(t *testing.T) {
+    e := newTestEnv(t)
+    withPolicy(t, nil)
+    budi, token := e.member("budi", "manager")
+    phone := e.signIn(budi.ID)
+    other := e.signIn(e.owner.ID)
+    if err := db.Model(&User{}).Where("username = ?", "budi").Update("must_change_password", true).Error; err != nil { t.Fatal(err) }
+    e.expect(e.doAs(token, http.MethodGet, "/products", nil), http.StatusForbidden, nil)
+
+    cases := []struct {
+        name         string
+        current, new string
+        want         int
+    }{
+        {"wrong current password", "wrong", "kopi susu gula aren", http.StatusUnauthorized},
+        {"too short", "correct horse battery", "kopi", http.StatusBadRequest},
+        {"breached", "correct horse battery", "password", http.StatusBadRequest},
+        {"contains the username", "correct horse battery", "budi-kopi-susu", http.StatusBadRequest},
+        {"unchanged", "correct horse battery", "correct horse battery", http.StatusBadRequest},
+        {"ok", "correct horse battery", "kopi susu gula aren", http.StatusOK},
+    }
+    for _, tc := range cases {
+        w := e.doAs(token, http.MethodPost, "/auth/password", map[string]any{"current_password": tc.current, "new_password": tc.new})
+        if w.Code != tc.want { t.Errorf("%s: status = %d, want %d (%s)", tc.name, w.Code, tc.want, w.Body) }
+    }
+    e.expect(e.doAs(token, http.MethodGet, "/products", nil), http.StatusOK, nil)
+    e.expect(e.doAs(phone, http.MethodGet, "/products", nil), http.StatusUnauthorized, nil)
+    // the owner's sessions are not the user's and stay open
+    e.expect(e.doAs(other, http.MethodGet, "/products", nil), http.StatusOK, nil)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Access control is by permission. Each route declares the permission it
+// needs and a user's role decides which permissions they hold. The three
+// built-in roles have defaults. An organization can change the manager and
+// cashier defaults and add roles of its own. The owner role always holds
+// every permission so an organization cannot lock itself out.
+var permissionCatalog = []struct {
+    Name        string `json:"name"`
+    Description string `json:"description"`
+}{
+    {"product.read", "View products, prices, barcodes, recipes and promotions"},
+    {"product.write", "Create, edit, archive and import products, their images, barcodes and recipes"},
+    {"product.delete", "Archive or permanently delete products"},
+    {"pricing.write", "Manage price lists, scheduled price changes and scale barcode rules"},
+    {"promotion.write", "Manage promotions and coupons"},
+    {"label.print", "Print shelf labels"},
+    {"label.write", "Manage label templates"},
+    {"customer.read", "View customers"},
+    {"customer.write", "Create and edit customers"},
+    {"transaction.read", "View transactions"},
+    {"transaction.create", "Ring up sales"},
+    {"transaction.void", "Void transactions"},
+    {"inventory.read", "View locations, stock levels, transfers, lots and inventory history"},
+    {"inventory.write", "Adjust stock, transfer stock and receive or write off lots"},
+    {"location.write", "Create and edit locations"},
+    {"report.read", "View sales and inventory reports"},
+    {"settings.read", "View settings"},
+    {"settings.write", "Change settings"},
+    {"organization.write", "Edit the organization profile: name, address, tax ID, logo, currency, timezone and locale"},
+    {"user.manage", "Add users, change their role and reset their password"},
+    {"role.manage", "Change what each role may do"},
+    {"device.manage", "Register and revoke devices for PIN sign-in"},
+}
+
+func knownPermission(p string) bool {
+    for _, e := range permissionCatalog {
+        if e.Name == p { return true }
+    }
+    return false
+}
+
+func allPermissions() []string {
+    out := make([]string, 0, len(permissionCatalog))
+    for _, e := range permissionCatalog { out = append(out, e.Name) }
+    return out
+}
+
+// defaultRolePermissions apply to built-in roles an organization has not
+// customized.
+func defaultRolePermissions(role string) ([]string, bool) {
+    switch role {
+    case "owner":
+        return allPermissions(), true
+    case "manager":
+        var out []string
+        for _, p := range allPermissions() {
+            if p != "role.manage" && p != "device.manage" && p != "organization.write" { out = append(out, p) }
+        }
+        return out, true
+    case "cashier":
+        return []string{"product.read", "label.print", "customer.read", "customer.write", "transaction.read", "transaction.create", "inventory.read", "report.read", "settings.read"}, true
+    }
+    return nil, false
+}
+
+// RolePermissions stores an organization's own permission set for a role,
+// replacing the built-in defaults or defining a new role. For the owner
+// role only RequireTwoFactor is used.
+type RolePermissions struct {
+    OrganizationID   uint     `gorm:"primaryKey;autoIncrement:false" json:"organization_id"`
+    Role             string   `gorm:"primaryKey;size:32" json:"role"`
+    Permissions      []string `gorm:"serializer:json" json:"permissions"`
+    RequireTwoFactor bool     `json:"require_two_factor"`
+    DateUpdated      string   `json:"date_updated"`
+}
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+var errUnknownRole = errors.New("unknown role")
+
+// rolePermissions returns the permissions role holds in the organization.
+func rolePermissions(tx *gorm.DB, orgID uint, role string) ([]string, error) {
+    if role == "owner" { return allPermissions(), nil }
+    var rp RolePermissions
+    err := tx.Where("organization_id = ? AND role = ?", orgID, role).First(&rp).Error
+    if err == nil { return rp.Permissions, nil }
+    if !errors.Is(err, gorm.ErrRecordNotFound) { return nil, err }
+    if perms, ok := defaultRolePermissions(role); ok { return perms, nil }
+    return nil, errUnknownRole
+}
+
+func hasPermission(perms []string, p string) bool {
+    for _, q := range perms {
+        if q == p { return true }
+    }
+    return false
+}
+
+// mayGrant checks that the caller may hand out role, or manage a user who
+// has it: nobody can give or take over permissions they do not hold. It
+// writes the error response when not.
+func mayGrant(c *gin.Context, orgID uint, role string) bool {
+    grant, err := rolePermissions(db, orgID, role)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return false }
+    perms := c.MustGet("permissions").([]string)
+    for _, p := range grant {
+        if !hasPermission(perms, p) { c.JSON(http.StatusForbidden, gin.H{"error": "role " + role + " has permissions you do not: " + p}); return false }
+    }
+    return true
+}
+
+// mayEditRole checks that the caller may change role from the permissions
+// in current to those in next. Only the owner may change their own role,
+// and nobody can edit a role that holds, or would hold, permissions they
+// lack. It writes the error response when not.
+func mayEditRole(c *gin.Context, role string, current, next []string) bool {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    if role == orgUser.Role && role != "owner" { c.JSON(http.StatusForbidden, gin.H{"error": "only the owner can change your own role"}); return false }
+    perms := c.MustGet("permissions").([]string)
+    for _, p := range current {
+        if !hasPermission(perms, p) { c.JSON(http.StatusForbidden, gin.H{"error": "role " + role + " has permissions you do not: " + p}); return false }
+    }
+    for _, p := range next {
+        if !hasPermission(perms, p) { c.JSON(http.StatusForbidden, gin.H{"error": "you cannot grant a permission you do not have: " + p}); return false }
+    }
+    return true
+}
+
+// sessionPermissions is what the request may do: the user's role, cut
+// down to cashier permissions in a PIN session.
+func sessionPermissions(c *gin.Context, orgUser OrganizationUser) ([]string, error) {
+    perms, err := rolePermissions(db, orgUser.OrganizationID, orgUser.Role)
+    if err != nil { return nil, err }
+    if _, pin := c.Get("deviceID"); pin { perms = cashierPermissions(orgUser.OrganizationID, perms) }
+    return perms, nil
+}
+
+// requirePermission guards a route. It runs after authMiddleware and leaves
+// the caller's permissions in the context as "permissions".
+func requirePermission(perm string) gin.HandlerFunc {
+    if !knownPermission(perm) { panic("unknown permission " + perm) }
+    return func(c *gin.Context) {
+        v, ok := c.Get("orgUser")
+        if !ok {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "no organization"})
+            return
+        }
+        orgUser := v.(OrganizationUser)
+        perms, err := sessionPermissions(c, orgUser)
+        if err != nil || !hasPermission(perms, perm) {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing permission", "permission": perm})
+            return
+        }
+        var u User
+        if err := db.Select("id, totp_enabled, must_change_password").First(&u, orgUser.UserID).Error; err != nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+            return
+        }
+        if u.MustChangePassword {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "change your password at POST /auth/password first", "password_change_required": true})
+            return
+        }
+        if !u.TOTPEnabled && roleRequiresTwoFactor(db, orgUser.OrganizationID, orgUser.Role) {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "your role requires two-factor authentication; enroll at POST /auth/2fa/setup", "two_factor_setup_required": true})
+            return
+        }
+        c.Set("permissions", perms)
+        c.Next()
+    }
+}
+
+// Permission handlers
+func myPermissions(c *gin.Context) {
+    v, ok := c.Get("orgUser")
+    if !ok { c.JSON(http.StatusForbidden, gin.H{"error": "no organization"}); return }
+    orgUser := v.(OrganizationUser)
+    perms, err := sessionPermissions(c, orgUser)
+    if err != nil { perms = []string{} }
+    c.JSON(http.StatusOK, gin.H{"role": orgUser.Role, "permissions": perms})
+}
+
+func listPermissions(c *gin.Context) {
+    c.JSON(http.StatusOK, permissionCatalog)
+}
+
+type roleInfo struct {
+    Name        string   `json:"name"`
+    BuiltIn     bool     `json:"built_in"`
+    Customized  bool     `json:"customized"`
+    Permissions []string `json:"permissions"`
+    RequireTwoFactor bool `json:"require_two_factor"`
+    Users       int64    `json:"users"`
+}
+
+func orgRoles(tx *gorm.DB, orgID uint) []roleInfo {
+    var custom []RolePermissions
+    tx.Where("organization_id = ?", orgID).Find(&custom)
+    byName := map[string]RolePermissions{}
+    for _, rp := range custom { byName[rp.Role] = rp }
+    names := []string{"owner", "manager", "cashier"}
+    for _, rp := range custom {
+        if _, builtIn := defaultRolePermissions(rp.Role); !builtIn { names = append(names, rp.Role) }
+    }
+    sort.Strings(names[3:])
+    out := make([]roleInfo, 0, len(names))
+    for _, n := range names {
+        r := roleInfo{Name: n}
+        _, r.BuiltIn = defaultRolePermissions(n)
+        rp, ok := byName[n]
+        r.Customized = ok && n != "owner"
+        r.RequireTwoFactor = rp.RequireTwoFactor
+        r.Permissions, _ = rolePermissions(tx, orgID, n)
+        tx.Model(&OrganizationUser{}).Where("organization_id = ? AND role = ?", orgID, n).Count(&r.Users)
+        out = append(out, r)
+    }
+    return out
+}
+
+func listRoles(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    c.JSON(http.StatusOK, orgRoles(db, orgUser.OrganizationID))
+}
+
+// putRole sets a role's permissions and whether it requires two-factor
+// authentication, creating the role if it is new. Omitted fields keep
+// their current value.
+func putRole(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    role := c.Param("role")
+    if !roleNamePattern.MatchString(role) { c.JSON(http.StatusBadRequest, gin.H{"error": "role names are 1-32 lower-case letters, digits, - or _"}); return }
+    var body struct {
+        Permissions      *[]string `json:"permissions"`
+        RequireTwoFactor *bool     `json:"require_two_factor"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if role == "owner" && body.Permissions != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "the owner role always has every permission"}); return }
+    rp := RolePermissions{OrganizationID: orgUser.OrganizationID, Role: role, Permissions: []string{}}
+    if err := db.Where("organization_id = ? AND role = ?", orgUser.OrganizationID, role).First(&rp).Error; err != nil {
+        // not stored yet: start from the defaults
+        rp.Permissions, _ = defaultRolePermissions(role)
+        if body.Permissions == nil && rp.Permissions == nil { c.JSON(http.StatusBadRequest, gin.H{"error": "permissions required for a new role"}); return }
+    }
+    current := rp.Permissions
+    if role == "owner" { current = allPermissions() }
+    if body.Permissions != nil {
+        perms := []string{}
+        seen := map[string]bool{}
+        for _, p := range *body.Permissions {
+            if !knownPermission(p) { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown permission " + p}); return }
+            if !seen[p] { seen[p] = true; perms = append(perms, p) }
+        }
+        sort.Strings(perms)
+        rp.Permissions = perms
+    }
+    if !mayEditRole(c, role, current, rp.Permissions) { return }
+    if body.RequireTwoFactor != nil { rp.RequireTwoFactor = *body.RequireTwoFactor }
+    if role == "owner" { rp.Permissions = []string{} }
+    rp.DateUpdated = nowISO()
+    if err := db.Save(&rp).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, rp)
+}
+
+// deleteRole removes a custom role, or puts a built-in one back to its
+// defaults.
+func deleteRole(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    role := c.Param("role")
+    current, err := rolePermissions(db, orgUser.OrganizationID, role)
+    if err != nil && !errors.Is(err, errUnknownRole) { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    defaults, builtIn := defaultRolePermissions(role)
+    if !mayEditRole(c, role, current, defaults) { return }
+    if !builtIn {
+        var n int64
+        db.Model(&OrganizationUser{}).Where("organization_id = ? AND role = ?", orgUser.OrganizationID, role).Count(&n)
+        if n > 0 { c.JSON(http.StatusConflict, gin.H{"error": "role is assigned to users"}); return }
+    }
+    res := db.Where("organization_id = ? AND role = ?", orgUser.OrganizationID, role).Delete(&RolePermissions{})
+    if res.Error != nil { c.JSON(http.StatusBadRequest, gin.H{"error": res.Error.Error()}); return }
+    c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPutRoleCannotEscalate(t *testing.T) {
+    e := newTestEnv(t)
+    now := nowISO()
+    mustCreate(t, &RolePermissions{OrganizationID: e.org.ID, Role: "supervisor", Permissions: []string{"role.manage", "product.read", "transaction.read", "report.read"}, DateUpdated: now})
+    _, supervisor := e.member("sup", "supervisor")
+    _, manager := e.member("mgr", "manager")
+
+    tests := []struct {
+        name   string
+        token  string
+        method string
+        role   string
+        body   map[string]any
+        want   int
+    }{
+        {"own role", supervisor, http.MethodPut, "supervisor", map[string]any{"permissions": []string{"role.manage", "product.read"}}, http.StatusForbidden},
+        {"grant a permission not held", supervisor, http.MethodPut, "auditor", map[string]any{"permissions": []string{"product.read", "user.manage"}}, http.StatusForbidden},
+        {"edit a role holding more", supervisor, http.MethodPut, "cashier", map[string]any{"permissions": []string{"product.read"}}, http.StatusForbidden},
+        {"reset a role holding more", supervisor, http.MethodDelete, "manager", nil, http.StatusForbidden},
+        {"owner role", supervisor, http.MethodPut, "owner", map[string]any{"require_two_factor": true}, http.StatusForbidden},
+        {"new role within own permissions", supervisor, http.MethodPut, "auditor", map[string]any{"permissions": []string{"product.read", "report.read"}}, http.StatusOK},
+        {"owner edits any role", e.token, http.MethodPut, "manager", map[string]any{"permissions": []string{"product.read", "role.manage"}}, http.StatusOK},
+        {"manager cannot reset own role", manager, http.MethodDelete, "manager", nil, http.StatusForbidden},
+        {"owner edits own role", e.token, http.MethodPut, "owner", map[string]any{"require_two_factor": true}, http.StatusOK},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) { e.with(t).expect(e.doAs(tt.token, tt.method, "/roles/"+tt.role, tt.body), tt.want, nil) })
+    }
+}
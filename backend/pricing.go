@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PriceList is a named set of per-product prices, e.g. wholesale or member.
+// Products without an entry on a list sell at their base Product.Price.
+type PriceList struct {
+    ID             uint   `gorm:"primaryKey" json:"id"`
+    OrganizationID uint   `gorm:"index" json:"organization_id"`
+    Name           string `json:"name"`
+    Code           string `json:"code"` // retail, wholesale, member, ...
+    DateCreated    string `json:"date_created"`
+    DateUpdated    string `json:"date_updated"`
+}
+
+type PriceListItem struct {
+    PriceListID uint    `gorm:"primaryKey" json:"price_list_id"`
+    ProductID   uint    `gorm:"primaryKey" json:"product_id"`
+    Price       float64 `json:"price"`
+    DateUpdated string  `json:"date_updated"`
+}
+
+// ScheduledPriceChange sets a product's base price (PriceListID nil) or its
+// price on a list once EffectiveAt has passed. EffectiveAt is RFC3339 UTC so
+// it compares lexically.
+type ScheduledPriceChange struct {
+    ID             uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID uint    `gorm:"index" json:"organization_id"`
+    ProductID      uint    `gorm:"index" json:"product_id"`
+    PriceListID    *uint   `json:"price_list_id"`
+    NewPrice       float64 `json:"new_price"`
+    EffectiveAt    string  `gorm:"index" json:"effective_at"`
+    Status         string  `json:"status"` // pending, applied, cancelled
+    UserID         uint    `json:"user_id"`
+    DateApplied    *string `json:"date_applied"`
+    DateCreated    string  `json:"date_created"`
+}
+
+type PriceHistory struct {
+    ID             uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID uint    `gorm:"index" json:"organization_id"`
+    ProductID      uint    `gorm:"index" json:"product_id"`
+    PriceListID    *uint   `json:"price_list_id"`
+    OldPrice       float64 `json:"old_price"`
+    NewPrice       float64 `json:"new_price"`
+    UserID         uint    `json:"user_id"`
+    Source         string  `json:"source"` // manual, schedule, import
+    DateCreated    string  `json:"date_created"`
+}
+
+func recordPriceChange(tx *gorm.DB, orgID, productID uint, priceListID *uint, oldPrice, newPrice float64, userID uint, source string) error {
+    if oldPrice == newPrice { return nil }
+    h := PriceHistory{OrganizationID: orgID, ProductID: productID, PriceListID: priceListID, OldPrice: oldPrice, NewPrice: newPrice, UserID: userID, Source: source, DateCreated: nowISO()}
+    return tx.Create(&h).Error
+}
+
+// setListPrice upserts a product's price on a list and records the change.
+func setListPrice(tx *gorm.DB, orgID, priceListID, productID uint, price float64, userID uint, source string) error {
+    var old PriceListItem
+    oldPrice := 0.0
+    if err := tx.Where("price_list_id = ? AND product_id = ?", priceListID, productID).First(&old).Error; err == nil {
+        oldPrice = old.Price
+    } else if !errors.Is(err, gorm.ErrRecordNotFound) {
+        return err
+    }
+    item := PriceListItem{PriceListID: priceListID, ProductID: productID, Price: price, DateUpdated: nowISO()}
+    if err := tx.Save(&item).Error; err != nil { return err }
+    return recordPriceChange(tx, orgID, productID, &priceListID, oldPrice, price, userID, source)
+}
+
+// priceAt resolves what a product costs on a price list (nil for the base
+// price) at a point in time, including scheduled changes due by then. A
+// product that is not on the list sells at its base price.
+func priceAt(tx *gorm.DB, p Product, priceListID *uint, at time.Time) float64 {
+    due := func(listID *uint) (float64, bool) {
+        q := tx.Where("organization_id = ? AND product_id = ? AND status = ? AND effective_at <= ?", p.OrganizationID, p.ID, "pending", at.UTC().Format(time.RFC3339))
+        if listID != nil { q = q.Where("price_list_id = ?", *listID) } else { q = q.Where("price_list_id IS NULL") }
+        var ch ScheduledPriceChange
+        if err := q.Order("effective_at desc, id desc").First(&ch).Error; err != nil { return 0, false }
+        return ch.NewPrice, true
+    }
+    if priceListID != nil {
+        if price, ok := due(priceListID); ok { return price }
+        var item PriceListItem
+        if err := tx.Where("price_list_id = ? AND product_id = ?", *priceListID, p.ID).First(&item).Error; err == nil { return item.Price }
+    }
+    if price, ok := due(nil); ok { return price }
+    return p.Price
+}
+
+// priceCart prices a cart's items at a point in time, as checkout and its
+// previews do. Each item gets its quantity in the product's unit and its
+// unit price filled in; the subtotal and promotion lines are returned.
+func priceCart(tx *gorm.DB, orgID uint, items []TransactionItem, priceListID *uint, at time.Time) (float64, []cartLine, error) {
+    subtotal := 0.0
+    lines := make([]cartLine, 0, len(items))
+    for i := range items {
+        var p Product
+        if err := tx.Scopes(notArchived).Where("id = ? AND organization_id = ?", items[i].ProductID, orgID).First(&p).Error; err != nil { return 0, nil, errors.New("unknown product") }
+        qty, err := saleQuantity(items[i], p)
+        if err != nil { return 0, nil, err }
+        items[i].Quantity = qty
+        items[i].Unit = p.Unit
+        items[i].PriceAtTransaction = priceAt(tx, p, priceListID, at)
+        subtotal += lineTotal(items[i].PriceAtTransaction, qty)
+        lines = append(lines, cartLine{ProductID: p.ID, Category: p.Category, Quantity: qty, UnitPrice: items[i].PriceAtTransaction})
+    }
+    return subtotal, lines, nil
+}
+
+// applyDuePriceChanges applies every pending scheduled change whose time has
+// come, oldest first.
+func applyDuePriceChanges() error {
+    var due []ScheduledPriceChange
+    if err := db.Where("status = ? AND effective_at <= ?", "pending", time.Now().UTC().Format(time.RFC3339)).Order("effective_at asc, id asc").Find(&due).Error; err != nil { return err }
+    for _, ch := range due {
+        err := db.Transaction(func(tx *gorm.DB) error {
+            // re-check under lock so concurrent runs apply each change once
+            var cur ScheduledPriceChange
+            if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cur, ch.ID).Error; err != nil { return err }
+            if cur.Status != "pending" { return nil }
+            // a deleted product's change is dropped; an archived one's waits
+            // until the product is restored
+            var p Product
+            err := tx.Where("id = ? AND organization_id = ?", cur.ProductID, cur.OrganizationID).First(&p).Error
+            if errors.Is(err, gorm.ErrRecordNotFound) { return tx.Model(&cur).Update("status", "cancelled").Error }
+            if err != nil { return err }
+            if p.ArchivedAt != nil { return nil }
+            if cur.PriceListID != nil {
+                if err := setListPrice(tx, cur.OrganizationID, *cur.PriceListID, cur.ProductID, cur.NewPrice, cur.UserID, "schedule"); err != nil { return err }
+            } else {
+                if err := tx.Model(&p).Updates(map[string]any{"price": cur.NewPrice, "version": gorm.Expr("version + 1"), "date_updated": nowISO()}).Error; err != nil { return err }
+                if err := recordPriceChange(tx, cur.OrganizationID, cur.ProductID, nil, p.Price, cur.NewPrice, cur.UserID, "schedule"); err != nil { return err }
+            }
+            now := nowISO()
+            return tx.Model(&cur).Updates(map[string]any{"status": "applied", "date_applied": now}).Error
+        })
+        if err != nil { log.Printf("pricing: apply scheduled change %d failed: %v", ch.ID, err) }
+    }
+    return nil
+}
+
+// runPriceScheduler applies due price changes every minute.
+func runPriceScheduler() {
+    for {
+        if err := applyDuePriceChanges(); err != nil { log.Printf("pricing: %v", err) }
+        time.Sleep(time.Minute)
+    }
+}
+
+// Price list handlers
+func listPriceLists(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var lists []PriceList
+    db.Where("organization_id = ?", orgUser.OrganizationID).Order("name asc").Find(&lists)
+    c.JSON(http.StatusOK, lists)
+}
+
+func createPriceList(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        Name string `json:"name"`
+        Code string `json:"code"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.Name == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    now := nowISO()
+    pl := PriceList{OrganizationID: orgUser.OrganizationID, Name: body.Name, Code: body.Code, DateCreated: now, DateUpdated: now}
+    if err := db.Create(&pl).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, pl)
+}
+
+func updatePriceList(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var pl PriceList
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&pl).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    var body struct {
+        Name string `json:"name"`
+        Code string `json:"code"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.Name == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    pl.Name = body.Name
+    pl.Code = body.Code
+    pl.DateUpdated = nowISO()
+    if err := db.Save(&pl).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, pl)
+}
+
+func deletePriceList(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    err := db.Transaction(func(tx *gorm.DB) error {
+        res := tx.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).Delete(&PriceList{})
+        if res.Error != nil { return res.Error }
+        if res.RowsAffected == 0 { return gorm.ErrRecordNotFound }
+        if err := tx.Where("price_list_id = ?", id).Delete(&PriceListItem{}).Error; err != nil { return err }
+        if err := tx.Model(&ScheduledPriceChange{}).Where("price_list_id = ? AND status = ?", id, "pending").Update("status", "cancelled").Error; err != nil { return err }
+        return tx.Model(&Customer{}).Where("price_list_id = ?", id).Update("price_list_id", nil).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.Status(http.StatusNoContent)
+}
+
+func listPriceListItems(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    type itemRes struct {
+        ProductID   uint    `json:"product_id"`
+        ProductName string  `json:"product_name"`
+        BasePrice   float64 `json:"base_price"`
+        Price       float64 `json:"price"`
+        DateUpdated string  `json:"date_updated"`
+    }
+    var rows []itemRes
+    db.Raw(`
+        SELECT pli.product_id, p.name as product_name, p.price as base_price, pli.price, pli.date_updated
+        FROM price_list_items pli
+        JOIN price_lists pl ON pl.id = pli.price_list_id
+        JOIN products p ON p.id = pli.product_id
+        WHERE pli.price_list_id = ? AND pl.organization_id = ?
+        ORDER BY p.name ASC`, id, orgUser.OrganizationID).Scan(&rows)
+    c.JSON(http.StatusOK, rows)
+}
+
+func putPriceListItem(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    productID, _ := strconv.Atoi(c.Param("productId"))
+    var body struct{ Price float64 `json:"price"` }
+    if err := c.BindJSON(&body); err != nil || body.Price < 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    err := db.Transaction(func(tx *gorm.DB) error {
+        var pl PriceList
+        if err := tx.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&pl).Error; err != nil { return err }
+        var p Product
+        if err := tx.Where("id = ? AND organization_id = ?", productID, orgUser.OrganizationID).First(&p).Error; err != nil { return err }
+        return setListPrice(tx, orgUser.OrganizationID, pl.ID, p.ID, body.Price, uid, "manual")
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, gin.H{"price_list_id": id, "product_id": productID, "price": body.Price})
+}
+
+func deletePriceListItem(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    productID, _ := strconv.Atoi(c.Param("productId"))
+    var pl PriceList
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&pl).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    if err := db.Where("price_list_id = ? AND product_id = ?", pl.ID, productID).Delete(&PriceListItem{}).Error; err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// Scheduled price change handlers
+func listPriceChanges(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    q := db.Where("organization_id = ?", orgUser.OrganizationID)
+    if status := c.Query("status"); status != "" { q = q.Where("status = ?", status) }
+    if pid := c.Query("product_id"); pid != "" { q = q.Where("product_id = ?", pid) }
+    var changes []ScheduledPriceChange
+    q.Order("effective_at asc, id asc").Find(&changes)
+    c.JSON(http.StatusOK, changes)
+}
+
+func schedulePriceChange(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        ProductID   uint    `json:"product_id"`
+        PriceListID *uint   `json:"price_list_id"`
+        NewPrice    float64 `json:"new_price"`
+        EffectiveAt string  `json:"effective_at"`
+    }
+    if err := c.BindJSON(&body); err != nil || body.NewPrice < 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    at, err := time.Parse(time.RFC3339, body.EffectiveAt)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "effective_at must be RFC3339"}); return }
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", body.ProductID, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "product not found"}); return
+    }
+    if body.PriceListID != nil {
+        var pl PriceList
+        if err := db.Where("id = ? AND organization_id = ?", *body.PriceListID, orgUser.OrganizationID).First(&pl).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "price list not found"}); return
+        }
+    }
+    ch := ScheduledPriceChange{OrganizationID: orgUser.OrganizationID, ProductID: p.ID, PriceListID: body.PriceListID, NewPrice: body.NewPrice, EffectiveAt: at.UTC().Format(time.RFC3339), Status: "pending", UserID: uid, DateCreated: nowISO()}
+    if err := db.Create(&ch).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, ch)
+}
+
+func cancelPriceChange(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    res := db.Model(&ScheduledPriceChange{}).Where("id = ? AND organization_id = ? AND status = ?", id, orgUser.OrganizationID, "pending").Update("status", "cancelled")
+    if res.Error != nil { c.JSON(http.StatusBadRequest, gin.H{"error": res.Error.Error()}); return }
+    if res.RowsAffected == 0 { c.JSON(http.StatusNotFound, gin.H{"error": "no pending change"}); return }
+    c.Status(http.StatusNoContent)
+}
+
+func productPriceHistory(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var history []PriceHistory
+    db.Where("organization_id = ? AND product_id = ?", orgUser.OrganizationID, id).Order("id desc").Find(&history)
+    c.JSON(http.StatusOK, history)
+}
+
+// productPrice returns the effective price of a product for an optional
+// customer or price list, at ?at= (RFC3339, default now).
+func productPrice(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    at := time.Now()
+    if s := c.Query("at"); s != "" {
+        t, err := time.Parse(time.RFC3339, s)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "at must be RFC3339"}); return }
+        at = t
+    }
+    var priceListID *uint
+    if s := c.Query("price_list_id"); s != "" {
+        var pl PriceList
+        if err := db.Where("id = ? AND organization_id = ?", s, orgUser.OrganizationID).First(&pl).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "price list not found"}); return
+        }
+        priceListID = &pl.ID
+    } else if s := c.Query("customer_id"); s != "" {
+        var cu Customer
+        if err := db.Where("id = ? AND organization_id = ?", s, orgUser.OrganizationID).First(&cu).Error; err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"}); return
+        }
+        priceListID = cu.PriceListID
+    }
+    c.JSON(http.StatusOK, gin.H{"product_id": p.ID, "price_list_id": priceListID, "price": priceAt(db, p, priceListID, at), "at": at.Format(time.RFC3339)})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPriceAt(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 0)
+    unlisted := e.product("Coffee", 7000, 0)
+    now := nowISO()
+    wholesale := PriceList{OrganizationID: e.org.ID, Name: "Wholesale", Code: "wholesale", DateCreated: now, DateUpdated: now}
+    member := PriceList{OrganizationID: e.org.ID, Name: "Member", Code: "member", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &wholesale)
+    mustCreate(t, &member)
+    mustCreate(t, &PriceListItem{PriceListID: wholesale.ID, ProductID: p.ID, Price: 4000, DateUpdated: now})
+    mustCreate(t, &PriceListItem{PriceListID: member.ID, ProductID: p.ID, Price: 4500, DateUpdated: now})
+
+    base := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+    schedule := func(list *uint, price float64, at time.Time) {
+        mustCreate(t, &ScheduledPriceChange{OrganizationID: e.org.ID, ProductID: p.ID, PriceListID: list, NewPrice: price, EffectiveAt: at.Format(time.RFC3339), Status: "pending", DateCreated: now})
+    }
+    schedule(nil, 5500, base)
+    schedule(nil, 6000, base.Add(48*time.Hour))
+    schedule(&wholesale.ID, 3800, base.Add(24*time.Hour))
+
+    tests := []struct {
+        name    string
+        product Product
+        list    *uint
+        at      time.Time
+        want    float64
+    }{
+        {"base before any change", p, nil, base.Add(-time.Minute), 5000},
+        {"base change due", p, nil, base, 5500},
+        {"latest due base change wins", p, nil, base.Add(72 * time.Hour), 6000},
+        {"due change in another zone", p, nil, base.In(time.FixedZone("WIB", 7*3600)), 5500},
+        {"list price", p, &wholesale.ID, base, 4000},
+        {"list change due", p, &wholesale.ID, base.Add(24 * time.Hour), 3800},
+        {"list without changes", p, &member.ID, base.Add(72 * time.Hour), 4500},
+        {"not on the list sells at base", unlisted, &wholesale.ID, base, 7000},
+    }
+    for _, tt := range tests {
+        if got := priceAt(db, tt.product, tt.list, tt.at); got != tt.want { t.Errorf("%s: priceAt = %v, want %v", tt.name, got, tt.want) }
+    }
+}
+
+func TestProductPriceForeignPriceList(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 0)
+    now := nowISO()
+    otherOrg := Organization{Name: "Other", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &otherOrg)
+    foreign := PriceList{OrganizationID: otherOrg.ID, Name: "Theirs", Code: "wholesale", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &foreign)
+    mustCreate(t, &PriceListItem{PriceListID: foreign.ID, ProductID: p.ID, Price: 1, DateUpdated: now})
+
+    e.expect(e.do(http.MethodGet, fmt.Sprintf("/products/%d/price?price_list_id=%d", p.ID, foreign.ID), nil), http.StatusNotFound, nil)
+    var res struct{ Price float64 `json:"price"` }
+    e.expect(e.do(http.MethodGet, fmt.Sprintf("/products/%d/price", p.ID), nil), http.StatusOK, &res)
+    if res.Price != 5000 { t.Fatalf("price = %v, want 5000", res.Price) }
+}
+
+func TestApplyDuePriceChanges(t *testing.T) {
+    e := newTestEnv(t)
+    now := nowISO()
+    list := PriceList{OrganizationID: e.org.ID, Name: "Wholesale", Code: "wholesale", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &list)
+    past := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+    future := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+
+    tests := []struct {
+        name       string
+        archived   bool
+        deleted    bool
+        list       *uint
+        effective  string
+        wantStatus string
+        wantPrice  float64
+    }{
+        {name: "due", effective: past, wantStatus: "applied", wantPrice: 6000},
+        {name: "due on a price list", list: &list.ID, effective: past, wantStatus: "applied", wantPrice: 6000},
+        {name: "not yet due", effective: future, wantStatus: "pending", wantPrice: 5000},
+        {name: "archived product waits", archived: true, effective: past, wantStatus: "pending", wantPrice: 5000},
+        {name: "archived product list price waits", archived: true, list: &list.ID, effective: past, wantStatus: "pending", wantPrice: 5000},
+        {name: "deleted product", deleted: true, effective: past, wantStatus: "cancelled"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p := e.product(tt.name, 5000, 0)
+            if tt.list != nil { mustCreate(t, &PriceListItem{PriceListID: *tt.list, ProductID: p.ID, Price: 5000, DateUpdated: now}) }
+            ch := ScheduledPriceChange{OrganizationID: e.org.ID, ProductID: p.ID, PriceListID: tt.list, NewPrice: 6000, EffectiveAt: tt.effective, Status: "pending", DateCreated: now}
+            mustCreate(t, &ch)
+            if tt.archived { db.Model(&p).Update("archived_at", now) }
+            if tt.deleted { db.Delete(&p) }
+
+            if err := applyDuePriceChanges(); err != nil { t.Fatal(err) }
+            db.First(&ch, ch.ID)
+            if ch.Status != tt.wantStatus { t.Errorf("status = %q, want %q", ch.Status, tt.wantStatus) }
+            if tt.deleted { return }
+            price := p.Price
+            if tt.list != nil {
+                var item PriceListItem
+                db.Where("price_list_id = ? AND product_id = ?", *tt.list, p.ID).First(&item)
+                price = item.Price
+            } else {
+                db.First(&p, p.ID)
+                price = p.Price
+            }
+            if price != tt.wantPrice { t.Errorf("price = %v, want %v", price, tt.wantPrice) }
+        })
+    }
+
+    // an archived product's change applies once it is restored
+    var waiting ScheduledPriceChange
+    db.Where("status = ?", "pending").Where("effective_at = ?", past).First(&waiting)
+    e.expect(e.do(http.MethodPost, fmt.Sprintf("/products/%d/restore", waiting.ProductID), nil), http.StatusOK, nil)
+    if err := applyDuePriceChanges(); err != nil { t.Fatal(err) }
+    db.First(&waiting, waiting.ID)
+    if waiting.Status != "applied" { t.Errorf("after restore status = %q, want applied", waiting.Status) }
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Column order for product import and export files.
+var productColumns = []string{"name", "price", "sku", "icon", "stock", "category", "unit"}
+
+const (
+    maxImportSize = 10 << 20
+    maxImportRows = 10000
+)
+
+var errTooManyRows = fmt.Errorf("file has more than %d rows", maxImportRows)
+
+var errImportConflict = errors.New("product was changed during the import; try again")
+
+type importRowError struct {
+    Row    int    `json:"row"`
+    Column string `json:"column,omitempty"`
+    Error  string `json:"error"`
+}
+
+type importRow struct {
+    Row      int
+    Name     string
+    Price    float64
+    SKU      *string
+    Icon     *string
+    Stock    *float64 // nil leaves an existing product's stock unchanged
+    Category *string
+    Unit     *string // nil keeps an existing product's unit, new ones get pcs
+    Columns  map[string]bool // the file's columns; absent ones leave existing products unchanged
+}
+
+// readImportRows reads the uploaded CSV or XLSX file, picking the format by
+// file extension and falling back to CSV.
+func readImportRows(filename string, data []byte) ([][]string, error) {
+    if strings.EqualFold(filepath.Ext(filename), ".xlsx") {
+        return readXLSXRows(data)
+    }
+    r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+    r.FieldsPerRecord = -1
+    r.TrimLeadingSpace = true
+    var records [][]string
+    for {
+        rec, err := r.Read()
+        if err == io.EOF { return records, nil }
+        if err != nil { return nil, err }
+        if len(records) > maxImportRows { return nil, errTooManyRows }
+        records = append(records, rec)
+    }
+}
+
+// parseImportRows maps the header row to known columns and validates each
+// data row. Row numbers are 1-based file lines, header included.
+func parseImportRows(records [][]string) ([]importRow, []importRowError) {
+    if len(records) == 0 { return nil, []importRowError{{Row: 1, Error: "file is empty"}} }
+    index := map[string]int{}
+    for i, h := range records[0] { index[strings.ToLower(strings.TrimSpace(h))] = i }
+    if _, ok := index["name"]; !ok { return nil, []importRowError{{Row: 1, Column: "name", Error: "missing required column"}} }
+    if _, ok := index["price"]; !ok { return nil, []importRowError{{Row: 1, Column: "price", Error: "missing required column"}} }
+
+    columns := map[string]bool{}
+    for col := range index { columns[col] = true }
+    var rows []importRow
+    var errs []importRowError
+    seenSKU := map[string]int{} // lower case, as the unique index compares them
+    for n, rec := range records[1:] {
+        line := n + 2
+        get := func(col string) string {
+            i, ok := index[col]
+            if !ok || i >= len(rec) { return "" }
+            return strings.TrimSpace(rec[i])
+        }
+        optional := func(col string) *string {
+            v := get(col)
+            if v == "" { return nil }
+            return &v
+        }
+        blank := true
+        for _, v := range rec { if strings.TrimSpace(v) != "" { blank = false; break } }
+        if blank { continue }
+
+        row := importRow{Row: line, Name: get("name"), SKU: optional("sku"), Icon: optional("icon"), Category: optional("category"), Unit: optional("unit"), Columns: columns}
+        if row.Name == "" { errs = append(errs, importRowError{Row: line, Column: "name", Error: "required"}) }
+        if row.Unit != nil && !validUnit(strings.ToLower(*row.Unit)) {
+            errs = append(errs, importRowError{Row: line, Column: "unit", Error: "unknown unit"})
+        } else if row.Unit != nil {
+            u := strings.ToLower(*row.Unit)
+            row.Unit = &u
+        }
+        price, err := strconv.ParseFloat(get("price"), 64)
+        if err != nil || price < 0 {
+            errs = append(errs, importRowError{Row: line, Column: "price", Error: "must be a non-negative number"})
+        }
+        row.Price = price
+        if s := get("stock"); s != "" {
+            stock, err := strconv.ParseFloat(s, 64)
+            if err != nil { errs = append(errs, importRowError{Row: line, Column: "stock", Error: "must be a number"}) }
+            stock = roundQuantity(stock)
+            row.Stock = &stock
+        }
+        if row.SKU != nil {
+            key := strings.ToLower(*row.SKU)
+            if prev, dup := seenSKU[key]; dup {
+                errs = append(errs, importRowError{Row: line, Column: "sku", Error: fmt.Sprintf("duplicate of row %d", prev)})
+            }
+            seenSKU[key] = line
+        }
+        rows = append(rows, row)
+    }
+    return rows, errs
+}
+
+// importProducts validates a product file and, unless dry_run=true, applies
+// it in one database transaction. Rows with a SKU update the organization's
+// product with that SKU; other rows create new products.
+func importProducts(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    fh, err := c.FormFile("file")
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"}); return }
+    if fh.Size > maxImportSize { c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"}); return }
+    f, err := fh.Open()
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    defer f.Close()
+    data, err := io.ReadAll(io.LimitReader(f, maxImportSize))
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    records, err := readImportRows(fh.Filename, data)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    rows, rowErrs := parseImportRows(records)
+    dryRun := c.Query("dry_run") == "true"
+
+    created, updated := 0, 0
+    var skuRow importRow
+    if len(rowErrs) == 0 {
+        errRollback := errors.New("dry run")
+        err = db.Transaction(func(tx *gorm.DB) error {
+            now := nowISO()
+            for _, row := range rows {
+                var p Product
+                found := false
+                if row.SKU != nil {
+                    // locked so sales wait rather than have their stock written over
+                    err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("organization_id = ? AND sku = ?", orgUser.OrganizationID, *row.SKU).First(&p).Error
+                    if err == nil { found = true } else if !errors.Is(err, gorm.ErrRecordNotFound) { return err }
+                }
+                unit := p.Unit
+                if row.Unit != nil { unit = *row.Unit } else if unit == "" { unit = defaultUnit }
+                if row.Stock != nil && *row.Stock != 0 {
+                    if err := checkQuantity(math.Abs(*row.Stock), unit); err != nil {
+                        rowErrs = append(rowErrs, importRowError{Row: row.Row, Column: "stock", Error: err.Error()})
+                        continue
+                    }
+                }
+                oldPrice := p.Price
+                if found {
+                    // only the file's columns change, and only if nobody
+                    // wrote the product since it was read; re-importing an
+                    // archived product brings it back
+                    updates := map[string]any{"name": row.Name, "price": row.Price, "unit": unit, "archived_at": nil, "date_updated": now, "version": gorm.Expr("version + 1")}
+                    if row.Columns["icon"] { updates["icon"] = row.Icon }
+                    if row.Columns["category"] { updates["category"] = row.Category }
+                    res := tx.Model(&Product{}).Where("id = ? AND version = ?", p.ID, p.Version).Updates(updates)
+                    if res.Error != nil { return fmt.Errorf("row %d: %w", row.Row, res.Error) }
+                    if res.RowsAffected == 0 { return fmt.Errorf("row %d: %w", row.Row, errImportConflict) }
+                    if err := tx.First(&p, p.ID).Error; err != nil { return err }
+                } else {
+                    p = Product{OrganizationID: orgUser.OrganizationID, UserID: uid, Name: row.Name, Price: row.Price, SKU: row.SKU, Icon: row.Icon, Category: row.Category, Unit: unit, Version: 1, DateCreated: now, DateUpdated: now}
+                    if err := tx.Create(&p).Error; err != nil {
+                        if errors.Is(err, gorm.ErrDuplicatedKey) { skuRow = row }
+                        return fmt.Errorf("row %d: %w", row.Row, err)
+                    }
+                }
+                if err := indexProduct(tx, p); err != nil { return err }
+                if row.Stock != nil {
+                    if d := roundQuantity(*row.Stock - p.StockQuantity); d != 0 {
+                        if err := importStock(tx, p, d, uid); err != nil { return err }
+                    }
+                }
+                if found {
+                    if err := recordPriceChange(tx, p.OrganizationID, p.ID, nil, oldPrice, p.Price, uid, "import"); err != nil { return err }
+                }
+                if found { updated++ } else { created++ }
+            }
+            if dryRun || len(rowErrs) > 0 { return errRollback }
+            return nil
+        })
+        if errors.Is(err, gorm.ErrDuplicatedKey) {
+            // lost a race with another write of the same SKU
+            c.JSON(http.StatusConflict, gin.H{"error": "SKU is already in use", "errors": []importRowError{{Row: skuRow.Row, Column: "sku", Error: "already in use"}}})
+            return
+        }
+        if errors.Is(err, errImportConflict) { c.JSON(http.StatusConflict, gin.H{"error": err.Error()}); return }
+        if err != nil && !errors.Is(err, errRollback) { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    }
+
+    status := http.StatusOK
+    if len(rowErrs) > 0 { status = http.StatusUnprocessableEntity }
+    c.JSON(status, gin.H{
+        "dry_run": dryRun,
+        "applied": !dryRun && len(rowErrs) == 0,
+        "rows": len(rows),
+        "created": created,
+        "updated": updated,
+        "errors": rowErrs,
+    })
+}
+
+// importStock books the change an import makes to a product's stock count
+// at the organization's default location.
+func importStock(tx *gorm.DB, p Product, delta float64, userID uint) error {
+    m := InventoryMovement{OrganizationID: p.OrganizationID, ProductID: p.ID, LocationID: defaultLocationID(tx, p.OrganizationID), UserID: userID, Reason: "adjustment", Note: "import", DateCreated: nowISO()}
+    if m.LocationID == nil {
+        if err := addProductStock(tx, p.OrganizationID, p.ID, delta); err != nil { return err }
+    } else if err := adjustLocationStock(tx, p.OrganizationID, *m.LocationID, p.ID, delta); err != nil {
+        return err
+    }
+    if delta < 0 { return depleteLots(tx, -delta, m) }
+    m.Quantity = delta
+    return tx.Create(&m).Error
+}
+
+// exportProducts downloads the organization's catalog in the import format.
+func exportProducts(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var products []Product
+    db.Scopes(notArchived).Where("organization_id = ?", orgUser.OrganizationID).Order("name asc").Find(&products)
+
+    deref := func(s *string) string { if s == nil { return "" }; return *s }
+    records := [][]string{productColumns}
+    for _, p := range products {
+        records = append(records, []string{p.Name, strconv.FormatFloat(p.Price, 'f', -1, 64), deref(p.SKU), deref(p.Icon), strconv.FormatFloat(p.StockQuantity, 'f', -1, 64), deref(p.Category), p.Unit})
+    }
+
+    var buf bytes.Buffer
+    switch c.DefaultQuery("format", "csv") {
+    case "csv":
+        w := csv.NewWriter(&buf)
+        _ = w.WriteAll(records)
+        c.Header("Content-Disposition", `attachment; filename="products.csv"`)
+        c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+    case "xlsx":
+        if err := writeXLSX(&buf, records, map[int]bool{1: true, 4: true}); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+        c.Header("Content-Disposition", `attachment; filename="products.xlsx"`)
+        c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", buf.Bytes())
+    default:
+        c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or xlsx"})
+    }
+}
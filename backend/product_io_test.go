@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// zipParts builds a zip file from name/content pairs.
+func zipParts(t *testing.T, parts ...string) []byte {
+    t.Helper()
+    var buf bytes.Buffer
+    zw := zip.NewWriter(&buf)
+    for i := 0; i < len(parts); i += 2 {
+        w, err := zw.Create(parts[i])
+        if err != nil { t.Fatal(err) }
+        if _, err := w.Write([]byte(parts[i+1])); err != nil { t.Fatal(err) }
+    }
+    if err := zw.Close(); err != nil { t.Fatal(err) }
+    return buf.Bytes()
+}
+
+func sheetXML(rows string) string {
+    return `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` + rows + `</sheetData></worksheet>`
+}
+
+func TestReadXLSXRows(t *testing.T) {
+    var exported bytes.Buffer
+    if err := writeXLSX(&exported, [][]string{{"name", "price"}, {"Tea & Milk", "5000"}}, map[int]bool{1: true}); err != nil { t.Fatal(err) }
+
+    // A workbook whose first sheet lives in sheet2.xml, as when a user
+    // reorders or deletes sheets.
+    reordered := zipParts(t,
+        "xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Products" sheetId="2" r:id="rId7"/><sheet name="Old" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+        "xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId7" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="/xl/worksheets/sheet2.xml"/><Relationship Id="rId9" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/sharedStrings" Target="strings.xml"/></Relationships>`,
+        "xl/strings.xml", `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><si><t>name</t></si><si><r><t>Kopi </t></r><r><t>Susu</t></r></si></sst>`,
+        "xl/worksheets/sheet1.xml", sheetXML(`<row><c r="A1" t="inlineStr"><is><t>wrong sheet</t></is></c></row>`),
+        "xl/worksheets/sheet2.xml", sheetXML(`<row><c r="A1" t="s"><v>0</v></c></row><row><c r="A2" t="s"><v>1</v></c><c r="C2"><v>12</v></c></row>`),
+    )
+
+    tests := []struct {
+        name    string
+        data    []byte
+        want    [][]string
+        wantErr string
+    }{
+        {name: "exported", data: exported.Bytes(), want: [][]string{{"name", "price"}, {"Tea & Milk", "5000"}}},
+        {name: "first sheet by workbook order", data: reordered, want: [][]string{{"name"}, {"Kopi Susu", "", "12"}}},
+        {name: "not a zip", data: []byte("name,price"), wantErr: "not a valid xlsx"},
+        {name: "no workbook", data: zipParts(t, "xl/worksheets/sheet1.xml", sheetXML("")), wantErr: "no workbook"},
+        {name: "column out of range", data: zipParts(t,
+            "xl/workbook.xml", `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet r:id="rId1"/></sheets></workbook>`,
+            "xl/_rels/workbook.xml.rels", `<Relationships><Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+            "xl/worksheets/sheet1.xml", sheetXML(`<row><c r="ZZZZZZ1"><v>1</v></c></row>`)), wantErr: "bad cell reference"},
+        {name: "too many rows", data: zipParts(t,
+            "xl/workbook.xml", `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet r:id="rId1"/></sheets></workbook>`,
+            "xl/_rels/workbook.xml.rels", `<Relationships><Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+            "xl/worksheets/sheet1.xml", sheetXML(strings.Repeat("<row/>", maxImportRows+2))), wantErr: "more than"},
+        {name: "part too large", data: zipParts(t,
+            "xl/workbook.xml", `<workbook>`+strings.Repeat(" ", maxXLSXPartSize)+`</workbook>`), wantErr: "too large"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := readXLSXRows(tt.data)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) { t.Fatalf("err = %v, want %q", err, tt.wantErr) }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            if !reflect.DeepEqual(got, tt.want) { t.Fatalf("rows = %q, want %q", got, tt.want) }
+        })
+    }
+}
+
+func (e *testEnv) importFile(query, filename, content string) *httptest.ResponseRecorder {
+    e.t.Helper()
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    fw, err := mw.CreateFormFile("file", filename)
+    if err != nil { e.t.Fatal(err) }
+    fw.Write([]byte(content))
+    mw.Close()
+    r := httptest.NewRequest(http.MethodPost, "/api/v1/products/import"+query, &body)
+    r.Header.Set("Content-Type", mw.FormDataContentType())
+    r.Header.Set("Authorization", "Bearer "+e.token)
+    w := httptest.NewRecorder()
+    e.router.ServeHTTP(w, r)
+    return w
+}
+
+func TestImportStock(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Rice", 10000, 0)
+    db.Model(&p).Update("sku", "RICE")
+    lot := e.addLot(p, e.loc.ID, "L1", "2026-04-01", 8)
+
+    // fractional stock is refused for pcs and accepted for kg
+    var res struct {
+        Errors []importRowError `json:"errors"`
+    }
+    e.expect(e.importFile("", "p.csv", "name,price,sku,stock,unit\nRice,10000,RICE,2.5,\nSugar,15000,SUGAR,2.5,kg\n"), http.StatusUnprocessableEntity, &res)
+    if len(res.Errors) != 1 || res.Errors[0].Row != 2 || res.Errors[0].Column != "stock" { t.Fatalf("errors = %+v", res.Errors) }
+    if got := orgTotal(t, p.ID); got != 8 { t.Fatalf("total after refused import = %v, want 8", got) }
+
+    e.expect(e.importFile("", "p.csv", "name,price,sku,stock,unit\nRice,10000,RICE,3,\nSugar,15000,SUGAR,2.5,kg\n"), http.StatusOK, nil)
+    if got := orgTotal(t, p.ID); got != 3 { t.Errorf("rice total = %v, want 3", got) }
+    if got := stockAt(t, p.ID, e.loc.ID); got != 3 { t.Errorf("rice at default location = %v, want 3", got) }
+    if r := lotRemaining(t, lot.ID); r != 3 { t.Errorf("rice lot remaining = %v, want 3", r) }
+    var sugar Product
+    db.Where("sku = ?", "SUGAR").First(&sugar)
+    if got := stockAt(t, sugar.ID, e.loc.ID); got != 2.5 || sugar.StockQuantity != 2.5 { t.Errorf("sugar stock %v at location %v, want 2.5", sugar.StockQuantity, got) }
+}
+
+func TestImportRowLimit(t *testing.T) {
+    e := newTestEnv(t)
+    var csv strings.Builder
+    csv.WriteString("name,price\n")
+    for i := 0; i <= maxImportRows; i++ { fmt.Fprintf(&csv, "P%d,1\n", i) }
+    e.expect(e.importFile("?dry_run=true", "p.csv", csv.String()), http.StatusBadRequest, nil)
+}
+
+// An import changes only the columns in the file, and never writes the
+// stock it did not book.
+func TestImportUpdatesFileColumns(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 5)
+    if err := db.Model(&p).Updates(map[string]any{"sku": "TEA", "icon": "☕", "category": "Drinks"}).Error; err != nil { t.Fatal(err) }
+    tests := []struct {
+        name         string
+        file         string
+        status       int
+        icon, cat    *string
+        price, stock float64
+    }{
+        {"icon and category absent", "name,price,sku\nTea,6000,TEA\n", http.StatusOK, ptr("☕"), ptr("Drinks"), 6000, 5},
+        {"category only", "name,price,sku,category\nTea,6500,TEA,Hot drinks\n", http.StatusOK, ptr("☕"), ptr("Hot drinks"), 6500, 5},
+        {"empty cells clear", "name,price,sku,icon,category\nTea,6500,TEA,,\n", http.StatusOK, nil, nil, 6500, 5},
+        {"stock is booked", "name,price,sku,stock\nTea,6500,TEA,9\n", http.StatusOK, nil, nil, 6500, 9},
+        {"sku matched whatever its case in the file", "name,price,sku\nTea,7000,TEA\nTea again,7000,tea\n", http.StatusUnprocessableEntity, nil, nil, 6500, 9},
+    }
+    for _, tt := range tests {
+        var before Product
+        db.First(&before, p.ID)
+        e.expect(e.importFile("", "p.csv", tt.file), tt.status, nil)
+        var got Product
+        db.First(&got, p.ID)
+        str := func(s *string) string { if s == nil { return "<nil>" }; return *s }
+        if str(got.Icon) != str(tt.icon) || str(got.Category) != str(tt.cat) { t.Errorf("%s: icon %s category %s, want %s %s", tt.name, str(got.Icon), str(got.Category), str(tt.icon), str(tt.cat)) }
+        if got.Price != tt.price || got.StockQuantity != tt.stock { t.Errorf("%s: price %v stock %v, want %v %v", tt.name, got.Price, got.StockQuantity, tt.price, tt.stock) }
+        if tt.status == http.StatusOK && got.Version <= before.Version { t.Errorf("%s: version %d not bumped from %d", tt.name, got.Version, before.Version) }
+    }
+}
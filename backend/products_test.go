@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestArchiveAndRestoreProduct(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 0)
+    names := func(query string) []string {
+        var products []Product
+        e.expect(e.do(http.MethodGet, "/products"+query, nil), http.StatusOK, &products)
+        var out []string
+        for _, p := range products { out = append(out, p.Name) }
+        return out
+    }
+
+    e.expect(e.do(http.MethodDelete, fmt.Sprintf("/products/%d", p.ID), nil), http.StatusNoContent, nil)
+    if got := names(""); len(got) != 0 { t.Errorf("listed after archiving: %v", got) }
+    if got := names("?archived=true"); len(got) != 1 || got[0] != "Tea" { t.Errorf("archived = %v, want [Tea]", got) }
+    // archived products can't be sold
+    e.expect(e.do(http.MethodPost, "/transactions", map[string]any{
+        "amount_received": 5000, "items": []map[string]any{{"product_id": p.ID, "quantity": 1}},
+    }), http.StatusBadRequest, nil)
+
+    var restored Product
+    e.expect(e.do(http.MethodPost, fmt.Sprintf("/products/%d/restore", p.ID), nil), http.StatusOK, &restored)
+    if restored.ArchivedAt != nil || restored.Version != 3 { t.Errorf("restored = archived_at %v, version %d; want nil, 3", restored.ArchivedAt, restored.Version) }
+    if got := names(""); len(got) != 1 { t.Errorf("listed after restoring: %v", got) }
+    e.expect(e.do(http.MethodPost, fmt.Sprintf("/products/%d/restore", p.ID), nil), http.StatusNotFound, nil)
+}
+
+func TestHardDeleteProduct(t *testing.T) {
+    e := newTestEnv(t)
+    now := nowISO()
+    tests := []struct {
+        name   string
+        setup  func(p Product)
+        status int
+    }{
+        {"unused", func(p Product) {}, http.StatusNoContent},
+        {"archived", func(p Product) { db.Model(&p).Update("archived_at", now) }, http.StatusNoContent},
+        {"sold", func(p Product) {
+            mustCreate(t, &TransactionItem{TransactionID: 1, ProductID: p.ID, Quantity: 1, PriceAtTransaction: p.Price, DateCreated: now, DateUpdated: now})
+        }, http.StatusConflict},
+        {"ingredient", func(p Product) {
+            latte := e.product("Latte", 20000, 0)
+            mustCreate(t, &RecipeItem{OrganizationID: e.org.ID, ProductID: latte.ID, IngredientID: p.ID, Quantity: 0.2, DateCreated: now})
+        }, http.StatusConflict},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p := e.product("Milk "+tt.name, 1000, 5)
+            tt.setup(p)
+            mustCreate(t, &ProductBarcode{OrganizationID: e.org.ID, ProductID: p.ID, Code: "BC-" + tt.name, Multiplier: 1, DateCreated: now})
+            mustCreate(t, &ScheduledPriceChange{OrganizationID: e.org.ID, ProductID: p.ID, NewPrice: 1200, EffectiveAt: "2099-01-01T00:00:00Z", Status: "pending", DateCreated: now})
+
+            e.with(t).expect(e.do(http.MethodDelete, fmt.Sprintf("/products/%d?hard=true", p.ID), nil), tt.status, nil)
+            deleted := tt.status == http.StatusNoContent
+            var n int64
+            db.Model(&Product{}).Where("id = ?", p.ID).Count(&n)
+            if (n == 0) != deleted { t.Errorf("product rows = %d, deleted = %v", n, deleted) }
+            for _, model := range []any{&ProductBarcode{}, &ProductStock{}, &ScheduledPriceChange{}} {
+                db.Model(model).Where("product_id = ?", p.ID).Count(&n)
+                if (n == 0) != deleted { t.Errorf("%T rows = %d, deleted = %v", model, n, deleted) }
+            }
+        })
+    }
+}
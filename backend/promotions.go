@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Promotion is a server-side discount rule evaluated at checkout.
+//
+//   - buy_x_get_y: buying BuyQuantity of ProductID gets FreeQuantity more free
+//   - bundle: the Items together sell for BundlePrice
+//   - category_percent: Percent off every product in Category
+//
+// Any rule can be limited to a date range, a daily time window (happy hour,
+// may cross midnight) and days of the week.
+type Promotion struct {
+    ID             uint            `gorm:"primaryKey" json:"id"`
+    OrganizationID uint            `gorm:"index" json:"organization_id"`
+    Name           string          `json:"name"`
+    Type           string          `json:"type"`
+    IsActive       bool            `json:"is_active"`
+    Priority       int             `json:"priority"` // higher is evaluated first
+    ProductID      *uint           `json:"product_id"`
+    BuyQuantity    int             `json:"buy_quantity"`
+    FreeQuantity   int             `json:"free_quantity"`
+    BundlePrice    float64         `json:"bundle_price"`
+    Category       *string         `json:"category"`
+    Percent        float64         `json:"percent"`
+    StartDate      *string         `json:"start_date"` // YYYY-MM-DD, inclusive
+    EndDate        *string         `json:"end_date"`
+    StartTime      *string         `json:"start_time"` // HH:MM
+    EndTime        *string         `json:"end_time"`
+    DaysOfWeek     string          `json:"days_of_week"` // e.g. "1,2,3,4,5" (0 = Sunday); empty for every day
+    Items          []PromotionItem `gorm:"foreignKey:PromotionID" json:"items"`
+    DateCreated    string          `json:"date_created"`
+    DateUpdated    string          `json:"date_updated"`
+}
+
+// PromotionItem is one component of a bundle.
+type PromotionItem struct {
+    ID          uint `gorm:"primaryKey" json:"id"`
+    PromotionID uint `gorm:"index" json:"promotion_id"`
+    ProductID   uint `json:"product_id"`
+    Quantity    int  `json:"quantity"`
+}
+
+// TransactionPromotion records a promotion applied to a sale.
+type TransactionPromotion struct {
+    ID             uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID uint    `gorm:"index" json:"organization_id"`
+    TransactionID  uint    `gorm:"index" json:"transaction_id"`
+    PromotionID    uint    `gorm:"index" json:"promotion_id"`
+    Name           string  `json:"name"`
+    Discount       float64 `json:"discount"`
+    DateCreated    string  `json:"date_created"`
+}
+
+const (
+    promoBuyXGetY        = "buy_x_get_y"
+    promoBundle          = "bundle"
+    promoCategoryPercent = "category_percent"
+)
+
+// cartLine is one priced line of a cart being evaluated.
+type cartLine struct {
+    ProductID uint
+    Category  *string
+    Quantity  float64 // in the product's unit
+    UnitPrice float64
+}
+
+type appliedPromotion struct {
+    PromotionID uint    `json:"promotion_id"`
+    Name        string  `json:"name"`
+    Discount    float64 `json:"discount"`
+}
+
+func validatePromotion(p *Promotion) error {
+    if p.Name == "" { return errors.New("name is required") }
+    switch p.Type {
+    case promoBuyXGetY:
+        if p.ProductID == nil || p.BuyQuantity <= 0 || p.FreeQuantity <= 0 { return errors.New("buy_x_get_y needs product_id, buy_quantity and free_quantity") }
+    case promoBundle:
+        if len(p.Items) < 1 || p.BundlePrice < 0 { return errors.New("bundle needs items and a bundle_price") }
+        for _, it := range p.Items {
+            if it.Quantity <= 0 { return errors.New("bundle item quantity must be positive") }
+        }
+    case promoCategoryPercent:
+        if p.Category == nil || *p.Category == "" || p.Percent <= 0 || p.Percent > 100 { return errors.New("category_percent needs category and a percent in (0, 100]") }
+    default:
+        return errors.New("type must be buy_x_get_y, bundle or category_percent")
+    }
+    for _, d := range []*string{p.StartDate, p.EndDate} {
+        if d == nil { continue }
+        if _, err := time.Parse(dateLayout, *d); err != nil { return errors.New("dates must be YYYY-MM-DD") }
+    }
+    for _, t := range []*string{p.StartTime, p.EndTime} {
+        if t == nil { continue }
+        if _, err := time.Parse("15:04", *t); err != nil { return errors.New("times must be HH:MM") }
+    }
+    if (p.StartTime == nil) != (p.EndTime == nil) { return errors.New("start_time and end_time go together") }
+    for _, d := range strings.Split(p.DaysOfWeek, ",") {
+        if d = strings.TrimSpace(d); d == "" { continue }
+        if n, err := strconv.Atoi(d); err != nil || n < 0 || n > 6 { return errors.New("days_of_week must be numbers 0-6") }
+    }
+    return nil
+}
+
+// activeAt reports whether the promotion's date range, time window and days
+// of the week include at.
+func (p Promotion) activeAt(at time.Time) bool {
+    if !p.IsActive { return false }
+    day := at.Format(dateLayout)
+    if p.StartDate != nil && day < *p.StartDate { return false }
+    if p.EndDate != nil && day > *p.EndDate { return false }
+    if p.DaysOfWeek != "" {
+        match := false
+        for _, d := range strings.Split(p.DaysOfWeek, ",") {
+            if n, err := strconv.Atoi(strings.TrimSpace(d)); err == nil && n == int(at.Weekday()) { match = true }
+        }
+        if !match { return false }
+    }
+    if p.StartTime != nil && p.EndTime != nil {
+        now := at.Format("15:04")
+        if *p.StartTime <= *p.EndTime {
+            return now >= *p.StartTime && now < *p.EndTime
+        }
+        return now >= *p.StartTime || now < *p.EndTime
+    }
+    return true
+}
+
+// evaluatePromotions applies promotions to a cart by priority. Each unit is
+// discounted by at most one promotion.
+func evaluatePromotions(promos []Promotion, lines []cartLine, at time.Time) []appliedPromotion {
+    lines = mergeCartLines(lines)
+    sort.SliceStable(promos, func(i, j int) bool {
+        if promos[i].Priority != promos[j].Priority { return promos[i].Priority > promos[j].Priority }
+        return promos[i].ID < promos[j].ID
+    })
+    remaining := make([]float64, len(lines))
+    for i, l := range lines { remaining[i] = l.Quantity }
+    find := func(productID uint) int {
+        for i, l := range lines {
+            if l.ProductID == productID { return i }
+        }
+        return -1
+    }
+    var applied []appliedPromotion
+    for _, p := range promos {
+        if !p.activeAt(at) { continue }
+        discount := 0.0
+        switch p.Type {
+        case promoBuyXGetY:
+            i := find(*p.ProductID)
+            if i < 0 { continue }
+            sets := math.Floor(remaining[i] / float64(p.BuyQuantity+p.FreeQuantity))
+            discount = sets * float64(p.FreeQuantity) * lines[i].UnitPrice
+            remaining[i] -= sets * float64(p.BuyQuantity+p.FreeQuantity)
+        case promoBundle:
+            n := math.Inf(1)
+            normal := 0.0
+            idx := make([]int, len(p.Items))
+            for k, it := range p.Items {
+                idx[k] = find(it.ProductID)
+                if idx[k] < 0 { n = 0; break }
+                if m := math.Floor(remaining[idx[k]] / float64(it.Quantity)); m < n { n = m }
+                normal += float64(it.Quantity) * lines[idx[k]].UnitPrice
+            }
+            if n == 0 || normal <= p.BundlePrice { continue }
+            discount = n * (normal - p.BundlePrice)
+            for k, it := range p.Items { remaining[idx[k]] -= n * float64(it.Quantity) }
+        case promoCategoryPercent:
+            for i, l := range lines {
+                if l.Category == nil || !strings.EqualFold(*l.Category, *p.Category) || remaining[i] == 0 { continue }
+                discount += remaining[i] * l.UnitPrice * p.Percent / 100
+                remaining[i] = 0
+            }
+        }
+        if discount > 0 {
+            applied = append(applied, appliedPromotion{PromotionID: p.ID, Name: p.Name, Discount: math.Round(discount*100) / 100})
+        }
+    }
+    return applied
+}
+
+// mergeCartLines adds up lines of the same product, so a product scanned
+// twice counts towards its promotions once with the total quantity. A merged
+// line is priced at the lowest of its unit prices.
+func mergeCartLines(lines []cartLine) []cartLine {
+    merged := make([]cartLine, 0, len(lines))
+    index := map[uint]int{}
+    for _, l := range lines {
+        i, ok := index[l.ProductID]
+        if !ok {
+            index[l.ProductID] = len(merged)
+            merged = append(merged, l)
+            continue
+        }
+        merged[i].Quantity = roundQuantity(merged[i].Quantity + l.Quantity)
+        merged[i].UnitPrice = min(merged[i].UnitPrice, l.UnitPrice)
+    }
+    return merged
+}
+
+// loadPromotions returns the organization's active promotions with items.
+func loadPromotions(tx *gorm.DB, orgID uint) []Promotion {
+    var promos []Promotion
+    tx.Preload("Items").Where("organization_id = ? AND is_active = ?", orgID, true).Find(&promos)
+    return promos
+}
+
+// Promotion handlers
+func listPromotions(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var promos []Promotion
+    db.Preload("Items").Where("organization_id = ?", orgUser.OrganizationID).Order("priority desc, id asc").Find(&promos)
+    c.JSON(http.StatusOK, promos)
+}
+
+func createPromotion(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    p := Promotion{IsActive: true}
+    if err := c.BindJSON(&p); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if err := validatePromotion(&p); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    now := nowISO()
+    p.ID = 0
+    p.OrganizationID = orgUser.OrganizationID
+    p.DateCreated = now
+    p.DateUpdated = now
+    for i := range p.Items { p.Items[i].ID = 0 }
+    if err := db.Create(&p).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusCreated, p)
+}
+
+func updatePromotion(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var existing Promotion
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&existing).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    var p Promotion
+    if err := c.BindJSON(&p); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if err := validatePromotion(&p); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    p.ID = existing.ID
+    p.OrganizationID = existing.OrganizationID
+    p.DateCreated = existing.DateCreated
+    p.DateUpdated = nowISO()
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Where("promotion_id = ?", p.ID).Delete(&PromotionItem{}).Error; err != nil { return err }
+        for i := range p.Items {
+            p.Items[i].ID = 0
+            p.Items[i].PromotionID = p.ID
+        }
+        if len(p.Items) > 0 {
+            if err := tx.Create(&p.Items).Error; err != nil { return err }
+        }
+        return tx.Omit("Items").Save(&p).Error
+    })
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, p)
+}
+
+func deletePromotion(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    // Deactivate rather than delete so reports keep the promotion
+    res := db.Model(&Promotion{}).Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).Updates(map[string]any{"is_active": false, "date_updated": nowISO()})
+    if res.Error != nil { c.JSON(http.StatusBadRequest, gin.H{"error": res.Error.Error()}); return }
+    if res.RowsAffected == 0 { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return }
+    c.Status(http.StatusNoContent)
+}
+
+// evaluateCart previews checkout pricing and promotions for a cart.
+func evaluateCart(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var body struct {
+        CustomerID  *uint             `json:"customer_id"`
+        PriceListID *uint             `json:"price_list_id"`
+        Items       []TransactionItem `json:"items"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    if body.CustomerID != nil && body.PriceListID == nil {
+        var cu Customer
+        if err := db.Where("id = ? AND organization_id = ?", *body.CustomerID, orgUser.OrganizationID).First(&cu).Error; err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "unknown customer"}); return }
+        body.PriceListID = cu.PriceListID
+    }
+    at := time.Now().In(orgTimezone(orgUser.OrganizationID))
+    subtotal, lines, err := priceCart(db, orgUser.OrganizationID, body.Items, body.PriceListID, at)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    applied := evaluatePromotions(loadPromotions(db, orgUser.OrganizationID), lines, at)
+    discount := 0.0
+    for _, a := range applied { discount += a.Discount }
+    c.JSON(http.StatusOK, gin.H{"subtotal": subtotal, "discount_amount": discount, "total_amount": subtotal - discount, "promotions": applied})
+}
+
+// promotionReport summarizes uses and total discount per promotion between
+// ?from= and ?to= (YYYY-MM-DD in the organization's timezone, default the
+// last 30 days).
+func promotionReport(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    loc := orgTimezone(orgUser.OrganizationID)
+    from := c.DefaultQuery("from", time.Now().In(loc).AddDate(0, 0, -30).Format(dateLayout))
+    to := c.DefaultQuery("to", time.Now().In(loc).Format(dateLayout))
+    start, end, err := localDayRange(from, to, loc)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    type res struct {
+        PromotionID   uint    `json:"promotionId"`
+        Name          string  `json:"name"`
+        Uses          int     `json:"uses"`
+        TotalDiscount float64 `json:"totalDiscount"`
+        Revenue       float64 `json:"revenue"`
+    }
+    var rows []res
+    db.Raw(`
+        SELECT tp.promotion_id, MAX(tp.name) as name, COUNT(tp.id) as uses,
+               SUM(tp.discount) as total_discount, SUM(t.total_amount) as revenue
+        FROM transaction_promotions tp
+        JOIN transactions t ON t.id = tp.transaction_id
+        WHERE tp.organization_id = ? AND t.transaction_date >= ? AND t.transaction_date < ?
+        GROUP BY tp.promotion_id
+        ORDER BY total_discount DESC`, orgUser.OrganizationID, start, end).Scan(&rows)
+    c.JSON(http.StatusOK, rows)
+}
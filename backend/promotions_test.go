@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestEvaluatePromotions(t *testing.T) {
+    drinks := ptr("Drinks")
+    tea := cartLine{ProductID: 1, Category: drinks, Quantity: 1, UnitPrice: 5000}
+    coffee := cartLine{ProductID: 2, Category: drinks, Quantity: 1, UnitPrice: 8000}
+    bread := cartLine{ProductID: 3, Quantity: 1, UnitPrice: 12000}
+    qty := func(l cartLine, q float64) cartLine { l.Quantity = q; return l }
+
+    buy2get1 := Promotion{ID: 1, Name: "Tea 2+1", Type: promoBuyXGetY, IsActive: true, ProductID: ptr(uint(1)), BuyQuantity: 2, FreeQuantity: 1}
+    breakfast := Promotion{ID: 2, Name: "Breakfast", Type: promoBundle, IsActive: true, Priority: 10, BundlePrice: 15000,
+        Items: []PromotionItem{{ProductID: 2, Quantity: 1}, {ProductID: 3, Quantity: 1}}}
+    drinks10 := Promotion{ID: 3, Name: "Drinks 10%", Type: promoCategoryPercent, IsActive: true, Category: ptr("drinks"), Percent: 10}
+    happyHour := drinks10
+    happyHour.ID, happyHour.Name, happyHour.StartTime, happyHour.EndTime = 4, "Late", ptr("22:00"), ptr("02:00")
+    weekdays := drinks10
+    weekdays.ID, weekdays.Name, weekdays.DaysOfWeek = 5, "Weekdays", "1,2,3,4,5"
+    june := drinks10
+    june.ID, june.Name, june.StartDate, june.EndDate = 6, "June", ptr("2026-06-01"), ptr("2026-06-30")
+
+    wib := time.FixedZone("WIB", 7*3600)
+    monday := time.Date(2026, 6, 1, 10, 0, 0, 0, wib)
+    sunday := time.Date(2026, 6, 7, 10, 0, 0, 0, wib)
+
+    tests := []struct {
+        name   string
+        promos []Promotion
+        lines  []cartLine
+        at     time.Time
+        want   []appliedPromotion
+    }{
+        {"buy 2 get 1", []Promotion{buy2get1}, []cartLine{qty(tea, 3)}, monday, []appliedPromotion{{1, "Tea 2+1", 5000}}},
+        {"buy 2 get 1 twice", []Promotion{buy2get1}, []cartLine{qty(tea, 7)}, monday, []appliedPromotion{{1, "Tea 2+1", 10000}}},
+        {"buy 2 get 1 over separate lines", []Promotion{buy2get1}, []cartLine{tea, bread, qty(tea, 2)}, monday, []appliedPromotion{{1, "Tea 2+1", 5000}}},
+        {"not enough for the free item", []Promotion{buy2get1}, []cartLine{qty(tea, 2)}, monday, nil},
+        {"bundle", []Promotion{breakfast}, []cartLine{coffee, bread}, monday, []appliedPromotion{{2, "Breakfast", 5000}}},
+        {"bundle from separate lines", []Promotion{breakfast}, []cartLine{coffee, bread, coffee, bread}, monday, []appliedPromotion{{2, "Breakfast", 10000}}},
+        {"bundle incomplete", []Promotion{breakfast}, []cartLine{qty(coffee, 2)}, monday, nil},
+        {"category percent", []Promotion{drinks10}, []cartLine{qty(tea, 2), coffee, bread}, monday, []appliedPromotion{{3, "Drinks 10%", 1800}}},
+        {"units go to the higher priority first", []Promotion{drinks10, breakfast}, []cartLine{qty(coffee, 2), bread}, monday,
+            []appliedPromotion{{2, "Breakfast", 5000}, {3, "Drinks 10%", 800}}},
+        {"time window across midnight", []Promotion{happyHour}, []cartLine{tea}, time.Date(2026, 6, 1, 1, 30, 0, 0, wib), []appliedPromotion{{4, "Late", 500}}},
+        {"outside time window", []Promotion{happyHour}, []cartLine{tea}, time.Date(2026, 6, 1, 2, 0, 0, 0, wib), nil},
+        {"weekday", []Promotion{weekdays}, []cartLine{tea}, monday, []appliedPromotion{{5, "Weekdays", 500}}},
+        {"not on sunday", []Promotion{weekdays}, []cartLine{tea}, sunday, nil},
+        {"last day of the range", []Promotion{june}, []cartLine{tea}, time.Date(2026, 6, 30, 23, 59, 0, 0, wib), []appliedPromotion{{6, "June", 500}}},
+        {"after the range", []Promotion{june}, []cartLine{tea}, time.Date(2026, 7, 1, 0, 0, 0, 0, wib), nil},
+        {"inactive", []Promotion{func() Promotion { p := drinks10; p.IsActive = false; return p }()}, []cartLine{tea}, monday, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := evaluatePromotions(tt.promos, tt.lines, tt.at); !reflect.DeepEqual(got, tt.want) { t.Fatalf("got %+v, want %+v", got, tt.want) }
+        })
+    }
+}
+
+func TestMergeCartLines(t *testing.T) {
+    got := mergeCartLines([]cartLine{{ProductID: 1, Quantity: 1, UnitPrice: 5000}, {ProductID: 2, Quantity: 0.25, UnitPrice: 100}, {ProductID: 1, Quantity: 2, UnitPrice: 4500}, {ProductID: 2, Quantity: 0.5, UnitPrice: 100}})
+    want := []cartLine{{ProductID: 1, Quantity: 3, UnitPrice: 4500}, {ProductID: 2, Quantity: 0.75, UnitPrice: 100}}
+    if !reflect.DeepEqual(got, want) { t.Fatalf("got %+v, want %+v", got, want) }
+}
+
+// Promotion and coupon dates are days in the organization's timezone, not
+// the server's.
+func TestCheckoutUsesOrganizationDay(t *testing.T) {
+    for _, zone := range []string{"Pacific/Kiritimati", "Pacific/Pago_Pago"} {
+        t.Run(zone, func(t *testing.T) {
+            e := newTestEnv(t).with(t)
+            if err := db.Model(&e.org).Update("timezone", zone).Error; err != nil { t.Fatal(err) }
+            loc, _ := time.LoadLocation(zone)
+            today := time.Now().In(loc)
+            tea := e.product("Tea", 5000, 10)
+            if err := db.Model(&tea).Update("category", "Drinks").Error; err != nil { t.Fatal(err) }
+            day := func(d int) *string { return ptr(today.AddDate(0, 0, d).Format(dateLayout)) }
+            tests := []struct {
+                name  string
+                start *string
+                end   *string
+                want  bool
+            }{
+                {"today", day(0), day(0), true},
+                {"ended yesterday", day(-1), day(-1), false},
+                {"starts tomorrow", day(1), day(1), false},
+            }
+            for i, tt := range tests {
+                promo := Promotion{OrganizationID: e.org.ID, Name: tt.name, Type: promoCategoryPercent, IsActive: true, Category: ptr("drinks"), Percent: 10, StartDate: tt.start, EndDate: tt.end}
+                mustCreate(t, &promo)
+                code := fmt.Sprintf("DAY%d", i)
+                mustCreate(t, &Coupon{OrganizationID: e.org.ID, Code: code, Type: "fixed", Value: 1000, IsActive: true, StartDate: tt.start, EndDate: tt.end})
+                items := []map[string]any{{"product_id": tea.ID, "quantity": 1}}
+
+                var cart struct {
+                    Promotions []appliedPromotion `json:"promotions"`
+                }
+                e.expect(e.do(http.MethodPost, "/checkout/evaluate", map[string]any{"items": items}), http.StatusOK, &cart)
+                if got := len(cart.Promotions) == 1; got != tt.want { t.Errorf("%s: promotion applied = %v, want %v", tt.name, got, tt.want) }
+                var coupon struct {
+                    Valid bool `json:"valid"`
+                }
+                e.expect(e.do(http.MethodPost, "/coupons/validate", map[string]any{"code": code, "items": items}), http.StatusOK, &coupon)
+                if coupon.Valid != tt.want { t.Errorf("%s: coupon valid = %v, want %v", tt.name, coupon.Valid, tt.want) }
+                if err := db.Model(&promo).Update("is_active", false).Error; err != nil { t.Fatal(err) }
+            }
+        })
+    }
+}
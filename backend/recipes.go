@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RecipeItem is one ingredient of a composite product: selling one unit of
+// ProductID uses Quantity of IngredientID, in the ingredient's unit.
+// Ingredients may themselves have recipes (a syrup made in house).
+// Composite products hold no stock of their own.
+type RecipeItem struct {
+    ID             uint    `gorm:"primaryKey" json:"id"`
+    OrganizationID uint    `gorm:"index" json:"organization_id"`
+    ProductID      uint    `gorm:"index" json:"product_id"`
+    IngredientID   uint    `gorm:"index" json:"ingredient_id"`
+    Quantity       float64 `gorm:"type:decimal(14,3)" json:"quantity"`
+    DateCreated    string  `json:"date_created"`
+}
+
+const maxRecipeDepth = 8
+
+var errRecipeCycle = errors.New("recipe uses itself")
+
+// explodeRecipe returns the stocked products, and quantities in their own
+// units, that qty of productID uses. A product without a recipe uses itself.
+func explodeRecipe(tx *gorm.DB, productID uint, qty float64) (map[uint]float64, error) {
+    usage := map[uint]float64{}
+    var walk func(id uint, q float64, path []uint) error
+    walk = func(id uint, q float64, path []uint) error {
+        for _, seen := range path {
+            if seen == id { return errRecipeCycle }
+        }
+        if len(path) >= maxRecipeDepth { return errors.New("recipes nested too deeply") }
+        var items []RecipeItem
+        if err := tx.Where("product_id = ?", id).Find(&items).Error; err != nil { return err }
+        if len(items) == 0 {
+            usage[id] = roundQuantity(usage[id] + q)
+            return nil
+        }
+        for _, it := range items {
+            if err := walk(it.IngredientID, q*it.Quantity, append(path, id)); err != nil { return err }
+        }
+        return nil
+    }
+    return usage, walk(productID, qty, nil)
+}
+
+// consumeStock takes what qty of a sold product uses out of stock at the
+// location (or organization-wide) and records it in inventory history.
+// Ingredients are handled in id order so concurrent sales lock rows in
+// the same order.
+func consumeStock(tx *gorm.DB, orgID uint, locationID *uint, productID uint, qty float64, userID, transactionID uint) error {
+    usage, err := explodeRecipe(tx, productID, qty)
+    if err != nil { return err }
+    ids := make([]uint, 0, len(usage))
+    for id := range usage { ids = append(ids, id) }
+    sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+    for _, id := range ids {
+        q := usage[id]
+        if locationID != nil {
+            if err := adjustLocationStock(tx, orgID, *locationID, id, -q); err != nil { return err }
+        } else if err := addProductStock(tx, orgID, id, -q); err != nil {
+            return err
+        }
+        var via *uint
+        if id != productID { via = &productID }
+        m := InventoryMovement{OrganizationID: orgID, ProductID: id, LocationID: locationID, UserID: userID, Reason: "sale", ReferenceID: &transactionID, ViaProductID: via}
+        if err := depleteLots(tx, q, m); err != nil { return err }
+    }
+    return nil
+}
+
+// rolledUpCost is the cost of one unit of a product: its own cost, or the
+// sum of its ingredients' costs. complete is false when some ingredient
+// has no cost recorded.
+func rolledUpCost(tx *gorm.DB, productID uint) (cost float64, complete bool, err error) {
+    usage, err := explodeRecipe(tx, productID, 1)
+    if err != nil { return 0, false, err }
+    complete = true
+    for id, q := range usage {
+        var p Product
+        if err := tx.Select("id, cost").First(&p, id).Error; err != nil { return 0, false, err }
+        if p.Cost == nil { complete = false; continue }
+        cost += q * *p.Cost
+    }
+    return cost, complete, nil
+}
+
+type recipeLine struct {
+    IngredientID uint     `json:"ingredient_id"`
+    Name         string   `json:"name"`
+    Quantity     float64  `json:"quantity"`
+    Unit         string   `json:"unit"`
+    UnitCost     *float64 `json:"unit_cost"` // rolled up for nested recipes
+    Cost         *float64 `json:"cost"`
+}
+
+func recipeResponse(c *gin.Context, p Product) {
+    var items []RecipeItem
+    db.Where("product_id = ?", p.ID).Order("id asc").Find(&items)
+    lines := []recipeLine{}
+    for _, it := range items {
+        var ing Product
+        db.First(&ing, it.IngredientID)
+        l := recipeLine{IngredientID: it.IngredientID, Name: ing.Name, Quantity: it.Quantity, Unit: ing.Unit}
+        if unitCost, complete, err := rolledUpCost(db, ing.ID); err == nil && complete {
+            cost := unitCost * it.Quantity
+            l.UnitCost, l.Cost = &unitCost, &cost
+        }
+        lines = append(lines, l)
+    }
+    res := gin.H{"product_id": p.ID, "price": p.Price, "items": lines}
+    if len(items) > 0 {
+        cost, complete, err := rolledUpCost(db, p.ID)
+        if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+        res["cost"] = cost
+        res["cost_complete"] = complete
+        res["margin"] = p.Price - cost
+    }
+    c.JSON(http.StatusOK, res)
+}
+
+// Recipe handlers
+func getRecipe(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    recipeResponse(c, p)
+}
+
+// putRecipe replaces a product's recipe; an empty list makes it a plain
+// stocked product again. Quantities may be given in another unit of the
+// ingredient's kind, e.g. 18 g of beans stocked by the kg.
+func putRecipe(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    var body struct {
+        Items []struct {
+            IngredientID uint    `json:"ingredient_id"`
+            Quantity     float64 `json:"quantity"`
+            Unit         string  `json:"unit"`
+        } `json:"items"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    now := nowISO()
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Where("product_id = ?", p.ID).Delete(&RecipeItem{}).Error; err != nil { return err }
+        seen := map[uint]bool{}
+        for _, it := range body.Items {
+            if it.IngredientID == p.ID { return errRecipeCycle }
+            if seen[it.IngredientID] { return fmt.Errorf("ingredient %d listed twice", it.IngredientID) }
+            seen[it.IngredientID] = true
+            var ing Product
+            if err := tx.Scopes(notArchived).Where("id = ? AND organization_id = ?", it.IngredientID, orgUser.OrganizationID).First(&ing).Error; err != nil {
+                return fmt.Errorf("unknown ingredient %d", it.IngredientID)
+            }
+            qty := it.Quantity
+            if it.Unit != "" {
+                var err error
+                if qty, err = convertQuantity(qty, it.Unit, ing.Unit); err != nil { return err }
+            }
+            if qty <= 0 { return fmt.Errorf("%s: quantity must be positive", ing.Name) }
+            item := RecipeItem{OrganizationID: orgUser.OrganizationID, ProductID: p.ID, IngredientID: ing.ID, Quantity: roundQuantity(qty), DateCreated: now}
+            if err := tx.Create(&item).Error; err != nil { return err }
+        }
+        // catches cycles through other products' recipes
+        _, err := explodeRecipe(tx, p.ID, 1)
+        return err
+    })
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    recipeResponse(c, p)
+}
+
+// ingredientUsageReport compares, per ingredient, the theoretical usage
+// implied by recipe sales with the actual stock that left: sales, write-offs
+// and stock count adjustments. The variance is waste and shrinkage.
+func ingredientUsageReport(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    loc := orgTimezone(orgUser.OrganizationID)
+    from := c.DefaultQuery("from", time.Now().In(loc).AddDate(0, 0, -30).Format(dateLayout))
+    to := c.DefaultQuery("to", time.Now().In(loc).Format(dateLayout))
+    start, end, err := localDayRange(from, to, loc)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    type res struct {
+        ProductID    uint     `json:"productId"`
+        Name         string   `json:"name"`
+        Unit         string   `json:"unit"`
+        Theoretical  float64  `json:"theoretical"`  // used by recipe sales
+        DirectSales  float64  `json:"directSales"`  // sold as itself
+        WriteOff     float64  `json:"writeOff"`
+        Adjustment   float64  `json:"adjustment"`   // net stock count corrections
+        Actual       float64  `json:"actual"`
+        Variance     float64  `json:"variance"`     // actual beyond what sales explain
+        Cost         *float64 `json:"cost"`
+        VarianceCost *float64 `json:"varianceCost"`
+    }
+    var rows []res
+    // A voided sale's movements are netted out with the sale they reverse,
+    // counted in the sale's period whenever the void happened
+    db.Raw(`
+        SELECT p.id as product_id, p.name, p.unit, p.cost,
+               -COALESCE(SUM(CASE WHEN m.reason IN ('sale', 'void') AND m.via_product_id IS NOT NULL THEN m.quantity END), 0) as theoretical,
+               -COALESCE(SUM(CASE WHEN m.reason IN ('sale', 'void') AND m.via_product_id IS NULL THEN m.quantity END), 0) as direct_sales,
+               -COALESCE(SUM(CASE WHEN m.reason = 'write_off' THEN m.quantity END), 0) as write_off,
+               COALESCE(SUM(CASE WHEN m.reason = 'adjustment' THEN m.quantity END), 0) as adjustment
+        FROM products p
+        JOIN inventory_movements m ON m.product_id = p.id
+        WHERE p.organization_id = ?
+          AND EXISTS (SELECT 1 FROM recipe_items r WHERE r.ingredient_id = p.id)
+          AND (m.reason <> 'void' AND m.date_created >= ? AND m.date_created < ?
+               OR m.reason = 'void' AND EXISTS (
+                   SELECT 1 FROM inventory_movements s
+                   WHERE s.reason = 'sale' AND s.reference_id = m.reference_id AND s.product_id = m.product_id
+                     AND s.date_created >= ? AND s.date_created < ?))
+        GROUP BY p.id, p.name, p.unit, p.cost
+        ORDER BY p.name ASC`, orgUser.OrganizationID, start, end, start, end).Scan(&rows)
+    for i := range rows {
+        r := &rows[i]
+        // sales and their voids cancel out only up to float error
+        r.Theoretical, r.DirectSales = roundQuantity(r.Theoretical), roundQuantity(r.DirectSales)
+        r.Actual = roundQuantity(r.Theoretical + r.DirectSales + r.WriteOff - r.Adjustment)
+        r.Variance = roundQuantity(r.Actual - r.Theoretical - r.DirectSales)
+        if r.Cost != nil {
+            v := r.Variance * *r.Cost
+            r.VarianceCost = &v
+        }
+    }
+    c.JSON(http.StatusOK, rows)
+}
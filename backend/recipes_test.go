@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExplodeRecipe(t *testing.T) {
+    newTestDB(t)
+    // recipes as product -> ingredient -> quantity; ids are per case
+    recipe := func(items map[uint]map[uint]float64) {
+        for product, ingredients := range items {
+            for ingredient, q := range ingredients {
+                mustCreate(t, &RecipeItem{OrganizationID: 1, ProductID: product, IngredientID: ingredient, Quantity: q, DateCreated: nowISO()})
+            }
+        }
+    }
+    // latte (10): 0.18 l milk (11), 1 espresso shot (12); a shot is 0.018 kg beans (13)
+    recipe(map[uint]map[uint]float64{10: {11: 0.18, 12: 1}, 12: {13: 0.018}})
+    // breakfast set (20): a latte and 2 croissants (21); a croissant uses 0.05 l milk
+    recipe(map[uint]map[uint]float64{20: {10: 1, 21: 2}, 21: {11: 0.05}})
+    // a cycle: 30 uses 31, 31 uses 32, 32 uses 30
+    recipe(map[uint]map[uint]float64{30: {31: 1}, 31: {32: 1}, 32: {30: 1}})
+    // nine levels: 40 uses 41 ... 48 uses 49
+    deep := map[uint]map[uint]float64{}
+    for id := uint(40); id < 49; id++ { deep[id] = map[uint]float64{id + 1: 1} }
+    recipe(deep)
+
+    tests := []struct {
+        name    string
+        product uint
+        qty     float64
+        want    map[uint]float64
+        wantErr error
+    }{
+        {name: "no recipe uses itself", product: 11, qty: 2.5, want: map[uint]float64{11: 2.5}},
+        {name: "nested", product: 10, qty: 2, want: map[uint]float64{11: 0.36, 13: 0.036}},
+        {name: "shared ingredient adds up", product: 20, qty: 3, want: map[uint]float64{11: 0.84, 13: 0.054}},
+        {name: "cycle", product: 30, qty: 1, wantErr: errRecipeCycle},
+        {name: "too deep", product: 40, qty: 1, wantErr: errors.New("recipes nested too deeply")},
+        {name: "deep but within limit", product: 42, qty: 1, want: map[uint]float64{49: 1}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := explodeRecipe(db, tt.product, tt.qty)
+            if tt.wantErr != nil {
+                if err == nil || err.Error() != tt.wantErr.Error() { t.Fatalf("err = %v, want %v", err, tt.wantErr) }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            if !reflect.DeepEqual(got, tt.want) { t.Fatalf("usage = %v, want %v", got, tt.want) }
+        })
+    }
+}
+
+func TestIngredientUsageReportNetsVoids(t *testing.T) {
+    e := newTestEnv(t)
+    milk := e.product("Milk", 1000, 10)
+    latte := e.product("Latte", 20000, 0)
+    mustCreate(t, &RecipeItem{OrganizationID: e.org.ID, ProductID: latte.ID, IngredientID: milk.ID, Quantity: 0.2, DateCreated: nowISO()})
+    sell := func(qty float64) uint {
+        var sale Transaction
+        e.expect(e.do(http.MethodPost, "/transactions", map[string]any{
+            "amount_received": 100000, "items": []map[string]any{{"product_id": latte.ID, "quantity": qty}},
+        }), http.StatusCreated, &sale)
+        return sale.ID
+    }
+    // yesterday: 2 lattes kept and 1 voided today; today: 3 lattes and 1 voided at once
+    kept, voidedLater := sell(2), sell(1)
+    yesterday := time.Now().UTC().AddDate(0, 0, -1).Format(time.RFC3339)
+    db.Model(&InventoryMovement{}).Where("reference_id IN ?", []uint{kept, voidedLater}).Update("date_created", yesterday)
+    sell(3)
+    voidedNow := sell(1)
+    for _, id := range []uint{voidedLater, voidedNow} {
+        e.expect(e.do(http.MethodDelete, fmt.Sprintf("/transactions/%d", id), nil), http.StatusNoContent, nil)
+    }
+
+    loc := orgTimezone(e.org.ID)
+    today := time.Now().In(loc)
+    day := func(d time.Time) string { return d.Format(dateLayout) }
+    tests := []struct {
+        name, from, to string
+        want           float64
+    }{
+        {"yesterday", day(today.AddDate(0, 0, -1)), day(today.AddDate(0, 0, -1)), 0.4},
+        {"today", day(today), day(today), 0.6},
+        {"both days", day(today.AddDate(0, 0, -1)), day(today), 1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var rows []struct {
+                ProductID   uint    `json:"productId"`
+                Theoretical float64 `json:"theoretical"`
+                Actual      float64 `json:"actual"`
+                Variance    float64 `json:"variance"`
+            }
+            e.with(t).expect(e.do(http.MethodGet, "/analytics/ingredient-usage?from="+tt.from+"&to="+tt.to, nil), http.StatusOK, &rows)
+            if len(rows) != 1 || rows[0].ProductID != milk.ID { t.Fatalf("rows = %+v", rows) }
+            if r := rows[0]; r.Theoretical != tt.want || r.Actual != tt.want || r.Variance != 0 { t.Errorf("milk = %+v, want %v used and no variance", r, tt.want) }
+        })
+    }
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// secretKeys must not appear anywhere in a response.
+var secretKeys = map[string]bool{
+    "password": true, "password_hash": true, "pin_hash": true, "totp_secret": true, "totp_last_step": true,
+    "code_hash": true, "recovery_code_hash": true, "token_hash": true,
+}
+
+// findSecretKeys returns the paths of secret keys in a decoded JSON value.
+func findSecretKeys(v any, path string) []string {
+    var found []string
+    switch v := v.(type) {
+    case map[string]any:
+        for k, child := range v {
+            if secretKeys[k] { found = append(found, path+"."+k) }
+            found = append(found, findSecretKeys(child, path+"."+k)...)
+        }
+    case []any:
+        for i, child := range v { found = append(found, findSecretKeys(child, fmt.Sprintf("%s[%d]", path, i))...) }
+    }
+    return found
+}
+
+// storedSecrets is every credential hash and secret in the database.
+func storedSecrets(t *testing.T) []string {
+    t.Helper()
+    var out []string
+    for _, q := range []struct{ table, col string }{
+        {"users", "password"}, {"users", "totp_secret"}, {"organization_users", "pin_hash"},
+        {"devices", "token_hash"}, {"invitations", "token_hash"}, {"refresh_tokens", "token_hash"}, {"recovery_codes", "code_hash"},
+    } {
+        var vals []string
+        if err := db.Table(q.table).Where(q.col+" <> ''").Pluck(q.col, &vals).Error; err != nil { t.Fatal(err) }
+        out = append(out, vals...)
+    }
+    return out
+}
+
+// Every route is called, with a working body where one is needed to reach
+// the data, and no response may carry a credential: neither under a
+// secret key nor as a stored hash or secret value under any other key.
+func TestResponsesCarryNoSecrets(t *testing.T) {
+    e := newTestEnv(t)
+    now := nowISO()
+    p := e.product("Tea", 5000, 20)
+    shop := e.location("Shop")
+    barcode := ProductBarcode{OrganizationID: e.org.ID, ProductID: p.ID, Code: "4006381333931", Multiplier: 1, DateCreated: now}
+    mustCreate(t, &barcode)
+    customer := Customer{OrganizationID: e.org.ID, Name: "Sari", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &customer)
+    coupon := Coupon{OrganizationID: e.org.ID, Code: "HEMAT", Type: "fixed", Value: 1000, IsActive: true}
+    mustCreate(t, &coupon)
+    label := LabelTemplate{OrganizationID: e.org.ID, Name: "Shelf", WidthMM: 40, HeightMM: 30, BarcodeType: "code128"}
+    mustCreate(t, &label)
+    list := PriceList{OrganizationID: e.org.ID, Name: "Wholesale", Code: "wholesale", DateCreated: now, DateUpdated: now}
+    mustCreate(t, &list)
+    mustCreate(t, &PriceListItem{PriceListID: list.ID, ProductID: p.ID, Price: 4500, DateUpdated: now})
+    change := ScheduledPriceChange{OrganizationID: e.org.ID, ProductID: p.ID, NewPrice: 5500, EffectiveAt: "2099-01-01T00:00:00Z", Status: "pending", UserID: e.owner.ID, DateCreated: now}
+    mustCreate(t, &change)
+    promo := Promotion{OrganizationID: e.org.ID, Name: "Tea deal", Type: "percent", IsActive: true, ProductID: &p.ID, Percent: 10}
+    mustCreate(t, &promo)
+    lot := e.addLot(p, e.loc.ID, "L1", "2099-01-01", 5)
+    mustCreate(t, &Setting{OrganizationID: e.org.ID, Key: "store_name", Value: "Warung", Version: 1})
+
+    // a cashier with a PIN, 2FA and recovery codes, so there is something to leak
+    cashier, _ := e.member("kasir", "cashier")
+    pin, err := hashPIN("1234")
+    if err != nil { t.Fatal(err) }
+    if err := db.Model(&OrganizationUser{}).Where("user_id = ?", cashier.ID).Update("pin_hash", pin).Error; err != nil { t.Fatal(err) }
+    if err := db.Model(&cashier).Updates(map[string]any{"totp_secret": totpEncoding.EncodeToString([]byte("12345678901234567890")), "totp_enabled": true, "totp_last_step": 1}).Error; err != nil { t.Fatal(err) }
+    if err := db.Transaction(func(tx *gorm.DB) error { _, err := newRecoveryCodes(tx, cashier.ID); return err }); err != nil { t.Fatal(err) }
+
+    var device struct {
+        DeviceToken string `json:"device_token"`
+    }
+    e.expect(e.do(http.MethodPost, "/devices", map[string]any{"name": "Till 1", "location_id": shop.ID}), http.StatusCreated, &device)
+    var inv struct {
+        Invitation struct{ ID uint `json:"id"` } `json:"invitation"`
+        Token      string `json:"token"`
+    }
+    e.expect(e.do(http.MethodPost, "/invitations", map[string]any{"role": "cashier", "email": "new@example.com"}), http.StatusCreated, &inv)
+    var login struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    e.expect(e.doAs("", http.MethodPost, "/auth/login", map[string]any{"username": "owner", "password": "correct horse battery"}), http.StatusOK, &login)
+    var tr struct{ ID uint `json:"id"` }
+    e.expect(e.do(http.MethodPost, "/stock-transfers", map[string]any{
+        "from_location_id": e.loc.ID, "to_location_id": shop.ID,
+        "items": []map[string]any{{"product_id": p.ID, "quantity": 2}},
+    }), http.StatusCreated, &tr)
+    var sale struct{ ID uint `json:"id"` }
+    e.expect(e.do(http.MethodPost, "/transactions", map[string]any{
+        "amount_received": 10000, "transaction_date": now,
+        "items": []map[string]any{{"product_id": p.ID, "quantity": 1}},
+    }), http.StatusCreated, &sale)
+
+    ids := map[string]uint{
+        "products": p.ID, "customers": customer.ID, "coupons": coupon.ID, "label-templates": label.ID,
+        "locations": shop.ID, "price-lists": list.ID, "price-changes": change.ID, "promotions": promo.ID,
+        "stock-lots": lot.ID, "stock-transfers": tr.ID, "transactions": sale.ID, "users": cashier.ID, "invitations": inv.Invitation.ID,
+    }
+    var devices []DeviceResponse
+    e.expect(e.do(http.MethodGet, "/devices", nil), http.StatusOK, &devices)
+    ids["devices"] = devices[0].ID
+    params := map[string]string{
+        ":productId": fmt.Sprint(p.ID), ":barcodeId": fmt.Sprint(barcode.ID), ":code": barcode.Code,
+        ":name": "missing.jpg", ":key": "store_name", ":role": "cashier",
+    }
+    bodies := map[string]any{
+        "POST /auth/login":              map[string]any{"username": "owner", "password": "correct horse battery"},
+        "POST /auth/register":           map[string]any{"name": "New", "username": "newshop", "password": "kopi susu gula aren", "organization_name": "New Shop"},
+        "POST /auth/refresh":            map[string]any{"refresh_token": login.RefreshToken},
+        "POST /auth/invitation":         map[string]any{"token": inv.Token},
+        "POST /auth/invitation/accept":  map[string]any{"token": inv.Token, "name": "Invited", "username": "invited", "password": "kopi susu gula aren"},
+        "POST /auth/pin-login":          map[string]any{"user_id": cashier.ID, "pin": "1234"},
+        "POST /auth/2fa/setup":          map[string]any{"password": "correct horse battery"},
+        "POST /users":                   map[string]any{"name": "Dewi", "username": "dewi", "password": "kopi susu gula aren", "role": "cashier", "pin": "4321"},
+        "PUT /users/:id":                map[string]any{"pin": "5678"},
+        "POST /users/:id/reset-password": map[string]any{"newPassword": "teh manis hangat"},
+        "PUT /customers/:id":            map[string]any{"name": "Sari W"},
+        "PUT /locations/:id":            map[string]any{"name": "Shop 1", "type": "outlet", "is_active": true},
+        "POST /checkout/evaluate":       map[string]any{"items": []map[string]any{{"product_id": p.ID, "quantity": 2}}},
+        "POST /coupons/validate":        map[string]any{"code": "HEMAT", "items": []map[string]any{{"product_id": p.ID, "quantity": 2}}},
+    }
+
+    routes := e.router.Routes()
+    // deletes last, so the other routes still find their data
+    sort.SliceStable(routes, func(i, j int) bool { return routes[i].Method != http.MethodDelete && routes[j].Method == http.MethodDelete })
+    for _, r := range routes {
+        route := strings.TrimPrefix(r.Path, "/api/v1")
+        path := route
+        for name, v := range params { path = strings.ReplaceAll(path, name, v) }
+        if strings.Contains(path, ":id") {
+            resource := strings.Split(route, "/")[1]
+            id, ok := ids[resource]
+            if !ok { t.Fatalf("%s %s: no fixture for %s", r.Method, route, resource) }
+            path = strings.ReplaceAll(path, ":id", fmt.Sprint(id))
+        }
+        if strings.Contains(path, ":") { t.Fatalf("%s %s: unfilled parameter in %s", r.Method, route, path) }
+
+        var body []byte
+        if b, ok := bodies[r.Method+" "+route]; ok {
+            body, _ = json.Marshal(b)
+        } else if r.Method != http.MethodGet {
+            body = []byte("{}")
+        }
+        req := httptest.NewRequest(r.Method, "/api/v1"+path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        // a fresh session each time, since some routes end theirs
+        req.Header.Set("Authorization", "Bearer "+e.signIn(e.owner.ID))
+        req.Header.Set("X-Device-Token", device.DeviceToken)
+        w := httptest.NewRecorder()
+        e.router.ServeHTTP(w, req)
+
+        name := r.Method + " " + route
+        if w.Code >= 500 { t.Errorf("%s: status %d: %s", name, w.Code, w.Body) }
+        if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+            var v any
+            if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil { t.Errorf("%s: decode: %v", name, err) }
+            if keys := findSecretKeys(v, ""); len(keys) > 0 { t.Errorf("%s: secret keys %v in %s", name, keys, w.Body) }
+        }
+        if name == "POST /auth/2fa/setup" { continue } // shows the new secret once, for the authenticator app
+        for _, s := range storedSecrets(t) {
+            if bytes.Contains(w.Body.Bytes(), []byte(s)) { t.Errorf("%s: response carries a stored secret: %s", name, w.Body) }
+        }
+    }
+}
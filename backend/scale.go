@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Scale barcodes are EAN-13 codes printed by weighing scales in the
+// in-store range 20-29: two prefix digits, the product's 5-digit PLU, a
+// 5-digit value and the check digit. Depending on the prefix the value is
+// the weight or the price of the item.
+//
+//   2 1 | 0 0 4 2 1 | 0 1 2 5 0 | 2   prefix 21, PLU 00421, 1.250 kg
+type ScaleBarcodeRule struct {
+    ID             uint   `gorm:"primaryKey" json:"id"`
+    OrganizationID uint   `gorm:"index" json:"organization_id"`
+    Prefix         string `gorm:"size:2" json:"prefix"`
+    Embedded       string `json:"embedded"` // weight, price
+    Decimals       int    `json:"decimals"` // implied decimals of the value
+    Unit           string `json:"unit"`     // unit of an embedded weight
+}
+
+// defaultScaleRules apply to organizations that have not set their own:
+// 20-24 carry a weight in grams (kg with three decimals), 25-29 a price
+// without decimals.
+func defaultScaleRules() []ScaleBarcodeRule {
+    var rules []ScaleBarcodeRule
+    for d := 0; d <= 9; d++ {
+        r := ScaleBarcodeRule{Prefix: "2" + strconv.Itoa(d), Embedded: "weight", Decimals: 3, Unit: "kg"}
+        if d >= 5 { r = ScaleBarcodeRule{Prefix: r.Prefix, Embedded: "price"} }
+        rules = append(rules, r)
+    }
+    return rules
+}
+
+func scaleRules(tx *gorm.DB, orgID uint) []ScaleBarcodeRule {
+    var rules []ScaleBarcodeRule
+    tx.Where("organization_id = ?", orgID).Order("prefix asc").Find(&rules)
+    if len(rules) == 0 { return defaultScaleRules() }
+    return rules
+}
+
+func validScaleRule(r ScaleBarcodeRule) error {
+    if len(r.Prefix) != 2 || r.Prefix[0] != '2' || r.Prefix[1] < '0' || r.Prefix[1] > '9' { return errors.New("prefix must be 20-29") }
+    if r.Decimals < 0 || r.Decimals > 4 { return errors.New("decimals must be 0-4") }
+    switch r.Embedded {
+    case "weight":
+        if !validUnit(r.Unit) || !fractionalUnit(r.Unit) { return errors.New("weight rules need a weight or volume unit") }
+    case "price":
+    default:
+        return errors.New("embedded must be weight or price")
+    }
+    return nil
+}
+
+type scaleItem struct {
+    Product  Product `json:"-"`
+    Quantity float64 `json:"quantity"` // in the product's unit
+    Total    float64 `json:"total"`
+    Embedded string  `json:"embedded"`
+    PLU      string  `json:"plu"`
+}
+
+var errNotScaleBarcode = errors.New("not a scale barcode")
+
+// parseScaleBarcode resolves a scale barcode to the product and quantity
+// it stands for. A price-embedded code is turned into the quantity that
+// costs that much at the product's current price.
+func parseScaleBarcode(tx *gorm.DB, orgID uint, code string) (scaleItem, error) {
+    if len(code) != 13 || code[0] != '2' || !allDigits(code) || !validGTIN(code) { return scaleItem{}, errNotScaleBarcode }
+    var rule *ScaleBarcodeRule
+    for _, r := range scaleRules(tx, orgID) {
+        if r.Prefix == code[:2] { rule = &r; break }
+    }
+    if rule == nil { return scaleItem{}, errNotScaleBarcode }
+    plu := code[2:7]
+    raw, _ := strconv.Atoi(code[7:12])
+    value := float64(raw) / math.Pow10(rule.Decimals)
+    var p Product
+    if err := tx.Scopes(notArchived).Where("organization_id = ? AND plu = ?", orgID, plu).First(&p).Error; err != nil { return scaleItem{}, err }
+    item := scaleItem{Product: p, Embedded: rule.Embedded, PLU: plu}
+    if rule.Embedded == "weight" {
+        qty, err := convertQuantity(value, rule.Unit, p.Unit)
+        if err != nil { return scaleItem{}, err }
+        item.Quantity = qty
+        item.Total = lineTotal(p.Price, qty)
+    } else {
+        if p.Price <= 0 { return scaleItem{}, errors.New("product has no price to derive a quantity from") }
+        item.Quantity = roundQuantity(value / p.Price)
+        item.Total = value
+    }
+    if item.Quantity <= 0 { return scaleItem{}, errors.New("barcode carries no quantity") }
+    return item, nil
+}
+
+// Scale rule handlers
+func listScaleRules(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    c.JSON(http.StatusOK, scaleRules(db, orgUser.OrganizationID))
+}
+
+// putScaleRules replaces the organization's rules; an empty list restores
+// the defaults.
+func putScaleRules(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    var rules []ScaleBarcodeRule
+    if err := c.BindJSON(&rules); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    seen := map[string]bool{}
+    for i := range rules {
+        if err := validScaleRule(rules[i]); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+        if seen[rules[i].Prefix] { c.JSON(http.StatusBadRequest, gin.H{"error": "duplicate prefix " + rules[i].Prefix}); return }
+        seen[rules[i].Prefix] = true
+        rules[i].ID = 0
+        rules[i].OrganizationID = orgUser.OrganizationID
+        if rules[i].Embedded == "price" { rules[i].Unit = "" }
+    }
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Where("organization_id = ?", orgUser.OrganizationID).Delete(&ScaleBarcodeRule{}).Error; err != nil { return err }
+        if len(rules) == 0 { return nil }
+        return tx.Create(&rules).Error
+    })
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, scaleRules(db, orgUser.OrganizationID))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// scaleCode builds a scale barcode from its prefix, PLU and value, adding
+// the check digit.
+func scaleCode(t *testing.T, prefix, plu, value string) string {
+    t.Helper()
+    code := prefix + plu + value
+    for d := '0'; d <= '9'; d++ {
+        if validGTIN(code + string(d)) { return code + string(d) }
+    }
+    t.Fatalf("no check digit for %s", code)
+    return ""
+}
+
+func (e *testEnv) scaleProduct(name, unit, plu string, price float64) Product {
+    e.t.Helper()
+    p := e.product(name, price, 0)
+    if err := db.Model(&p).Updates(map[string]any{"unit": unit, "plu": plu}).Error; err != nil { e.t.Fatal(err) }
+    db.First(&p, p.ID)
+    return p
+}
+
+type scaleCase struct {
+    name     string
+    code     string
+    product  string
+    quantity float64
+    total    float64
+    embedded string
+    wantErr  error // compared with errors.Is, or by message when not a sentinel
+}
+
+func checkScaleCases(t *testing.T, e *testEnv, tests []scaleCase) {
+    t.Helper()
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            item, err := parseScaleBarcode(db, e.org.ID, tt.code)
+            if tt.wantErr != nil {
+                if err == nil || !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error() { t.Fatalf("err = %v, want %v", err, tt.wantErr) }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            if item.Product.Name != tt.product || item.Quantity != tt.quantity || item.Total != tt.total || item.Embedded != tt.embedded || item.PLU != tt.code[2:7] {
+                t.Errorf("got %s %v total %v (%s, plu %s), want %s %v total %v (%s)", item.Product.Name, item.Quantity, item.Total, item.Embedded, item.PLU, tt.product, tt.quantity, tt.total, tt.embedded)
+            }
+        })
+    }
+}
+
+func TestParseScaleBarcode(t *testing.T) {
+    e := newTestEnv(t)
+    e.scaleProduct("Apples", "kg", "00421", 30000)
+    e.scaleProduct("Cheese", "g", "00500", 150)
+    e.scaleProduct("Bread", "pcs", "00600", 12000)
+    e.scaleProduct("Sample", "kg", "00700", 0)
+    old := e.scaleProduct("Old stock", "kg", "00800", 10000)
+    db.Model(&old).Update("archived_at", nowISO())
+
+    noQuantity := errors.New("barcode carries no quantity")
+    checkScaleCases(t, e, []scaleCase{
+        {name: "weight in kg", code: scaleCode(t, "21", "00421", "01250"), product: "Apples", quantity: 1.25, total: 37500, embedded: "weight"},
+        {name: "weight on prefix 20", code: scaleCode(t, "20", "00421", "00500"), product: "Apples", quantity: 0.5, total: 15000, embedded: "weight"},
+        {name: "weight converted to grams", code: scaleCode(t, "24", "00500", "00250"), product: "Cheese", quantity: 250, total: 37500, embedded: "weight"},
+        {name: "weight of a counted product", code: scaleCode(t, "21", "00600", "01000"), wantErr: errors.New("cannot convert kg to pcs")},
+        {name: "zero weight", code: scaleCode(t, "21", "00421", "00000"), wantErr: noQuantity},
+        {name: "price", code: scaleCode(t, "25", "00421", "15000"), product: "Apples", quantity: 0.5, total: 15000, embedded: "price"},
+        // the quantity is rounded to three decimals; the total stays the printed price
+        {name: "price rounds the quantity", code: scaleCode(t, "29", "00421", "10000"), product: "Apples", quantity: 0.333, total: 10000, embedded: "price"},
+        {name: "price rounds up", code: scaleCode(t, "25", "00421", "20000"), product: "Apples", quantity: 0.667, total: 20000, embedded: "price"},
+        {name: "price below a thousandth", code: scaleCode(t, "25", "00421", "00001"), wantErr: noQuantity},
+        {name: "price of a product without one", code: scaleCode(t, "25", "00700", "05000"), wantErr: errors.New("product has no price to derive a quantity from")},
+        {name: "unknown plu", code: scaleCode(t, "21", "99999", "01000"), wantErr: gorm.ErrRecordNotFound},
+        {name: "archived product", code: scaleCode(t, "21", "00800", "01000"), wantErr: gorm.ErrRecordNotFound},
+        {name: "bad check digit", code: "2100421012500", wantErr: errNotScaleBarcode},
+        {name: "not in store range", code: "8992761111113", wantErr: errNotScaleBarcode},
+        {name: "too short", code: "210042101250", wantErr: errNotScaleBarcode},
+        {name: "not digits", code: "21OO421012502", wantErr: errNotScaleBarcode},
+    })
+}
+
+func TestScaleRulesReplaceDefaults(t *testing.T) {
+    e := newTestEnv(t)
+    e.scaleProduct("Apples", "kg", "00421", 30000)
+    e.scaleProduct("Cheese", "g", "00500", 150)
+    defaultWeight := scaleCode(t, "21", "00421", "01250")
+
+    rules := []map[string]any{
+        {"prefix": "22", "embedded": "weight", "decimals": 2, "unit": "kg"},
+        {"prefix": "23", "embedded": "weight", "decimals": 0, "unit": "g"},
+        {"prefix": "28", "embedded": "price", "decimals": 2, "unit": "kg"},
+    }
+    var got []ScaleBarcodeRule
+    e.expect(e.do(http.MethodPut, "/scale-barcode-rules", rules), http.StatusOK, &got)
+    if len(got) != 3 || got[2].Unit != "" { t.Fatalf("rules = %+v, want 3 with no unit on the price rule", got) }
+
+    checkScaleCases(t, e, []scaleCase{
+        {name: "default prefix gone", code: defaultWeight, wantErr: errNotScaleBarcode},
+        {name: "default price prefix gone", code: scaleCode(t, "25", "00421", "15000"), wantErr: errNotScaleBarcode},
+        {name: "two decimals", code: scaleCode(t, "22", "00421", "00125"), product: "Apples", quantity: 1.25, total: 37500, embedded: "weight"},
+        {name: "grams", code: scaleCode(t, "23", "00421", "00750"), product: "Apples", quantity: 0.75, total: 22500, embedded: "weight"},
+        {name: "price with decimals", code: scaleCode(t, "28", "00500", "37500"), product: "Cheese", quantity: 2.5, total: 375, embedded: "price"},
+    })
+
+    tests := []struct {
+        name  string
+        rules []map[string]any
+    }{
+        {"prefix out of range", []map[string]any{{"prefix": "30", "embedded": "price"}}},
+        {"duplicate prefix", []map[string]any{{"prefix": "25", "embedded": "price"}, {"prefix": "25", "embedded": "price"}}},
+        {"counted weight unit", []map[string]any{{"prefix": "21", "embedded": "weight", "decimals": 3, "unit": "pcs"}}},
+        {"too many decimals", []map[string]any{{"prefix": "21", "embedded": "weight", "decimals": 5, "unit": "kg"}}},
+        {"unknown embedding", []map[string]any{{"prefix": "21", "embedded": "count"}}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) { e.with(t).expect(e.do(http.MethodPut, "/scale-barcode-rules", tt.rules), http.StatusBadRequest, nil) })
+    }
+    // refused rule sets leave the saved ones alone
+    if rules := scaleRules(db, e.org.ID); len(rules) != 3 { t.Fatalf("rules after refused puts = %d, want 3", len(rules)) }
+
+    // an empty list restores the defaults
+    e.expect(e.do(http.MethodPut, "/scale-barcode-rules", []map[string]any{}), http.StatusOK, &got)
+    if len(got) != 10 { t.Fatalf("defaults = %d rules, want 10", len(got)) }
+    checkScaleCases(t, e, []scaleCase{
+        {name: "defaults back", code: defaultWeight, product: "Apples", quantity: 1.25, total: 37500, embedded: "weight"},
+    })
+}
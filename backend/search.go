@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ProductSearchToken is one lower-cased word of a product's name, SKU or
+// category. The primary key doubles as the (organization, token) index that
+// exact and prefix lookups range over, so search never scans products.
+type ProductSearchToken struct {
+    OrganizationID uint   `gorm:"primaryKey;autoIncrement:false" json:"organization_id"`
+    Token          string `gorm:"primaryKey;size:64" json:"token"`
+    ProductID      uint   `gorm:"primaryKey;autoIncrement:false;index" json:"product_id"`
+}
+
+const (
+    searchMaxTokenLen = 64
+    searchNearCap     = 200         // typo matches kept per query word, closest first
+    searchVocabTTL    = time.Minute // how long a cached vocabulary is trusted
+)
+
+// searchVocab caches each organization's distinct tokens for typo matching,
+// so a search does not read the whole vocabulary. indexProduct drops an
+// organization's entry; the TTL covers writes whose transaction had not
+// committed when the entry was reloaded.
+var searchVocab = struct {
+    sync.Mutex
+    orgs map[uint]orgVocab
+}{orgs: map[uint]orgVocab{}}
+
+type orgVocab struct {
+    byLen  map[int][]string // tokens by length in runes
+    loaded time.Time
+}
+
+// vocabulary returns the organization's tokens by length, from the cache
+// when it is fresh.
+func vocabulary(orgID uint) (map[int][]string, error) {
+    searchVocab.Lock()
+    v, ok := searchVocab.orgs[orgID]
+    searchVocab.Unlock()
+    if ok && time.Since(v.loaded) < searchVocabTTL { return v.byLen, nil }
+    var tokens []string
+    if err := db.Model(&ProductSearchToken{}).Distinct("token").Where("organization_id = ?", orgID).Pluck("token", &tokens).Error; err != nil { return nil, err }
+    v = orgVocab{byLen: map[int][]string{}, loaded: time.Now()}
+    for _, t := range tokens {
+        n := len([]rune(t))
+        v.byLen[n] = append(v.byLen[n], t)
+    }
+    searchVocab.Lock()
+    searchVocab.orgs[orgID] = v
+    searchVocab.Unlock()
+    return v.byLen, nil
+}
+
+func forgetVocabulary(orgID uint) {
+    searchVocab.Lock()
+    delete(searchVocab.orgs, orgID)
+    searchVocab.Unlock()
+}
+
+// searchTokens splits s into distinct lower-case words of letters and digits.
+func searchTokens(s string) []string {
+    seen := map[string]bool{}
+    var out []string
+    for _, f := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+        if r := []rune(f); len(r) > searchMaxTokenLen { f = string(r[:searchMaxTokenLen]) }
+        if !seen[f] { seen[f] = true; out = append(out, f) }
+    }
+    return out
+}
+
+func productTokens(p Product) []string {
+    text := p.Name
+    if p.Category != nil { text += " " + *p.Category }
+    toks := searchTokens(text)
+    if p.SKU != nil {
+        // the whole SKU as well as its parts, so "ab-12" and "12" both hit
+        toks = append(toks, searchTokens(*p.SKU)...)
+        if whole := strings.ToLower(*p.SKU); len([]rune(whole)) <= searchMaxTokenLen { toks = append(toks, whole) }
+    }
+    seen := map[string]bool{}
+    out := toks[:0]
+    for _, t := range toks {
+        if !seen[t] { seen[t] = true; out = append(out, t) }
+    }
+    return out
+}
+
+// indexProduct replaces a product's search tokens. Call it after every
+// write to name, SKU or category.
+func indexProduct(tx *gorm.DB, p Product) error {
+    defer forgetVocabulary(p.OrganizationID)
+    if err := tx.Where("product_id = ?", p.ID).Delete(&ProductSearchToken{}).Error; err != nil { return err }
+    var rows []ProductSearchToken
+    for _, t := range productTokens(p) {
+        rows = append(rows, ProductSearchToken{OrganizationID: p.OrganizationID, Token: t, ProductID: p.ID})
+    }
+    if len(rows) == 0 { return nil }
+    return tx.Create(&rows).Error
+}
+
+// buildSearchIndex indexes every product when the token table is empty,
+// as on the first start after upgrading.
+func buildSearchIndex(db *gorm.DB) error {
+    var n int64
+    if err := db.Model(&ProductSearchToken{}).Limit(1).Count(&n).Error; err != nil || n > 0 { return err }
+    var batch []Product
+    return db.FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+        for _, p := range batch {
+            if err := indexProduct(db, p); err != nil { return err }
+        }
+        return nil
+    }).Error
+}
+
+// levenshtein returns the edit distance of a and b, or limit+1 once it is
+// known to exceed limit.
+func levenshtein(a, b string, limit int) int {
+    ra, rb := []rune(a), []rune(b)
+    if d := len(ra) - len(rb); d > limit || -d > limit { return limit + 1 }
+    prev := make([]int, len(rb)+1)
+    cur := make([]int, len(rb)+1)
+    for j := range prev { prev[j] = j }
+    for i := 1; i <= len(ra); i++ {
+        cur[0] = i
+        rowMin := i
+        for j := 1; j <= len(rb); j++ {
+            cost := 1
+            if ra[i-1] == rb[j-1] { cost = 0 }
+            cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+            rowMin = min(rowMin, cur[j])
+        }
+        if rowMin > limit { return limit + 1 }
+        prev, cur = cur, prev
+    }
+    return prev[len(rb)]
+}
+
+// maxTypos is how many edits a query word of n letters may be off by.
+func maxTypos(n int) int {
+    switch {
+    case n < 3: return 0
+    case n < 6: return 1
+    default: return 2
+    }
+}
+
+// Match costs per query word; a product's tier is its worst word.
+const (
+    matchExact  = 0
+    matchPrefix = 1
+    matchFuzzy  = 2 // plus the edit distance
+)
+
+// nearTokens returns the vocabulary tokens within maxTypos of w that it does
+// not already prefix, grouped by edit distance, at most searchNearCap of them.
+func nearTokens(vocab map[int][]string, w string) map[int][]string {
+    maxD := maxTypos(len([]rune(w)))
+    if maxD == 0 { return nil }
+    type near struct {
+        token string
+        d     int
+    }
+    var found []near
+    n := len([]rune(w))
+    for l := n - maxD; l <= n+maxD; l++ {
+        for _, t := range vocab[l] {
+            if strings.HasPrefix(t, w) { continue }
+            if d := levenshtein(w, t, maxD); d <= maxD { found = append(found, near{t, d}) }
+        }
+    }
+    sort.Slice(found, func(i, j int) bool {
+        if found[i].d != found[j].d { return found[i].d < found[j].d }
+        return found[i].token < found[j].token
+    })
+    out := map[int][]string{}
+    for i := 0; i < len(found) && i < searchNearCap; i++ { out[found[i].d] = append(out[found[i].d], found[i].token) }
+    return out
+}
+
+// wordMatches is SQL for the products whose tokens match query word i, with
+// the best match cost of that word: matchExact, matchPrefix, or matchFuzzy
+// plus the edit distance.
+func wordMatches(orgID uint, i int, w string, near map[int][]string) (string, []any) {
+    cases := "WHEN token = ? THEN ? WHEN token LIKE ? THEN ?"
+    args := []any{w, matchExact, w + "%", matchPrefix}
+    where := "token LIKE ?"
+    whereArgs := []any{w + "%"}
+    for d := 1; d <= 2; d++ {
+        if len(near[d]) == 0 { continue }
+        cases += " WHEN token IN ? THEN ?"
+        args = append(args, near[d], matchFuzzy+d)
+        where += " OR token IN ?"
+        whereArgs = append(whereArgs, near[d])
+    }
+    sql := fmt.Sprintf("SELECT product_id, %d AS word, MIN(CASE %s END) AS cost FROM product_search_tokens WHERE organization_id = ? AND (%s) GROUP BY product_id", i, cases, where)
+    return sql, append(append(args, orgID), whereArgs...)
+}
+
+// likePrefix is a LIKE pattern for values starting with s, for use with
+// ESCAPE '!'.
+func likePrefix(s string) string {
+    return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s) + "%"
+}
+
+// searchProducts ranks exact SKU and barcode hits first, then products
+// whose words all match exactly, by prefix, and finally within a few typos.
+// Filters: category, in_stock=true. Paging: page, page_size (max 100); the
+// total is returned in X-Total-Count. Matching, ranking and paging run in
+// the database; only typo candidates are found in the cached vocabulary.
+func searchProducts(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    orgID := orgUser.OrganizationID
+    q := strings.TrimSpace(c.Query("q"))
+    page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+    if err != nil || page < 1 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad page"}); return }
+    size, err := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+    if err != nil || size < 1 || size > 100 { c.JSON(http.StatusBadRequest, gin.H{"error": "page_size must be 1-100"}); return }
+    filters := "p.organization_id = ? AND p.archived_at IS NULL"
+    filterArgs := []any{orgID}
+    if cat := c.Query("category"); cat != "" { filters += " AND p.category = ?"; filterArgs = append(filterArgs, cat) }
+    if c.Query("in_stock") == "true" { filters += " AND p.stock_quantity > 0" }
+
+    words := searchTokens(q)
+    if len(words) == 0 {
+        var total int64
+        db.Table("products p").Where(filters, filterArgs...).Count(&total)
+        var products []Product
+        db.Table("products p").Where(filters, filterArgs...).Order("p.name asc, p.id asc").Offset((page - 1) * size).Limit(size).Find(&products)
+        c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+        c.JSON(http.StatusOK, products)
+        return
+    }
+
+    vocab, err := vocabulary(orgID)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    // one row per product and matched word; products matching every word
+    // are those with len(words) distinct words
+    var parts []string
+    var matchArgs []any
+    for i, w := range words {
+        sql, args := wordMatches(orgID, i, w, nearTokens(vocab, w))
+        parts = append(parts, sql)
+        matchArgs = append(matchArgs, args...)
+    }
+    match := "SELECT product_id, SUM(cost) AS cost, MAX(cost) AS worst FROM (" + strings.Join(parts, " UNION ALL ") + ") w GROUP BY product_id HAVING COUNT(DISTINCT word) = ?"
+    matchArgs = append(matchArgs, len(words))
+
+    exact := "(p.sku = ? OR p.id IN (SELECT b.product_id FROM product_barcodes b WHERE b.organization_id = ? AND b.code = ?))"
+    exactArgs := []any{q, orgID, q}
+    from := "FROM products p LEFT JOIN (" + match + ") m ON m.product_id = p.id WHERE " + filters + " AND (m.product_id IS NOT NULL OR " + exact + ")"
+    fromArgs := append(append(append([]any{}, matchArgs...), filterArgs...), exactArgs...)
+
+    var total int64
+    if err := db.Raw("SELECT COUNT(*) "+from, fromArgs...).Scan(&total).Error; err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    // tier: 0 SKU/barcode, 1 exact words, 2 prefixes, 3 typos; then names
+    // starting with the query, total match cost, name
+    order := fmt.Sprintf("CASE WHEN %s THEN 0 WHEN m.worst = %d THEN 1 WHEN m.worst = %d THEN 2 ELSE 3 END, CASE WHEN LOWER(p.name) LIKE ? ESCAPE '!' THEN 0 ELSE 1 END, COALESCE(m.cost, 0), p.name, p.id", exact, matchExact, matchPrefix)
+    args := append(append(append([]any{}, fromArgs...), exactArgs...), likePrefix(strings.ToLower(q)), size, (page-1)*size)
+    products := []Product{}
+    if err := db.Raw("SELECT p.* "+from+" ORDER BY "+order+" LIMIT ? OFFSET ?", args...).Scan(&products).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+    }
+    c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+    c.JSON(http.StatusOK, products)
+}
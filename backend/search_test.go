@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func (e *testEnv) search(query url.Values) ([]string, string) {
+    e.t.Helper()
+    var products []Product
+    w := e.do(http.MethodGet, "/products/search?"+query.Encode(), nil)
+    e.expect(w, http.StatusOK, &products)
+    names := []string{}
+    for _, p := range products { names = append(names, p.Name) }
+    return names, w.Header().Get("X-Total-Count")
+}
+
+func TestSearchProducts(t *testing.T) {
+    e := newTestEnv(t)
+    add := func(name, sku, category string, stock float64) Product {
+        p := e.product(name, 1000, stock)
+        updates := map[string]any{}
+        if sku != "" { p.SKU = &sku; updates["sku"] = sku }
+        if category != "" { p.Category = &category; updates["category"] = category }
+        if len(updates) > 0 { db.Model(&p).Updates(updates) }
+        if err := indexProduct(db, p); err != nil { t.Fatal(err) }
+        return p
+    }
+    add("Kopi Susu", "KS-01", "Drinks", 5)
+    add("Kopi Hitam", "", "Drinks", 0)
+    add("Susu Kopi Gula Aren", "", "Drinks", 3)
+    add("Teh Manis", "", "Drinks", 2)
+    add("Roti Bakar", "", "Food", 4)
+    add("Indomie Goreng", "", "Food", 10)
+    scanned := add("Sabun Mandi", "", "", 1)
+    mustCreate(t, &ProductBarcode{OrganizationID: e.org.ID, ProductID: scanned.ID, Code: "8992761111113", Multiplier: 1, DateCreated: nowISO()})
+    archived := add("Kopi Lama", "", "Drinks", 1)
+    db.Model(&archived).Update("archived_at", nowISO())
+
+    tests := []struct {
+        name  string
+        query url.Values
+        want  []string
+        total string
+    }{
+        {"no query lists by name", url.Values{"page_size": {"3"}}, []string{"Indomie Goreng", "Kopi Hitam", "Kopi Susu"}, "7"},
+        {"sku first", url.Values{"q": {"KS-01"}}, []string{"Kopi Susu"}, "1"},
+        {"barcode", url.Values{"q": {"8992761111113"}}, []string{"Sabun Mandi"}, "1"},
+        {"every word must match", url.Values{"q": {"kopi susu"}}, []string{"Kopi Susu", "Susu Kopi Gula Aren"}, "2"},
+        {"name starting with the query first", url.Values{"q": {"susu kopi"}}, []string{"Susu Kopi Gula Aren", "Kopi Susu"}, "2"},
+        {"exact words before prefixes", url.Values{"q": {"kop"}}, []string{"Kopi Hitam", "Kopi Susu", "Susu Kopi Gula Aren"}, "3"},
+        {"typo", url.Values{"q": {"indomei"}}, []string{"Indomie Goreng"}, "1"},
+        {"exact before typo", url.Values{"q": {"roti"}}, []string{"Roti Bakar"}, "1"},
+        {"no match", url.Values{"q": {"pizza"}}, []string{}, "0"},
+        {"category filter", url.Values{"q": {"kopi"}, "category": {"Drinks"}, "in_stock": {"true"}}, []string{"Kopi Susu", "Susu Kopi Gula Aren"}, "2"},
+        {"second page", url.Values{"q": {"kopi"}, "page": {"2"}, "page_size": {"2"}}, []string{"Susu Kopi Gula Aren"}, "3"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, total := e.with(t).search(tt.query)
+            if !reflect.DeepEqual(got, tt.want) || total != tt.total { t.Fatalf("got %q (total %s), want %q (total %s)", got, total, tt.want, tt.total) }
+        })
+    }
+
+    // a new product's words reach the cached typo vocabulary at once
+    if got, _ := e.search(url.Values{"q": {"rendang"}}); len(got) != 0 { t.Fatalf("before adding: %q", got) }
+    add("Nasi Rendang", "", "Food", 1)
+    if got, _ := e.search(url.Values{"q": {"rendnag"}}); !reflect.DeepEqual(got, []string{"Nasi Rendang"}) { t.Fatalf("typo after adding: %q", got) }
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"time"
 
 	"gorm.io/gorm"
 )
@@ -18,17 +17,17 @@ func seedData(db *gorm.DB) {
         return
     }
 
-    now := time.Now().Format(time.RFC3339)
+    now := nowISO()
 
     // Create default admin and organization
     // Seed with bcrypt-hashed password 'admin123'
     hashed := "$2a$10$C1c1W7m8l3RkJ0d7qKZkWeK0zO7pZyP0e7Q2mF1oXq1M7vJ3m7z0e" // precomputed bcrypt for 'admin123'
-    admin := User{ Name: "Admin", Username: "admin", Password: hashed, DateCreated: now, DateUpdated: now }
+    admin := User{ Name: "Admin", Username: "admin", Password: hashed, MustChangePassword: true, DateCreated: now, DateUpdated: now }
     if err := db.Create(&admin).Error; err != nil {
         log.Printf("seed: create admin failed: %v", err)
         return
     }
-    org := Organization{Name: "Demo Store", DateCreated: now, DateUpdated: now}
+    org := Organization{Name: "Demo Store", ReceiptFooter: "Thank you for your purchase!", Currency: "IDR", Timezone: "Asia/Jakarta", Locale: "id-ID", DateCreated: now, DateUpdated: now}
     if err := db.Create(&org).Error; err != nil { log.Printf("seed: create org failed: %v", err); return }
     ou := OrganizationUser{OrganizationID: org.ID, UserID: admin.ID, Role: "owner", IsActive: true, DateCreated: now, DateUpdated: now}
     if err := db.Create(&ou).Error; err != nil { log.Printf("seed: create org user failed: %v", err); return }
@@ -36,8 +35,6 @@ func seedData(db *gorm.DB) {
     // Settings defaults
     defaults := []Setting{
         {OrganizationID: org.ID, UserID: admin.ID, Key: "printer_type", Value: "Bluetooth"},
-        {OrganizationID: org.ID, UserID: admin.ID, Key: "business_name", Value: "My Business"},
-        {OrganizationID: org.ID, UserID: admin.ID, Key: "receipt_footer", Value: "Thank you for your purchase!"},
         {OrganizationID: org.ID, UserID: admin.ID, Key: "use_inventory_tracking", Value: "true"},
         {OrganizationID: org.ID, UserID: admin.ID, Key: "use_sku_field", Value: "true"},
     }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A login opens an AuthSession. Access tokens are short-lived JWTs that
+// name their session, and authMiddleware refuses them once the session is
+// revoked. The session is kept alive by rotating refresh tokens: each one
+// can be exchanged once, and presenting a used one again means it was
+// stolen, so the whole session is revoked.
+type AuthSession struct {
+    ID           uint    `gorm:"primaryKey" json:"id"`
+    UserID       uint    `gorm:"index" json:"user_id"`
+    OrganizationID uint  `json:"organization_id"` // the organization it works in
+    DeviceID     *uint   `gorm:"index" json:"device_id"` // set for PIN sessions
+    LocationID   *uint   `json:"location_id"` // the device's location, sales default to it
+    UserAgent    string  `json:"user_agent"`
+    IP           string  `json:"ip"`
+    LastUsedAt   string  `json:"last_used_at"`
+    RevokedAt    *string `json:"revoked_at"`
+    RevokeReason string  `json:"revoke_reason"`
+    DateCreated  string  `json:"date_created"`
+}
+
+type RefreshToken struct {
+    ID          uint    `gorm:"primaryKey" json:"id"`
+    SessionID   uint    `gorm:"index" json:"session_id"`
+    TokenHash   string  `gorm:"size:64;uniqueIndex" json:"-"`
+    ExpiresAt   string  `json:"expires_at"`
+    UsedAt      *string `json:"used_at"` // set when rotated
+    DateCreated string  `json:"date_created"`
+}
+
+const refreshTokenExpiry = 30 * 24 * time.Hour
+
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token for the session and returns
+// its plain value, which only the client keeps.
+func issueRefreshToken(tx *gorm.DB, sessionID uint) (string, error) {
+    var raw [32]byte
+    if _, err := rand.Read(raw[:]); err != nil { return "", err }
+    token := base64.RawURLEncoding.EncodeToString(raw[:])
+    rt := RefreshToken{SessionID: sessionID, TokenHash: hashToken(token), ExpiresAt: time.Now().Add(refreshTokenExpiry).UTC().Format(time.RFC3339), DateCreated: nowISO()}
+    if err := tx.Create(&rt).Error; err != nil { return "", err }
+    return token, nil
+}
+
+// startSession opens a session for a successful login and returns the
+// token pair fields of the login response.
+func startSession(c *gin.Context, userID, orgID uint) (gin.H, error) {
+    now := nowISO()
+    s := AuthSession{UserID: userID, OrganizationID: orgID, UserAgent: c.Request.UserAgent(), IP: c.ClientIP(), LastUsedAt: now, DateCreated: now}
+    var refresh string
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Create(&s).Error; err != nil { return err }
+        var err error
+        refresh, err = issueRefreshToken(tx, s.ID)
+        return err
+    })
+    if err != nil { return nil, err }
+    access, err := generateToken(userID, s.ID, orgID)
+    if err != nil { return nil, err }
+    return gin.H{"token": access, "refresh_token": refresh, "expires_in": int(tokenExpiry.Seconds())}, nil
+}
+
+func revokeSession(tx *gorm.DB, sessionID uint, reason string) error {
+    return tx.Model(&AuthSession{}).Where("id = ? AND revoked_at IS NULL", sessionID).
+        Updates(map[string]any{"revoked_at": nowISO(), "revoke_reason": reason}).Error
+}
+
+// revokeUserSessions signs a user out everywhere, as on deactivation or a
+// password reset. Their access tokens stop working on the next request.
+func revokeUserSessions(tx *gorm.DB, userID uint, reason string) error {
+    return tx.Model(&AuthSession{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+        Updates(map[string]any{"revoked_at": nowISO(), "revoke_reason": reason}).Error
+}
+
+var (
+    errRefreshInvalid = errors.New("invalid refresh token")
+    errRefreshReused  = errors.New("refresh token reuse detected; session revoked")
+)
+
+// refreshHandler exchanges a refresh token for a new access token and a
+// new refresh token.
+func refreshHandler(c *gin.Context) {
+    var body struct{ RefreshToken string `json:"refresh_token"` }
+    if err := c.BindJSON(&body); err != nil || body.RefreshToken == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var s AuthSession
+    var refresh string
+    var orgID uint
+    reused := false
+    err := db.Transaction(func(tx *gorm.DB) error {
+        var rt RefreshToken
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_hash = ?", hashToken(body.RefreshToken)).First(&rt).Error; err != nil { return errRefreshInvalid }
+        if err := tx.First(&s, rt.SessionID).Error; err != nil || s.RevokedAt != nil { return errRefreshInvalid }
+        if rt.UsedAt != nil {
+            // committed below, outside the failing transaction
+            reused = true
+            return errRefreshReused
+        }
+        if exp, err := time.Parse(time.RFC3339, rt.ExpiresAt); err != nil || time.Now().After(exp) { return errRefreshInvalid }
+        // stay in the session's organization while the user is still in it
+        ou, err := activeMembership(tx, s.UserID, s.OrganizationID)
+        if err != nil { ou, err = activeMembership(tx, s.UserID, 0) }
+        if err != nil {
+            if err := revokeSession(tx, s.ID, "user deactivated"); err != nil { return err }
+            return nil
+        }
+        orgID = ou.OrganizationID
+        now := nowISO()
+        if err := tx.Model(&rt).Update("used_at", now).Error; err != nil { return err }
+        if err := tx.Model(&s).Updates(map[string]any{"last_used_at": now, "organization_id": orgID}).Error; err != nil { return err }
+        refresh, err = issueRefreshToken(tx, s.ID)
+        return err
+    })
+    if reused { _ = revokeSession(db, s.ID, "refresh token reuse") }
+    if errors.Is(err, errRefreshInvalid) || errors.Is(err, errRefreshReused) { c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()}); return }
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    if refresh == "" { c.JSON(http.StatusUnauthorized, gin.H{"error": "user has no active organization"}); return }
+    access, err := generateToken(s.UserID, s.ID, orgID)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, gin.H{"token": access, "refresh_token": refresh, "expires_in": int(tokenExpiry.Seconds())})
+}
+
+// logoutHandler revokes the current session, or with { all: true } every
+// session of the user.
+func logoutHandler(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    sid := c.MustGet("sessionID").(uint)
+    var body struct{ All bool `json:"all"` }
+    if err := c.ShouldBindJSON(&body); err != nil && c.Request.ContentLength > 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var err error
+    if body.All { err = revokeUserSessions(db, uid, "logout") } else { err = revokeSession(db, sid, "logout") }
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.Status(http.StatusNoContent)
+}
+
+func listSessions(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    sid := c.MustGet("sessionID").(uint)
+    var sessions []AuthSession
+    db.Where("user_id = ? AND revoked_at IS NULL", uid).Order("last_used_at desc").Find(&sessions)
+    type res struct {
+        AuthSession
+        Current bool `json:"current"`
+    }
+    out := make([]res, 0, len(sessions))
+    for _, s := range sessions { out = append(out, res{s, s.ID == sid}) }
+    c.JSON(http.StatusOK, out)
+}
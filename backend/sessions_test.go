@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// refreshSession opens a session for the user with a refresh token, as a
+// password login does.
+func (e *testEnv) refreshSession(userID uint) (AuthSession, string) {
+    e.t.Helper()
+    s := AuthSession{UserID: userID, OrganizationID: e.org.ID, LastUsedAt: nowISO(), DateCreated: nowISO()}
+    mustCreate(e.t, &s)
+    refresh, err := issueRefreshToken(db, s.ID)
+    if err != nil { e.t.Fatal(err) }
+    return s, refresh
+}
+
+type tokenPair struct {
+    Token        string `json:"token"`
+    RefreshToken string `json:"refresh_token"`
+    ExpiresIn    int    `json:"expires_in"`
+}
+
+func (e *testEnv) refresh(token string, status int) tokenPair {
+    e.t.Helper()
+    var pair tokenPair
+    var v any
+    if status == http.StatusOK { v = &pair }
+    e.expect(e.doAs("", http.MethodPost, "/auth/refresh", map[string]string{"refresh_token": token}), status, v)
+    return pair
+}
+
+func revokeReason(t *testing.T, sessionID uint) string {
+    t.Helper()
+    var s AuthSession
+    if err := db.First(&s, sessionID).Error; err != nil { t.Fatal(err) }
+    if s.RevokedAt == nil { return "" }
+    return s.RevokeReason
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+    e := newTestEnv(t)
+    s, first := e.refreshSession(e.owner.ID)
+
+    second := e.refresh(first, http.StatusOK)
+    if second.Token == "" || second.RefreshToken == "" || second.RefreshToken == first { t.Fatalf("refresh = %+v, want a new token pair", second) }
+    if second.ExpiresIn != int(tokenExpiry.Seconds()) { t.Errorf("expires_in = %d", second.ExpiresIn) }
+    var used RefreshToken
+    db.Where("token_hash = ?", hashToken(first)).First(&used)
+    if used.UsedAt == nil { t.Error("rotated token not marked used") }
+    e.expect(e.doAs(second.Token, http.MethodGet, "/auth/me", nil), http.StatusOK, nil)
+
+    // the new refresh token rotates again
+    third := e.refresh(second.RefreshToken, http.StatusOK)
+    e.expect(e.doAs(third.Token, http.MethodGet, "/auth/me", nil), http.StatusOK, nil)
+    var n int64
+    db.Model(&RefreshToken{}).Where("session_id = ?", s.ID).Count(&n)
+    if n != 3 { t.Errorf("refresh tokens = %d, want 3", n) }
+    if reason := revokeReason(t, s.ID); reason != "" { t.Errorf("session revoked: %s", reason) }
+}
+
+func TestRefreshReplayRevokesSession(t *testing.T) {
+    e := newTestEnv(t)
+    s, first := e.refreshSession(e.owner.ID)
+    second := e.refresh(first, http.StatusOK)
+
+    // the used token is presented again, as by whoever stole it
+    e.refresh(first, http.StatusUnauthorized)
+    if reason := revokeReason(t, s.ID); reason != "refresh token reuse" { t.Fatalf("revoke reason = %q, want refresh token reuse", reason) }
+    // so the legitimate client's tokens stop working too
+    e.refresh(second.RefreshToken, http.StatusUnauthorized)
+    e.expect(e.doAs(second.Token, http.MethodGet, "/auth/me", nil), http.StatusUnauthorized, nil)
+    // other sessions of the user are untouched
+    e.expect(e.do(http.MethodGet, "/auth/me", nil), http.StatusOK, nil)
+}
+
+func TestRefreshRefused(t *testing.T) {
+    e := newTestEnv(t)
+    other := Organization{Name: "Second Store", DateCreated: nowISO(), DateUpdated: nowISO()}
+    mustCreate(t, &other)
+    tests := []struct {
+        name       string
+        setup      func(u User, s AuthSession, refresh string) string // returns the token to send
+        status     int
+        wantReason string // session revoke reason afterwards
+        wantOrg    uint   // organization of the new token, when refreshed
+    }{
+        {
+            name:   "unknown token",
+            setup:  func(u User, s AuthSession, refresh string) string { return "not-a-token" },
+            status: http.StatusUnauthorized,
+        },
+        {
+            name: "expired token",
+            setup: func(u User, s AuthSession, refresh string) string {
+                db.Model(&RefreshToken{}).Where("session_id = ?", s.ID).Update("expires_at", time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+                return refresh
+            },
+            status: http.StatusUnauthorized,
+        },
+        {
+            name: "logged out session",
+            setup: func(u User, s AuthSession, refresh string) string {
+                if err := revokeSession(db, s.ID, "logout"); err != nil { t.Fatal(err) }
+                return refresh
+            },
+            status:     http.StatusUnauthorized,
+            wantReason: "logout",
+        },
+        {
+            name: "deactivated user",
+            setup: func(u User, s AuthSession, refresh string) string {
+                db.Model(&OrganizationUser{}).Where("user_id = ?", u.ID).Update("is_active", false)
+                return refresh
+            },
+            status:     http.StatusUnauthorized,
+            wantReason: "user deactivated",
+        },
+        {
+            name: "deactivated in the session's organization only",
+            setup: func(u User, s AuthSession, refresh string) string {
+                mustCreate(t, &OrganizationUser{OrganizationID: other.ID, UserID: u.ID, Role: "cashier", IsActive: true, DateCreated: nowISO(), DateUpdated: nowISO()})
+                db.Model(&OrganizationUser{}).Where("user_id = ? AND organization_id = ?", u.ID, e.org.ID).Update("is_active", false)
+                return refresh
+            },
+            status:  http.StatusOK,
+            wantOrg: other.ID,
+        },
+        {
+            name:    "still a member",
+            setup:   func(u User, s AuthSession, refresh string) string { return refresh },
+            status:  http.StatusOK,
+            wantOrg: e.org.ID,
+        },
+    }
+    for i, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            u, _ := e.with(t).member(fmt.Sprintf("user%d", i), "cashier")
+            s, refresh := e.with(t).refreshSession(u.ID)
+            pair := e.with(t).refresh(tt.setup(u, s, refresh), tt.status)
+            if reason := revokeReason(t, s.ID); reason != tt.wantReason { t.Errorf("revoke reason = %q, want %q", reason, tt.wantReason) }
+            if tt.status != http.StatusOK { return }
+            var me struct {
+                Organization Organization `json:"organization"`
+            }
+            e.with(t).expect(e.doAs(pair.Token, http.MethodGet, "/auth/me", nil), http.StatusOK, &me)
+            if me.Organization.ID != tt.wantOrg { t.Errorf("token organization = %d, want %d", me.Organization.ID, tt.wantOrg) }
+        })
+    }
+
+    e.expect(e.doAs("", http.MethodPost, "/auth/refresh", map[string]string{}), http.StatusBadRequest, nil)
+}
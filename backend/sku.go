@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SKUs are unique per organization, enforced by the idx_org_sku index on
+// products. Products without a SKU store NULL, which the index allows many
+// times.
+
+// maxSKULength is the size of the products.sku column.
+const maxSKULength = 100
+
+// dedupeSKUs prepares existing products for the unique SKU index. Blank SKUs
+// become NULL. Within an organization, SKUs that are equal ignoring case and
+// surrounding spaces (as MySQL compares them) are kept by the oldest product;
+// the others get a "-2", "-3", ... suffix, or lose their SKU when the suffix
+// does not fit. Every change is logged.
+func dedupeSKUs(tx *gorm.DB) error {
+    if !tx.Migrator().HasTable(&Product{}) || !tx.Migrator().HasColumn(&Product{}, "sku") { return nil }
+    return tx.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Exec("UPDATE products SET sku = NULL WHERE TRIM(sku) = ''").Error; err != nil { return err }
+        var products []Product
+        if err := tx.Select("id", "organization_id", "sku").Where("sku IS NOT NULL").Order("organization_id asc, id asc").Find(&products).Error; err != nil { return err }
+        key := func(orgID uint, sku string) string { return fmt.Sprintf("%d/%s", orgID, strings.ToLower(strings.TrimSpace(sku))) }
+        taken := map[string]bool{}
+        for _, p := range products { taken[key(p.OrganizationID, *p.SKU)] = false }
+        for _, p := range products {
+            k := key(p.OrganizationID, *p.SKU)
+            if !taken[k] { taken[k] = true; continue }
+            var sku *string
+            base := strings.TrimSpace(*p.SKU)
+            for n := 2; ; n++ {
+                s := fmt.Sprintf("%s-%d", base, n)
+                if len(s) > maxSKULength { break }
+                if _, used := taken[key(p.OrganizationID, s)]; !used { sku = &s; break }
+            }
+            if sku != nil { taken[key(p.OrganizationID, *sku)] = true }
+            if err := tx.Model(&Product{}).Where("id = ?", p.ID).Update("sku", sku).Error; err != nil { return err }
+            if sku == nil {
+                log.Printf("product %d (organization %d): cleared duplicate SKU %q", p.ID, p.OrganizationID, *p.SKU)
+            } else {
+                log.Printf("product %d (organization %d): duplicate SKU %q renamed to %q", p.ID, p.OrganizationID, *p.SKU, *sku)
+            }
+        }
+        return nil
+    })
+}
+
+// normalizeSKU trims a SKU and turns a blank one into NULL.
+func normalizeSKU(sku *string) *string {
+    if sku == nil { return nil }
+    s := strings.TrimSpace(*sku)
+    if s == "" { return nil }
+    return &s
+}
+
+// findSKUConflict returns the organization's other product (archived ones
+// included) that already uses sku, if any.
+func findSKUConflict(tx *gorm.DB, orgID uint, sku *string, excludeID uint) (*Product, error) {
+    if sku == nil { return nil, nil }
+    var other Product
+    err := tx.Where("organization_id = ? AND sku = ? AND id <> ?", orgID, *sku, excludeID).First(&other).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) { return nil, nil }
+    if err != nil { return nil, err }
+    return &other, nil
+}
+
+func respondSKUConflict(c *gin.Context, other *Product) {
+    c.JSON(http.StatusConflict, gin.H{
+        "error": "SKU " + *other.SKU + " is already used by " + other.Name,
+        "conflict": gin.H{"id": other.ID, "name": other.Name, "sku": other.SKU, "archived": other.ArchivedAt != nil},
+    })
+}
+
+// checkSKU responds 409 and returns false when sku is taken by another
+// product of the organization. A save that still hits the unique index
+// (a concurrent write) is reported the same way via saveSKUError.
+func checkSKU(c *gin.Context, orgID uint, sku *string, excludeID uint) bool {
+    other, err := findSKUConflict(db, orgID, sku, excludeID)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return false }
+    if other != nil { respondSKUConflict(c, other); return false }
+    return true
+}
+
+// saveSKUError responds to a failed product save, turning a duplicate key
+// on the SKU index into the same 409 as checkSKU.
+func saveSKUError(c *gin.Context, err error, orgID uint, sku *string, excludeID uint) {
+    if errors.Is(err, gorm.ErrDuplicatedKey) {
+        if other, _ := findSKUConflict(db, orgID, sku, excludeID); other != nil {
+            respondSKUConflict(c, other)
+            return
+        }
+        c.JSON(http.StatusConflict, gin.H{"error": "SKU is already in use"})
+        return
+    }
+    c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDedupeSKUs(t *testing.T) {
+    newTestDB(t)
+    // products from before the unique index
+    if err := db.Migrator().DropIndex(&Product{}, "idx_org_sku"); err != nil { t.Fatal(err) }
+    long := strings.Repeat("X", maxSKULength)
+    now := nowISO()
+    add := func(orgID uint, sku string) uint {
+        p := Product{OrganizationID: orgID, Name: sku, SKU: &sku, Unit: defaultUnit, DateCreated: now, DateUpdated: now}
+        mustCreate(t, &p)
+        return p.ID
+    }
+    ids := []uint{
+        add(1, "ABC"), add(1, "abc "), add(1, "ABC-2"), add(1, "Abc"),
+        add(2, "ABC"),
+        add(1, "  "),
+        add(1, long), add(1, long),
+    }
+    if err := dedupeSKUs(db); err != nil { t.Fatal(err) }
+
+    want := []*string{ptr("ABC"), ptr("abc-3"), ptr("ABC-2"), ptr("Abc-4"), ptr("ABC"), nil, &long, nil}
+    for i, id := range ids {
+        var p Product
+        db.First(&p, id)
+        if (p.SKU == nil) != (want[i] == nil) || (p.SKU != nil && *p.SKU != *want[i]) { t.Errorf("product %d: sku = %v, want %v", i, p.SKU, want[i]) }
+    }
+    if err := db.AutoMigrate(&Product{}); err != nil { t.Fatalf("unique index after dedupe: %v", err) }
+}
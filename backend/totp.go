@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Two-factor authentication with time-based one-time passwords (RFC 6238:
+// HMAC-SHA1, 6 digits, 30 second steps), as generated by authenticator
+// apps. A user enrolls by scanning the provisioning QR code and confirming
+// a code, and receives single-use recovery codes for a lost phone. Logins of
+// enrolled users stop after the password with a challenge token, which
+// POST /auth/2fa/verify exchanges for the session once a code is given.
+// Roles can require enrollment; until then their users are refused on
+// every route but the self-service ones.
+
+// clock is the time codes are checked against; tests can fix it.
+var clock = time.Now
+
+const (
+    totpPeriod               = 30
+    totpDigits               = 6
+    totpSkew                 = 1 // steps accepted either side, for drifting phones
+    twoFactorIssuer          = "Poshit"
+    twoFactorChallengeExpiry = 5 * time.Minute
+    recoveryCodeCount        = 10
+)
+
+type RecoveryCode struct {
+    ID          uint    `gorm:"primaryKey" json:"id"`
+    UserID      uint    `gorm:"index" json:"user_id"`
+    CodeHash    string  `gorm:"size:64" json:"-"`
+    UsedAt      *string `json:"used_at"`
+    DateCreated string  `json:"date_created"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode is the code for a time step (RFC 4226 HOTP of the step counter).
+func totpCode(secret []byte, step int64) string {
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], uint64(step))
+    mac := hmac.New(sha1.New, secret)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+    off := sum[len(sum)-1] & 0x0f
+    v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// checkTOTP looks for code around time t and returns the step it belongs
+// to. Steps up to lastStep were used already and are refused, so a code
+// works once.
+func checkTOTP(secret []byte, code string, t time.Time, lastStep int64) (int64, bool) {
+    code = strings.TrimSpace(code)
+    if len(code) != totpDigits || !allDigits(code) { return 0, false }
+    now := t.Unix() / totpPeriod
+    for s := now - totpSkew; s <= now+totpSkew; s++ {
+        if s <= lastStep { continue }
+        if hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) { return s, true }
+    }
+    return 0, false
+}
+
+func totpURI(username string, secret []byte) string {
+    v := url.Values{}
+    v.Set("secret", totpEncoding.EncodeToString(secret))
+    v.Set("issuer", twoFactorIssuer)
+    v.Set("algorithm", "SHA1")
+    v.Set("digits", strconv.Itoa(totpDigits))
+    v.Set("period", strconv.Itoa(totpPeriod))
+    label := url.PathEscape(twoFactorIssuer + ":" + username)
+    return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// normalizeRecoveryCode lets codes be typed in any case, with or without
+// the dash.
+func normalizeRecoveryCode(code string) string {
+    return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones, which are shown once.
+func newRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+    if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil { return nil, err }
+    const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+    now := nowISO()
+    codes := make([]string, 0, recoveryCodeCount)
+    for i := 0; i < recoveryCodeCount; i++ {
+        var raw [10]byte
+        if _, err := rand.Read(raw[:]); err != nil { return nil, err }
+        b := make([]byte, len(raw))
+        for j, r := range raw { b[j] = alphabet[int(r)%len(alphabet)] }
+        code := string(b[:5]) + "-" + string(b[5:])
+        if err := tx.Create(&RecoveryCode{UserID: userID, CodeHash: hashToken(normalizeRecoveryCode(code)), DateCreated: now}).Error; err != nil { return nil, err }
+        codes = append(codes, code)
+    }
+    return codes, nil
+}
+
+var errBadSecondFactor = errors.New("invalid code")
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code
+// of an enrolled user and uses it up.
+func checkSecondFactor(tx *gorm.DB, u User, code, recoveryCode string) error {
+    if recoveryCode != "" {
+        res := tx.Model(&RecoveryCode{}).Where("user_id = ? AND code_hash = ? AND used_at IS NULL", u.ID, hashToken(normalizeRecoveryCode(recoveryCode))).Update("used_at", nowISO())
+        if res.Error != nil { return res.Error }
+        if res.RowsAffected == 0 { return errBadSecondFactor }
+        return nil
+    }
+    secret, err := totpEncoding.DecodeString(u.TOTPSecret)
+    if err != nil { return errBadSecondFactor }
+    step, ok := checkTOTP(secret, code, clock(), u.TOTPLastStep)
+    if !ok { return errBadSecondFactor }
+    // conditional so two requests cannot both spend the same code
+    res := tx.Model(&User{}).Where("id = ? AND totp_last_step < ?", u.ID, step).Update("totp_last_step", step)
+    if res.Error != nil { return res.Error }
+    if res.RowsAffected == 0 { return errBadSecondFactor }
+    return nil
+}
+
+// roleRequiresTwoFactor reports whether the organization requires users in
+// role to enroll.
+func roleRequiresTwoFactor(tx *gorm.DB, orgID uint, role string) bool {
+    var rp RolePermissions
+    if err := tx.Where("organization_id = ? AND role = ?", orgID, role).First(&rp).Error; err != nil { return false }
+    return rp.RequireTwoFactor
+}
+
+func signTwoFactorChallenge(userID, orgID uint) (string, error) {
+    claims := jwt.MapClaims{
+        "sub": userID,
+        "org": orgID,
+        "typ": "2fa",
+        "exp": clock().Add(twoFactorChallengeExpiry).Unix(),
+    }
+    return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+}
+
+func parseTwoFactorChallenge(s string) (userID, orgID uint, err error) {
+    token, err := jwt.Parse(s, func(token *jwt.Token) (interface{}, error) { return jwtSecret, nil }, jwt.WithTimeFunc(clock))
+    if err != nil || !token.Valid { return 0, 0, errors.New("invalid or expired challenge") }
+    claims, _ := token.Claims.(jwt.MapClaims)
+    sub, ok1 := claims["sub"].(float64)
+    org, ok2 := claims["org"].(float64)
+    if claims["typ"] != "2fa" || !ok1 || !ok2 { return 0, 0, errors.New("invalid or expired challenge") }
+    return uint(sub), uint(org), nil
+}
+
+// Two-factor handlers
+
+// verifyTwoFactor is the second step of a login: the challenge token from
+// POST /auth/login and a code from the authenticator or a recovery code.
+func verifyTwoFactor(c *gin.Context) {
+    var body struct {
+        ChallengeToken string `json:"challenge_token"`
+        Code           string `json:"code"`
+        RecoveryCode   string `json:"recovery_code"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    userID, orgID, err := parseTwoFactorChallenge(body.ChallengeToken)
+    if err != nil { c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()}); return }
+    var user User
+    if err := db.First(&user, userID).Error; err != nil || !user.TOTPEnabled { c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired challenge"}); return }
+    if !checkLoginAllowed(c, user.Username) { return }
+    if err := checkSecondFactor(db, user, body.Code, body.RecoveryCode); err != nil {
+        if errors.Is(err, errBadSecondFactor) {
+            recordLoginAttempt(c, user.Username, "bad_totp")
+            c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+    }
+    orgUser, err := activeMembership(db, user.ID, orgID)
+    if err != nil {
+        recordLoginAttempt(c, user.Username, "no_organization")
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user has no active organization"})
+        return
+    }
+    recordLoginAttempt(c, user.Username, "success")
+    completeLogin(c, user, orgUser)
+}
+
+// setupTwoFactor starts enrollment with a new secret, shown as a
+// provisioning URI and as a QR code for authenticator apps. It takes
+// effect once confirmed with POST /auth/2fa/enable.
+func setupTwoFactor(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    var body struct{ Password string `json:"password"` }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var user User
+    if err := db.First(&user, uid).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "user not found"}); return }
+    if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.Password)) != nil { c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong password"}); return }
+    if user.TOTPEnabled { c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"}); return }
+    secret := make([]byte, 20)
+    if _, err := rand.Read(secret); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    if err := db.Model(&user).Updates(map[string]any{"totp_secret": totpEncoding.EncodeToString(secret), "totp_last_step": 0}).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+    }
+    uri := totpURI(user.Username, secret)
+    res := gin.H{"secret": totpEncoding.EncodeToString(secret), "otpauth_url": uri}
+    if img, err := encodeBarcode("qr", uri, 256, 256); err == nil {
+        var buf bytes.Buffer
+        if png.Encode(&buf, img) == nil { res["qr_png"] = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()) }
+    }
+    c.JSON(http.StatusOK, res)
+}
+
+// enableTwoFactor confirms enrollment with a code from the app and returns
+// the recovery codes.
+func enableTwoFactor(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    var body struct{ Code string `json:"code"` }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var user User
+    if err := db.First(&user, uid).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "user not found"}); return }
+    if user.TOTPEnabled { c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"}); return }
+    if user.TOTPSecret == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "start with POST /auth/2fa/setup"}); return }
+    var codes []string
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := checkSecondFactor(tx, user, body.Code, ""); err != nil { return err }
+        if err := tx.Model(&user).Update("totp_enabled", true).Error; err != nil { return err }
+        var err error
+        codes, err = newRecoveryCodes(tx, user.ID)
+        return err
+    })
+    if errors.Is(err, errBadSecondFactor) { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// disableTwoFactor turns 2FA off with the password and a code, unless the
+// user's role requires it.
+func disableTwoFactor(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    var body struct {
+        Password     string `json:"password"`
+        Code         string `json:"code"`
+        RecoveryCode string `json:"recovery_code"`
+    }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var user User
+    if err := db.First(&user, uid).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "user not found"}); return }
+    if !user.TOTPEnabled { c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication is not enabled"}); return }
+    if v, ok := c.Get("orgUser"); ok {
+        ou := v.(OrganizationUser)
+        if roleRequiresTwoFactor(db, ou.OrganizationID, ou.Role) { c.JSON(http.StatusConflict, gin.H{"error": "your role requires two-factor authentication"}); return }
+    }
+    if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.Password)) != nil { c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong password"}); return }
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := checkSecondFactor(tx, user, body.Code, body.RecoveryCode); err != nil { return err }
+        return clearTwoFactor(tx, user.ID)
+    })
+    if errors.Is(err, errBadSecondFactor) { c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()}); return }
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.Status(http.StatusNoContent)
+}
+
+func clearTwoFactor(tx *gorm.DB, userID uint) error {
+    if err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]any{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error; err != nil { return err }
+    return tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
+
+// regenerateRecoveryCodes replaces the recovery codes, given a current code.
+func regenerateRecoveryCodes(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    var body struct{ Code string `json:"code"` }
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var user User
+    if err := db.First(&user, uid).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "user not found"}); return }
+    if !user.TOTPEnabled { c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication is not enabled"}); return }
+    var codes []string
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := checkSecondFactor(tx, user, body.Code, ""); err != nil { return err }
+        var err error
+        codes, err = newRecoveryCodes(tx, user.ID)
+        return err
+    })
+    if errors.Is(err, errBadSecondFactor) { c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()}); return }
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// resetUserTwoFactor removes a user's 2FA, for one who lost both phone and
+// recovery codes, and signs them out.
+func resetUserTwoFactor(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var ou OrganizationUser
+    if err := db.Where("organization_id = ? AND user_id = ?", orgUser.OrganizationID, id).First(&ou).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    if !mayGrant(c, orgUser.OrganizationID, ou.Role) { return }
+    err := db.Transaction(func(tx *gorm.DB) error {
+        if err := clearTwoFactor(tx, ou.UserID); err != nil { return err }
+        return revokeUserSessions(tx, ou.UserID, "2fa reset")
+    })
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RFC 6238 appendix B (SHA1), cut to our 6 digits
+func TestTOTPCode(t *testing.T) {
+    secret := []byte("12345678901234567890")
+    cases := []struct {
+        unix int64
+        want string
+    }{
+        {59, "287082"},
+        {1111111109, "081804"},
+        {1111111111, "050471"},
+        {1234567890, "005924"},
+        {2000000000, "279037"},
+        {20000000000, "353130"},
+    }
+    for _, tc := range cases {
+        if got := totpCode(secret, tc.unix/totpPeriod); got != tc.want { t.Errorf("totpCode at %d = %s, want %s", tc.unix, got, tc.want) }
+    }
+}
+
+func TestCheckTOTP(t *testing.T) {
+    secret := []byte("12345678901234567890")
+    now := time.Unix(1111111111, 0)
+    step := now.Unix() / totpPeriod
+    cases := []struct {
+        name     string
+        code     string
+        lastStep int64
+        want     bool
+    }{
+        {"current step", totpCode(secret, step), 0, true},
+        {"one step behind", totpCode(secret, step-1), 0, true},
+        {"one step ahead", totpCode(secret, step+1), 0, true},
+        {"two steps behind", totpCode(secret, step-2), 0, false},
+        {"two steps ahead", totpCode(secret, step+2), 0, false},
+        {"replayed", totpCode(secret, step), step, false},
+        {"older than the last used", totpCode(secret, step-1), step, false},
+        {"newer than the last used", totpCode(secret, step+1), step, true},
+        {"too short", "12345", 0, false},
+        {"not digits", "12a456", 0, false},
+    }
+    for _, tc := range cases {
+        if _, ok := checkTOTP(secret, tc.code, now, tc.lastStep); ok != tc.want { t.Errorf("%s: ok = %v, want %v", tc.name, ok, tc.want) }
+    }
+}
+
+func TestVerifyTwoFactor(t *testing.T) {
+    e := newTestEnv(t)
+    secret := []byte("12345678901234567890")
+    if err := db.Model(&e.owner).Updates(map[string]any{"totp_secret": totpEncoding.EncodeToString(secret), "totp_enabled": true}).Error; err != nil { t.Fatal(err) }
+    now := time.Unix(2000000000, 0)
+    clock = func() time.Time { return now }
+    t.Cleanup(func() { clock = time.Now })
+    var codes []string
+    err := db.Transaction(func(tx *gorm.DB) error {
+        var err error
+        codes, err = newRecoveryCodes(tx, e.owner.ID)
+        return err
+    })
+    if err != nil { t.Fatal(err) }
+
+    challenge := func() string {
+        var out struct {
+            ChallengeToken string `json:"challenge_token"`
+        }
+        e.expect(e.doAs("", http.MethodPost, "/auth/login", map[string]any{"username": e.owner.Username, "password": "correct horse battery"}), http.StatusOK, &out)
+        return out.ChallengeToken
+    }
+    code := totpCode(secret, now.Unix()/totpPeriod)
+    cases := []struct {
+        name string
+        body map[string]any
+        want int
+    }{
+        {"code", map[string]any{"code": code}, http.StatusOK},
+        {"same code again", map[string]any{"code": code}, http.StatusUnauthorized},
+        {"wrong code", map[string]any{"code": "000000"}, http.StatusUnauthorized},
+        {"recovery code", map[string]any{"recovery_code": codes[0]}, http.StatusOK},
+        {"recovery code again", map[string]any{"recovery_code": codes[0]}, http.StatusUnauthorized},
+        {"recovery code typed loosely", map[string]any{"recovery_code": " " + strings.ToUpper(strings.ReplaceAll(codes[1], "-", ""))}, http.StatusOK},
+    }
+    for _, tc := range cases {
+        tc.body["challenge_token"] = challenge()
+        if w := e.doAs("", http.MethodPost, "/auth/2fa/verify", tc.body); w.Code != tc.want { t.Errorf("%s: status = %d, want %d (%s)", tc.name, w.Code, tc.want, w.Body) }
+    }
+    // the next step's code still works once the clock moves on
+    now = now.Add(totpPeriod * time.Second)
+    e.expect(e.doAs("", http.MethodPost, "/auth/2fa/verify", map[string]any{"challenge_token": challenge(), "code": totpCode(secret, now.Unix()/totpPeriod)}), http.StatusOK, nil)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Units of measure. Product.Price is the price of one Product.Unit and all
+// quantities of the product (stock, sales, lots, transfers) are in that
+// unit, with up to three decimals. Counted units need whole quantities;
+// weighed and measured ones may be fractional.
+
+const defaultUnit = "pcs"
+
+type unitInfo struct {
+    dimension string  // quantities convert only within a dimension
+    factor    float64 // size in the dimension's base unit
+}
+
+var units = map[string]unitInfo{
+    "pcs": {"count", 1},
+    "g":   {"mass", 0.001},
+    "kg":  {"mass", 1},
+    "ml":  {"volume", 0.001},
+    "l":   {"volume", 1},
+    "cm":  {"length", 0.01},
+    "m":   {"length", 1},
+}
+
+func validUnit(u string) bool { _, ok := units[u]; return ok }
+
+// fractionalUnit reports whether quantities in u may have decimals.
+func fractionalUnit(u string) bool { return units[u].dimension != "count" }
+
+// roundQuantity rounds to the three decimals quantity columns store.
+func roundQuantity(q float64) float64 { return math.Round(q*1000) / 1000 }
+
+// convertQuantity converts q from one unit to another of the same dimension.
+func convertQuantity(q float64, from, to string) (float64, error) {
+    if from == to { return q, nil }
+    f, okF := units[from]
+    t, okT := units[to]
+    if !okF { return 0, fmt.Errorf("unknown unit %q", from) }
+    if !okT { return 0, fmt.Errorf("unknown unit %q", to) }
+    if f.dimension != t.dimension { return 0, fmt.Errorf("cannot convert %s to %s", from, to) }
+    return roundQuantity(q * f.factor / t.factor), nil
+}
+
+// checkQuantity validates a sale or stock quantity in unit.
+func checkQuantity(q float64, unit string) error {
+    if q <= 0 || math.IsNaN(q) || math.IsInf(q, 0) { return errors.New("quantity must be positive") }
+    if roundQuantity(q) != q { return errors.New("quantity has more than 3 decimals") }
+    if !fractionalUnit(unit) && q != math.Trunc(q) { return fmt.Errorf("quantity in %s must be a whole number", unit) }
+    return nil
+}
+
+// lineTotal is the price of qty at unitPrice, rounded to cents.
+func lineTotal(unitPrice, qty float64) float64 { return math.Round(unitPrice*qty*100) / 100 }
+
+// parseUnitAmount reads values like "100g", "1 kg" or "pcs" into an amount
+// and unit; a bare unit means 1.
+func parseUnitAmount(s string) (float64, string, error) {
+    s = strings.ToLower(strings.TrimSpace(s))
+    i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+    if i < 0 { return 0, "", errors.New("missing unit") }
+    amount := 1.0
+    if num := strings.TrimSpace(s[:i]); num != "" {
+        v, err := strconv.ParseFloat(num, 64)
+        if err != nil || v <= 0 { return 0, "", errors.New("bad amount") }
+        amount = v
+    }
+    u := strings.TrimSpace(s[i:])
+    if !validUnit(u) { return 0, "", fmt.Errorf("unknown unit %q", u) }
+    return amount, u, nil
+}
+
+// unitPrice handles GET /products/:id/unit-price?per=100g&quantity=250&unit=g:
+// the product's price expressed per another amount, and the total for a
+// quantity given in any unit of the same dimension.
+func unitPrice(c *gin.Context) {
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return
+    }
+    res := gin.H{"product_id": p.ID, "unit": p.Unit, "price": p.Price}
+    if per := c.Query("per"); per != "" {
+        amount, u, err := parseUnitAmount(per)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "per: " + err.Error()}); return }
+        inProductUnit, err := convertQuantity(amount, u, p.Unit)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+        res["per"] = per
+        res["price_per"] = lineTotal(p.Price, inProductUnit)
+    }
+    if s := c.Query("quantity"); s != "" {
+        qty, err := strconv.ParseFloat(s, 64)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad quantity"}); return }
+        qty, err = convertQuantity(qty, c.DefaultQuery("unit", p.Unit), p.Unit)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+        if err := checkQuantity(qty, p.Unit); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+        res["quantity"] = qty
+        res["total"] = lineTotal(p.Price, qty)
+    }
+    c.JSON(http.StatusOK, res)
+}
+
+// saleQuantity is an item's quantity in its product's unit. Items may be
+// given in another unit of the same dimension, such as grams of a product
+// sold by the kilo.
+func saleQuantity(it TransactionItem, p Product) (float64, error) {
+    qty := it.Quantity
+    if it.Unit != "" && it.Unit != p.Unit {
+        var err error
+        if qty, err = convertQuantity(qty, it.Unit, p.Unit); err != nil { return 0, err }
+    }
+    if err := checkQuantity(qty, p.Unit); err != nil { return 0, fmt.Errorf("%s: %w", p.Name, err) }
+    return qty, nil
+}
+
+// checkUnitAndPLU validates a product's unit and its optional scale PLU.
+func checkUnitAndPLU(unit string, plu *string) error {
+    if !validUnit(unit) { return fmt.Errorf("unknown unit %q", unit) }
+    if plu != nil && (len(*plu) != 5 || !allDigits(*plu)) { return errors.New("plu must be 5 digits") }
+    return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseUnitAmount(t *testing.T) {
+    tests := []struct {
+        in      string
+        amount  float64
+        unit    string
+        wantErr string
+    }{
+        {in: "100g", amount: 100, unit: "g"},
+        {in: "1 kg", amount: 1, unit: "kg"},
+        {in: " 2.5 L ", amount: 2.5, unit: "l"},
+        {in: "pcs", amount: 1, unit: "pcs"},
+        {in: "m", amount: 1, unit: "m"},
+        {in: "0.5ml", amount: 0.5, unit: "ml"},
+        {in: "", wantErr: "missing unit"},
+        {in: "100", wantErr: "missing unit"},
+        {in: "0g", wantErr: "bad amount"},
+        {in: "1.2.3kg", wantErr: "bad amount"},
+        {in: "5 lbs", wantErr: `unknown unit "lbs"`},
+        {in: "-1kg", wantErr: `unknown unit "-1kg"`},
+    }
+    for _, tt := range tests {
+        amount, unit, err := parseUnitAmount(tt.in)
+        if tt.wantErr != "" {
+            if err == nil || err.Error() != tt.wantErr { t.Errorf("parseUnitAmount(%q) err = %v, want %q", tt.in, err, tt.wantErr) }
+            continue
+        }
+        if err != nil || amount != tt.amount || unit != tt.unit { t.Errorf("parseUnitAmount(%q) = %v, %q, %v; want %v, %q", tt.in, amount, unit, err, tt.amount, tt.unit) }
+    }
+}
+
+func TestConvertQuantity(t *testing.T) {
+    tests := []struct {
+        q        float64
+        from, to string
+        want     float64
+        wantErr  string
+    }{
+        {q: 3, from: "pcs", to: "pcs", want: 3},
+        {q: 250, from: "g", to: "kg", want: 0.25},
+        {q: 1.5, from: "kg", to: "g", want: 1500},
+        {q: 1, from: "g", to: "kg", want: 0.001},
+        {q: 0.4, from: "g", to: "kg", want: 0},        // below the third decimal
+        {q: 0.0004, from: "kg", to: "g", want: 0.4},
+        {q: 2, from: "l", to: "ml", want: 2000},
+        {q: 330, from: "ml", to: "l", want: 0.33},
+        {q: 150, from: "cm", to: "m", want: 1.5},
+        {q: 1, from: "kg", to: "l", wantErr: "cannot convert kg to l"},
+        {q: 1, from: "pcs", to: "g", wantErr: "cannot convert pcs to g"},
+        {q: 1, from: "lb", to: "kg", wantErr: `unknown unit "lb"`},
+        {q: 1, from: "kg", to: "oz", wantErr: `unknown unit "oz"`},
+    }
+    for _, tt := range tests {
+        got, err := convertQuantity(tt.q, tt.from, tt.to)
+        if tt.wantErr != "" {
+            if err == nil || err.Error() != tt.wantErr { t.Errorf("convertQuantity(%v, %s, %s) err = %v, want %q", tt.q, tt.from, tt.to, err, tt.wantErr) }
+            continue
+        }
+        if err != nil || got != tt.want { t.Errorf("convertQuantity(%v, %s, %s) = %v, %v; want %v", tt.q, tt.from, tt.to, got, err, tt.want) }
+    }
+}
+
+func TestCheckQuantity(t *testing.T) {
+    tests := []struct {
+        q       float64
+        unit    string
+        wantErr string
+    }{
+        {q: 1, unit: "pcs"},
+        {q: 12, unit: "pcs"},
+        {q: 1.5, unit: "kg"},
+        {q: 0.001, unit: "kg"},
+        {q: 1.25, unit: "l"},
+        {q: 0, unit: "pcs", wantErr: "quantity must be positive"},
+        {q: -1, unit: "kg", wantErr: "quantity must be positive"},
+        {q: math.NaN(), unit: "kg", wantErr: "quantity must be positive"},
+        {q: math.Inf(1), unit: "kg", wantErr: "quantity must be positive"},
+        {q: 0.0005, unit: "kg", wantErr: "quantity has more than 3 decimals"},
+        {q: 1.5, unit: "pcs", wantErr: "quantity in pcs must be a whole number"},
+    }
+    for _, tt := range tests {
+        err := checkQuantity(tt.q, tt.unit)
+        if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) { t.Errorf("checkQuantity(%v, %s) = %v, want %q", tt.q, tt.unit, err, tt.wantErr) }
+    }
+}
+
+func TestSaleQuantity(t *testing.T) {
+    rice := Product{Name: "Rice", Unit: "kg"}
+    egg := Product{Name: "Egg", Unit: "pcs"}
+    tests := []struct {
+        name    string
+        item    TransactionItem
+        p       Product
+        want    float64
+        wantErr string
+    }{
+        {"product unit", TransactionItem{Quantity: 1.5}, rice, 1.5, ""},
+        {"same unit named", TransactionItem{Quantity: 2, Unit: "kg"}, rice, 2, ""},
+        {"grams of a kilo product", TransactionItem{Quantity: 250, Unit: "g"}, rice, 0.25, ""},
+        {"other dimension", TransactionItem{Quantity: 1, Unit: "l"}, rice, 0, "cannot convert l to kg"},
+        {"half an egg", TransactionItem{Quantity: 0.5}, egg, 0, "Egg: quantity in pcs must be a whole number"},
+        {"too little to weigh", TransactionItem{Quantity: 0.4, Unit: "g"}, rice, 0, "Rice: quantity must be positive"},
+    }
+    for _, tt := range tests {
+        got, err := saleQuantity(tt.item, tt.p)
+        if tt.wantErr != "" {
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) { t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr) }
+            continue
+        }
+        if err != nil || got != tt.want { t.Errorf("%s: got %v, %v; want %v", tt.name, got, err, tt.want) }
+    }
+}
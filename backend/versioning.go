@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Products and settings carry a version that every write bumps. Reads send
+// it as the ETag; writes must send it back as If-Match (or a body "version")
+// and are refused with 412 when the row has moved on since, instead of
+// silently overwriting a sale's stock decrement or another manager's edit.
+// A write without a version is refused with 428.
+
+// expectedVersion returns the version the client based its write on, from
+// If-Match or else bodyVersion. Zero means the client sent none.
+func expectedVersion(c *gin.Context, bodyVersion int) (int, error) {
+    h := strings.TrimSpace(c.GetHeader("If-Match"))
+    if h == "" || h == "*" { return bodyVersion, nil }
+    h = strings.Trim(strings.TrimPrefix(h, "W/"), `"`)
+    v, err := strconv.Atoi(h)
+    if err != nil || v <= 0 { return 0, errors.New("If-Match must be a version ETag") }
+    return v, nil
+}
+
+func setETag(c *gin.Context, version int) {
+    c.Header("ETag", `"`+strconv.Itoa(version)+`"`)
+}
+
+// respondStale answers a write based on an old version with 412 and the
+// current state, so the client can show what changed and retry.
+func respondStale(c *gin.Context, version int, current any) {
+    setETag(c, version)
+    c.JSON(http.StatusPreconditionFailed, gin.H{"error": "modified by someone else, reload and retry", "version": version, "current": current})
+}
+
+// respondVersionRequired refuses a write that names no version with 428 and
+// the current version, so a client cannot overwrite changes it never saw.
+func respondVersionRequired(c *gin.Context, version int) {
+    setETag(c, version)
+    c.JSON(http.StatusPreconditionRequired, gin.H{"error": "send the version you edited as If-Match or \"version\"", "version": version})
+}
+
+// addProductStock changes a product's organization-wide stock by delta.
+// Stock cannot be edited through PUT or PATCH, so the version is left
+// alone: a sale does not make an open product edit stale.
+func addProductStock(tx *gorm.DB, orgID, productID uint, delta float64) error {
+    return tx.Model(&Product{}).Where("id = ? AND organization_id = ?", productID, orgID).
+        UpdateColumn("stock_quantity", gorm.Expr("stock_quantity + ?", delta)).Error
+}
+
+// writeProduct applies updates to p if it is still at version and reloads
+// p. It responds itself and returns false on a stale version or a failed
+// save.
+func writeProduct(c *gin.Context, p *Product, version int, updates map[string]any) bool {
+    updates["version"] = gorm.Expr("version + 1")
+    updates["date_updated"] = nowISO()
+    res := db.Model(&Product{}).Where("id = ? AND organization_id = ? AND version = ?", p.ID, p.OrganizationID, version).Updates(updates)
+    if res.Error != nil {
+        sku := p.SKU
+        if s, ok := updates["sku"].(*string); ok { sku = s }
+        saveSKUError(c, res.Error, p.OrganizationID, sku, p.ID)
+        return false
+    }
+    if err := db.First(p, p.ID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error": "not found"}); return false }
+    if res.RowsAffected == 0 { respondStale(c, p.Version, p); return false }
+    _ = indexProduct(db, *p)
+    setETag(c, p.Version)
+    return true
+}
+
+// patchProduct updates only the fields present in the body.
+func patchProduct(c *gin.Context) {
+    uid := c.MustGet("userID").(uint)
+    orgUser := c.MustGet("orgUser").(OrganizationUser)
+    id, _ := strconv.Atoi(c.Param("id"))
+    var p Product
+    if err := db.Where("id = ? AND organization_id = ?", id, orgUser.OrganizationID).First(&p).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+        return
+    }
+    var body map[string]json.RawMessage
+    if err := c.BindJSON(&body); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad request"}); return }
+    var bodyVersion int
+    if raw, ok := body["version"]; ok {
+        if err := json.Unmarshal(raw, &bodyVersion); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad version"}); return }
+    }
+    version, err := expectedVersion(c, bodyVersion)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    if version == 0 { respondVersionRequired(c, p.Version); return }
+
+    updates := map[string]any{}
+    for field, raw := range body {
+        var v any
+        switch field {
+        case "name":
+            var s string
+            err = json.Unmarshal(raw, &s)
+            if err == nil && s == "" { err = errors.New("empty") }
+            v = s
+        case "price":
+            var f float64
+            err = json.Unmarshal(raw, &f)
+            v = f
+        case "stock_quantity":
+            // stock moves through sales, receipts, transfers and adjustments
+            c.JSON(http.StatusBadRequest, gin.H{"error": "stock_quantity cannot be edited; adjust stock at a location instead"})
+            return
+        case "unit":
+            var s string
+            err = json.Unmarshal(raw, &s)
+            if err == nil && !validUnit(s) { err = errors.New("unknown") }
+            v = s
+        case "plu":
+            var s *string
+            err = json.Unmarshal(raw, &s)
+            if err == nil && checkUnitAndPLU(defaultUnit, s) != nil { err = errors.New("must be 5 digits") }
+            v = s
+        case "cost":
+            var f *float64
+            err = json.Unmarshal(raw, &f)
+            if err == nil && f != nil && *f < 0 { err = errors.New("negative") }
+            v = f
+        case "sku", "icon", "category":
+            var s *string
+            err = json.Unmarshal(raw, &s)
+            if field == "sku" { s = normalizeSKU(s) }
+            v = s
+        default:
+            continue
+        }
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad " + field}); return }
+        updates[field] = v
+    }
+    if len(updates) == 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "no updatable fields"}); return }
+    if sku, ok := updates["sku"]; ok {
+        if !checkSKU(c, p.OrganizationID, sku.(*string), p.ID) { return }
+    }
+    oldPrice := p.Price
+    if !writeProduct(c, &p, version, updates) { return }
+    if _, ok := updates["price"]; ok {
+        _ = recordPriceChange(db, p.OrganizationID, p.ID, nil, oldPrice, p.Price, uid, "manual")
+    }
+    c.JSON(http.StatusOK, p)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestWritesNeedAVersion(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 10)
+    path := fmt.Sprintf("/products/%d", p.ID)
+    put := func(body map[string]any) map[string]any {
+        body["name"], body["price"], body["stock_quantity"] = "Green tea", 6000, 99
+        return body
+    }
+    // creating a setting needs no version
+    e.expect(e.do(http.MethodPut, "/settings/tax_rate", map[string]any{"value": "11"}), http.StatusOK, nil)
+
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        body   map[string]any
+        want   int
+    }{
+        {"put product without version", http.MethodPut, path, put(map[string]any{}), http.StatusPreconditionRequired},
+        {"put product with old version", http.MethodPut, path, put(map[string]any{"version": p.Version + 1}), http.StatusPreconditionFailed},
+        {"patch product without version", http.MethodPatch, path, map[string]any{"name": "Black tea"}, http.StatusPreconditionRequired},
+        {"patch product stock", http.MethodPatch, path, map[string]any{"stock_quantity": 5, "version": p.Version}, http.StatusBadRequest},
+        {"put setting without version", http.MethodPut, "/settings/tax_rate", map[string]any{"value": "12"}, http.StatusPreconditionRequired},
+        {"put profile setting without version", http.MethodPut, "/settings/business_name", map[string]any{"value": "Warung"}, http.StatusPreconditionRequired},
+        {"put organization without version", http.MethodPut, "/organization", map[string]any{"name": "Warung"}, http.StatusPreconditionRequired},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) { e.with(t).expect(e.do(tt.method, tt.path, tt.body), tt.want, nil) })
+    }
+
+    var got Product
+    e.expect(e.do(http.MethodPut, path, put(map[string]any{"version": p.Version})), http.StatusOK, &got)
+    if got.Name != "Green tea" || got.StockQuantity != 10 { t.Fatalf("after put: name %q stock %v, want Green tea and unchanged stock 10", got.Name, got.StockQuantity) }
+
+    var s Setting
+    e.expect(e.do(http.MethodGet, "/settings/tax_rate", nil), http.StatusOK, &s)
+    e.expect(e.do(http.MethodPut, "/settings/tax_rate", map[string]any{"value": "12", "version": s.Version}), http.StatusOK, nil)
+
+    var org Organization
+    e.expect(e.do(http.MethodGet, "/organization", nil), http.StatusOK, &org)
+    e.expect(e.do(http.MethodPut, "/organization", map[string]any{"name": "Warung", "version": org.Version}), http.StatusOK, &org)
+    if org.Name != "Warung" { t.Fatalf("organization name = %q", org.Name) }
+}
+
+func TestStockChangesKeepTheVersion(t *testing.T) {
+    e := newTestEnv(t)
+    p := e.product("Tea", 5000, 10)
+    // the edit was opened before the stock moved
+    var opened Product
+    e.expect(e.do(http.MethodGet, fmt.Sprintf("/products/%d", p.ID), nil), http.StatusOK, &opened)
+
+    e.expect(e.do(http.MethodPost, "/transactions", map[string]any{
+        "amount_received": 10000, "items": []map[string]any{{"product_id": p.ID, "quantity": 3}},
+    }), http.StatusCreated, nil)
+    if err := addProductStock(db, e.org.ID, p.ID, 2); err != nil { t.Fatal(err) }
+
+    var got Product
+    e.expect(e.do(http.MethodPatch, fmt.Sprintf("/products/%d", p.ID), map[string]any{"name": "Green tea", "version": opened.Version}), http.StatusOK, &got)
+    if got.Version != opened.Version+1 || got.StockQuantity != 9 { t.Errorf("after edit: version %d, stock %v; want %d, 9", got.Version, got.StockQuantity, opened.Version+1) }
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Minimal XLSX support for product import/export: reads the first worksheet
+// as rows of strings and writes a single-sheet workbook of inline strings.
+
+const (
+    maxXLSXPartSize = 32 << 20 // uncompressed bytes read from one zip entry
+    maxXLSXColumns  = 16384    // XFD, the last column Excel has
+)
+
+type xlsxRelationships struct {
+    Items []struct {
+        ID     string `xml:"Id,attr"`
+        Type   string `xml:"Type,attr"`
+        Target string `xml:"Target,attr"`
+    } `xml:"Relationship"`
+}
+
+type xlsxWorkbook struct {
+    Sheets []struct {
+        RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+    } `xml:"sheets>sheet"`
+}
+
+type xlsxSharedStrings struct {
+    Items []struct {
+        T    string `xml:"t"`
+        Runs []struct {
+            T string `xml:"t"`
+        } `xml:"r"`
+    } `xml:"si"`
+}
+
+type xlsxSheet struct {
+    Rows []struct {
+        Cells []struct {
+            Ref    string `xml:"r,attr"`
+            Type   string `xml:"t,attr"`
+            Value  string `xml:"v"`
+            Inline struct {
+                T string `xml:"t"`
+            } `xml:"is"`
+        } `xml:"c"`
+    } `xml:"sheetData>row"`
+}
+
+func readXLSXRows(data []byte) ([][]string, error) {
+    zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil { return nil, errors.New("not a valid xlsx file") }
+    files := map[string]*zip.File{}
+    for _, f := range zr.File { files[f.Name] = f }
+
+    workbook := "xl/workbook.xml"
+    if target := xlsxRelTarget(files, "", "/officeDocument", ""); target != "" { workbook = target }
+    f, ok := files[workbook]
+    if !ok { return nil, errors.New("xlsx has no workbook") }
+    var wb xlsxWorkbook
+    if err := decodeZipXML(f, &wb); err != nil { return nil, err }
+    if len(wb.Sheets) == 0 { return nil, errors.New("xlsx has no worksheets") }
+    sheetPath := xlsxRelTarget(files, workbook, "", wb.Sheets[0].RelID)
+    f, ok = files[sheetPath]
+    if !ok { return nil, errors.New("xlsx has no first worksheet") }
+
+    var shared []string
+    if f, ok := files[xlsxRelTarget(files, workbook, "/sharedStrings", "")]; ok {
+        var ss xlsxSharedStrings
+        if err := decodeZipXML(f, &ss); err != nil { return nil, err }
+        for _, it := range ss.Items {
+            if len(it.Runs) == 0 { shared = append(shared, it.T); continue }
+            var sb strings.Builder
+            for _, r := range it.Runs { sb.WriteString(r.T) }
+            shared = append(shared, sb.String())
+        }
+    }
+    var sheet xlsxSheet
+    if err := decodeZipXML(f, &sheet); err != nil { return nil, err }
+
+    if len(sheet.Rows) > maxImportRows+1 { return nil, errTooManyRows }
+    rows := make([][]string, 0, len(sheet.Rows))
+    for _, r := range sheet.Rows {
+        var row []string
+        for i, cell := range r.Cells {
+            col := i
+            if cell.Ref != "" { col = xlsxColumnIndex(cell.Ref) }
+            if col < 0 || col >= maxXLSXColumns { return nil, fmt.Errorf("bad cell reference %q", cell.Ref) }
+            for len(row) < col { row = append(row, "") }
+            v := cell.Value
+            switch cell.Type {
+            case "s":
+                idx, err := strconv.Atoi(v)
+                if err != nil || idx < 0 || idx >= len(shared) { return nil, fmt.Errorf("bad shared string in %s", cell.Ref) }
+                v = shared[idx]
+            case "inlineStr":
+                v = cell.Inline.T
+            }
+            row = append(row, v)
+        }
+        rows = append(rows, row)
+    }
+    return rows, nil
+}
+
+// xlsxRelTarget finds a part through the relationships of the part at
+// from ("" for the package), by relationship id or by a suffix of its type.
+// It returns "" when there is no such relationship.
+func xlsxRelTarget(files map[string]*zip.File, from, typeSuffix, id string) string {
+    dir, name := path.Split(from)
+    f, ok := files[dir+"_rels/"+name+".rels"]
+    if !ok { return "" }
+    var rels xlsxRelationships
+    if err := decodeZipXML(f, &rels); err != nil { return "" }
+    for _, r := range rels.Items {
+        if (id != "" && r.ID == id) || (typeSuffix != "" && strings.HasSuffix(r.Type, typeSuffix)) {
+            if strings.HasPrefix(r.Target, "/") { return strings.TrimPrefix(r.Target, "/") }
+            return path.Join(dir, r.Target)
+        }
+    }
+    return ""
+}
+
+// decodeZipXML decodes one zip entry, refusing entries that inflate past
+// maxXLSXPartSize.
+func decodeZipXML(f *zip.File, v any) error {
+    rc, err := f.Open()
+    if err != nil { return err }
+    defer rc.Close()
+    data, err := io.ReadAll(io.LimitReader(rc, maxXLSXPartSize+1))
+    if err != nil { return err }
+    if len(data) > maxXLSXPartSize { return fmt.Errorf("xlsx part %s is too large", f.Name) }
+    return xml.Unmarshal(data, v)
+}
+
+// xlsxColumnIndex turns a cell reference like "C12" into a zero-based column.
+func xlsxColumnIndex(ref string) int {
+    n := 0
+    for _, ch := range ref {
+        if ch < 'A' || ch > 'Z' { break }
+        n = n*26 + int(ch-'A'+1)
+    }
+    return n - 1
+}
+
+func xlsxColumnName(i int) string {
+    name := ""
+    for i++; i > 0; i = (i - 1) / 26 {
+        name = string(rune('A'+(i-1)%26)) + name
+    }
+    return name
+}
+
+// writeXLSX writes rows to a single sheet. The first row is the header;
+// cells in numericCols are written as numbers when they parse as one.
+func writeXLSX(w io.Writer, rows [][]string, numericCols map[int]bool) error {
+    zw := zip.NewWriter(w)
+    parts := []struct{ name, body string }{
+        {"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+        {"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+        {"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Products" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+        {"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+    }
+    for _, p := range parts {
+        fw, err := zw.Create(p.name)
+        if err != nil { return err }
+        if _, err := io.WriteString(fw, p.body); err != nil { return err }
+    }
+
+    var sb strings.Builder
+    sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+    sb.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+    for r, row := range rows {
+        fmt.Fprintf(&sb, `<row r="%d">`, r+1)
+        for col, v := range row {
+            ref := xlsxColumnName(col) + strconv.Itoa(r+1)
+            if _, err := strconv.ParseFloat(v, 64); err == nil && r > 0 && numericCols[col] {
+                fmt.Fprintf(&sb, `<c r="%s"><v>%s</v></c>`, ref, v)
+                continue
+            }
+            fmt.Fprintf(&sb, `<c r="%s" t="inlineStr"><is><t>`, ref)
+            if err := xml.EscapeText(&sb, []byte(v)); err != nil { return err }
+            sb.WriteString(`</t></is></c>`)
+        }
+        sb.WriteString(`</row>`)
+    }
+    sb.WriteString(`</sheetData></worksheet>`)
+    fw, err := zw.Create("xl/worksheets/sheet1.xml")
+    if err != nil { return err }
+    if _, err := io.WriteString(fw, sb.String()); err != nil { return err }
+    return zw.Close()
+}
@@ -0,0 +1,53 @@
+class Organization {
+  int? id;
+  String name;
+  String legalName;
+  String address;
+  String taxId;
+  String phone;
+  String? logoUrl;
+  String currency;
+  String timezone;
+  String locale;
+  String receiptFooter;
+
+  Organization({
+    this.id,
+    required this.name,
+    this.legalName = '',
+    this.address = '',
+    this.taxId = '',
+    this.phone = '',
+    this.logoUrl,
+    this.currency = 'IDR',
+    this.timezone = 'Asia/Jakarta',
+    this.locale = 'id-ID',
+    this.receiptFooter = '',
+  });
+
+  factory Organization.fromMap(Map<String, dynamic> map) {
+    return Organization(
+      id: map['id'],
+      name: map['name'] ?? '',
+      legalName: map['legal_name'] ?? '',
+      address: map['address'] ?? '',
+      taxId: map['tax_id'] ?? '',
+      phone: map['phone'] ?? '',
+      logoUrl: map['logo_url'],
+      currency: map['currency'] ?? 'IDR',
+      timezone: map['timezone'] ?? 'Asia/Jakarta',
+      locale: map['locale'] ?? 'id-ID',
+      receiptFooter: map['receipt_footer'] ?? '',
+    );
+  }
+
+  // Lines printed under the business name on receipts and invoices.
+  List<String> get headerLines {
+    return [
+      if (legalName.isNotEmpty && legalName != name) legalName,
+      ...address.split('\n').map((l) => l.trim()).where((l) => l.isNotEmpty),
+      if (phone.isNotEmpty) 'Tel: $phone',
+      if (taxId.isNotEmpty) 'NPWP: $taxId',
+    ];
+  }
+}
@@ -5,7 +5,8 @@ class Product {
   double price;
   String? sku;
   String? icon; // Material icon name
-  int stockQuantity;
+  double stockQuantity; // fractional for products sold by weight or volume
+  int version; // sent back on update so the server can refuse stale edits
   String dateCreated;
   String dateUpdated;
 
@@ -17,6 +18,7 @@ class Product {
     this.sku,
     this.icon,
     this.stockQuantity = 0,
+    this.version = 0,
     required this.dateCreated,
     required this.dateUpdated,
   });
@@ -30,6 +32,7 @@ class Product {
       'sku': sku,
       'icon': icon,
       'stock_quantity': stockQuantity,
+      'version': version,
       'date_created': dateCreated,
       'date_updated': dateUpdated,
     };
@@ -43,7 +46,8 @@ class Product {
       price: (map['price'] as num).toDouble(),
       sku: map['sku'],
       icon: map['icon'],
-      stockQuantity: (map['stock_quantity'] as num).toInt(),
+      stockQuantity: (map['stock_quantity'] as num).toDouble(),
+      version: (map['version'] as num?)?.toInt() ?? 0,
       dateCreated: map['date_created'],
       dateUpdated: map['date_updated'],
     );
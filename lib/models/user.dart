@@ -31,7 +31,7 @@ class User {
       id: map['id'],
       name: map['name'],
       username: map['username'],
-      password: map['password'],
+      password: map['password'] ?? '',
       dateCreated: map['date_created'],
       dateUpdated: map['date_updated'],
     );
@@ -1,4 +1,5 @@
 import 'package:flutter/material.dart';
+import 'package:poshit/api/api_client.dart';
 import 'package:poshit/models/product.dart';
 import 'package:poshit/services/product_service.dart';
 import 'package:poshit/services/settings_service.dart';
@@ -36,7 +37,10 @@ class _AddEditProductScreenState extends State<AddEditProductScreen> {
       _nameController.text = widget.product!.name;
       _priceController.text = widget.product!.price.toString();
       _skuController.text = widget.product!.sku ?? '';
-      _stockQuantityController.text = widget.product!.stockQuantity.toString();
+      final stock = widget.product!.stockQuantity;
+      _stockQuantityController.text = stock == stock.roundToDouble()
+          ? stock.toInt().toString()
+          : stock.toString();
       _iconName = widget.product!.icon;
     }
   }
@@ -56,6 +60,12 @@ class _AddEditProductScreenState extends State<AddEditProductScreen> {
     super.dispose();
   }
 
+  // Stock may be fractional for products sold by weight or volume; a
+  // decimal comma is accepted as well as a point.
+  double? _parseQuantity(String value) {
+    return double.tryParse(value.trim().replaceAll(',', '.'));
+  }
+
   Future<void> _saveProduct() async {
     if (_formKey.currentState!.validate()) {
       final userId = _userSessionService.currentUserId;
@@ -74,8 +84,8 @@ class _AddEditProductScreenState extends State<AddEditProductScreen> {
       final String? sku = _useSkuField && _skuController.text.isNotEmpty
           ? _skuController.text
           : null;
-      final int stockQuantity = _useInventoryTracking
-          ? int.parse(_stockQuantityController.text)
+      final double stockQuantity = _useInventoryTracking
+          ? _parseQuantity(_stockQuantityController.text)!
           : 0;
 
       if (widget.product == null) {
@@ -100,11 +110,27 @@ class _AddEditProductScreenState extends State<AddEditProductScreen> {
           price: price,
           sku: sku,
           icon: _iconName,
-          stockQuantity: stockQuantity,
+          stockQuantity: widget.product!.stockQuantity,
+          version: widget.product!.version,
           dateCreated: widget.product!.dateCreated,
           dateUpdated: DateTime.now().toIso8601String(),
         );
-        await _productService.updateProduct(updatedProduct);
+        try {
+          await _productService.updateProduct(updatedProduct);
+          if (_useInventoryTracking) {
+            await _productService.adjustStock(
+              widget.product!.id!,
+              stockQuantity - widget.product!.stockQuantity,
+            );
+          }
+        } on ApiError catch (e) {
+          if (!mounted) return;
+          final msg = e.statusCode == 412
+              ? 'This product was changed elsewhere. Reopen it and try again.'
+              : 'Update failed';
+          ScaffoldMessenger.of(context).showSnackBar(SnackBar(content: Text(msg)));
+          return;
+        }
       }
       if (!mounted) return;
       Navigator.pop(context, true); // Pop with true to indicate success
@@ -163,13 +189,15 @@ class _AddEditProductScreenState extends State<AddEditProductScreen> {
                   decoration: const InputDecoration(
                     labelText: 'Stock Quantity',
                   ),
-                  keyboardType: TextInputType.number,
+                  keyboardType: const TextInputType.numberWithOptions(
+                    decimal: true,
+                  ),
                   validator: (value) {
                     if (value == null || value.isEmpty) {
                       return 'Please enter stock quantity';
                     }
-                    if (int.tryParse(value) == null) {
-                      return 'Please enter a valid integer';
+                    if (_parseQuantity(value) == null) {
+                      return 'Please enter a valid number';
                     }
                     return null;
                   },
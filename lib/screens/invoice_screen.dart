@@ -2,8 +2,10 @@ import 'package:flutter/material.dart';
 import 'package:poshit/models/transaction.dart';
 import 'package:poshit/models/transaction_item.dart';
 import 'package:poshit/models/product.dart';
+import 'package:poshit/models/organization.dart';
 import 'package:poshit/services/transaction_service.dart';
 import 'package:poshit/services/product_service.dart';
+import 'package:poshit/services/settings_service.dart';
 import 'package:poshit/utils/currency_formatter.dart';
 import 'package:pdf/pdf.dart';
 import 'package:pdf/widgets.dart' as pw;
@@ -23,11 +25,13 @@ class _InvoiceScreenState extends State<InvoiceScreen> {
   late Future<Map<String, dynamic>> _invoiceDataFuture;
   final TransactionService _transactionService = TransactionService();
   final ProductService _productService = ProductService();
+  final SettingsService _settingsService = SettingsService();
 
   Future<void> _generateInvoicePdf(
     Transaction transaction,
     List<TransactionItem> items,
     Map<int, Product> productMap,
+    Organization? organization,
   ) async {
     final pdf = pw.Document();
 
@@ -38,12 +42,21 @@ class _InvoiceScreenState extends State<InvoiceScreen> {
             crossAxisAlignment: pw.CrossAxisAlignment.start,
             children: [
               pw.Text(
-                'PoSHIT - Invoice',
+                organization?.name ?? 'PoSHIT',
                 style: pw.TextStyle(
                   fontSize: 24,
                   fontWeight: pw.FontWeight.bold,
                 ),
               ),
+              ...?organization?.headerLines.map((line) => pw.Text(line)),
+              pw.SizedBox(height: 10),
+              pw.Text(
+                'Invoice',
+                style: pw.TextStyle(
+                  fontSize: 18,
+                  fontWeight: pw.FontWeight.bold,
+                ),
+              ),
               pw.SizedBox(height: 20),
               pw.Text('Transaction ID: ${transaction.id}'),
               pw.Text('Date: ${formatDateTime(transaction.transactionDate)}'),
@@ -197,6 +210,7 @@ class _InvoiceScreenState extends State<InvoiceScreen> {
         data['transaction'],
         data['items'],
         data['productMap'],
+        data['organization'],
       );
       return data;
     });
@@ -211,6 +225,7 @@ class _InvoiceScreenState extends State<InvoiceScreen> {
       widget.transactionId,
     );
     final products = await _productService.getProducts();
+    final organization = await _settingsService.getOrganization();
 
     // Map product IDs to product objects for easy lookup
     final Map<int, Product> productMap = {for (var p in products) p.id!: p};
@@ -219,6 +234,7 @@ class _InvoiceScreenState extends State<InvoiceScreen> {
       'transaction': transaction,
       'items': items,
       'productMap': productMap,
+      'organization': organization,
     };
   }
 
@@ -239,6 +255,7 @@ class _InvoiceScreenState extends State<InvoiceScreen> {
             final Transaction transaction = snapshot.data!['transaction'];
             final List<TransactionItem> items = snapshot.data!['items'];
             final Map<int, Product> productMap = snapshot.data!['productMap'];
+            final Organization? organization = snapshot.data!['organization'];
 
             return Column(
               children: [
@@ -248,6 +265,17 @@ class _InvoiceScreenState extends State<InvoiceScreen> {
                     child: Column(
                       crossAxisAlignment: CrossAxisAlignment.start,
                       children: [
+                        if (organization != null) ...[
+                          Text(
+                            organization.name,
+                            style: const TextStyle(
+                              fontSize: 22,
+                              fontWeight: FontWeight.bold,
+                            ),
+                          ),
+                          ...organization.headerLines.map((line) => Text(line)),
+                          const SizedBox(height: 10),
+                        ],
                         Text(
                           'Invoice for Transaction ID: ${transaction.id}',
                           style: const TextStyle(
@@ -324,8 +352,12 @@ class _InvoiceScreenState extends State<InvoiceScreen> {
                     mainAxisAlignment: MainAxisAlignment.spaceAround,
                     children: [
                       ElevatedButton.icon(
-                        onPressed: () =>
-                            _generateInvoicePdf(transaction, items, productMap),
+                        onPressed: () => _generateInvoicePdf(
+                          transaction,
+                          items,
+                          productMap,
+                          organization,
+                        ),
                         icon: const Icon(Icons.print),
                         label: const Text('Print Invoice'),
                       ),
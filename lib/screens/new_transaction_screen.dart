@@ -206,7 +206,7 @@ class _NewTransactionScreenState extends State<NewTransactionScreen> {
       totalAmount: totalAmount,
       amountReceived: amountReceived,
       change: changeGiven,
-      transactionDate: DateTime.now().toIso8601String(),
+      transactionDate: DateTime.now().toUtc().toIso8601String(),
       dateCreated: DateTime.now().toIso8601String(),
       dateUpdated: DateTime.now().toIso8601String(),
     );
@@ -545,7 +545,7 @@ class _ProductListPane extends StatelessWidget {
                                   ),
                                   if (useInventoryTracking)
                                     _Chip(
-                                      text: 'Stock: ${product.stockQuantity}',
+                                      text: 'Stock: ${formatQuantity(product.stockQuantity)}',
                                     ),
                                 ],
                               ),
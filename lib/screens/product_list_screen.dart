@@ -3,6 +3,7 @@ import 'package:poshit/models/product.dart';
 import 'package:poshit/services/product_service.dart';
 import 'package:poshit/screens/add_edit_product_screen.dart';
 import 'package:poshit/services/settings_service.dart';
+import 'package:poshit/utils/currency_formatter.dart';
 
 class ProductListScreen extends StatefulWidget {
   const ProductListScreen({super.key});
@@ -78,7 +79,7 @@ class _ProductListScreenState extends State<ProductListScreen> {
                   child: ListTile(
                     title: Text(product.name),
                     subtitle: Text(
-                      'Price: Rp. ${product.price.toStringAsFixed(0)}${_useInventoryTracking ? ' | Stock: ${product.stockQuantity}' : ''}${_useSkuField && product.sku != null ? ' | SKU: ${product.sku}' : ''}',
+                      'Price: Rp. ${product.price.toStringAsFixed(0)}${_useInventoryTracking ? ' | Stock: ${formatQuantity(product.stockQuantity)}' : ''}${_useSkuField && product.sku != null ? ' | SKU: ${product.sku}' : ''}',
                     ),
                     trailing: Row(
                       mainAxisSize: MainAxisSize.min,
@@ -39,6 +39,7 @@ class _ReceiptPreviewScreenState extends State<ReceiptPreviewScreen> {
   BluetoothDevice? _device;
   String _businessName = 'My Store';
   String _receiptFooter = 'Thank you!';
+  List<String> _headerLines = [];
 
   // Bluetooth is unsupported on Windows in this app; guard calls on Windows
   bool get _connected =>
@@ -66,10 +67,12 @@ class _ReceiptPreviewScreenState extends State<ReceiptPreviewScreen> {
   Future<void> _loadSettings() async {
     final businessName = await _settingsService.getBusinessName();
     final receiptFooter = await _settingsService.getReceiptFooter();
+    final organization = await _settingsService.getOrganization();
     if (mounted) {
       setState(() {
         _businessName = businessName;
         _receiptFooter = receiptFooter;
+        _headerLines = organization?.headerLines ?? [];
       });
     }
   }
@@ -196,6 +199,12 @@ class _ReceiptPreviewScreenState extends State<ReceiptPreviewScreen> {
         width: PosTextSize.size2,
       ),
     );
+    for (final line in _headerLines) {
+      bytes += generator.text(
+        line,
+        styles: const PosStyles(align: PosAlign.center),
+      );
+    }
     bytes += generator.text(
       "--------------------------------",
       styles: const PosStyles(align: PosAlign.center),
@@ -331,6 +340,7 @@ class _ReceiptPreviewScreenState extends State<ReceiptPreviewScreen> {
                   ),
                 ),
               ),
+              ..._headerLines.map((line) => pw.Center(child: pw.Text(line))),
               pw.SizedBox(height: 20),
               pw.Text("Transaction ID: ${widget.transaction.id}"),
               pw.Text("Date: ${widget.transaction.transactionDate}"),
@@ -437,6 +447,7 @@ class _ReceiptPreviewScreenState extends State<ReceiptPreviewScreen> {
                             .copyWith(fontWeight: FontWeight.bold),
                       ),
                     ),
+                    ..._headerLines.map((line) => Center(child: Text(line))),
                     const Divider(),
                     Text("Transaction ID: ${widget.transaction.id}"),
                     Text(
@@ -145,11 +145,26 @@ class _SettingsScreenState extends State<SettingsScreen> {
   }
 
   Future<void> _saveSettings() async {
-    await _settingsService.setPrinterType(_selectedPrinterType);
-    await _settingsService.setBusinessName(_businessNameController.text);
-    await _settingsService.setReceiptFooter(_receiptFooterController.text);
-    await _settingsService.setUseInventoryTracking(_useInventoryTracking);
-    await _settingsService.setUseSkuField(_useSkuField);
+    try {
+      await _settingsService.setPrinterType(_selectedPrinterType);
+      await _settingsService.setBusinessName(_businessNameController.text);
+      await _settingsService.setReceiptFooter(_receiptFooterController.text);
+      await _settingsService.setUseInventoryTracking(_useInventoryTracking);
+      await _settingsService.setUseSkuField(_useSkuField);
+    } on SettingsConflict {
+      // Someone else saved first: show their values instead of overwriting
+      await _loadSettings();
+      if (mounted) {
+        ScaffoldMessenger.of(context).showSnackBar(
+          const SnackBar(
+            content: Text(
+              'Settings were changed on another device. The latest values are shown; make your changes again.',
+            ),
+          ),
+        );
+      }
+      return;
+    }
 
     // Update original values after successful save
     _originalPrinterType = _selectedPrinterType;
@@ -69,21 +69,20 @@ class ProductService {
     return 1;
   }
 
-  Future<void> updateStockQuantity(int productId, int newQuantity) async {
-    // Could be added to API if needed; for now fetch and update product
-    final product = await getProductById(productId);
-    if (product == null) return;
-    final updated = Product(
-      id: product.id,
-      userId: product.userId,
-      name: product.name,
-      price: product.price,
-      sku: product.sku,
-      stockQuantity: newQuantity,
-      dateCreated: product.dateCreated,
-      dateUpdated: DateTime.now().toIso8601String(),
+  // Stock is not part of a product update; a change is booked as an
+  // adjustment at the organization's default location.
+  Future<void> adjustStock(int productId, double delta) async {
+    if (delta == 0) return;
+    final locations = await _api.getJsonList('/locations');
+    final location = locations.cast<Map<String, dynamic>>().firstWhere(
+      (l) => l['is_default'] == true,
+      orElse: () => throw ApiError('No default location'),
     );
-    await updateProduct(updated);
+    await _api.postJson('/locations/${location['id']}/stock', {
+      'product_id': productId,
+      'delta': delta,
+    });
+    ProductEvents().notifyUpdated();
   }
 
   Future<List<Product>> searchProducts(String query) async {
@@ -1,3 +1,4 @@
+import 'package:poshit/models/organization.dart';
 import 'package:poshit/services/user_session_service.dart';
 import 'package:poshit/api/api_client.dart';
 import 'package:poshit/services/settings_events.dart';
@@ -5,6 +6,9 @@ import 'package:poshit/services/settings_events.dart';
 class SettingsService {
   final UserSessionService _userSessionService = UserSessionService();
   final ApiClient _api = ApiClient();
+  // The version each setting was read at, sent back when it is written so
+  // the server refuses to overwrite a change made elsewhere in the meantime.
+  final Map<String, int> _versions = {};
 
   Future<void> setPrinterType(String printerType) async {
     await _setSetting('printer_type', printerType);
@@ -33,6 +37,18 @@ class SettingsService {
     return await _getSetting('receipt_footer', 'Thank you for your purchase!');
   }
 
+  // The organization profile holds the business details printed on
+  // receipts and invoices.
+  Future<Organization?> getOrganization() async {
+    final userId = _userSessionService.currentUserId;
+    if (userId == null) return null;
+    try {
+      return Organization.fromMap(await _api.getJson('/organization'));
+    } catch (_) {
+      return null;
+    }
+  }
+
   Future<void> setUseInventoryTracking(bool useInventoryTracking) async {
     await _setSetting(
       'use_inventory_tracking',
@@ -57,7 +73,14 @@ class SettingsService {
   }
 
   Future<void> setLastConnectedPrinterAddress(String address) async {
-    await _setSetting('last_connected_printer_address', address);
+    const key = 'last_connected_printer_address';
+    try {
+      await _setSetting(key, address);
+    } on SettingsConflict {
+      // The printer connected last wins, so write over the current version
+      await _getSettingNullable(key, null);
+      await _setSetting(key, address);
+    }
     SettingsEvents().notifyUpdated();
   }
 
@@ -68,7 +91,26 @@ class SettingsService {
   Future<void> _setSetting(String key, String value) async {
     final userId = _userSessionService.currentUserId;
     if (userId == null) return;
-    await _api.putJson('/settings/$key', {'value': value});
+    final body = <String, dynamic>{'value': value};
+    final version = _versions[key];
+    if (version != null) body['version'] = version;
+    try {
+      final res = await _api.putJson('/settings/$key', body);
+      _remember(key, res);
+    } on ApiError catch (e) {
+      if (e.statusCode != 412 && e.statusCode != 428) rethrow;
+      _versions.remove(key);
+      throw SettingsConflict(key);
+    }
+  }
+
+  void _remember(String key, Map<String, dynamic> res) {
+    final version = (res['version'] as num?)?.toInt();
+    if (version != null && version > 0) {
+      _versions[key] = version;
+    } else {
+      _versions.remove(key);
+    }
   }
 
   Future<String> _getSetting(String key, String defaultValue) async {
@@ -76,6 +118,7 @@ class SettingsService {
     if (userId == null) return defaultValue;
     try {
       final res = await _api.getJson('/settings/$key');
+      _remember(key, res);
       final value = res['value'];
       if (value == null) {
         await _setSetting(key, defaultValue);
@@ -92,6 +135,7 @@ class SettingsService {
     if (userId == null) return defaultValue;
     try {
       final res = await _api.getJson('/settings/$key');
+      _remember(key, res);
       final value = res['value'];
       if (value == null) {
         if (defaultValue != null) {
@@ -105,3 +149,12 @@ class SettingsService {
     }
   }
 }
+
+// SettingsConflict means a setting was changed elsewhere after it was read.
+// Reload the settings and let the user make their change again.
+class SettingsConflict implements Exception {
+  final String key;
+  SettingsConflict(this.key);
+  @override
+  String toString() => 'SettingsConflict: $key was changed elsewhere';
+}
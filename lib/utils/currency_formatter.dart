@@ -13,7 +13,12 @@ String formatDateTime(String isoString) {
   final dateTime = DateTime.tryParse(isoString);
   if (dateTime == null) return isoString;
   final dateFormat = DateFormat('dd-MM-yyyy HH:mm:ss');
-  return dateFormat.format(dateTime);
+  return dateFormat.format(dateTime.toLocal());
+}
+
+// formatQuantity shows stock without trailing zeros: 12, 1.5, 0.125.
+String formatQuantity(double quantity) {
+  return NumberFormat('#,##0.###', 'id_ID').format(quantity);
 }
 
 String formatDate(DateTime date) {
@@ -33,4 +33,19 @@ void main() {
     expect(fromMap.sku, 'SKU1');
     expect(fromMap.stockQuantity, 10);
   });
+
+  test('Product keeps fractional stock', () {
+    final product = Product.fromMap({
+      'id': 2,
+      'user_id': 1,
+      'name': 'Rice',
+      'price': 12000,
+      'stock_quantity': 2.5,
+      'version': 3,
+      'date_created': '2024-01-01',
+      'date_updated': '2024-01-02',
+    });
+    expect(product.stockQuantity, 2.5);
+    expect(product.toMap()['stock_quantity'], 2.5);
+  });
 }